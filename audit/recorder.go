@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"sync"
+	"time"
+
+	"secmail/config"
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kuun/slog"
+	"gorm.io/gorm"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultQueueSize     = 1000
+)
+
+// Recorder writes audit log entries in batches from a background goroutine,
+// so recording an event never waits for the database. When the queue is
+// full, entries are dropped with a warning.
+type Recorder struct {
+	db            *gorm.DB
+	batchSize     int
+	flushInterval time.Duration
+	queue         chan models.AuditLog
+	done          chan struct{}
+	wg            sync.WaitGroup
+	closeOnce     sync.Once
+}
+
+func NewRecorder(db *gorm.DB, cfg config.AuditConfig) *Recorder {
+	r := &Recorder{
+		db:            db,
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		done:          make(chan struct{}),
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = defaultBatchSize
+	}
+	if r.flushInterval <= 0 {
+		r.flushInterval = defaultFlushInterval
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	r.queue = make(chan models.AuditLog, queueSize)
+
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+// Record queues an entry. A nil recorder discards it.
+func (r *Recorder) Record(entry models.AuditLog) {
+	if r == nil {
+		return
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	select {
+	case r.queue <- entry:
+	default:
+		log.Warnf("Audit queue full, dropping %s entry for %s", entry.Action, entry.EmailAddress)
+	}
+}
+
+// Close writes the queued entries and stops the recorder.
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+	})
+}
+
+func (r *Recorder) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]models.AuditLog, 0, r.batchSize)
+	for {
+		select {
+		case entry := <-r.queue:
+			batch = append(batch, entry)
+			if len(batch) >= r.batchSize {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-r.done:
+			// drain what is left in the queue
+			for {
+				select {
+				case entry := <-r.queue:
+					batch = append(batch, entry)
+				default:
+					if len(batch) > 0 {
+						r.flush(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *Recorder) flush(batch []models.AuditLog) {
+	r.resolveAddresses(batch)
+	if err := r.db.CreateInBatches(batch, r.batchSize).Error; err != nil {
+		log.Errorf("Failed to write %d audit log entries: %v", len(batch), err)
+	}
+}
+
+// resolveAddresses fills in the address of entries that only know the
+// message, so callers don't need an extra query while serving a request.
+func (r *Recorder) resolveAddresses(batch []models.AuditLog) {
+	var ids []uuid.UUID
+	for _, entry := range batch {
+		if entry.EmailAddress == "" && entry.MessageID != nil {
+			ids = append(ids, *entry.MessageID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	var rows []struct {
+		MessageID uuid.UUID
+		EmailID   uint
+		Address   string
+	}
+	if err := r.db.Unscoped().Model(&models.Message{}).
+		Select("messages.id AS message_id, email_addresses.id AS email_id, email_addresses.address").
+		Joins("JOIN email_addresses ON email_addresses.id = messages.email_id").
+		Where("messages.id IN ?", ids).
+		Scan(&rows).Error; err != nil {
+		log.Warnf("Failed to resolve audit log addresses: %v", err)
+		return
+	}
+
+	for _, row := range rows {
+		for i := range batch {
+			if batch[i].EmailAddress == "" && batch[i].MessageID != nil && *batch[i].MessageID == row.MessageID {
+				batch[i].EmailID = row.EmailID
+				batch[i].EmailAddress = row.Address
+			}
+		}
+	}
+}
+
+// RecordRequest queues an audit log entry with the client of a request, if
+// an audit recorder was set in the "audit" key of its context.
+func RecordRequest(c *gin.Context, entry models.AuditLog) {
+	v, ok := c.Get("audit")
+	if !ok {
+		return
+	}
+	entry.IP = c.ClientIP()
+	entry.UserAgent = c.GetHeader("User-Agent")
+	v.(*Recorder).Record(entry)
+}
@@ -0,0 +1,53 @@
+package audit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+
+	"secmail/config"
+	"secmail/database/databasetest"
+	"secmail/models"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	return databasetest.Open(t)
+}
+
+func TestRecorder(t *testing.T) {
+	db := setupTestDB(t)
+
+	email := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	db.Create(&email)
+	msg := models.Message{ID: uuid.New(), EmailID: email.ID}
+	db.Create(&msg)
+
+	r := NewRecorder(db, config.AuditConfig{BatchSize: 2, FlushInterval: time.Hour})
+	r.Record(models.AuditLog{EmailID: email.ID, EmailAddress: email.Address, Action: models.AuditActionAccess, IP: "10.0.0.1"})
+	r.Record(models.AuditLog{MessageID: &msg.ID, Action: models.AuditActionAccess, IP: "10.0.0.1"})
+	r.Record(models.AuditLog{EmailID: email.ID, EmailAddress: email.Address, Action: models.AuditActionDeliver, IP: "10.0.0.2"})
+
+	// the last entry is only written when the recorder is closed
+	r.Close()
+	r.Close()
+
+	var logs []models.AuditLog
+	db.Where("action <> ?", models.AuditActionCreate).Order("id").Find(&logs)
+	assert.Len(t, logs, 3)
+
+	// the address is resolved from the message
+	assert.Equal(t, email.ID, logs[1].EmailID)
+	assert.Equal(t, email.Address, logs[1].EmailAddress)
+	assert.Equal(t, msg.ID, *logs[1].MessageID)
+	assert.False(t, logs[1].CreatedAt.IsZero())
+	assert.Equal(t, models.AuditActionDeliver, logs[2].Action)
+}
+
+func TestRecorderNil(t *testing.T) {
+	var r *Recorder
+	r.Record(models.AuditLog{Action: models.AuditActionAccess})
+	r.Close()
+}
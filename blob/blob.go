@@ -0,0 +1,86 @@
+// Package blob stores attachment contents outside of the database, which
+// only keeps their keys.
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+
+	"secmail/config"
+	"secmail/models"
+
+	"github.com/kuun/slog"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+var ErrNotFound = errors.New("blob not found")
+
+var keyRegexp = regexp.MustCompile(`^[0-9a-z][0-9a-z-]*$`)
+
+// Store keeps blobs by key. Replicas have to share it.
+type Store interface {
+	// Put stores size bytes read from r; an existing blob is replaced.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens a blob, ErrNotFound if there is none.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes a blob, it is not an error if there is none.
+	Delete(ctx context.Context, key string) error
+}
+
+// NewStore creates the store named in the configuration.
+func NewStore(cfg config.BlobConfig) (Store, error) {
+	switch cfg.Store {
+	case "", "file":
+		return NewFileStore(cfg.Dir)
+	case "s3":
+		return NewS3Store(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown blob store: %s", cfg.Store)
+	}
+}
+
+func validKey(key string) error {
+	if !keyRegexp.MatchString(key) {
+		return fmt.Errorf("invalid blob key: %q", key)
+	}
+	return nil
+}
+
+// PutBytes stores data as a blob.
+func PutBytes(ctx context.Context, s Store, key string, data []byte) error {
+	return s.Put(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// ReadAll returns the content of a blob.
+func ReadAll(ctx context.Context, s Store, key string) ([]byte, error) {
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// OpenAttachment opens the content of an attachment, decrypting it when it
+// is encrypted at rest: its key is then not the SHA-256 of the content.
+func OpenAttachment(ctx context.Context, s Store, a *models.Attachment) (io.ReadCloser, error) {
+	if a.Hash == "" || a.BlobKey == a.Hash {
+		return s.Get(ctx, a.BlobKey)
+	}
+	sealed, err := ReadAll(ctx, s, a.BlobKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := models.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
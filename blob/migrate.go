@@ -0,0 +1,133 @@
+package blob
+
+import (
+	"context"
+
+	"secmail/database"
+	"secmail/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const migrateBatchSize = 100
+
+// legacyAttachment is an attachment with its content in the data column,
+// as stored by earlier versions.
+type legacyAttachment struct {
+	ID          uuid.UUID
+	MessageID   uuid.UUID
+	FileName    string
+	ContentType string
+	Data        []byte
+}
+
+// DataMigrations are the data migrations moving contents from the database
+// into s, to run by database.Up before the migrations dropping their
+// columns.
+func DataMigrations(s Store) []database.DataMigration {
+	return []database.DataMigration{{
+		Version: 3,
+		Name:    "attachment_data",
+		Run:     func(db *gorm.DB) error { return MigrateAttachments(db, s) },
+	}}
+}
+
+// MigrateAttachments moves the attachment contents stored in the database
+// by earlier versions into the store, leaving their column empty for
+// migration 3 to drop. Messages stored before their raw source was kept get
+// it rebuilt first, while the contents are at hand.
+func MigrateAttachments(db *gorm.DB, s Store) error {
+	if !db.Migrator().HasColumn(&models.Attachment{}, "data") {
+		return nil
+	}
+	ctx := context.Background()
+
+	moved := 0
+	for {
+		var rows []legacyAttachment
+		if err := db.Table("attachments").
+			Select("id", "message_id", "file_name", "content_type", "data").
+			Where("data IS NOT NULL AND (blob_key IS NULL OR blob_key = '')").
+			Limit(migrateBatchSize).
+			Find(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			if err := rebuildSource(db, row.MessageID); err != nil {
+				return err
+			}
+			var stored bool
+			err := db.Transaction(func(tx *gorm.DB) error {
+				hash := Hash(row.Data)
+				isNew, err := Ref(ctx, tx, s, hash, row.Data)
+				if err != nil {
+					return err
+				}
+				stored = isNew
+				return tx.Table("attachments").Where("id = ?", row.ID).Updates(map[string]any{
+					"blob_key": hash,
+					"hash":     hash,
+					"size":     len(row.Data),
+					"data":     nil,
+				}).Error
+			})
+			if err != nil {
+				if stored {
+					Abandon(db, []string{Hash(row.Data)})
+				}
+				return err
+			}
+			moved++
+		}
+	}
+	if moved > 0 {
+		log.Infof("Moved %d attachments from the database to the blob store", moved)
+	}
+	return nil
+}
+
+// rebuildSource stores the rebuilt source of a message without one.
+func rebuildSource(db *gorm.DB, messageID uuid.UUID) error {
+	var msg models.Message
+	if err := db.Unscoped().Where("id = ?", messageID).First(&msg).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	if len(msg.Raw) > 0 {
+		return nil
+	}
+
+	var rows []legacyAttachment
+	if err := db.Table("attachments").
+		Select("id", "message_id", "file_name", "content_type", "data").
+		Where("message_id = ? AND data IS NOT NULL", messageID).
+		Find(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		msg.Attachments = append(msg.Attachments, models.Attachment{
+			ID:          row.ID,
+			MessageID:   row.MessageID,
+			FileName:    row.FileName,
+			ContentType: row.ContentType,
+			Data:        row.Data,
+		})
+	}
+
+	var addr models.EmailAddress
+	if err := db.Unscoped().First(&addr, msg.EmailID).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	source, err := msg.Source(addr.Address)
+	if err != nil {
+		return err
+	}
+	return db.Unscoped().Model(&msg).Update("raw", source).Error
+}
@@ -0,0 +1,161 @@
+package blob
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"secmail/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const collectBatchSize = 100
+
+// Hash returns the SHA-256 of a content, the key of its blob unless it is
+// encrypted at rest.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Ref takes a reference to the blob of data under key, storing the content
+// when it is not referenced yet. It has to run in the transaction that
+// stores the reference: the blob row stays locked until it commits, so that
+// Collect cannot delete the content in between. stored tells whether the
+// content was written, and has to be passed to Abandon if the transaction
+// fails.
+func Ref(ctx context.Context, tx *gorm.DB, s Store, key string, data []byte) (stored bool, err error) {
+	row := models.Blob{Hash: key, Size: int64(len(data)), RefCount: 1}
+	if err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "hash"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"ref_count":  gorm.Expr("blobs.ref_count + 1"),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&row).Error; err != nil {
+		return false, err
+	}
+
+	var refs int
+	if err := tx.Model(&models.Blob{}).Where("hash = ?", key).Select("ref_count").Scan(&refs).Error; err != nil {
+		return false, err
+	}
+	if refs > 1 {
+		return false, nil
+	}
+	// a new blob, or one released but not collected yet, which may already
+	// be partially deleted
+	if err := PutBytes(ctx, s, key, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RefContent takes a reference to the blob of an attachment content of an
+// address and returns its key. The key is the SHA-256 of the content, or
+// with encryption at rest one derived from the data key of the address,
+// the content being sealed with it.
+func RefContent(ctx context.Context, tx *gorm.DB, s Store, emailID uint, content []byte) (key string, stored bool, err error) {
+	if !models.Encrypting() {
+		key = Hash(content)
+		stored, err = Ref(ctx, tx, s, key, content)
+		return key, stored, err
+	}
+	key, err = models.BlobKey(emailID, content)
+	if err != nil {
+		return "", false, err
+	}
+	sealed, err := models.Seal(emailID, content)
+	if err != nil {
+		return "", false, err
+	}
+	stored, err = Ref(ctx, tx, s, key, sealed)
+	return key, stored, err
+}
+
+// Unref drops references to blobs, counts maps their keys to the number of
+// references dropped.
+func Unref(tx *gorm.DB, counts map[string]int) error {
+	for key, n := range counts {
+		if err := tx.Model(&models.Blob{}).Where("hash = ?", key).
+			Update("ref_count", gorm.Expr("ref_count - ?", n)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abandon records the blobs stored by a transaction that failed, which
+// rolled their rows back, so that Collect deletes them. They are not
+// deleted right away: another transaction may have referenced the same
+// content since.
+func Abandon(db *gorm.DB, keys []string) {
+	for _, key := range keys {
+		row := models.Blob{Hash: key, RefCount: 0}
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+			log.Warnf("Failed to record abandoned blob %s: %v", key, err)
+		}
+	}
+}
+
+// DeleteAttachments deletes the attachments of messages, given as a list of
+// ids or a query selecting them, and drops their blob references. It has to
+// run before the messages are hard deleted, which would otherwise cascade to
+// the attachments and leave their blobs referenced forever.
+func DeleteAttachments(tx *gorm.DB, messageIDs any) error {
+	attachments := func() *gorm.DB {
+		return tx.Model(&models.Attachment{}).Where("message_id IN (?)", messageIDs)
+	}
+	var refs []struct {
+		BlobKey string
+		Count   int
+	}
+	if err := attachments().Select("blob_key, COUNT(*) AS count").Group("blob_key").Scan(&refs).Error; err != nil {
+		return err
+	}
+	counts := make(map[string]int, len(refs))
+	for _, r := range refs {
+		counts[r.BlobKey] = r.Count
+	}
+	if err := Unref(tx, counts); err != nil {
+		return err
+	}
+	return attachments().Delete(&models.Attachment{}).Error
+}
+
+// Collect deletes the blobs without references and returns their number.
+func Collect(ctx context.Context, db *gorm.DB, s Store) (int, error) {
+	total := 0
+	for {
+		var hashes []string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// rows being referenced again are locked, skip them
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Model(&models.Blob{}).
+				Where("ref_count <= 0").
+				Limit(collectBatchSize).
+				Pluck("hash", &hashes).Error; err != nil {
+				return err
+			}
+			for _, hash := range hashes {
+				if err := s.Delete(ctx, hash); err != nil {
+					return err
+				}
+			}
+			if len(hashes) == 0 {
+				return nil
+			}
+			return tx.Where("hash IN ?", hashes).Delete(&models.Blob{}).Error
+		})
+		if err != nil {
+			return total, err
+		}
+		total += len(hashes)
+		if len(hashes) < collectBatchSize {
+			return total, nil
+		}
+	}
+}
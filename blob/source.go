@@ -0,0 +1,282 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"secmail/models"
+)
+
+// The body of an attachment part stripped from a message source is a line
+// naming the content in the blob store and how it was encoded:
+//
+//	secmail-blob:<sha256>:base64:<line length>:<crlf|lf>
+const strippedPrefix = "secmail-blob:"
+
+var strippedRegexp = regexp.MustCompile(`^secmail-blob:([0-9a-f]{64}):base64:([0-9]+):(crlf|lf)$`)
+
+// maxPartDepth bounds the nesting of multiparts walked in a source.
+const maxPartDepth = 20
+
+// part is a leaf part of a message source, its body is src[start:end].
+type part struct {
+	header     textproto.MIMEHeader
+	start, end int
+}
+
+// StripSource returns the source of a message without the attachment
+// contents in hashes, which the blob store keeps. Only base64 parts that
+// encode back byte for byte are stripped, so that Source returns the
+// source as received.
+func StripSource(raw []byte, hashes map[string]bool) []byte {
+	if len(hashes) == 0 {
+		return raw
+	}
+	var out bytes.Buffer
+	last := 0
+	for _, p := range leafParts(raw, 0, len(raw), 0, nil) {
+		if !strings.EqualFold(strings.TrimSpace(p.header.Get("Content-Transfer-Encoding")), "base64") {
+			continue
+		}
+		payload := bytes.TrimRight(raw[p.start:p.end], " \t\r\n")
+		lineLen, eol, ok := base64Layout(payload)
+		if !ok {
+			continue
+		}
+		content, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(payload), eol, ""))
+		if err != nil {
+			continue
+		}
+		hash := Hash(content)
+		if !hashes[hash] || !bytes.Equal(encodeBase64(content, lineLen, eol), payload) {
+			continue
+		}
+
+		eolName := "crlf"
+		if eol == "\n" {
+			eolName = "lf"
+		}
+		out.Write(raw[last:p.start])
+		fmt.Fprintf(&out, "%s%s:base64:%d:%s", strippedPrefix, hash, lineLen, eolName)
+		last = p.start + len(payload)
+	}
+	if last == 0 {
+		return raw
+	}
+	out.Write(raw[last:])
+	return out.Bytes()
+}
+
+// Source returns the RFC 822 source of a message, with the attachment
+// contents stripped from it read back from the store. The attachments of
+// the message have to be loaded.
+func Source(ctx context.Context, s Store, m *models.Message, to string) ([]byte, error) {
+	source, err := m.Source(to)
+	if err != nil || !bytes.Contains(source, []byte(strippedPrefix)) {
+		return source, err
+	}
+
+	contents := make(map[string][]byte)
+	var out bytes.Buffer
+	last := 0
+	for _, p := range leafParts(source, 0, len(source), 0, nil) {
+		payload := bytes.TrimRight(source[p.start:p.end], " \t\r\n")
+		match := strippedRegexp.FindSubmatch(payload)
+		if match == nil {
+			continue
+		}
+		hash := string(match[1])
+		content, ok := contents[hash]
+		if !ok {
+			if content, err = attachmentContent(ctx, s, m, hash); err != nil {
+				return nil, err
+			}
+			contents[hash] = content
+		}
+		lineLen, _ := strconv.Atoi(string(match[2]))
+		eol := "\r\n"
+		if string(match[3]) == "lf" {
+			eol = "\n"
+		}
+
+		out.Write(source[last:p.start])
+		out.Write(encodeBase64(content, lineLen, eol))
+		last = p.start + len(payload)
+	}
+	out.Write(source[last:])
+	return out.Bytes(), nil
+}
+
+// SourceSize returns the size of the source Source returns for a message
+// whose stored source is source, without reading the attachment contents.
+func SourceSize(m *models.Message, source []byte) int {
+	size := len(source)
+	if !bytes.Contains(source, []byte(strippedPrefix)) {
+		return size
+	}
+	for _, p := range leafParts(source, 0, len(source), 0, nil) {
+		payload := bytes.TrimRight(source[p.start:p.end], " \t\r\n")
+		match := strippedRegexp.FindSubmatch(payload)
+		if match == nil {
+			continue
+		}
+		for _, a := range m.Attachments {
+			if a.Hash != string(match[1]) {
+				continue
+			}
+			lineLen, _ := strconv.Atoi(string(match[2]))
+			eolLen := 2
+			if string(match[3]) == "lf" {
+				eolLen = 1
+			}
+			encoded := base64.StdEncoding.EncodedLen(int(a.Size))
+			if encoded > 0 && lineLen > 0 {
+				encoded += (encoded - 1) / lineLen * eolLen
+			}
+			size += encoded - len(payload)
+			break
+		}
+	}
+	return size
+}
+
+// attachmentContent reads the content of the attachment of m with hash.
+func attachmentContent(ctx context.Context, s Store, m *models.Message, hash string) ([]byte, error) {
+	for i := range m.Attachments {
+		if m.Attachments[i].Hash != hash {
+			continue
+		}
+		r, err := OpenAttachment(ctx, s, &m.Attachments[i])
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("message %s has no attachment %s", m.ID, hash)
+}
+
+// base64Layout returns the line length and line ending of base64 encoded
+// text, whose lines all have the same length but the last one.
+func base64Layout(payload []byte) (int, string, bool) {
+	if len(payload) == 0 {
+		return 0, "", false
+	}
+	eol := "\r\n"
+	if i := bytes.IndexByte(payload, '\n'); i > 0 && payload[i-1] != '\r' {
+		eol = "\n"
+	}
+	lines := strings.Split(string(payload), eol)
+	lineLen := len(lines[0])
+	for i, line := range lines {
+		if len(line) == 0 || len(line) > lineLen || (i < len(lines)-1 && len(line) != lineLen) {
+			return 0, "", false
+		}
+	}
+	return lineLen, eol, true
+}
+
+// encodeBase64 encodes content in lines of lineLen characters.
+func encodeBase64(content []byte, lineLen int, eol string) []byte {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	var out bytes.Buffer
+	for len(encoded) > lineLen {
+		out.WriteString(encoded[:lineLen])
+		out.WriteString(eol)
+		encoded = encoded[lineLen:]
+	}
+	out.WriteString(encoded)
+	return out.Bytes()
+}
+
+// leafParts appends the parts of the entity src[start:end] that are not
+// multiparts, walking the multiparts it contains.
+func leafParts(src []byte, start, end, depth int, parts []part) []part {
+	bodyStart := headerEnd(src[start:end])
+	if bodyStart < 0 {
+		return parts
+	}
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(src[start : start+bodyStart]))).ReadMIMEHeader()
+	if err != nil {
+		return parts
+	}
+	bodyStart += start
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		if params["boundary"] == "" || depth >= maxPartDepth {
+			return parts
+		}
+		for _, body := range multipartBodies(src, bodyStart, end, params["boundary"]) {
+			parts = leafParts(src, body[0], body[1], depth+1, parts)
+		}
+		return parts
+	}
+	return append(parts, part{header: header, start: bodyStart, end: end})
+}
+
+// headerEnd returns the offset of the body of an entity, after the blank
+// line ending its header, or -1 if it has none.
+func headerEnd(entity []byte) int {
+	for pos := 0; pos < len(entity); {
+		i := bytes.IndexByte(entity[pos:], '\n')
+		if i < 0 {
+			return -1
+		}
+		line := entity[pos : pos+i]
+		pos += i + 1
+		if len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			return pos
+		}
+	}
+	return -1
+}
+
+// multipartBodies returns the offsets of the body parts of the multipart
+// body src[start:end], up to its closing delimiter. A part ends before the
+// line break preceding the next delimiter.
+func multipartBodies(src []byte, start, end int, boundary string) [][2]int {
+	delimiter := []byte("--" + boundary)
+	var bodies [][2]int
+	partStart := -1
+	for pos := start; pos < end; {
+		next := end
+		lineEnd := end
+		if i := bytes.IndexByte(src[pos:end], '\n'); i >= 0 {
+			lineEnd = pos + i
+			next = lineEnd + 1
+		}
+		line := bytes.TrimSuffix(src[pos:lineEnd], []byte("\r"))
+		if rest, ok := bytes.CutPrefix(line, delimiter); ok {
+			rest, closing := bytes.CutPrefix(rest, []byte("--"))
+			if len(bytes.TrimRight(rest, " \t")) == 0 {
+				if partStart >= 0 {
+					bodyEnd := pos
+					if bodyEnd > partStart && src[bodyEnd-1] == '\n' {
+						bodyEnd--
+						if bodyEnd > partStart && src[bodyEnd-1] == '\r' {
+							bodyEnd--
+						}
+					}
+					bodies = append(bodies, [2]int{partStart, bodyEnd})
+				}
+				if closing {
+					return bodies
+				}
+				partStart = next
+			}
+		}
+		pos = next
+	}
+	// an unterminated last part is left as is
+	return bodies
+}
@@ -0,0 +1,48 @@
+package challenge
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"secmail/config"
+)
+
+var (
+	ErrMissingSolution = errors.New("challenge solution required")
+	ErrInvalidSolution = errors.New("invalid challenge solution")
+	ErrExpired         = errors.New("challenge expired")
+	ErrReused          = errors.New("challenge already used")
+)
+
+// Challenge is handed to a client before it may create an address.
+type Challenge struct {
+	Provider   string     `json:"provider"`
+	Token      string     `json:"token,omitempty"`
+	Difficulty int        `json:"difficulty,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Solution is the client's answer to a challenge. For proof of work the
+// Response is the nonce; a captcha provider would put its response token here.
+type Solution struct {
+	Token    string
+	Response string
+}
+
+// Verifier issues challenges and checks their solutions. Implementations must
+// be safe for concurrent use.
+type Verifier interface {
+	Issue(clientIP string) (*Challenge, error)
+	Verify(solution Solution, clientIP string) error
+}
+
+// NewVerifier creates the verifier named in the configuration.
+func NewVerifier(cfg config.ChallengeConfig) (Verifier, error) {
+	switch cfg.Provider {
+	case "", "pow":
+		return NewProofOfWork(cfg.Secret, cfg.Difficulty, cfg.TTL)
+	default:
+		return nil, fmt.Errorf("unknown challenge provider: %s", cfg.Provider)
+	}
+}
@@ -0,0 +1,165 @@
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDifficulty = 16
+	defaultTTL        = 5 * time.Minute
+	maxDifficulty     = 32
+)
+
+// ProofOfWork is a hashcash style verifier: the client has to find a nonce so
+// that SHA-256(token ":" nonce) starts with Difficulty zero bits.
+//
+// Tokens are signed with an HMAC instead of being stored, so any instance
+// sharing the secret can verify them. Used tokens are remembered in memory
+// until they expire.
+type ProofOfWork struct {
+	secret     []byte
+	difficulty int
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewProofOfWork creates a proof of work verifier. An empty secret is replaced
+// by a random one, which only works with a single instance.
+func NewProofOfWork(secret string, difficulty int, ttl time.Duration) (*ProofOfWork, error) {
+	if difficulty <= 0 {
+		difficulty = defaultDifficulty
+	}
+	if difficulty > maxDifficulty {
+		return nil, fmt.Errorf("challenge difficulty %d exceeds maximum of %d", difficulty, maxDifficulty)
+	}
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ProofOfWork{
+		secret:     key,
+		difficulty: difficulty,
+		ttl:        ttl,
+		now:        time.Now,
+		used:       make(map[string]time.Time),
+	}, nil
+}
+
+func (p *ProofOfWork) Issue(clientIP string) (*Challenge, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	expiresAt := p.now().Add(p.ttl).Truncate(time.Second)
+
+	// the payload is difficulty:expiry:nonce, the client IP is only signed
+	payload := fmt.Sprintf("%d:%d:%s", p.difficulty, expiresAt.Unix(), hex.EncodeToString(nonce))
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(p.sign(payload, clientIP))
+
+	return &Challenge{
+		Provider:   "pow",
+		Token:      token,
+		Difficulty: p.difficulty,
+		ExpiresAt:  &expiresAt,
+	}, nil
+}
+
+func (p *ProofOfWork) Verify(solution Solution, clientIP string) error {
+	if solution.Token == "" || solution.Response == "" {
+		return ErrMissingSolution
+	}
+
+	encPayload, encSig, ok := strings.Cut(solution.Token, ".")
+	if !ok {
+		return ErrInvalidSolution
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return ErrInvalidSolution
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil || !hmac.Equal(sig, p.sign(string(payload), clientIP)) {
+		return ErrInvalidSolution
+	}
+
+	parts := strings.Split(string(payload), ":")
+	if len(parts) != 3 {
+		return ErrInvalidSolution
+	}
+	difficulty, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return ErrInvalidSolution
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrInvalidSolution
+	}
+	expiresAt := time.Unix(expires, 0)
+	if p.now().After(expiresAt) {
+		return ErrExpired
+	}
+
+	sum := sha256.Sum256([]byte(solution.Token + ":" + solution.Response))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return ErrInvalidSolution
+	}
+
+	return p.markUsed(solution.Token, expiresAt)
+}
+
+func (p *ProofOfWork) sign(payload, clientIP string) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(payload + "|" + clientIP))
+	return mac.Sum(nil)
+}
+
+func (p *ProofOfWork) markUsed(token string, expiresAt time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for t, exp := range p.used {
+		if now.After(exp) {
+			delete(p.used, t)
+		}
+	}
+
+	if _, ok := p.used[token]; ok {
+		return ErrReused
+	}
+	p.used[token] = expiresAt
+	return nil
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,70 @@
+package challenge
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// solve finds a nonce the same way the web client does.
+func solve(ch *Challenge) string {
+	for i := 0; ; i++ {
+		nonce := strconv.Itoa(i)
+		sum := sha256.Sum256([]byte(ch.Token + ":" + nonce))
+		if leadingZeroBits(sum[:]) >= ch.Difficulty {
+			return nonce
+		}
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	pow, err := NewProofOfWork("secret", 8, time.Minute)
+	assert.NoError(t, err)
+
+	ch, err := pow.Issue("10.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "pow", ch.Provider)
+	assert.Equal(t, 8, ch.Difficulty)
+
+	nonce := solve(ch)
+
+	// missing solution
+	assert.ErrorIs(t, pow.Verify(Solution{Token: ch.Token}, "10.0.0.1"), ErrMissingSolution)
+
+	// the token is bound to the client IP
+	assert.ErrorIs(t, pow.Verify(Solution{Token: ch.Token, Response: nonce}, "10.0.0.2"), ErrInvalidSolution)
+
+	// tampered token
+	assert.ErrorIs(t, pow.Verify(Solution{Token: "x" + ch.Token, Response: nonce}, "10.0.0.1"), ErrInvalidSolution)
+
+	assert.NoError(t, pow.Verify(Solution{Token: ch.Token, Response: nonce}, "10.0.0.1"))
+
+	// a solution can only be used once
+	assert.ErrorIs(t, pow.Verify(Solution{Token: ch.Token, Response: nonce}, "10.0.0.1"), ErrReused)
+}
+
+func TestProofOfWorkWrongNonce(t *testing.T) {
+	pow, err := NewProofOfWork("secret", 24, time.Minute)
+	assert.NoError(t, err)
+
+	ch, err := pow.Issue("10.0.0.1")
+	assert.NoError(t, err)
+
+	// with 24 bits of difficulty a fixed guess is practically never valid
+	assert.ErrorIs(t, pow.Verify(Solution{Token: ch.Token, Response: "0"}, "10.0.0.1"), ErrInvalidSolution)
+}
+
+func TestProofOfWorkExpired(t *testing.T) {
+	pow, err := NewProofOfWork("secret", 1, time.Minute)
+	assert.NoError(t, err)
+
+	ch, err := pow.Issue("10.0.0.1")
+	assert.NoError(t, err)
+	nonce := solve(ch)
+
+	pow.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	assert.ErrorIs(t, pow.Verify(Solution{Token: ch.Token, Response: nonce}, "10.0.0.1"), ErrExpired)
+}
@@ -1,18 +1,89 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
-
-	"github.com/spf13/viper"
+	"net"
+	"time"
 )
 
 type DatabaseConfig struct {
+	// Driver is "postgres" (default) or "sqlite"
+	Driver   string `mapstructure:"driver"`
 	Host     string `mapstructure:"host"`
 	Port     int    `mapstructure:"port"`
 	User     string `mapstructure:"user"`
 	Password string `mapstructure:"password"`
 	DBName   string `mapstructure:"dbname"`
 	SSLMode  string `mapstructure:"sslmode"`
+	// Path is the database file of the sqlite driver, secmail.db by default
+	Path string `mapstructure:"path"`
+	// BusyTimeout is how long sqlite waits for the lock of another
+	// connection, 5s by default
+	BusyTimeout time.Duration `mapstructure:"busy_timeout"`
+}
+
+// HTTPConfig is the listener of the API and the web app.
+type HTTPConfig struct {
+	// Listen is the address of the listener, :8080 by default
+	Listen string `mapstructure:"listen"`
+	TLS    struct {
+		Enable   bool   `mapstructure:"enable"`
+		CertFile string `mapstructure:"cert_file"`
+		KeyFile  string `mapstructure:"key_file"`
+	} `mapstructure:"tls"`
+	// TrustedProxies are the addresses or CIDRs of the reverse proxies
+	// whose X-Forwarded-For header gives the client IP, and whose
+	// X-Forwarded-Proto header the scheme of JMAP URLs. None by default:
+	// the client IP is the address of the peer
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// ReadTimeout bounds reading a request, 30s by default
+	ReadTimeout time.Duration `mapstructure:"read_timeout"`
+	// WriteTimeout bounds writing a response, none by default as it would
+	// cut JMAP event streams and large downloads
+	WriteTimeout time.Duration `mapstructure:"write_timeout"`
+	// IdleTimeout closes keep-alive connections, 2m by default
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// MaxHeaderBytes limits the request headers, 1MB by default
+	MaxHeaderBytes int `mapstructure:"max_header_bytes"`
+	// CORSOrigins may call the API from browsers, as the web app served
+	// from another origin; "*" allows any origin
+	CORSOrigins []string `mapstructure:"cors_origins"`
+}
+
+// LoadTLSConfig loads the certificate of the HTTP server. It returns nil
+// when TLS is disabled.
+func (h *HTTPConfig) LoadTLSConfig() (*tls.Config, error) {
+	if !h.TLS.Enable {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(h.TLS.CertFile, h.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// TrustedProxy tells whether ip, the address of a peer, is one of the
+// trusted proxies, whose X-Forwarded-* headers can be believed.
+func (h *HTTPConfig) TrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, proxy := range h.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if addr.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+	return false
 }
 
 type SMTPConfig struct {
@@ -24,33 +95,214 @@ type SMTPConfig struct {
 		CertFile string `mapstructure:"cert_file"`
 		KeyFile  string `mapstructure:"key_file"`
 	} `mapstructure:"tls"`
+	// AllowInsecureAuth permits AUTH without STARTTLS
+	AllowInsecureAuth bool `mapstructure:"allow_insecure_auth"`
 }
 
-type Config struct {
-	EmailDomain string         `mapstructure:"email_domain"`
-	Database    DatabaseConfig `mapstructure:"database"`
-	SMTP        SMTPConfig     `mapstructure:"smtp"`
+// LoadTLSConfig loads the certificate of the SMTP server, which the other
+// mail protocols share. It returns nil when TLS is disabled.
+func (s *SMTPConfig) LoadTLSConfig() (*tls.Config, error) {
+	if !s.TLS.Enable {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.TLS.CertFile, s.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
 }
 
-var GlobalConfig Config
+type IMAPConfig struct {
+	Enable bool   `mapstructure:"enable"`
+	Host   string `mapstructure:"host"`
+	Port   int    `mapstructure:"port"`
+	// AllowInsecureAuth permits LOGIN without STARTTLS
+	AllowInsecureAuth bool `mapstructure:"allow_insecure_auth"`
+}
 
-func (d *DatabaseConfig) DSN() string {
-	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		d.Host, d.Port, d.User, d.Password, d.DBName, d.SSLMode)
+type POP3Config struct {
+	Enable bool   `mapstructure:"enable"`
+	Host   string `mapstructure:"host"`
+	Port   int    `mapstructure:"port"`
+	// AllowInsecureAuth permits USER/PASS without STLS
+	AllowInsecureAuth bool `mapstructure:"allow_insecure_auth"`
+	// DeleteOnQuit removes messages marked with DELE when the client quits
+	DeleteOnQuit bool `mapstructure:"delete_on_quit"`
 }
 
-func InitConfig() error {
-	viper.SetConfigName("secmail")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath("./etc")
+type JMAPConfig struct {
+	Enable bool `mapstructure:"enable"`
+}
 
-	if err := viper.ReadInConfig(); err != nil {
-		return err
-	}
+// CompatConfig enables the MailHog/Mailpit compatible routes, which expose
+// the messages of all addresses.
+type CompatConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// RequireAPIKey restricts the routes to admin API keys
+	RequireAPIKey bool `mapstructure:"require_api_key"`
+}
 
-	if err := viper.Unmarshal(&GlobalConfig); err != nil {
-		return err
-	}
+// SandboxConfig turns the SMTP server into a catch-all: every recipient, on
+// any domain, is provisioned as an inbox.
+type SandboxConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// TTL of provisioned inboxes, 24h by default
+	TTL time.Duration `mapstructure:"ttl"`
+	// RequireAuth rejects mail from clients without SMTP credentials
+	RequireAuth bool `mapstructure:"require_auth"`
+}
 
-	return nil
+// RelayConfig is the outbound smarthost that forwarded and sent mail goes
+// through.
+type RelayConfig struct {
+	Enable   bool   `mapstructure:"enable"`
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// TLS is "starttls" (default), "tls" for implicit TLS or "none"
+	TLS string `mapstructure:"tls"`
+	// SRSSecret signs the rewritten envelope senders, it has to be shared
+	// by all replicas
+	SRSSecret string `mapstructure:"srs_secret"`
+	// MaxAttempts before a message is given up as bounced, 5 by default
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// RetryInterval is the delay before the first retry, doubled for each
+	// following one, 5m by default
+	RetryInterval time.Duration `mapstructure:"retry_interval"`
+	// SendQuota is how many messages an address may send or reply in
+	// SendQuotaPeriod, 10 per 24h by default
+	SendQuota       int           `mapstructure:"send_quota"`
+	SendQuotaPeriod time.Duration `mapstructure:"send_quota_period"`
+}
+
+// DKIMConfig manages the keys signing outbound mail for email_domain.
+type DKIMConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// Store is "database" (default, shared by all replicas) or "file"
+	Store string `mapstructure:"store"`
+	// Dir holds the keys of the file store
+	Dir string `mapstructure:"dir"`
+	// Algorithm of generated keys, "rsa" (default) or "ed25519"
+	Algorithm string `mapstructure:"algorithm"`
+}
+
+// BlobConfig is where attachment contents are stored.
+type BlobConfig struct {
+	// Store is "file" (default) or "s3"
+	Store string `mapstructure:"store"`
+	// Dir holds the blobs of the file store
+	Dir string   `mapstructure:"dir"`
+	S3  S3Config `mapstructure:"s3"`
+}
+
+// S3Config is a bucket of an S3-compatible object storage.
+type S3Config struct {
+	// Endpoint is the URL of the service, e.g. https://s3.eu-west-1.amazonaws.com
+	Endpoint string `mapstructure:"endpoint"`
+	// Region signs the requests, us-east-1 by default
+	Region    string `mapstructure:"region"`
+	Bucket    string `mapstructure:"bucket"`
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	// PathStyle puts the bucket in the path instead of the host name, as
+	// most self-hosted services require
+	PathStyle bool `mapstructure:"path_style"`
+}
+
+// EncryptionConfig enables the encryption at rest of message contents and
+// attachments. Each address has a data key, wrapped by the master key.
+type EncryptionConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// MasterKey is 32 random bytes in base64, it can be read from
+	// master_key_file like the other secrets
+	MasterKey string `mapstructure:"master_key"`
+	// PreviousMasterKeys unwrap the data keys wrapped before a rotation,
+	// until they are wrapped again with MasterKey on start; they can be read
+	// from previous_master_keys_file, one per line
+	PreviousMasterKeys []string `mapstructure:"previous_master_keys"`
+	// KeyStore is "database" (default, shared by all replicas) or "file"
+	KeyStore string `mapstructure:"key_store"`
+	// KeyDir holds the data keys of the file store
+	KeyDir string `mapstructure:"key_dir"`
+}
+
+// RateLimitRule describes a token bucket: Requests tokens are added every
+// Period, and at most Burst tokens can be saved up. A rule with no requests
+// disables the limit.
+type RateLimitRule struct {
+	Requests int           `mapstructure:"requests"`
+	Period   time.Duration `mapstructure:"period"`
+	Burst    int           `mapstructure:"burst"`
+}
+
+func (r RateLimitRule) Enabled() bool {
+	return r.Requests > 0 && r.Period > 0
+}
+
+type RateLimitConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// Store is "memory" (per process) or "database" (shared by all replicas)
+	Store         string        `mapstructure:"store"`
+	CreateAddress RateLimitRule `mapstructure:"create_address"`
+	APIRead       RateLimitRule `mapstructure:"api_read"`
+	SMTPSender    RateLimitRule `mapstructure:"smtp_sender"`
+	SMTPRecipient RateLimitRule `mapstructure:"smtp_recipient"`
+	// ForwardRule limits the creation of forwarding rules per client IP
+	// and per address, each one mails a verification code
+	ForwardRule RateLimitRule `mapstructure:"forward_rule"`
+}
+
+type ChallengeConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// Provider selects the verifier, only "pow" (proof of work) for now
+	Provider   string        `mapstructure:"provider"`
+	Difficulty int           `mapstructure:"difficulty"`
+	TTL        time.Duration `mapstructure:"ttl"`
+	// Secret signs challenges, it has to be shared by all replicas
+	Secret string `mapstructure:"secret"`
+}
+
+type AuthConfig struct {
+	// AdminKey is a static key with the admin scope, used to create the
+	// first API keys
+	AdminKey string `mapstructure:"admin_key"`
+}
+
+type AuditConfig struct {
+	// Retention is how long audit log entries are kept, zero keeps them forever
+	Retention     time.Duration `mapstructure:"retention"`
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	QueueSize     int           `mapstructure:"queue_size"`
+}
+
+type Config struct {
+	EmailDomain string           `mapstructure:"email_domain"`
+	Database    DatabaseConfig   `mapstructure:"database"`
+	HTTP        HTTPConfig       `mapstructure:"http"`
+	SMTP        SMTPConfig       `mapstructure:"smtp"`
+	IMAP        IMAPConfig       `mapstructure:"imap"`
+	POP3        POP3Config       `mapstructure:"pop3"`
+	JMAP        JMAPConfig       `mapstructure:"jmap"`
+	Compat      CompatConfig     `mapstructure:"compat"`
+	Sandbox     SandboxConfig    `mapstructure:"sandbox"`
+	Relay       RelayConfig      `mapstructure:"relay"`
+	DKIM        DKIMConfig       `mapstructure:"dkim"`
+	Blob        BlobConfig       `mapstructure:"blob"`
+	Encryption  EncryptionConfig `mapstructure:"encryption"`
+	RateLimit   RateLimitConfig  `mapstructure:"rate_limit"`
+	Challenge   ChallengeConfig  `mapstructure:"challenge"`
+	Auth        AuthConfig       `mapstructure:"auth"`
+	Audit       AuditConfig      `mapstructure:"audit"`
+}
+
+var GlobalConfig Config
+
+func (d *DatabaseConfig) DSN() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		d.Host, d.Port, d.User, d.Password, d.DBName, d.SSLMode)
 }
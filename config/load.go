@@ -0,0 +1,135 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// EnvPrefix prefixes the environment variables overriding settings:
+	// SECMAIL_DATABASE_PASSWORD sets database.password
+	EnvPrefix = "SECMAIL"
+	// FileSuffix reads a string setting from a file, as database.password_file
+	// or SECMAIL_DATABASE_PASSWORD_FILE, so that secrets stay out of the
+	// configuration file and the environment. A list of strings is read one
+	// value per line.
+	FileSuffix = "_file"
+)
+
+// InitConfig loads the configuration into GlobalConfig, see Load.
+func InitConfig(path string) error {
+	cfg, err := Load(path)
+	if err != nil {
+		return err
+	}
+	GlobalConfig = *cfg
+	return nil
+}
+
+// Load reads the configuration file at path, or etc/secmail.yaml if path is
+// empty, overrides its settings from the environment and validates them.
+// The default file is optional, settings may all come from the environment.
+func Load(path string) (*Config, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("secmail")
+		v.AddConfigPath("./etc")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if path != "" || !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("failed to read configuration: %w", err)
+		}
+	}
+
+	// viper only reads the environment variables of the keys it knows
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	keys := settingKeys(reflect.TypeOf(Config{}), "")
+	for key, t := range keys {
+		v.BindEnv(key)
+		if fromFile(t) {
+			v.BindEnv(key + FileSuffix)
+		}
+	}
+	for key, t := range keys {
+		if !fromFile(t) {
+			continue
+		}
+		if err := readFile(v, key, t.Kind() == reflect.Slice); err != nil {
+			return nil, err
+		}
+	}
+
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// settingKeys maps the keys of the settings of t, a struct, to their type.
+func settingKeys(t reflect.Type, prefix string) map[string]reflect.Type {
+	keys := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("mapstructure")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+		if field.Type.Kind() == reflect.Struct {
+			for k, t := range settingKeys(field.Type, key+".") {
+				keys[k] = t
+			}
+			continue
+		}
+		keys[key] = field.Type
+	}
+	return keys
+}
+
+// fromFile tells whether a setting of type t can be read from a file:
+// strings and lists of strings.
+func fromFile(t reflect.Type) bool {
+	return t.Kind() == reflect.String || (t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String)
+}
+
+// readFile sets key to the content of the file named by key_file, without
+// its trailing newline, or for a list to its non-blank lines.
+func readFile(v *viper.Viper, key string, list bool) error {
+	path := v.GetString(key + FileSuffix)
+	if path == "" {
+		return nil
+	}
+	if (!list && v.GetString(key) != "") || (list && len(v.GetStringSlice(key)) > 0) {
+		return fmt.Errorf("invalid configuration: %s and %s%s are both set", key, key, FileSuffix)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %s%s: %w", key, FileSuffix, err)
+	}
+	if !list {
+		v.Set(key, strings.TrimRight(string(data), "\r\n"))
+		return nil
+	}
+	var values []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			values = append(values, line)
+		}
+	}
+	v.Set(key, values)
+	return nil
+}
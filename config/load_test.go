@@ -0,0 +1,150 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Load("../etc/secmail.example.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "secmail.test", cfg.EmailDomain)
+}
+
+func TestLoadEnv(t *testing.T) {
+	path := writeFile(t, "secmail.yaml", `
+email_domain: "secmail.test"
+database:
+  driver: "sqlite"
+  path: "secmail.db"
+smtp:
+  port: 25
+`)
+	secret := writeFile(t, "secret", "s3cret\n")
+	t.Setenv("SECMAIL_EMAIL_DOMAIN", "example.org")
+	t.Setenv("SECMAIL_SMTP_PORT", "2525")
+	t.Setenv("SECMAIL_HTTP_TRUSTED_PROXIES", "10.0.0.0/8,127.0.0.1")
+	t.Setenv("SECMAIL_AUDIT_RETENTION", "72h")
+	t.Setenv("SECMAIL_RELAY_SRS_SECRET_FILE", secret)
+	t.Setenv("SECMAIL_ENCRYPTION_MASTER_KEY_FILE", writeFile(t, "master", "bWFzdGVy\n"))
+	t.Setenv("SECMAIL_ENCRYPTION_PREVIOUS_MASTER_KEYS_FILE", writeFile(t, "previous", "b2xk\n\nb2xkZXI=\n"))
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "example.org", cfg.EmailDomain)
+	assert.Equal(t, "sqlite", cfg.Database.Driver)
+	assert.Equal(t, 2525, cfg.SMTP.Port)
+	assert.Equal(t, []string{"10.0.0.0/8", "127.0.0.1"}, cfg.HTTP.TrustedProxies)
+	assert.Equal(t, 72*time.Hour, cfg.Audit.Retention)
+	assert.Equal(t, "s3cret", cfg.Relay.SRSSecret)
+	assert.Equal(t, "bWFzdGVy", cfg.Encryption.MasterKey)
+	assert.Equal(t, []string{"b2xk", "b2xkZXI="}, cfg.Encryption.PreviousMasterKeys)
+}
+
+func TestLoadErrors(t *testing.T) {
+	secret := writeFile(t, "secret", "s3cret")
+	tests := []struct {
+		name    string
+		yaml    string
+		env     map[string]string
+		wantErr string
+	}{
+		{
+			name: "both set",
+			yaml: `
+email_domain: "secmail.test"
+database:
+  driver: "sqlite"
+  password: "inline"
+smtp:
+  port: 25
+`,
+			env:     map[string]string{"SECMAIL_DATABASE_PASSWORD_FILE": secret},
+			wantErr: "invalid configuration: database.password and database.password_file are both set",
+		},
+		{
+			name: "list both set",
+			yaml: `
+email_domain: "secmail.test"
+database:
+  driver: "sqlite"
+smtp:
+  port: 25
+encryption:
+  previous_master_keys: ["b2xk"]
+`,
+			env:     map[string]string{"SECMAIL_ENCRYPTION_PREVIOUS_MASTER_KEYS_FILE": secret},
+			wantErr: "invalid configuration: encryption.previous_master_keys and encryption.previous_master_keys_file are both set",
+		},
+		{
+			name: "missing secret file",
+			yaml: `
+email_domain: "secmail.test"
+database:
+  driver: "sqlite"
+  password_file: "/nonexistent/secret"
+smtp:
+  port: 25
+`,
+			wantErr: "invalid configuration: database.password_file: open /nonexistent/secret: no such file or directory",
+		},
+		{
+			name: "invalid",
+			yaml: `
+database:
+  driver: "mysql"
+smtp:
+  port: 70000
+http:
+  listen: "8080"
+  trusted_proxies: ["10.0.0.0/33"]
+  read_timeout: "-1s"
+  idle_timeout: "-1s"
+relay:
+  enable: true
+  port: 587
+  tls: "ssl"
+blob:
+  store: "s3"
+`,
+			wantErr: `invalid configuration:
+  email_domain is required
+  database.driver must be one of ["postgres" "sqlite"], got "mysql"
+  http.listen must be a host:port address, got "8080"
+  http.trusted_proxies must be IP addresses or CIDRs, got "10.0.0.0/33"
+  http.read_timeout must not be negative
+  http.idle_timeout must not be negative
+  smtp.port must be a port between 1 and 65535, got 70000
+  relay.host is required
+  relay.srs_secret is required
+  relay.tls must be one of ["starttls" "tls" "none"], got "ssl"
+  blob.s3.endpoint is required
+  blob.s3.bucket is required`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := Load(writeFile(t, "secmail.yaml", tt.yaml))
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "secmail.yaml"))
+	assert.ErrorContains(t, err, "failed to read configuration")
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// validator collects the problems of a configuration.
+type validator struct {
+	errs []string
+}
+
+func (v *validator) errorf(format string, args ...any) {
+	v.errs = append(v.errs, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) required(key, value string) {
+	if value == "" {
+		v.errorf("%s is required", key)
+	}
+}
+
+func (v *validator) oneOf(key, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.errorf("%s must be one of %q, got %q", key, allowed, value)
+}
+
+func (v *validator) port(key string, port int) {
+	if port < 1 || port > 65535 {
+		v.errorf("%s must be a port between 1 and 65535, got %d", key, port)
+	}
+}
+
+func (v *validator) tls(key string, enable bool, certFile, keyFile string) {
+	if enable {
+		v.required(key+".cert_file", certFile)
+		v.required(key+".key_file", keyFile)
+	}
+}
+
+// Validate reports every missing or invalid setting, so that they can all
+// be fixed before anything starts.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.required("email_domain", c.EmailDomain)
+
+	db := c.Database
+	v.oneOf("database.driver", db.Driver, "postgres", "sqlite")
+	if db.Driver == "" || db.Driver == "postgres" {
+		v.required("database.host", db.Host)
+		v.port("database.port", db.Port)
+		v.required("database.user", db.User)
+		v.required("database.dbname", db.DBName)
+	}
+	if db.BusyTimeout < 0 {
+		v.errorf("database.busy_timeout must not be negative, got %s", db.BusyTimeout)
+	}
+
+	if c.HTTP.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.Listen); err != nil {
+			v.errorf("http.listen must be a host:port address, got %q", c.HTTP.Listen)
+		}
+	}
+	v.tls("http.tls", c.HTTP.TLS.Enable, c.HTTP.TLS.CertFile, c.HTTP.TLS.KeyFile)
+	for _, proxy := range c.HTTP.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				v.errorf("http.trusted_proxies must be IP addresses or CIDRs, got %q", proxy)
+			}
+		}
+	}
+	for _, timeout := range []struct {
+		key string
+		d   time.Duration
+	}{
+		{"http.read_timeout", c.HTTP.ReadTimeout},
+		{"http.write_timeout", c.HTTP.WriteTimeout},
+		{"http.idle_timeout", c.HTTP.IdleTimeout},
+	} {
+		if timeout.d < 0 {
+			v.errorf("%s must not be negative", timeout.key)
+		}
+	}
+
+	v.port("smtp.port", c.SMTP.Port)
+	v.tls("smtp.tls", c.SMTP.TLS.Enable, c.SMTP.TLS.CertFile, c.SMTP.TLS.KeyFile)
+	if c.IMAP.Enable {
+		v.port("imap.port", c.IMAP.Port)
+	}
+	if c.POP3.Enable {
+		v.port("pop3.port", c.POP3.Port)
+	}
+
+	if c.Relay.Enable {
+		v.required("relay.host", c.Relay.Host)
+		v.port("relay.port", c.Relay.Port)
+		v.required("relay.srs_secret", c.Relay.SRSSecret)
+		v.oneOf("relay.tls", c.Relay.TLS, "starttls", "tls", "none")
+	}
+	if c.DKIM.Enable {
+		v.oneOf("dkim.store", c.DKIM.Store, "database", "file")
+		v.oneOf("dkim.algorithm", c.DKIM.Algorithm, "rsa", "ed25519")
+	}
+
+	v.oneOf("blob.store", c.Blob.Store, "file", "s3")
+	if c.Blob.Store == "s3" {
+		v.required("blob.s3.endpoint", c.Blob.S3.Endpoint)
+		v.required("blob.s3.bucket", c.Blob.S3.Bucket)
+	}
+
+	if c.Encryption.Enable {
+		if c.Encryption.MasterKey == "" {
+			v.errorf("encryption.master_key or encryption.master_key_file is required")
+		}
+		v.oneOf("encryption.key_store", c.Encryption.KeyStore, "database", "file")
+	}
+
+	if c.RateLimit.Enable {
+		v.oneOf("rate_limit.store", c.RateLimit.Store, "memory", "database")
+	}
+	if c.Challenge.Enable {
+		v.oneOf("challenge.provider", c.Challenge.Provider, "pow")
+	}
+	if c.Audit.Retention < 0 {
+		v.errorf("audit.retention must not be negative, got %s", c.Audit.Retention)
+	}
+
+	if len(v.errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(v.errs, "\n  "))
+	}
+	return nil
+}
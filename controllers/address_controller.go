@@ -1,13 +1,19 @@
 package controllers
 
 import (
+	"errors"
+	"io"
 	"math/rand"
 	"net/http"
 	"regexp"
+	"strconv"
 	"time"
 
+	"secmail/blob"
+	"secmail/challenge"
 	"secmail/config"
 	"secmail/models"
+	"secmail/pgp"
 
 	"github.com/gin-gonic/gin"
 	"github.com/kuun/slog"
@@ -25,15 +31,43 @@ const (
 	charset       = "abcdefghijklmnopqrstuvwxyz0123456789"
 )
 
+// Local part of custom addresses created with an API key; generated
+// addresses are 10 characters of the same alphabet.
+const localPartPattern = `[a-z0-9](?:[a-z0-9._-]{0,62}[a-z0-9])?`
+
+var localPartRegexp = regexp.MustCompile(`^` + localPartPattern + `$`)
+
+// In sandbox mode every recipient becomes an inbox, on any domain.
+const sandboxEmailPattern = `^[a-z0-9!#$%&'*+/=?^_{|}~.-]{1,64}@[a-z0-9-]+(?:\.[a-z0-9-]+)*$`
+
 // Update email pattern to use dynamic domain
 func getEmailPattern() string {
+	if config.GlobalConfig.Sandbox.Enable {
+		return sandboxEmailPattern
+	}
 	escapedDomain := regexp.QuoteMeta(config.GlobalConfig.EmailDomain)
-	return `^[a-z0-9]{10}@` + escapedDomain + `$`
+	return `^` + localPartPattern + `@` + escapedDomain + `$`
+}
+
+type CreateEmailRequest struct {
+	ChallengeToken    string `json:"challengeToken"`
+	ChallengeResponse string `json:"challengeResponse"`
+	// custom lifetime and local part, only for API keys
+	TTLSeconds int    `json:"ttlSeconds"`
+	LocalPart  string `json:"localPart"`
+	// PGPPublicKey is an armored OpenPGP public key, incoming mail is then
+	// stored encrypted to it
+	PGPPublicKey string `json:"pgpPublicKey"`
 }
 
 type CreateEmailResponse struct {
 	Address   string    `json:"address"`
 	ExpiresAt time.Time `json:"expiresAt"`
+	// AccessToken is the password for IMAP and the other mailbox protocols,
+	// it is only returned when the address is created
+	AccessToken string `json:"accessToken,omitempty"`
+	// PGPFingerprint is the fingerprint of the OpenPGP key of the address
+	PGPFingerprint string `json:"pgpFingerprint,omitempty"`
 }
 
 func generateRandomString(length int) string {
@@ -50,34 +84,139 @@ func isValidEmailFormat(email string) bool {
 	return match
 }
 
+// GetChallenge issues a challenge that must be solved before creating an
+// address. Provider "none" means no challenge is required.
+func GetChallenge(c *gin.Context) {
+	verifier, ok := c.Get("challenge")
+	if !ok {
+		c.JSON(http.StatusOK, challenge.Challenge{Provider: "none"})
+		return
+	}
+
+	ch, err := verifier.(challenge.Verifier).Issue(c.ClientIP())
+	if err != nil {
+		log.Errorf("Failed to issue challenge: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue challenge"})
+		return
+	}
+	c.JSON(http.StatusOK, ch)
+}
+
+// verifyChallenge checks the solution in the request if a challenge verifier
+// is configured, and writes the error response if it is not valid.
+func verifyChallenge(c *gin.Context, req *CreateEmailRequest) bool {
+	verifier, ok := c.Get("challenge")
+	if !ok {
+		return true
+	}
+
+	err := verifier.(challenge.Verifier).Verify(challenge.Solution{
+		Token:    req.ChallengeToken,
+		Response: req.ChallengeResponse,
+	}, c.ClientIP())
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, challenge.ErrMissingSolution):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Challenge solution required"})
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid challenge solution: " + err.Error()})
+	}
+	return false
+}
+
 func CreateTempEmail(c *gin.Context) {
 	db := c.MustGet("db").(*gorm.DB)
 
+	// The request body is optional
+	var req CreateEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Anonymous callers get a random address with the default lifetime
+	apiKey := currentAPIKey(c)
+	if apiKey == nil {
+		if req.TTLSeconds != 0 || req.LocalPart != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key required for custom addresses"})
+			return
+		}
+		if !verifyChallenge(c, &req) {
+			return
+		}
+	}
+
+	var fingerprint string
+	if req.PGPPublicKey != "" {
+		var err error
+		if fingerprint, err = pgp.Fingerprint(req.PGPPublicKey); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	lifespan := emailLifespan
+	if req.TTLSeconds != 0 {
+		maxTTL := apiKey.MaxTTL
+		if maxTTL == 0 {
+			maxTTL = emailLifespan
+		}
+		lifespan = time.Duration(req.TTLSeconds) * time.Second
+		if lifespan <= 0 || lifespan > maxTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "TTL must be between 1 and " +
+				strconv.Itoa(int(maxTTL/time.Second)) + " seconds"})
+			return
+		}
+	}
+
 	// Get client info
 	clientIP := c.ClientIP()
 	userAgent := c.GetHeader("User-Agent")
 
-	// Generate random email address
 	var email models.EmailAddress
-	var exists bool
+
+	if req.LocalPart != "" {
+		if !localPartRegexp.MatchString(req.LocalPart) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid local part"})
+			return
+		}
+		emailAddress := req.LocalPart + "@" + config.GlobalConfig.EmailDomain
+		if db.Where("address = ?", emailAddress).First(&models.EmailAddress{}).Error == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email address already exists"})
+			return
+		}
+		email = models.EmailAddress{
+			Address:      emailAddress,
+			ExpiresAt:    time.Now().Add(lifespan),
+			CreatorIP:    clientIP,
+			CreatorAgent: userAgent,
+		}
+	}
 
 	// Keep generating until we find an unused address
-	for {
+	for email.Address == "" {
 		randomPart := generateRandomString(emailLength)
 		emailAddress := randomPart + "@" + config.GlobalConfig.EmailDomain
 
-		exists = db.Where("address = ?", emailAddress).First(&email).Error == nil
+		exists := db.Where("address = ?", emailAddress).First(&models.EmailAddress{}).Error == nil
 		if !exists {
 			email = models.EmailAddress{
 				Address:      emailAddress,
-				ExpiresAt:   time.Now().Add(emailLifespan),
-				CreatorIP:   clientIP,
+				ExpiresAt:    time.Now().Add(lifespan),
+				CreatorIP:    clientIP,
 				CreatorAgent: userAgent,
 			}
-			break
 		}
 	}
 
+	email.PGPKey = req.PGPPublicKey
+	accessToken, err := email.NewAccessToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create email"})
+		return
+	}
+
 	// Save to database
 	if err := db.Create(&email).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create email"})
@@ -86,8 +225,10 @@ func CreateTempEmail(c *gin.Context) {
 
 	// Return response
 	c.JSON(http.StatusCreated, CreateEmailResponse{
-		Address:   email.Address,
-		ExpiresAt: email.ExpiresAt,
+		Address:        email.Address,
+		ExpiresAt:      email.ExpiresAt,
+		AccessToken:    accessToken,
+		PGPFingerprint: fingerprint,
 	})
 }
 
@@ -122,6 +263,9 @@ func GetTempEmail(c *gin.Context) {
 		Address:   email.Address,
 		ExpiresAt: email.ExpiresAt,
 	}
+	if email.PGPKey != "" {
+		emailResponse.PGPFingerprint, _ = pgp.Fingerprint(email.PGPKey)
+	}
 	c.JSON(http.StatusOK, emailResponse)
 }
 
@@ -135,13 +279,9 @@ func DeleteTempEmail(c *gin.Context) {
 		return
 	}
 
-	// Begin transaction
-	tx := db.Begin()
-
 	// Find email
 	var email models.EmailAddress
-	if err := tx.Where("address = ?", emailAddress).First(&email).Error; err != nil {
-		tx.Rollback()
+	if err := db.Where("address = ?", emailAddress).First(&email).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Email address not found"})
 			return
@@ -150,19 +290,46 @@ func DeleteTempEmail(c *gin.Context) {
 		return
 	}
 
+	deleteEmailAddress(c, db, &email)
+}
+
+// deleteEmailAddress deletes an address with its messages and writes the
+// response.
+func deleteEmailAddress(c *gin.Context, db *gorm.DB, email *models.EmailAddress) {
+	// Begin transaction
+	tx := db.Begin()
+
 	// Set client info for audit log
-	email.CreatorIP = c.ClientIP()
-	email.CreatorAgent = c.GetHeader("User-Agent")
+	email.DeleterIP = c.ClientIP()
+	email.DeleterAgent = c.GetHeader("User-Agent")
 
-	// Delete associated data (attachments will be deleted by cascade)
+	// Delete associated data
+	if err := blob.DeleteAttachments(tx, tx.Model(&models.Message{}).Select("id").Where("email_id = ?", email.ID)); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachments"})
+		return
+	}
 	if err := tx.Where("email_id = ?", email.ID).Delete(&models.Message{}).Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete messages"})
 		return
 	}
+	if err := tx.Where("email_id = ?", email.ID).Delete(&models.ForwardRule{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete forwarding rules"})
+		return
+	}
+	if models.Encrypting() {
+		// queued mail cannot be decrypted once the data key is shredded
+		if err := tx.Unscoped().Where("email_id = ?", email.ID).Delete(&models.OutboundMessage{}).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete outbound messages"})
+			return
+		}
+	}
 
 	// Delete the email
-	if err := tx.Delete(&email).Error; err != nil {
+	if err := tx.Delete(email).Error; err != nil {
 		tx.Rollback()
 		log.Errorf("Failed to delete email address: %s, error: %s", email.Address, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete email"})
@@ -176,5 +343,10 @@ func DeleteTempEmail(c *gin.Context) {
 		return
 	}
 
+	// the contents left until the address expires cannot be read anymore
+	if err := models.Shred(email.ID); err != nil {
+		log.Errorf("Failed to shred the data key of email address: %s, error: %s", email.Address, err)
+	}
+
 	c.Status(http.StatusNoContent)
 }
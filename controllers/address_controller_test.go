@@ -1,44 +1,61 @@
 package controllers
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/driver/sqlite"
+	"github.com/stretchr/testify/require"
 	"gorm.io/gorm"
 
+	"secmail/blob"
+	"secmail/challenge"
 	"secmail/config"
+	"secmail/database/databasetest"
 	"secmail/models"
+	"secmail/pgp"
 )
 
-func setupTestDB(t *testing.T) *gorm.DB {
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
-		//Logger: logger.Default.LogMode(logger.Info),
-	})
-	if err != nil {
-		t.Fatalf("Failed to connect to test database: %v", err)
-	}
+// fakeVerifier accepts the solution "ok" and rejects everything else.
+type fakeVerifier struct{}
+
+func (fakeVerifier) Issue(_ string) (*challenge.Challenge, error) {
+	return &challenge.Challenge{Provider: "fake", Token: "token"}, nil
+}
 
-	// Migrate the schema
-	err = db.AutoMigrate(&models.EmailAddress{}, &models.Message{}, &models.Attachment{})
-	if err != nil {
-		t.Fatalf("Failed to migrate test database: %v", err)
+func (fakeVerifier) Verify(solution challenge.Solution, _ string) error {
+	switch {
+	case solution.Response == "":
+		return challenge.ErrMissingSolution
+	case solution.Token != "token" || solution.Response != "ok":
+		return challenge.ErrInvalidSolution
 	}
+	return nil
+}
 
-	return db
+func setupTestDB(t *testing.T) *gorm.DB {
+	return databasetest.Open(t)
 }
 
+// testBlobs is the blob store of the test routers.
+var testBlobs = blob.NewMemoryStore()
+
 func setupTestRouter(db *gorm.DB) *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
 	r.Use(func(c *gin.Context) {
 		c.Set("db", db)
+		c.Set("blobs", testBlobs)
 	})
 	return r
 }
@@ -286,3 +303,147 @@ func TestDeleteTempEmail(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateTempEmailChallenge(t *testing.T) {
+	config.GlobalConfig = config.Config{
+		EmailDomain: "test.com",
+	}
+
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "Valid Solution",
+			body:         `{"challengeToken":"token","challengeResponse":"ok"}`,
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "Missing Solution",
+			body:         "",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Invalid Solution",
+			body:         `{"challengeToken":"token","challengeResponse":"wrong"}`,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			router := setupTestRouter(db)
+			router.Use(func(c *gin.Context) {
+				c.Set("challenge", challenge.Verifier(fakeVerifier{}))
+			})
+			router.POST("/email", CreateTempEmail)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/email", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+}
+
+func TestCreateTempEmailPGP(t *testing.T) {
+	config.GlobalConfig = config.Config{
+		EmailDomain: "test.com",
+	}
+	entity, err := openpgp.NewEntity("Inbox", "", "inbox@test.com", nil)
+	require.NoError(t, err)
+	var key bytes.Buffer
+	w, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+	body, err := json.Marshal(CreateEmailRequest{PGPPublicKey: key.String()})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "Valid Key",
+			body:         string(body),
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "Invalid Key",
+			body:         `{"pgpPublicKey":"not a key"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			router := setupTestRouter(db)
+			router.POST("/email", CreateTempEmail)
+			router.GET("/email/:id", GetTempEmail)
+			router.GET("/message/:id", GetMessage)
+
+			w := doRequest(router, "POST", "/email", "", tt.body)
+			assert.Equal(t, tt.expectedCode, w.Code)
+			if w.Code != http.StatusCreated {
+				return
+			}
+
+			var response CreateEmailResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			fingerprint := strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint))
+			assert.Equal(t, fingerprint, response.PGPFingerprint)
+			var email models.EmailAddress
+			require.NoError(t, db.First(&email).Error)
+			assert.Equal(t, key.String(), email.PGPKey)
+
+			w = doRequest(router, "GET", "/email/"+response.Address, "", "")
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, fingerprint, response.PGPFingerprint)
+
+			// the client gets the armored ciphertext to decrypt
+			raw, err := pgp.Encrypt(key.String(), []byte("Subject: Hello\r\n\r\nSecret\r\n"))
+			require.NoError(t, err)
+			msg := models.Message{EmailID: email.ID, Subject: pgp.HiddenSubject, Raw: raw, PGP: true}
+			require.NoError(t, db.Create(&msg).Error)
+			w = doRequest(router, "GET", "/message/"+msg.ID.String(), "", "")
+			require.Equal(t, http.StatusOK, w.Code)
+			var detail MessageDetailResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &detail))
+			assert.True(t, detail.PGP)
+			assert.True(t, strings.HasPrefix(detail.Content, "-----BEGIN PGP MESSAGE-----"))
+		})
+	}
+}
+
+func TestGetChallenge(t *testing.T) {
+	db := setupTestDB(t)
+
+	// without a verifier no challenge is required
+	router := setupTestRouter(db)
+	router.GET("/challenge", GetChallenge)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/challenge", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"provider":"none"}`, w.Body.String())
+
+	router = setupTestRouter(db)
+	router.Use(func(c *gin.Context) {
+		c.Set("challenge", challenge.Verifier(fakeVerifier{}))
+	})
+	router.GET("/challenge", GetChallenge)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/challenge", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response challenge.Challenge
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "fake", response.Provider)
+	assert.Equal(t, "token", response.Token)
+}
@@ -0,0 +1,379 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type AdminAddressResponse struct {
+	ID           uint      `json:"id"`
+	Address      string    `json:"address"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	Expired      bool      `json:"expired"`
+	CreatorIP    string    `json:"creatorIp"`
+	CreatorAgent string    `json:"creatorAgent"`
+	MessageCount int64     `json:"messageCount"`
+	StorageBytes int64     `json:"storageBytes"`
+}
+
+type AdminMessageResponse struct {
+	ID              uuid.UUID `json:"id"`
+	From            string    `json:"from"`
+	Subject         string    `json:"subject"`
+	AttachmentCount int64     `json:"attachmentCount"`
+	StorageBytes    int64     `json:"storageBytes"`
+	CreatedAt       time.Time `json:"receivedAt"`
+}
+
+type AuditLogResponse struct {
+	ID           uint       `json:"id"`
+	EmailID      uint       `json:"emailId"`
+	EmailAddress string     `json:"emailAddress"`
+	MessageID    *uuid.UUID `json:"messageId"`
+	Action       string     `json:"action"`
+	Detail       string     `json:"detail"`
+	IP           string     `json:"ip"`
+	UserAgent    string     `json:"userAgent"`
+	CreatedAt    time.Time  `json:"createdAt"`
+}
+
+// adminAddressRow is an address with its statistics, see addressStatsQuery.
+type adminAddressRow struct {
+	models.EmailAddress
+	MessageCount   int64
+	StorageBytes   int64
+	CreatedByIP    string
+	CreatedByAgent string
+}
+
+// Size of a message in stored bytes: text bodies, source and attachments.
+// Bodies and source count as stored, sealed when encryption at rest is
+// enabled; the source is NULL for messages received before it was kept.
+const messageSizeSQL = `OCTET_LENGTH(messages.content) + OCTET_LENGTH(messages.html_content) +
+	COALESCE(OCTET_LENGTH(messages.raw), 0) +
+	(SELECT COALESCE(SUM(attachments.size), 0) FROM attachments
+	 WHERE attachments.message_id = messages.id)`
+
+// addressStatsQuery selects addresses with message count, storage usage and
+// the creator from the audit log.
+func addressStatsQuery(db *gorm.DB) *gorm.DB {
+	return db.Model(&models.EmailAddress{}).Select(`email_addresses.*,
+		(SELECT COUNT(*) FROM messages
+		 WHERE messages.email_id = email_addresses.id AND messages.deleted_at IS NULL) AS message_count,
+		(SELECT COALESCE(SUM(` + messageSizeSQL + `), 0) FROM messages
+		 WHERE messages.email_id = email_addresses.id AND messages.deleted_at IS NULL) AS storage_bytes,
+		(SELECT audit_logs.ip FROM audit_logs
+		 WHERE audit_logs.email_id = email_addresses.id AND audit_logs.action = 'create'
+		 ORDER BY audit_logs.id LIMIT 1) AS created_by_ip,
+		(SELECT audit_logs.user_agent FROM audit_logs
+		 WHERE audit_logs.email_id = email_addresses.id AND audit_logs.action = 'create'
+		 ORDER BY audit_logs.id LIMIT 1) AS created_by_agent`)
+}
+
+func newAdminAddressResponse(row *adminAddressRow, now time.Time) AdminAddressResponse {
+	return AdminAddressResponse{
+		ID:           row.ID,
+		Address:      row.Address,
+		CreatedAt:    row.CreatedAt,
+		ExpiresAt:    row.ExpiresAt,
+		Expired:      now.After(row.ExpiresAt),
+		CreatorIP:    row.CreatedByIP,
+		CreatorAgent: row.CreatedByAgent,
+		MessageCount: row.MessageCount,
+		StorageBytes: row.StorageBytes,
+	}
+}
+
+// findAddressByID loads the address in the id parameter, or writes the error
+// response and returns false.
+func findAddressByID(c *gin.Context, db *gorm.DB, email *models.EmailAddress) bool {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address ID"})
+		return false
+	}
+	if err := db.First(email, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Email address not found"})
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	return true
+}
+
+// parseTimeQuery parses an optional RFC 3339 query parameter.
+func parseTimeQuery(c *gin.Context, name string) (*time.Time, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " time, expected RFC 3339"})
+		return nil, false
+	}
+	return &t, true
+}
+
+// AdminListAddresses lists addresses, optionally filtered by status (active
+// or expired), creator IP and a substring of the address.
+func AdminListAddresses(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	page, pageSize, offset := getPagination(c)
+	now := time.Now()
+
+	query := db.Model(&models.EmailAddress{})
+	switch c.Query("status") {
+	case "":
+	case "active":
+		query = query.Where("email_addresses.expires_at > ?", now)
+	case "expired":
+		query = query.Where("email_addresses.expires_at <= ?", now)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status, expected active or expired"})
+		return
+	}
+	if ip := c.Query("ip"); ip != "" {
+		query = query.Where(`EXISTS (SELECT 1 FROM audit_logs
+			WHERE audit_logs.email_id = email_addresses.id AND audit_logs.action = 'create' AND audit_logs.ip = ?)`, ip)
+	}
+	if q := c.Query("q"); q != "" {
+		query = query.Where("LOWER(email_addresses.address) LIKE ? ESCAPE '\\'", likePattern(q))
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var rows []adminAddressRow
+	if err := addressStatsQuery(query).
+		Order("email_addresses.created_at DESC").
+		Offset(offset).
+		Limit(pageSize).
+		Scan(&rows).Error; err != nil {
+		log.Errorf("Failed to list addresses: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch addresses"})
+		return
+	}
+
+	response := make([]AdminAddressResponse, len(rows))
+	for i := range rows {
+		response[i] = newAdminAddressResponse(&rows[i], now)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"addresses": response,
+		"total":     total,
+		"page":      page,
+		"size":      pageSize,
+	})
+}
+
+// AdminGetAddress returns an address with the list of its messages.
+func AdminGetAddress(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var email models.EmailAddress
+	if !findAddressByID(c, db, &email) {
+		return
+	}
+
+	var row adminAddressRow
+	if err := addressStatsQuery(db).Where("email_addresses.id = ?", email.ID).Scan(&row).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var messages []AdminMessageResponse
+	if err := db.Model(&models.Message{}).
+		Select(`messages.id, messages."from", messages.subject, messages.created_at,
+			(SELECT COUNT(*) FROM attachments
+			 WHERE attachments.message_id = messages.id) AS attachment_count,
+			`+messageSizeSQL+` AS storage_bytes`).
+		Where("messages.email_id = ?", email.ID).
+		Order("messages.created_at DESC").
+		Scan(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"address":  newAdminAddressResponse(&row, time.Now()),
+		"messages": messages,
+	})
+}
+
+// AdminDeleteAddress deletes an address and its messages, expired or not.
+func AdminDeleteAddress(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var email models.EmailAddress
+	if !findAddressByID(c, db, &email) {
+		return
+	}
+	deleteEmailAddress(c, db, &email)
+}
+
+// AdminExpireAddress expires an address immediately; the cleanup job removes
+// it later.
+func AdminExpireAddress(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var email models.EmailAddress
+	if !findAddressByID(c, db, &email) {
+		return
+	}
+
+	now := time.Now()
+	if email.ExpiresAt.After(now) {
+		if err := db.Model(&email).Update("expires_at", now).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to expire email"})
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminSearchAuditLogs searches the audit log by IP, action, address and a
+// from/to time range.
+func AdminSearchAuditLogs(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	page, pageSize, offset := getPagination(c)
+
+	query := db.Model(&models.AuditLog{})
+	if ip := c.Query("ip"); ip != "" {
+		query = query.Where("ip = ?", ip)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if address := c.Query("address"); address != "" {
+		query = query.Where("email_address = ?", address)
+	}
+	from, ok := parseTimeQuery(c, "from")
+	if !ok {
+		return
+	}
+	if from != nil {
+		query = query.Where("created_at >= ?", *from)
+	}
+	to, ok := parseTimeQuery(c, "to")
+	if !ok {
+		return
+	}
+	if to != nil {
+		query = query.Where("created_at < ?", *to)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var logs []models.AuditLog
+	if err := query.Order("created_at DESC").Offset(offset).Limit(pageSize).Find(&logs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit logs"})
+		return
+	}
+
+	response := make([]AuditLogResponse, len(logs))
+	for i, l := range logs {
+		response[i] = AuditLogResponse{
+			ID:           l.ID,
+			EmailID:      l.EmailID,
+			EmailAddress: l.EmailAddress,
+			MessageID:    l.MessageID,
+			Action:       l.Action,
+			Detail:       l.Detail,
+			IP:           l.IP,
+			UserAgent:    l.UserAgent,
+			CreatedAt:    l.CreatedAt,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"logs":  response,
+		"total": total,
+		"page":  page,
+		"size":  pageSize,
+	})
+}
+
+type OutboundMessageResponse struct {
+	ID            uint       `json:"id"`
+	EmailID       uint       `json:"emailId"`
+	MessageID     *uuid.UUID `json:"messageId"`
+	RuleID        *uint      `json:"ruleId"`
+	MailFrom      string     `json:"mailFrom"`
+	RcptTo        string     `json:"rcptTo"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt"`
+	LastError     string     `json:"lastError"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	SentAt        *time.Time `json:"sentAt"`
+	BouncedAt     *time.Time `json:"bouncedAt"`
+}
+
+// AdminListOutbound lists the relay queue, optionally by status.
+func AdminListOutbound(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	page, pageSize, offset := getPagination(c)
+
+	query := db.Model(&models.OutboundMessage{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var messages []models.OutboundMessage
+	if err := query.Omit("raw").Order("created_at DESC").Offset(offset).Limit(pageSize).Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch outbound messages"})
+		return
+	}
+
+	response := make([]OutboundMessageResponse, len(messages))
+	for i, m := range messages {
+		response[i] = OutboundMessageResponse{
+			ID:            m.ID,
+			EmailID:       m.EmailID,
+			MessageID:     m.MessageID,
+			RuleID:        m.RuleID,
+			MailFrom:      m.MailFrom,
+			RcptTo:        m.RcptTo,
+			Status:        m.Status,
+			Attempts:      m.Attempts,
+			NextAttemptAt: m.NextAttemptAt,
+			LastError:     m.LastError,
+			CreatedAt:     m.CreatedAt,
+			SentAt:        m.SentAt,
+			BouncedAt:     m.BouncedAt,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages": response,
+		"total":    total,
+		"page":     page,
+		"size":     pageSize,
+	})
+}
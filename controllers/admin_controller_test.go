@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/blob"
+	"secmail/models"
+)
+
+func setupAdminRouter(db *gorm.DB) *gin.Engine {
+	r := setupAuthRouter(db)
+	admin := r.Group("/admin", RequireScope(models.ScopeAdmin))
+	admin.GET("/addresses", AdminListAddresses)
+	admin.GET("/addresses/:id", AdminGetAddress)
+	admin.DELETE("/addresses/:id", AdminDeleteAddress)
+	admin.POST("/addresses/:id/expire", AdminExpireAddress)
+	admin.GET("/audit", AdminSearchAuditLogs)
+	admin.GET("/outbound", AdminListOutbound)
+	return r
+}
+
+// seedAddresses creates an active address with two messages from 10.0.0.1
+// and an expired one from 10.0.0.2.
+func seedAddresses(db *gorm.DB) (active, expired models.EmailAddress) {
+	active = models.EmailAddress{
+		Address:   "active1234@test.com",
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatorIP: "10.0.0.1",
+	}
+	db.Create(&active)
+	for i := 0; i < 2; i++ {
+		msg := models.Message{
+			ID:      uuid.New(),
+			EmailID: active.ID,
+			From:    "sender@example.com",
+			Subject: fmt.Sprintf("Subject %d", i),
+			Content: "hello",
+		}
+		db.Create(&msg)
+		att := models.Attachment{
+			ID:        uuid.New(),
+			MessageID: msg.ID,
+			FileName:  "a.txt",
+			BlobKey:   blob.Hash([]byte("0123456789")),
+			Hash:      blob.Hash([]byte("0123456789")),
+			Size:      10,
+		}
+		blob.PutBytes(context.Background(), testBlobs, att.BlobKey, []byte("0123456789"))
+		db.Create(&att)
+	}
+
+	expired = models.EmailAddress{
+		Address:   "expired123@test.com",
+		ExpiresAt: time.Now().Add(-time.Hour),
+		CreatorIP: "10.0.0.2",
+	}
+	db.Create(&expired)
+	return active, expired
+}
+
+type adminAddressList struct {
+	Addresses []AdminAddressResponse `json:"addresses"`
+	Total     int64                  `json:"total"`
+}
+
+func TestAdminListAddresses(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupAdminRouter(db)
+	seedAddresses(db)
+
+	tests := []struct {
+		name         string
+		query        string
+		expectedCode int
+		expected     []string
+	}{
+		{
+			name:         "All",
+			query:        "",
+			expectedCode: http.StatusOK,
+			expected:     []string{"expired123@test.com", "active1234@test.com"},
+		},
+		{
+			name:         "Active",
+			query:        "?status=active",
+			expectedCode: http.StatusOK,
+			expected:     []string{"active1234@test.com"},
+		},
+		{
+			name:         "Expired",
+			query:        "?status=expired",
+			expectedCode: http.StatusOK,
+			expected:     []string{"expired123@test.com"},
+		},
+		{
+			name:         "Creator IP",
+			query:        "?ip=10.0.0.2",
+			expectedCode: http.StatusOK,
+			expected:     []string{"expired123@test.com"},
+		},
+		{
+			name:         "Search",
+			query:        "?q=ACTIVE",
+			expectedCode: http.StatusOK,
+			expected:     []string{"active1234@test.com"},
+		},
+		{
+			name:         "Search Wildcards",
+			query:        "?q=%25_",
+			expectedCode: http.StatusOK,
+			expected:     []string{},
+		},
+		{
+			name:         "Invalid Status",
+			query:        "?status=deleted",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, "GET", "/admin/addresses"+tt.query, testAdminKey, "")
+			assert.Equal(t, tt.expectedCode, w.Code)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var response adminAddressList
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, int64(len(tt.expected)), response.Total)
+			addresses := make([]string, len(response.Addresses))
+			for i, a := range response.Addresses {
+				addresses[i] = a.Address
+			}
+			assert.ElementsMatch(t, tt.expected, addresses)
+		})
+	}
+
+	// statistics
+	w := doRequest(r, "GET", "/admin/addresses?status=active", testAdminKey, "")
+	var response adminAddressList
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, int64(2), response.Addresses[0].MessageCount)
+	assert.Equal(t, int64(2*(5+10)), response.Addresses[0].StorageBytes)
+	assert.Equal(t, "10.0.0.1", response.Addresses[0].CreatorIP)
+	assert.False(t, response.Addresses[0].Expired)
+}
+
+func TestAdminGetAddress(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupAdminRouter(db)
+	active, _ := seedAddresses(db)
+	// the source counts in stored bytes, and so do multi-byte characters
+	db.Model(&models.Message{}).Where("email_id = ?", active.ID).
+		Updates(map[string]any{"content": "héllo", "raw": []byte("From: a@b.c\r\n\r\nhéllo\r\n")})
+
+	w := doRequest(r, "GET", fmt.Sprintf("/admin/addresses/%d", active.ID), testAdminKey, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Address  AdminAddressResponse   `json:"address"`
+		Messages []AdminMessageResponse `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, active.Address, response.Address.Address)
+	assert.Len(t, response.Messages, 2)
+	assert.Equal(t, "sender@example.com", response.Messages[0].From)
+	assert.Equal(t, int64(1), response.Messages[0].AttachmentCount)
+	assert.Equal(t, int64(6+10+23), response.Messages[0].StorageBytes)
+	assert.Equal(t, int64(2*(6+10+23)), response.Address.StorageBytes)
+
+	w = doRequest(r, "GET", "/admin/addresses/999", testAdminKey, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminDeleteAndExpireAddress(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupAdminRouter(db)
+	active, expired := seedAddresses(db)
+
+	w := doRequest(r, "POST", fmt.Sprintf("/admin/addresses/%d/expire", active.ID), testAdminKey, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	var email models.EmailAddress
+	db.First(&email, active.ID)
+	assert.False(t, email.ExpiresAt.After(time.Now()))
+
+	// expired addresses can still be deleted
+	w = doRequest(r, "DELETE", fmt.Sprintf("/admin/addresses/%d", expired.ID), testAdminKey, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	var count int64
+	db.Model(&models.EmailAddress{}).Where("id = ?", expired.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	// anonymous callers are rejected
+	w = doRequest(r, "DELETE", fmt.Sprintf("/admin/addresses/%d", active.ID), "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAdminSearchAuditLogs(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupAdminRouter(db)
+	seedAddresses(db)
+
+	tests := []struct {
+		name          string
+		query         string
+		expectedCode  int
+		expectedTotal int64
+	}{
+		{name: "All", query: "", expectedCode: http.StatusOK, expectedTotal: 2},
+		{name: "By IP", query: "?ip=10.0.0.1", expectedCode: http.StatusOK, expectedTotal: 1},
+		{name: "By Action", query: "?action=delete", expectedCode: http.StatusOK, expectedTotal: 0},
+		{
+			name:          "By Date Range",
+			query:         "?from=" + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339) + "&to=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			expectedCode:  http.StatusOK,
+			expectedTotal: 2,
+		},
+		{name: "Future", query: "?from=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), expectedCode: http.StatusOK, expectedTotal: 0},
+		{name: "Invalid Date", query: "?from=yesterday", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, "GET", "/admin/audit"+tt.query, testAdminKey, "")
+			assert.Equal(t, tt.expectedCode, w.Code)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Logs  []AuditLogResponse `json:"logs"`
+				Total int64              `json:"total"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.expectedTotal, response.Total)
+		})
+	}
+
+	// entries about a message carry its id and a detail
+	messageID := uuid.New()
+	require.NoError(t, db.Create(&models.AuditLog{
+		EmailID:      1,
+		EmailAddress: "active1234@test.com",
+		MessageID:    &messageID,
+		Action:       models.AuditActionDeleteMessage,
+		Detail:       "imap",
+	}).Error)
+	w := doRequest(r, "GET", "/admin/audit?action=delete_message", testAdminKey, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Logs []AuditLogResponse `json:"logs"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Logs, 1)
+	require.NotNil(t, response.Logs[0].MessageID)
+	assert.Equal(t, messageID, *response.Logs[0].MessageID)
+	assert.Equal(t, "imap", response.Logs[0].Detail)
+}
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type RateLimitRequest struct {
+	Requests      int `json:"requests"`
+	PeriodSeconds int `json:"periodSeconds"`
+	Burst         int `json:"burst"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name          string            `json:"name" binding:"required"`
+	Scopes        []string          `json:"scopes" binding:"required,min=1"`
+	MaxTTLSeconds int               `json:"maxTtlSeconds"`
+	RateLimit     *RateLimitRequest `json:"rateLimit"`
+	ExpiresAt     *time.Time        `json:"expiresAt"`
+}
+
+type APIKeyResponse struct {
+	ID            uint              `json:"id"`
+	Name          string            `json:"name"`
+	Prefix        string            `json:"prefix"`
+	Scopes        []string          `json:"scopes"`
+	MaxTTLSeconds int               `json:"maxTtlSeconds"`
+	RateLimit     *RateLimitRequest `json:"rateLimit,omitempty"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	ExpiresAt     *time.Time        `json:"expiresAt"`
+	RevokedAt     *time.Time        `json:"revokedAt"`
+	LastUsedAt    *time.Time        `json:"lastUsedAt"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKeyResponse
+	// Key is only returned once, at creation
+	Key string `json:"key"`
+}
+
+func newAPIKeyResponse(k *models.APIKey) APIKeyResponse {
+	resp := APIKeyResponse{
+		ID:            k.ID,
+		Name:          k.Name,
+		Prefix:        k.Prefix,
+		Scopes:        k.ScopeList(),
+		MaxTTLSeconds: int(k.MaxTTL / time.Second),
+		CreatedAt:     k.CreatedAt,
+		ExpiresAt:     k.ExpiresAt,
+		RevokedAt:     k.RevokedAt,
+		LastUsedAt:    k.LastUsedAt,
+	}
+	if k.RateLimitRequests > 0 {
+		resp.RateLimit = &RateLimitRequest{
+			Requests:      k.RateLimitRequests,
+			PeriodSeconds: int(k.RateLimitPeriod / time.Second),
+			Burst:         k.RateLimitBurst,
+		}
+	}
+	return resp
+}
+
+func CreateAPIKey(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.APIKeyScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+			return
+		}
+	}
+	if req.MaxTTLSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid maximum TTL"})
+		return
+	}
+
+	key, hash, err := models.GenerateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+
+	apiKey := models.APIKey{
+		Name:      req.Name,
+		Prefix:    key[:10],
+		KeyHash:   hash,
+		Scopes:    strings.Join(req.Scopes, " "),
+		MaxTTL:    time.Duration(req.MaxTTLSeconds) * time.Second,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if rl := req.RateLimit; rl != nil {
+		if rl.Requests <= 0 || rl.PeriodSeconds <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rate limit"})
+			return
+		}
+		apiKey.RateLimitRequests = rl.Requests
+		apiKey.RateLimitPeriod = time.Duration(rl.PeriodSeconds) * time.Second
+		apiKey.RateLimitBurst = rl.Burst
+	}
+
+	if err := db.Create(&apiKey).Error; err != nil {
+		log.Errorf("Failed to create API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreateAPIKeyResponse{
+		APIKeyResponse: newAPIKeyResponse(&apiKey),
+		Key:            key,
+	})
+}
+
+func ListAPIKeys(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var keys []models.APIKey
+	if err := db.Order("created_at DESC").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	response := make([]APIKeyResponse, len(keys))
+	for i := range keys {
+		response[i] = newAPIKeyResponse(&keys[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": response})
+}
+
+func RevokeAPIKey(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	var apiKey models.APIKey
+	if err := db.First(&apiKey, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if apiKey.RevokedAt == nil {
+		now := time.Now()
+		if err := db.Model(&apiKey).Update("revoked_at", now).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
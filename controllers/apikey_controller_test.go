@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+
+	"secmail/config"
+	"secmail/models"
+)
+
+const testAdminKey = "admin-secret"
+
+func setupAuthRouter(db *gorm.DB) *gin.Engine {
+	config.GlobalConfig = config.Config{
+		EmailDomain: "test.com",
+		Auth:        config.AuthConfig{AdminKey: testAdminKey},
+	}
+	r := setupTestRouter(db)
+	r.Use(APIKeyAuth())
+	r.POST("/email", AllowScope(models.ScopeAddressCreate), CreateTempEmail)
+	admin := r.Group("/admin", RequireScope(models.ScopeAdmin))
+	admin.POST("/keys", CreateAPIKey)
+	admin.GET("/keys", ListAPIKeys)
+	admin.DELETE("/keys/:id", RevokeAPIKey)
+	return r
+}
+
+func doRequest(r *gin.Engine, method, path, key, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func createTestKey(t *testing.T, r *gin.Engine, body string) CreateAPIKeyResponse {
+	w := doRequest(r, "POST", "/admin/keys", testAdminKey, body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response CreateAPIKeyResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupAuthRouter(db)
+
+	tests := []struct {
+		name         string
+		key          string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "Anonymous",
+			body:         `{"name":"ci","scopes":["address:create"]}`,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Invalid Key",
+			key:          "sm_nope",
+			body:         `{"name":"ci","scopes":["address:create"]}`,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Unknown Scope",
+			key:          testAdminKey,
+			body:         `{"name":"ci","scopes":["everything"]}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Missing Name",
+			key:          testAdminKey,
+			body:         `{"scopes":["address:create"]}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "No Scopes",
+			key:          testAdminKey,
+			body:         `{"name":"ci","scopes":[]}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Success",
+			key:          testAdminKey,
+			body:         `{"name":"ci","scopes":["address:create"],"maxTtlSeconds":86400}`,
+			expectedCode: http.StatusCreated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, "POST", "/admin/keys", tt.key, tt.body)
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+
+	// only the hash is stored
+	var key models.APIKey
+	assert.NoError(t, db.First(&key).Error)
+	assert.Len(t, key.KeyHash, 64)
+	assert.Equal(t, 24*time.Hour, key.MaxTTL)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupAuthRouter(db)
+
+	readKey := createTestKey(t, r, `{"name":"reader","scopes":["address:read"]}`)
+	createKey := createTestKey(t, r, `{"name":"ci","scopes":["address:create"],"maxTtlSeconds":86400}`)
+
+	// scope is checked
+	w := doRequest(r, "POST", "/email", readKey.Key, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// non admin keys can't manage keys
+	w = doRequest(r, "GET", "/admin/keys", createKey.Key, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// custom address with a long lifetime
+	w = doRequest(r, "POST", "/email", createKey.Key, `{"localPart":"build-42","ttlSeconds":43200}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var response CreateEmailResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "build-42@test.com", response.Address)
+	assert.WithinDuration(t, time.Now().Add(12*time.Hour), response.ExpiresAt, 2*time.Second)
+
+	// the same address can't be created twice
+	w = doRequest(r, "POST", "/email", createKey.Key, `{"localPart":"build-42"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// the lifetime is limited by the key
+	w = doRequest(r, "POST", "/email", createKey.Key, `{"ttlSeconds":172800}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// anonymous callers can't customize addresses
+	w = doRequest(r, "POST", "/email", "", `{"localPart":"mine"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupAuthRouter(db)
+
+	key := createTestKey(t, r, `{"name":"ci","scopes":["address:create"]}`)
+
+	w := doRequest(r, "POST", "/email", key.Key, "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = doRequest(r, "DELETE", fmt.Sprintf("/admin/keys/%d", key.ID), testAdminKey, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = doRequest(r, "POST", "/email", key.Key, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = doRequest(r, "GET", "/admin/keys", testAdminKey, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Keys []APIKeyResponse `json:"keys"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Keys, 1)
+	assert.NotNil(t, response.Keys[0].RevokedAt)
+
+	w = doRequest(r, "DELETE", "/admin/keys/999", testAdminKey, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
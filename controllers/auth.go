@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"secmail/config"
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const lastUsedResolution = time.Minute
+
+// apiKeyFromRequest returns the key from "Authorization: Bearer" or X-API-Key.
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	auth := c.GetHeader("Authorization")
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// APIKeyAuth authenticates requests carrying an API key and stores the key
+// in the context as "apiKey". Requests without a key stay anonymous; a key
+// that is unknown, revoked or expired is rejected.
+func APIKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := apiKeyFromRequest(c)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		adminKey := config.GlobalConfig.Auth.AdminKey
+		if adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1 {
+			c.Set("apiKey", &models.APIKey{Name: "admin", Scopes: models.ScopeAdmin})
+			c.Next()
+			return
+		}
+
+		db := c.MustGet("db").(*gorm.DB)
+		var apiKey models.APIKey
+		if err := db.Where("key_hash = ?", models.HashToken(key)).First(&apiKey).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		now := time.Now()
+		if !apiKey.Active(now) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key revoked or expired"})
+			return
+		}
+
+		if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > lastUsedResolution {
+			if err := db.Model(&apiKey).UpdateColumn("last_used_at", now).Error; err != nil {
+				log.Warnf("Failed to update last use of API key %d: %v", apiKey.ID, err)
+			}
+		}
+
+		c.Set("apiKey", &apiKey)
+		c.Next()
+	}
+}
+
+// currentAPIKey returns the key the request was authenticated with, or nil
+// for anonymous requests.
+func currentAPIKey(c *gin.Context) *models.APIKey {
+	if v, ok := c.Get("apiKey"); ok {
+		return v.(*models.APIKey)
+	}
+	return nil
+}
+
+// RequireScope rejects requests without an API key granting scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := currentAPIKey(c)
+		if key == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key required"})
+			return
+		}
+		if !key.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
+
+// AllowScope lets anonymous requests through, but requests made with an API
+// key need the given scope.
+func AllowScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := currentAPIKey(c); key != nil && !key.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
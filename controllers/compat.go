@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"secmail/audit"
+	"secmail/blob"
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// The MailHog and Mailpit compatible routes expose the messages of all active
+// addresses, as a local mail catcher would.
+
+// compatMessage is a message with its recipient and parsed source.
+type compatMessage struct {
+	models.Message
+	To     string
+	Source []byte
+	Header mail.Header
+	Body   []byte
+}
+
+// activeMessages selects the messages of addresses that have not expired.
+func activeMessages(db *gorm.DB) *gorm.DB {
+	return db.Model(&models.Message{}).
+		Joins("JOIN email_addresses ON email_addresses.id = messages.email_id").
+		Where("email_addresses.expires_at > ? AND email_addresses.deleted_at IS NULL", time.Now())
+}
+
+// loadCompatMessages loads the messages with their attachments and parses
+// their source.
+func loadCompatMessages(c *gin.Context, db *gorm.DB, query *gorm.DB) ([]compatMessage, error) {
+	var messages []models.Message
+	if err := query.Preload("Attachments").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	emailIDs := make([]uint, 0, len(messages))
+	for _, m := range messages {
+		emailIDs = append(emailIDs, m.EmailID)
+	}
+	var addresses []models.EmailAddress
+	if len(emailIDs) > 0 {
+		if err := db.Select("id", "address").Where("id IN ?", emailIDs).Find(&addresses).Error; err != nil {
+			return nil, err
+		}
+	}
+	recipients := make(map[uint]string, len(addresses))
+	for _, a := range addresses {
+		recipients[a.ID] = a.Address
+	}
+
+	result := make([]compatMessage, len(messages))
+	for i, m := range messages {
+		result[i] = compatMessage{Message: m, To: recipients[m.EmailID]}
+		source, err := blob.Source(c.Request.Context(), c.MustGet("blobs").(blob.Store), &m, result[i].To)
+		if err != nil {
+			return nil, err
+		}
+		result[i].Source = source
+		if parsed, err := mail.ReadMessage(bytes.NewReader(source)); err == nil {
+			result[i].Header = parsed.Header
+			result[i].Body, _ = io.ReadAll(parsed.Body)
+		} else {
+			result[i].Header = mail.Header{}
+		}
+	}
+	return result, nil
+}
+
+// findCompatMessage loads an active message by id, nil if there is none.
+func findCompatMessage(c *gin.Context, db *gorm.DB, id string) (*compatMessage, error) {
+	messageID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil
+	}
+	messages, err := loadCompatMessages(c, db, activeMessages(db).Where("messages.id = ?", messageID))
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// getStartLimit reads the start and limit query parameters used by MailHog
+// and Mailpit.
+func getStartLimit(c *gin.Context) (start, limit int) {
+	start, _ = strconv.Atoi(c.DefaultQuery("start", "0"))
+	limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if start < 0 {
+		start = 0
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 50
+	}
+	return start, limit
+}
+
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(s))
+	return "%" + s + "%"
+}
+
+// searchText matches sender, subject and bodies. Only bodies stored in
+// plaintext are searched: the database holds ciphertext for those encrypted
+// at rest, and PGP messages have no readable body.
+func searchText(query *gorm.DB, text string) *gorm.DB {
+	p, sealed := likePattern(text), models.SealedPrefix+"%"
+	return query.Where(`LOWER(messages."from") LIKE ? ESCAPE '\' OR LOWER(messages.subject) LIKE ? ESCAPE '\' OR
+		(NOT messages.pgp AND messages.content NOT LIKE ? AND LOWER(messages.content) LIKE ? ESCAPE '\') OR
+		(NOT messages.pgp AND messages.html_content NOT LIKE ? AND LOWER(messages.html_content) LIKE ? ESCAPE '\')`,
+		p, p, sealed, p, sealed, p)
+}
+
+// deleteCompatMessages deletes messages and their attachments. Without ids,
+// every active message is deleted.
+func deleteCompatMessages(c *gin.Context, db *gorm.DB, ids []uuid.UUID) error {
+	query := activeMessages(db)
+	if ids != nil {
+		query = query.Where("messages.id IN ?", ids)
+	}
+	var messages []models.Message
+	if err := query.Select("messages.id", "messages.email_id").Find(&messages).Error; err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	deleted := make([]uuid.UUID, len(messages))
+	for i, m := range messages {
+		deleted[i] = m.ID
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := blob.DeleteAttachments(tx, deleted); err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", deleted).Delete(&models.Message{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		audit.RecordRequest(c, models.AuditLog{
+			EmailID:   messages[i].EmailID,
+			MessageID: &messages[i].ID,
+			Action:    models.AuditActionDeleteMessage,
+			Detail:    "compat api",
+		})
+	}
+	return nil
+}
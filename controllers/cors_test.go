@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name          string
+		origins       []string
+		method        string
+		origin        string
+		preflight     bool
+		expectedCode  int
+		expectedAllow string
+	}{
+		{
+			name:          "Allowed Origin",
+			origins:       []string{"https://mail.example.com/"},
+			method:        http.MethodGet,
+			origin:        "https://mail.example.com",
+			expectedCode:  http.StatusOK,
+			expectedAllow: "https://mail.example.com",
+		},
+		{
+			name:         "Other Origin",
+			origins:      []string{"https://mail.example.com"},
+			method:       http.MethodGet,
+			origin:       "https://evil.example.com",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "No Origins",
+			method:       http.MethodGet,
+			origin:       "https://mail.example.com",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:          "Any Origin",
+			origins:       []string{"*"},
+			method:        http.MethodGet,
+			origin:        "https://mail.example.com",
+			expectedCode:  http.StatusOK,
+			expectedAllow: "https://mail.example.com",
+		},
+		{
+			name:          "Preflight",
+			origins:       []string{"https://mail.example.com"},
+			method:        http.MethodOptions,
+			origin:        "https://mail.example.com",
+			preflight:     true,
+			expectedCode:  http.StatusNoContent,
+			expectedAllow: "https://mail.example.com",
+		},
+		{
+			name:         "Preflight Other Origin",
+			origins:      []string{"https://mail.example.com"},
+			method:       http.MethodOptions,
+			origin:       "https://evil.example.com",
+			preflight:    true,
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(CORS(tt.origins))
+			r.GET("/api/email/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/api/email/abc", nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+			}
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.Equal(t, tt.expectedAllow, w.Header().Get("Access-Control-Allow-Origin"))
+			if tt.preflight && tt.expectedAllow != "" {
+				assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "X-API-Key")
+			}
+		})
+	}
+}
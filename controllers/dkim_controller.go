@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"secmail/config"
+	"secmail/dkim"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RotateDKIMKeyRequest struct {
+	// Algorithm is "rsa" or "ed25519", the configured one by default
+	Algorithm string `json:"algorithm"`
+}
+
+type DKIMKeyResponse struct {
+	Selector  string `json:"selector"`
+	Algorithm string `json:"algorithm"`
+	Active    bool   `json:"active"`
+	// Pending is set until the key is activated
+	Pending   bool      `json:"pending"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Name and Value are the TXT record to publish; Strings is Value cut
+	// into strings of at most 255 characters
+	Name    string   `json:"name"`
+	Value   string   `json:"value"`
+	Strings []string `json:"strings"`
+}
+
+func newDKIMKeyResponse(k *dkim.Key) (DKIMKeyResponse, error) {
+	value, err := k.TXTRecord()
+	if err != nil {
+		return DKIMKeyResponse{}, err
+	}
+	parts, err := k.TXTStrings()
+	if err != nil {
+		return DKIMKeyResponse{}, err
+	}
+	return DKIMKeyResponse{
+		Selector:  k.Selector,
+		Algorithm: k.Algorithm,
+		Active:    k.Active,
+		Pending:   k.Pending,
+		CreatedAt: k.CreatedAt,
+		Name:      k.RecordName(config.GlobalConfig.EmailDomain),
+		Value:     value,
+		Strings:   parts,
+	}, nil
+}
+
+// AdminListDKIMKeys returns the DNS TXT records of the DKIM keys. Keys that
+// are no longer active stay published until they are deleted.
+func AdminListDKIMKeys(c *gin.Context) {
+	store := c.MustGet("dkim").(dkim.Store)
+
+	keys, err := store.Keys()
+	if err != nil {
+		log.Errorf("Failed to load DKIM keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load DKIM keys"})
+		return
+	}
+	response := make([]DKIMKeyResponse, 0, len(keys))
+	for _, k := range keys {
+		r, err := newDKIMKeyResponse(k)
+		if err != nil {
+			log.Errorf("Invalid DKIM key %s: %v", k.Selector, err)
+			continue
+		}
+		response = append(response, r)
+	}
+	c.JSON(http.StatusOK, gin.H{"domain": config.GlobalConfig.EmailDomain, "keys": response})
+}
+
+// AdminRotateDKIMKey generates a new pending key. The active key keeps
+// signing mail until the new one is activated, once its record is published.
+func AdminRotateDKIMKey(c *gin.Context) {
+	store := c.MustGet("dkim").(dkim.Store)
+
+	var req RotateDKIMKeyRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	algorithm := req.Algorithm
+	if algorithm == "" {
+		algorithm = config.GlobalConfig.DKIM.Algorithm
+	}
+	if algorithm != "" && algorithm != dkim.AlgorithmRSA && algorithm != dkim.AlgorithmEd25519 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown algorithm: " + algorithm})
+		return
+	}
+
+	key, err := dkim.Rotate(store, algorithm)
+	if err != nil {
+		log.Errorf("Failed to rotate DKIM key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate DKIM key"})
+		return
+	}
+	response, err := newDKIMKeyResponse(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode DKIM key"})
+		return
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// AdminActivateDKIMKey makes a key the one signing new mail. Its record has
+// to be published first. The previously active key stays published.
+func AdminActivateDKIMKey(c *gin.Context) {
+	store := c.MustGet("dkim").(dkim.Store)
+	selector := c.Param("selector")
+
+	if err := store.Activate(selector); err != nil {
+		if errors.Is(err, dkim.ErrKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "DKIM key not found"})
+			return
+		}
+		log.Errorf("Failed to activate DKIM key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate DKIM key"})
+		return
+	}
+	key, err := dkim.Active(store)
+	if err != nil || key == nil || key.Selector != selector {
+		log.Errorf("Failed to load the activated DKIM key %s: %v", selector, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate DKIM key"})
+		return
+	}
+	response, err := newDKIMKeyResponse(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode DKIM key"})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// AdminDeleteDKIMKey removes a retired key, once its record is unpublished.
+func AdminDeleteDKIMKey(c *gin.Context) {
+	store := c.MustGet("dkim").(dkim.Store)
+
+	if err := store.Delete(c.Param("selector")); err != nil {
+		switch {
+		case errors.Is(err, dkim.ErrKeyNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "DKIM key not found"})
+		case errors.Is(err, dkim.ErrActiveKey):
+			c.JSON(http.StatusConflict, gin.H{"error": "The active DKIM key cannot be deleted"})
+		default:
+			log.Errorf("Failed to delete DKIM key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete DKIM key"})
+		}
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
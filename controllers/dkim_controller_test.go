@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/dkim"
+	"secmail/models"
+)
+
+func setupDKIMRouter(db *gorm.DB) *gin.Engine {
+	r := setupAuthRouter(db)
+	store := dkim.NewDatabaseStore(db)
+	admin := r.Group("/admin/dkim", RequireScope(models.ScopeAdmin), func(c *gin.Context) {
+		c.Set("dkim", store)
+	})
+	admin.GET("", AdminListDKIMKeys)
+	admin.POST("/rotate", AdminRotateDKIMKey)
+	admin.POST("/:selector/activate", AdminActivateDKIMKey)
+	admin.DELETE("/:selector", AdminDeleteDKIMKey)
+	return r
+}
+
+func TestAdminDKIMKeys(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupDKIMRouter(db)
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(r, "GET", "/admin/dkim", "", "").Code)
+	assert.Equal(t, http.StatusBadRequest,
+		doRequest(r, "POST", "/admin/dkim/rotate", testAdminKey, `{"algorithm":"dsa"}`).Code)
+
+	w := doRequest(r, "POST", "/admin/dkim/rotate", testAdminKey, `{"algorithm":"ed25519"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var first DKIMKeyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+	assert.Equal(t, "ed25519", first.Algorithm)
+	assert.Equal(t, first.Selector+"._domainkey.test.com", first.Name)
+	assert.True(t, strings.HasPrefix(first.Value, "v=DKIM1; k=ed25519; p="))
+	assert.True(t, first.Pending)
+	assert.False(t, first.Active)
+
+	w = doRequest(r, "POST", "/admin/dkim/"+first.Selector+"/activate", testAdminKey, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+	assert.True(t, first.Active)
+	assert.False(t, first.Pending)
+
+	// RSA is the default, its record is split into strings
+	w = doRequest(r, "POST", "/admin/dkim/rotate", testAdminKey, "")
+	require.Equal(t, http.StatusCreated, w.Code)
+	var second DKIMKeyResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &second))
+	assert.Equal(t, "rsa", second.Algorithm)
+	assert.Greater(t, len(second.Strings), 1)
+	assert.Equal(t, second.Value, strings.Join(second.Strings, ""))
+	assert.True(t, second.Pending)
+	assert.Equal(t, http.StatusNotFound,
+		doRequest(r, "POST", "/admin/dkim/unknown/activate", testAdminKey, "").Code)
+	assert.Equal(t, http.StatusOK,
+		doRequest(r, "POST", "/admin/dkim/"+second.Selector+"/activate", testAdminKey, "").Code)
+
+	w = doRequest(r, "GET", "/admin/dkim", testAdminKey, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Domain string            `json:"domain"`
+		Keys   []DKIMKeyResponse `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Equal(t, "test.com", list.Domain)
+	require.Len(t, list.Keys, 2)
+	assert.True(t, list.Keys[0].Active)
+	assert.False(t, list.Keys[1].Active)
+
+	tests := []struct {
+		name       string
+		selector   string
+		wantStatus int
+	}{
+		{"active key", second.Selector, http.StatusConflict},
+		{"retired key", first.Selector, http.StatusNoContent},
+		{"unknown key", first.Selector, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, "DELETE", "/admin/dkim/"+tt.selector, testAdminKey, "")
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
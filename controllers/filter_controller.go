@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"secmail/audit"
+	"secmail/filter"
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// maxFilterTestMessages is how many of the latest messages a dry run
+// evaluates rules against.
+const maxFilterTestMessages = 50
+
+type FilterRulesRequest struct {
+	Rules []filter.Rule `json:"rules"`
+}
+
+type TestFilterRulesRequest struct {
+	// Rules to test, the stored rules of the address when omitted
+	Rules *[]filter.Rule `json:"rules"`
+}
+
+type FilterTestResult struct {
+	MessageID uuid.UUID     `json:"messageId"`
+	From      string        `json:"from"`
+	Subject   string        `json:"subject"`
+	Result    filter.Result `json:"result"`
+}
+
+// storedFilterRules decodes the rules of an address and writes an error
+// response if they are invalid.
+func storedFilterRules(c *gin.Context, email *models.EmailAddress) ([]filter.Rule, bool) {
+	rules, err := filter.Parse(email.FilterRules)
+	if err != nil {
+		log.Errorf("Invalid filter rules of %s: %v", email.Address, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid stored filter rules"})
+		return nil, false
+	}
+	if rules == nil {
+		rules = []filter.Rule{}
+	}
+	return rules, true
+}
+
+func GetFilterRules(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	email := findActiveAddress(c, db)
+	if email == nil {
+		return
+	}
+
+	rules, ok := storedFilterRules(c, email)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, FilterRulesRequest{Rules: rules})
+}
+
+// PutFilterRules replaces the rules of an address, an empty list removes
+// them. Rules can reject mail with a message of their own, so like sending
+// it needs the access token of the address.
+func PutFilterRules(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	email := findActiveAddress(c, db)
+	if email == nil || !checkAccessToken(c, email) {
+		return
+	}
+
+	var req FilterRulesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := filter.Validate(req.Rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rules: " + err.Error()})
+		return
+	}
+
+	var data string
+	if len(req.Rules) > 0 {
+		encoded, err := json.Marshal(req.Rules)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode rules"})
+			return
+		}
+		data = string(encoded)
+	} else {
+		req.Rules = []filter.Rule{}
+	}
+	if err := db.Model(email).Update("filter_rules", data).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update rules"})
+		return
+	}
+
+	audit.RecordRequest(c, models.AuditLog{
+		EmailID:      email.ID,
+		EmailAddress: email.Address,
+		Action:       models.AuditActionFilter,
+		Detail:       "set filter rules",
+	})
+	c.JSON(http.StatusOK, req)
+}
+
+// TestFilterRules evaluates rules against the latest messages of an
+// address without applying their actions.
+func TestFilterRules(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	email := findActiveAddress(c, db)
+	if email == nil {
+		return
+	}
+
+	var req TestFilterRulesRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	var rules []filter.Rule
+	if req.Rules != nil {
+		rules = *req.Rules
+		if err := filter.Validate(rules); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rules: " + err.Error()})
+			return
+		}
+	} else {
+		var ok bool
+		if rules, ok = storedFilterRules(c, email); !ok {
+			return
+		}
+	}
+
+	var messages []models.Message
+	if err := db.Preload("Attachments", func(tx *gorm.DB) *gorm.DB {
+		return tx.Select("id", "message_id")
+	}).Where("email_id = ?", email.ID).
+		Order("created_at DESC").
+		Limit(maxFilterTestMessages).
+		Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+
+	results := make([]FilterTestResult, len(messages))
+	for i, msg := range messages {
+		m := filter.NewMessage(msg.From, msg.Raw, len(msg.Attachments) > 0)
+		if len(msg.Raw) == 0 {
+			// stored before the source was kept
+			m.Subject = msg.Subject
+		}
+		results[i] = FilterTestResult{
+			MessageID: msg.ID,
+			From:      msg.From,
+			Subject:   msg.Subject,
+			Result:    filter.Evaluate(rules, m),
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
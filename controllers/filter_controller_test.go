@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/models"
+)
+
+func setupFilterRouter(db *gorm.DB) *gin.Engine {
+	r := setupAdminRouter(db)
+	r.GET("/email/:id/rules", GetFilterRules)
+	r.PUT("/email/:id/rules", PutFilterRules)
+	r.POST("/email/:id/rules/test", TestFilterRules)
+	return r
+}
+
+const testFilterRules = `{"rules":[{"name":"first","conditions":[{"field":"subject","op":"is","value":"subject 0"}],"actions":[{"type":"label","label":"first"}]}]}`
+
+func TestPutFilterRules(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupFilterRouter(db)
+	active, _ := seedAddresses(db)
+	token := seedAccessToken(t, db, &active)
+
+	tests := []struct {
+		name       string
+		address    string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{"no token", "active1234@test.com", "", testFilterRules, http.StatusUnauthorized},
+		{"wrong token", "active1234@test.com", "at_wrong", testFilterRules, http.StatusUnauthorized},
+		{"valid", "active1234@test.com", token, testFilterRules, http.StatusOK},
+		{"invalid rule", "active1234@test.com", token, `{"rules":[{"actions":[{"type":"bounce"}]}]}`, http.StatusBadRequest},
+		{"invalid body", "active1234@test.com", token, `{"rules":{}}`, http.StatusBadRequest},
+		{"expired address", "expired123@test.com", token, testFilterRules, http.StatusGone},
+		{"unknown address", "unknown123@test.com", token, testFilterRules, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doTokenRequest(r, "PUT", "/email/"+tt.address+"/rules", tt.token, tt.body)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	w := doRequest(r, "GET", "/email/active1234@test.com/rules", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var got FilterRulesRequest
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Len(t, got.Rules, 1)
+	assert.Equal(t, "first", got.Rules[0].Name)
+
+	// an empty list removes the rules
+	w = doTokenRequest(r, "PUT", "/email/active1234@test.com/rules", token, `{"rules":[]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, db.First(&active, active.ID).Error)
+	assert.Empty(t, active.FilterRules)
+
+	w = doRequest(r, "GET", "/email/active1234@test.com/rules", "", "")
+	assert.JSONEq(t, `{"rules":[]}`, w.Body.String())
+}
+
+func TestTestFilterRules(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupFilterRouter(db)
+	active, _ := seedAddresses(db)
+	token := seedAccessToken(t, db, &active)
+
+	var response struct {
+		Results []FilterTestResult `json:"results"`
+	}
+
+	// without a body, the stored rules are tested
+	w := doTokenRequest(r, "PUT", "/email/active1234@test.com/rules", token, testFilterRules)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, "POST", "/email/active1234@test.com/rules/test", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Results, 2)
+	for _, res := range response.Results {
+		if res.Subject == "Subject 0" {
+			assert.Equal(t, []string{"first"}, res.Result.Labels)
+		} else {
+			assert.Empty(t, res.Result.Matched)
+		}
+	}
+
+	w = doRequest(r, "POST", "/email/active1234@test.com/rules/test", "",
+		`{"rules":[{"conditions":[{"field":"has_attachment"}],"actions":[{"type":"discard"}]}]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Results, 2)
+	for _, res := range response.Results {
+		assert.True(t, res.Result.Discard)
+	}
+
+	w = doRequest(r, "POST", "/email/active1234@test.com/rules/test", "", `{"rules":[{"actions":[]}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// testing does not apply the actions
+	var count int64
+	db.Model(&models.Message{}).Count(&count)
+	assert.Equal(t, int64(2), count)
+}
@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"secmail/audit"
+	"secmail/config"
+	"secmail/models"
+	"secmail/ratelimit"
+	"secmail/relay"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxForwardRules limits the rules of an address, each one mails a
+// verification code to its destination.
+const maxForwardRules = 5
+
+type CreateForwardRuleRequest struct {
+	Destination string `json:"destination" binding:"required"`
+	From        string `json:"from"`
+	Subject     string `json:"subject"`
+}
+
+type VerifyForwardRuleRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type ForwardRuleResponse struct {
+	ID          uint       `json:"id"`
+	Destination string     `json:"destination"`
+	From        string     `json:"from"`
+	Subject     string     `json:"subject"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	VerifiedAt  *time.Time `json:"verifiedAt"`
+}
+
+func newForwardRuleResponse(r *models.ForwardRule) ForwardRuleResponse {
+	return ForwardRuleResponse{
+		ID:          r.ID,
+		Destination: r.Destination,
+		From:        r.FromFilter,
+		Subject:     r.SubjectFilter,
+		CreatedAt:   r.CreatedAt,
+		VerifiedAt:  r.VerifiedAt,
+	}
+}
+
+// findActiveAddress loads the address of the id parameter and writes an
+// error response if it is invalid, unknown or expired.
+func findActiveAddress(c *gin.Context, db *gorm.DB) *models.EmailAddress {
+	emailAddress := c.Param("id")
+	if !isValidEmailFormat(emailAddress) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email format"})
+		return nil
+	}
+
+	var email models.EmailAddress
+	if err := db.Where("address = ?", emailAddress).First(&email).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Email address not found"})
+			return nil
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil
+	}
+	if time.Now().After(email.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "Email address has expired"})
+		return nil
+	}
+	return &email
+}
+
+// findForwardRule loads a rule of an address and writes an error response
+// if there is none.
+func findForwardRule(c *gin.Context, db *gorm.DB, email *models.EmailAddress) *models.ForwardRule {
+	id, err := strconv.ParseUint(c.Param("ruleId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+		return nil
+	}
+	var rule models.ForwardRule
+	if err := db.Where("email_id = ?", email.ID).First(&rule, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Forwarding rule not found"})
+			return nil
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil
+	}
+	return &rule
+}
+
+// allowForwardRule applies the limit of rule creation per address, the
+// limit per client IP is a middleware. It writes the response when the
+// limit is reached.
+func allowForwardRule(c *gin.Context, email *models.EmailAddress) bool {
+	v, ok := c.Get("limiter")
+	if !ok {
+		return true
+	}
+	allowed, retryAfter := v.(*ratelimit.Limiter).Allow(c.Request.Context(), "forward_rule_address",
+		email.Address, config.GlobalConfig.RateLimit.ForwardRule)
+	if !allowed {
+		ratelimit.Reject(c, retryAfter)
+	}
+	return allowed
+}
+
+// validMailbox accepts a bare address, without display name.
+func validMailbox(address string) bool {
+	addr, err := mail.ParseAddress(address)
+	return err == nil && addr.Address == address && addr.Name == ""
+}
+
+// validDestination accepts a bare address outside of the temporary domain.
+func validDestination(destination string) bool {
+	if !validMailbox(destination) {
+		return false
+	}
+	_, domain, _ := strings.Cut(destination, "@")
+	return !strings.EqualFold(domain, config.GlobalConfig.EmailDomain)
+}
+
+// CreateForwardRule adds a rule and mails its verification code to the
+// destination; nothing is forwarded before the rule is verified. Like
+// sending, it needs the access token of the address.
+func CreateForwardRule(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	email := findActiveAddress(c, db)
+	if email == nil || !checkAccessToken(c, email) || !allowForwardRule(c, email) {
+		return
+	}
+
+	var req CreateForwardRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Destination = strings.ToLower(strings.TrimSpace(req.Destination))
+	if !validDestination(req.Destination) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid destination"})
+		return
+	}
+
+	var count int64
+	if err := db.Model(&models.ForwardRule{}).Where("email_id = ?", email.ID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if count >= maxForwardRules {
+		c.JSON(http.StatusConflict, gin.H{"error": "Too many forwarding rules"})
+		return
+	}
+
+	rule := models.ForwardRule{
+		EmailID:       email.ID,
+		Destination:   req.Destination,
+		FromFilter:    req.From,
+		SubjectFilter: req.Subject,
+	}
+	code, err := rule.NewVerificationCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate verification code"})
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&rule).Error; err != nil {
+			return err
+		}
+		return relay.SendVerification(tx, email, &rule, code)
+	})
+	if err != nil {
+		log.Errorf("Failed to create forwarding rule for %s: %v", email.Address, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create forwarding rule"})
+		return
+	}
+
+	audit.RecordRequest(c, models.AuditLog{
+		EmailID:      email.ID,
+		EmailAddress: email.Address,
+		Action:       models.AuditActionForward,
+		Detail:       "create rule to " + rule.Destination,
+	})
+	c.JSON(http.StatusCreated, newForwardRuleResponse(&rule))
+}
+
+func ListForwardRules(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	email := findActiveAddress(c, db)
+	if email == nil {
+		return
+	}
+
+	var rules []models.ForwardRule
+	if err := db.Where("email_id = ?", email.ID).Order("id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	response := make([]ForwardRuleResponse, len(rules))
+	for i := range rules {
+		response[i] = newForwardRuleResponse(&rules[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": response})
+}
+
+func VerifyForwardRule(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	email := findActiveAddress(c, db)
+	if email == nil || !checkAccessToken(c, email) {
+		return
+	}
+	rule := findForwardRule(c, db, email)
+	if rule == nil {
+		return
+	}
+
+	var req VerifyForwardRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if rule.VerifiedAt == nil {
+		if !rule.CheckVerificationCode(strings.TrimSpace(req.Code)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid verification code"})
+			return
+		}
+		now := time.Now()
+		if err := db.Model(rule).Updates(map[string]any{"verified_at": now, "code_hash": ""}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify forwarding rule"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, newForwardRuleResponse(rule))
+}
+
+func DeleteForwardRule(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	email := findActiveAddress(c, db)
+	if email == nil || !checkAccessToken(c, email) {
+		return
+	}
+	rule := findForwardRule(c, db, email)
+	if rule == nil {
+		return
+	}
+
+	if err := db.Delete(rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete forwarding rule"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/config"
+	"secmail/models"
+	"secmail/ratelimit"
+)
+
+var forwardCodeRegexp = regexp.MustCompile(`fc_[0-9a-f]{48}`)
+
+func setupForwardRouter(db *gorm.DB) *gin.Engine {
+	r := setupAdminRouter(db)
+	config.GlobalConfig.Relay = config.RelayConfig{Enable: true, SRSSecret: "secret"}
+	r.POST("/email/:id/forward", CreateForwardRule)
+	r.GET("/email/:id/forward", ListForwardRules)
+	r.POST("/email/:id/forward/:ruleId/verify", VerifyForwardRule)
+	r.DELETE("/email/:id/forward/:ruleId", DeleteForwardRule)
+	r.DELETE("/email/:id", DeleteTempEmail)
+	return r
+}
+
+// seedAccessToken gives an address an access token and returns it.
+func seedAccessToken(t *testing.T, db *gorm.DB, email *models.EmailAddress) string {
+	token, err := email.NewAccessToken()
+	require.NoError(t, err)
+	require.NoError(t, db.Save(email).Error)
+	return token
+}
+
+func TestCreateForwardRule(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupForwardRouter(db)
+	active, _ := seedAddresses(db)
+	token := seedAccessToken(t, db, &active)
+
+	tests := []struct {
+		name       string
+		address    string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{"no token", "active1234@test.com", "", `{"destination":"me@example.org"}`, http.StatusUnauthorized},
+		{"wrong token", "active1234@test.com", "at_wrong", `{"destination":"me@example.org"}`, http.StatusUnauthorized},
+		{"valid", "active1234@test.com", token, `{"destination":"Me@Example.org","subject":"invoice"}`, http.StatusCreated},
+		{"expired address", "expired123@test.com", token, `{"destination":"me@example.org"}`, http.StatusGone},
+		{"unknown address", "unknown123@test.com", token, `{"destination":"me@example.org"}`, http.StatusNotFound},
+		{"missing destination", "active1234@test.com", token, `{}`, http.StatusBadRequest},
+		{"display name", "active1234@test.com", token, `{"destination":"Me <me@example.org>"}`, http.StatusBadRequest},
+		{"temporary domain", "active1234@test.com", token, `{"destination":"other12345@test.com"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doTokenRequest(r, "POST", "/email/"+tt.address+"/forward", tt.token, tt.body)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	var rule models.ForwardRule
+	require.NoError(t, db.First(&rule).Error)
+	assert.Equal(t, "me@example.org", rule.Destination)
+	assert.Equal(t, "invoice", rule.SubjectFilter)
+	assert.Nil(t, rule.VerifiedAt)
+
+	// the verification code is queued for the destination
+	var queued []models.OutboundMessage
+	require.NoError(t, db.Find(&queued).Error)
+	require.Len(t, queued, 1)
+	assert.Equal(t, "me@example.org", queued[0].RcptTo)
+	assert.Equal(t, models.OutboundQueued, queued[0].Status)
+	assert.Regexp(t, forwardCodeRegexp, string(queued[0].Raw))
+
+	// the number of rules is limited
+	for i := 1; i < maxForwardRules; i++ {
+		w := doTokenRequest(r, "POST", "/email/active1234@test.com/forward", token, `{"destination":"me@example.org"}`)
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	w := doTokenRequest(r, "POST", "/email/active1234@test.com/forward", token, `{"destination":"me@example.org"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestForwardRuleRateLimit(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupForwardRouter(db)
+	config.GlobalConfig.RateLimit.ForwardRule = config.RateLimitRule{Requests: 1, Period: time.Hour, Burst: 2}
+	limiter := ratelimit.New(ratelimit.NewMemoryStore())
+	r.POST("/limited/:id/forward", ratelimit.Middleware(limiter, "forward_rule", config.GlobalConfig.RateLimit.ForwardRule),
+		func(c *gin.Context) { c.Set("limiter", limiter) }, CreateForwardRule)
+	active, _ := seedAddresses(db)
+	token := seedAccessToken(t, db, &active)
+	other := models.EmailAddress{Address: "other12345@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	otherToken := seedAccessToken(t, db, &other)
+
+	// the address reaches its limit
+	for i := 0; i < 2; i++ {
+		w := doTokenRequest(r, "POST", "/limited/active1234@test.com/forward", token, `{"destination":"me@example.org"}`)
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	w := doTokenRequest(r, "POST", "/limited/active1234@test.com/forward", token, `{"destination":"me@example.org"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// and so does the client IP, for any address
+	w = doTokenRequest(r, "POST", "/limited/other12345@test.com/forward", otherToken, `{"destination":"me@example.org"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	var count int64
+	db.Model(&models.ForwardRule{}).Count(&count)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestForwardRuleLifecycle(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupForwardRouter(db)
+	active, _ := seedAddresses(db)
+	token := seedAccessToken(t, db, &active)
+
+	w := doTokenRequest(r, "POST", "/email/active1234@test.com/forward", token, `{"destination":"me@example.org"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created ForwardRuleResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+	var queued models.OutboundMessage
+	require.NoError(t, db.First(&queued).Error)
+	code := forwardCodeRegexp.FindString(string(queued.Raw))
+
+	path := fmt.Sprintf("/email/active1234@test.com/forward/%d", created.ID)
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{"no token", path + "/verify", "", `{"code":"` + code + `"}`, http.StatusUnauthorized},
+		{"wrong code", path + "/verify", token, `{"code":"fc_wrong"}`, http.StatusBadRequest},
+		{"missing code", path + "/verify", token, `{}`, http.StatusBadRequest},
+		{"unknown rule", "/email/active1234@test.com/forward/999/verify", token, `{"code":"` + code + `"}`, http.StatusNotFound},
+		{"valid code", path + "/verify", token, `{"code":"` + code + `"}`, http.StatusOK},
+		{"already verified", path + "/verify", token, `{"code":"` + code + `"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doTokenRequest(r, "POST", tt.path, tt.token, tt.body)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	w = doRequest(r, "GET", "/email/active1234@test.com/forward", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Rules []ForwardRuleResponse `json:"rules"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Rules, 1)
+	assert.NotNil(t, list.Rules[0].VerifiedAt)
+
+	// the queue is visible to admins
+	w = doRequest(r, "GET", "/admin/outbound?status=queued", testAdminKey, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"rcptTo":"me@example.org"`)
+	assert.NotContains(t, w.Body.String(), code)
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(r, "DELETE", path, "", "").Code)
+	assert.Equal(t, http.StatusNoContent, doTokenRequest(r, "DELETE", path, token, "").Code)
+	assert.Equal(t, http.StatusNotFound, doTokenRequest(r, "DELETE", path, token, "").Code)
+
+	// rules are deleted with their address
+	w = doTokenRequest(r, "POST", "/email/active1234@test.com/forward", token, `{"destination":"me@example.org"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(r, "DELETE", "/email/active1234@test.com", "", "").Code)
+	var count int64
+	db.Model(&models.ForwardRule{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
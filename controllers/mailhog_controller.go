@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MailHog API v2 shapes, field names as MailHog serializes them.
+
+type MailHogPath struct {
+	Relays  []string
+	Mailbox string
+	Domain  string
+	Params  string
+}
+
+type MailHogContent struct {
+	Headers map[string][]string
+	Body    string
+	Size    int
+	MIME    *MailHogMIME
+}
+
+type MailHogMIME struct {
+	Parts []*MailHogContent
+}
+
+type MailHogRaw struct {
+	From string
+	To   []string
+	Data string
+	Helo string
+}
+
+type MailHogMessage struct {
+	ID      string
+	From    *MailHogPath
+	To      []*MailHogPath
+	Content *MailHogContent
+	Created time.Time
+	MIME    *MailHogMIME
+	Raw     *MailHogRaw
+}
+
+type MailHogMessagesResponse struct {
+	Total int64            `json:"total"`
+	Count int              `json:"count"`
+	Start int              `json:"start"`
+	Items []MailHogMessage `json:"items"`
+}
+
+func newMailHogPath(address string) *MailHogPath {
+	mailbox, domain, _ := strings.Cut(address, "@")
+	return &MailHogPath{Mailbox: mailbox, Domain: domain}
+}
+
+func newMailHogMessage(m *compatMessage) MailHogMessage {
+	from := m.From
+	if from == "" {
+		from = "mailer-daemon@invalid"
+	}
+	return MailHogMessage{
+		ID:   m.ID.String(),
+		From: newMailHogPath(from),
+		To:   []*MailHogPath{newMailHogPath(m.To)},
+		Content: &MailHogContent{
+			Headers: m.Header,
+			Body:    string(m.Body),
+			Size:    len(m.Source),
+		},
+		Created: m.CreatedAt,
+		Raw: &MailHogRaw{
+			From: m.From,
+			To:   []string{m.To},
+			Data: string(m.Source),
+		},
+	}
+}
+
+// mailHogList writes a page of the messages selected by the query, newest
+// first.
+func mailHogList(c *gin.Context, db *gorm.DB, query *gorm.DB) {
+	start, limit := getStartLimit(c)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	messages, err := loadCompatMessages(c, db, query.Order("messages.created_at DESC").Offset(start).Limit(limit))
+	if err != nil {
+		log.Errorf("Failed to load messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+
+	items := make([]MailHogMessage, len(messages))
+	for i := range messages {
+		items[i] = newMailHogMessage(&messages[i])
+	}
+	c.JSON(http.StatusOK, MailHogMessagesResponse{
+		Total: total,
+		Count: len(items),
+		Start: start,
+		Items: items,
+	})
+}
+
+// MailHogListMessages serves GET /api/v2/messages.
+func MailHogListMessages(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	mailHogList(c, db, activeMessages(db))
+}
+
+// MailHogSearch serves GET /api/v2/search with kind from, to or containing.
+func MailHogSearch(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	text := c.Query("query")
+	query := activeMessages(db)
+
+	switch c.Query("kind") {
+	case "from":
+		query = query.Where(`LOWER(messages."from") LIKE ? ESCAPE '\'`, likePattern(text))
+	case "to":
+		query = query.Where("LOWER(email_addresses.address) LIKE ? ESCAPE '\\'", likePattern(text))
+	case "containing":
+		query = searchText(query, text)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid search kind"})
+		return
+	}
+	mailHogList(c, db, query)
+}
+
+// MailHogDeleteMessage serves DELETE /api/v1/messages/:id.
+func MailHogDeleteMessage(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	messageID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	if err := deleteCompatMessages(c, db, []uuid.UUID{messageID}); err != nil {
+		log.Errorf("Failed to delete message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+	c.Status(http.StatusOK)
+}
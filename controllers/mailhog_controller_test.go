@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"secmail/models"
+)
+
+func TestMailHogMessages(t *testing.T) {
+	db := setupTestDB(t)
+	active, _ := seedAddresses(db)
+	r := setupCompatRouter(db)
+
+	tests := []struct {
+		name  string
+		path  string
+		code  int
+		total int64
+	}{
+		{"list", "/api/v2/messages", http.StatusOK, 2},
+		{"page", "/api/v2/messages?start=1&limit=1", http.StatusOK, 2},
+		{"search from", "/api/v2/search?kind=from&query=SENDER@", http.StatusOK, 2},
+		{"search to", "/api/v2/search?kind=to&query=expired", http.StatusOK, 0},
+		{"search containing", "/api/v2/search?kind=containing&query=subject+0", http.StatusOK, 1},
+		{"search wildcard", "/api/v2/search?kind=containing&query=subject_0", http.StatusOK, 0},
+		{"search body", "/api/v2/search?kind=containing&query=HELLO", http.StatusOK, 2},
+		{"invalid kind", "/api/v2/search?kind=size&query=1", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, http.MethodGet, tt.path, "", "")
+			require.Equal(t, tt.code, w.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			var resp MailHogMessagesResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.total, resp.Total)
+			assert.Equal(t, len(resp.Items), resp.Count)
+			for _, item := range resp.Items {
+				assert.Equal(t, active.Address, item.Raw.To[0])
+				assert.Equal(t, "sender", item.From.Mailbox)
+				assert.NotEmpty(t, item.Content.Headers["Subject"])
+			}
+		})
+	}
+
+	w := doRequest(r, http.MethodGet, "/api/v2/messages?limit=1", "", "")
+	var resp MailHogMessagesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Items, 1)
+
+	w = doRequest(r, http.MethodDelete, "/api/v1/messages/"+resp.Items[0].ID, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doRequest(r, http.MethodGet, "/api/v2/messages", "", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, int64(1), resp.Total)
+}
+
+func TestMailHogSearchUnreadableBodies(t *testing.T) {
+	db := setupTestDB(t)
+	active, _ := seedAddresses(db)
+	r := setupCompatRouter(db)
+
+	// the body of a PGP message is ciphertext, and so is a body sealed at
+	// rest even if it happens to contain the text
+	pgp := models.Message{ID: uuid.New(), EmailID: active.ID, From: "sender@example.com", Subject: "PGP", Content: "hello", PGP: true}
+	require.NoError(t, db.Create(&pgp).Error)
+	sealed := models.Message{ID: uuid.New(), EmailID: active.ID, From: "sender@example.com", Subject: "Sealed"}
+	require.NoError(t, db.Create(&sealed).Error)
+	require.NoError(t, db.Exec("UPDATE messages SET content = ? WHERE id = ?", models.SealedPrefix+"hello", sealed.ID).Error)
+
+	w := doRequest(r, http.MethodGet, "/api/v2/search?kind=containing&query=hello", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp MailHogMessagesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, int64(2), resp.Total)
+
+	// their sender and subject are still searched
+	w = doRequest(r, http.MethodGet, "/api/v2/search?kind=containing&query=pgp", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, int64(1), resp.Total)
+}
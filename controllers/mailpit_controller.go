@@ -0,0 +1,436 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"secmail/audit"
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Mailpit API v1 shapes.
+
+type MailpitAddress struct {
+	Name    string
+	Address string
+}
+
+type MailpitSummary struct {
+	ID          string
+	MessageID   string
+	Read        bool
+	From        *MailpitAddress
+	To          []MailpitAddress
+	Cc          []MailpitAddress
+	Bcc         []MailpitAddress
+	ReplyTo     []MailpitAddress
+	Subject     string
+	Created     time.Time
+	Tags        []string
+	Size        int
+	Attachments int
+	Snippet     string
+}
+
+type MailpitMessagesResponse struct {
+	Total         int64            `json:"total"`
+	Unread        int64            `json:"unread"`
+	Count         int              `json:"count"`
+	MessagesCount int64            `json:"messages_count"`
+	Start         int              `json:"start"`
+	Tags          []string         `json:"tags"`
+	Messages      []MailpitSummary `json:"messages"`
+}
+
+type MailpitAttachment struct {
+	PartID      string
+	FileName    string
+	ContentType string
+	ContentID   string
+	Size        int
+}
+
+type MailpitMessage struct {
+	ID          string
+	MessageID   string
+	From        *MailpitAddress
+	To          []MailpitAddress
+	Cc          []MailpitAddress
+	Bcc         []MailpitAddress
+	ReplyTo     []MailpitAddress
+	ReturnPath  string
+	Subject     string
+	Date        time.Time
+	Tags        []string
+	Text        string
+	HTML        string
+	Size        int
+	Inline      []MailpitAttachment
+	Attachments []MailpitAttachment
+}
+
+type MailpitIDsRequest struct {
+	IDs  []string `json:"IDs"`
+	Read bool     `json:"Read"`
+}
+
+const snippetLength = 250
+
+func mailpitAddresses(header mail.Header, name string) []MailpitAddress {
+	list, err := header.AddressList(name)
+	addrs := make([]MailpitAddress, 0, len(list))
+	if err != nil {
+		return addrs
+	}
+	for _, a := range list {
+		addrs = append(addrs, MailpitAddress{Name: a.Name, Address: a.Address})
+	}
+	return addrs
+}
+
+func mailpitFrom(m *compatMessage) *MailpitAddress {
+	if from := mailpitAddresses(m.Header, "From"); len(from) > 0 {
+		return &from[0]
+	}
+	return &MailpitAddress{Address: m.From}
+}
+
+func mailpitTo(m *compatMessage) []MailpitAddress {
+	if to := mailpitAddresses(m.Header, "To"); len(to) > 0 {
+		return to
+	}
+	return []MailpitAddress{{Address: m.To}}
+}
+
+func snippet(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) <= snippetLength {
+		return text
+	}
+	text = text[:snippetLength]
+	for !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+	return text + "..."
+}
+
+func newMailpitSummary(m *compatMessage) MailpitSummary {
+	return MailpitSummary{
+		ID:          m.ID.String(),
+		MessageID:   strings.Trim(m.Header.Get("Message-Id"), "<>"),
+		Read:        m.Seen,
+		From:        mailpitFrom(m),
+		To:          mailpitTo(m),
+		Cc:          mailpitAddresses(m.Header, "Cc"),
+		Bcc:         mailpitAddresses(m.Header, "Bcc"),
+		ReplyTo:     mailpitAddresses(m.Header, "Reply-To"),
+		Subject:     m.Subject,
+		Created:     m.CreatedAt,
+		Tags:        []string{},
+		Size:        len(m.Source),
+		Attachments: len(m.Attachments),
+		Snippet:     snippet(m.Content),
+	}
+}
+
+func newMailpitMessage(m *compatMessage) MailpitMessage {
+	attachments := make([]MailpitAttachment, len(m.Attachments))
+	for i, a := range m.Attachments {
+		attachments[i] = MailpitAttachment{
+			PartID:      a.ID.String(),
+			FileName:    a.FileName,
+			ContentType: a.ContentType,
+			Size:        int(a.Size),
+		}
+	}
+	date, err := m.Header.Date()
+	if err != nil {
+		date = m.CreatedAt
+	}
+
+	return MailpitMessage{
+		ID:          m.ID.String(),
+		MessageID:   strings.Trim(m.Header.Get("Message-Id"), "<>"),
+		From:        mailpitFrom(m),
+		To:          mailpitTo(m),
+		Cc:          mailpitAddresses(m.Header, "Cc"),
+		Bcc:         mailpitAddresses(m.Header, "Bcc"),
+		ReplyTo:     mailpitAddresses(m.Header, "Reply-To"),
+		ReturnPath:  m.From,
+		Subject:     m.Subject,
+		Date:        date,
+		Tags:        []string{},
+		Text:        m.Content,
+		HTML:        m.HTMLContent,
+		Size:        len(m.Source),
+		Inline:      []MailpitAttachment{},
+		Attachments: attachments,
+	}
+}
+
+// splitSearch splits a search on spaces, keeping quoted phrases together.
+func splitSearch(search string) []string {
+	var terms []string
+	var term strings.Builder
+	quoted := false
+	for _, r := range search {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+		default:
+			term.WriteRune(r)
+		}
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms
+}
+
+// mailpitSearch applies a Mailpit search: free text, from:, to:, subject:,
+// is:read, is:unread and has:attachment.
+func mailpitSearch(query *gorm.DB, search string) *gorm.DB {
+	for _, term := range splitSearch(search) {
+		key, value, ok := strings.Cut(term, ":")
+		switch key = strings.ToLower(key); {
+		case ok && key == "from":
+			query = query.Where(`LOWER(messages."from") LIKE ? ESCAPE '\'`, likePattern(value))
+		case ok && key == "to":
+			query = query.Where("LOWER(email_addresses.address) LIKE ? ESCAPE '\\'", likePattern(value))
+		case ok && key == "subject":
+			query = query.Where("LOWER(messages.subject) LIKE ? ESCAPE '\\'", likePattern(value))
+		case ok && key == "is" && strings.EqualFold(value, "read"):
+			query = query.Where("messages.seen = ?", true)
+		case ok && key == "is" && strings.EqualFold(value, "unread"):
+			query = query.Where("messages.seen = ?", false)
+		case ok && key == "has" && strings.EqualFold(value, "attachment"):
+			query = query.Where("EXISTS (SELECT 1 FROM attachments WHERE attachments.message_id = messages.id)")
+		default:
+			query = searchText(query, term)
+		}
+	}
+	return query
+}
+
+// mailpitList writes a page of the messages selected by the query, newest
+// first.
+func mailpitList(c *gin.Context, db *gorm.DB, query *gorm.DB) {
+	start, limit := getStartLimit(c)
+
+	var total, unread, matched int64
+	if err := activeMessages(db).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := activeMessages(db).Where("messages.seen = ?", false).Count(&unread).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := query.Session(&gorm.Session{}).Count(&matched).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	messages, err := loadCompatMessages(c, db, query.Order("messages.created_at DESC").Offset(start).Limit(limit))
+	if err != nil {
+		log.Errorf("Failed to load messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+
+	summaries := make([]MailpitSummary, len(messages))
+	for i := range messages {
+		summaries[i] = newMailpitSummary(&messages[i])
+	}
+	c.JSON(http.StatusOK, MailpitMessagesResponse{
+		Total:         total,
+		Unread:        unread,
+		Count:         len(summaries),
+		MessagesCount: matched,
+		Start:         start,
+		Tags:          []string{},
+		Messages:      summaries,
+	})
+}
+
+// MailpitListMessages serves GET /api/v1/messages.
+func MailpitListMessages(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	mailpitList(c, db, activeMessages(db))
+}
+
+// MailpitSearch serves GET /api/v1/search.
+func MailpitSearch(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	search := strings.TrimSpace(c.Query("query"))
+	if search == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing search query"})
+		return
+	}
+	mailpitList(c, db, mailpitSearch(activeMessages(db), search))
+}
+
+// mailpitMessage loads the message of the id parameter, "latest" is the
+// newest message. It writes the error response if there is none.
+func mailpitMessage(c *gin.Context, db *gorm.DB) *compatMessage {
+	id := c.Param("id")
+	if id == "latest" {
+		var latest []string
+		if err := activeMessages(db).Order("messages.created_at DESC").Limit(1).
+			Pluck("messages.id", &latest).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return nil
+		}
+		if len(latest) > 0 {
+			id = latest[0]
+		}
+	}
+
+	message, err := findCompatMessage(c, db, id)
+	if err != nil {
+		log.Errorf("Failed to load message %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil
+	}
+	if message == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil
+	}
+	return message
+}
+
+// MailpitGetMessage serves GET /api/v1/message/:id and marks the message as
+// read.
+func MailpitGetMessage(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	message := mailpitMessage(c, db)
+	if message == nil {
+		return
+	}
+
+	if !message.Seen {
+		if err := db.Model(&message.Message).Update("seen", true).Error; err != nil {
+			log.Warnf("Failed to mark message %s as read: %v", message.ID, err)
+		}
+	}
+	audit.RecordRequest(c, models.AuditLog{
+		EmailID:      message.EmailID,
+		EmailAddress: message.To,
+		MessageID:    &message.ID,
+		Action:       models.AuditActionAccess,
+		Detail:       "compat api read message",
+	})
+
+	c.JSON(http.StatusOK, newMailpitMessage(message))
+}
+
+// MailpitGetRaw serves GET /api/v1/message/:id/raw.
+func MailpitGetRaw(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	message := mailpitMessage(c, db)
+	if message == nil {
+		return
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", message.Source)
+}
+
+// MailpitGetPart serves GET /api/v1/message/:id/part/:partId, the part ids
+// are attachment ids.
+func MailpitGetPart(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	message := mailpitMessage(c, db)
+	if message == nil {
+		return
+	}
+
+	for i, a := range message.Attachments {
+		if a.ID.String() == c.Param("partId") {
+			c.Header("Content-Disposition", "attachment; filename="+a.FileName)
+			serveAttachment(c, &message.Attachments[i], a.ContentType)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Part not found"})
+}
+
+// bindMailpitIDs reads the optional {"IDs": [...]} body, nil ids means all
+// messages.
+func bindMailpitIDs(c *gin.Context, req *MailpitIDsRequest) ([]uuid.UUID, bool) {
+	if err := c.ShouldBindJSON(req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return nil, false
+	}
+	if len(req.IDs) == 0 {
+		return nil, true
+	}
+
+	ids := make([]uuid.UUID, len(req.IDs))
+	for i, id := range req.IDs {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID " + id})
+			return nil, false
+		}
+		ids[i] = parsed
+	}
+	return ids, true
+}
+
+// MailpitDeleteMessages serves DELETE /api/v1/messages: the messages in the
+// body, or all messages without a body as in MailHog.
+func MailpitDeleteMessages(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	var req MailpitIDsRequest
+	ids, ok := bindMailpitIDs(c, &req)
+	if !ok {
+		return
+	}
+
+	if err := deleteCompatMessages(c, db, ids); err != nil {
+		log.Errorf("Failed to delete messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete messages"})
+		return
+	}
+	c.String(http.StatusOK, "ok")
+}
+
+// MailpitSetReadStatus serves PUT /api/v1/messages.
+func MailpitSetReadStatus(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	var req MailpitIDsRequest
+	ids, ok := bindMailpitIDs(c, &req)
+	if !ok {
+		return
+	}
+
+	query := activeMessages(db)
+	if ids != nil {
+		query = query.Where("messages.id IN ?", ids)
+	}
+	var selected []string
+	if err := query.Pluck("messages.id", &selected).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if len(selected) > 0 {
+		if err := db.Model(&models.Message{}).Where("id IN ?", selected).Update("seen", req.Read).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update messages"})
+			return
+		}
+	}
+	c.String(http.StatusOK, "ok")
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/models"
+)
+
+func setupCompatRouter(db *gorm.DB) *gin.Engine {
+	r := setupTestRouter(db)
+	r.GET("/api/v2/messages", MailHogListMessages)
+	r.GET("/api/v2/search", MailHogSearch)
+	r.DELETE("/api/v1/messages/:id", MailHogDeleteMessage)
+	r.GET("/api/v1/messages", MailpitListMessages)
+	r.PUT("/api/v1/messages", MailpitSetReadStatus)
+	r.DELETE("/api/v1/messages", MailpitDeleteMessages)
+	r.GET("/api/v1/search", MailpitSearch)
+	r.GET("/api/v1/message/:id", MailpitGetMessage)
+	r.GET("/api/v1/message/:id/raw", MailpitGetRaw)
+	r.GET("/api/v1/message/:id/part/:partId", MailpitGetPart)
+	return r
+}
+
+func TestMailpitMessages(t *testing.T) {
+	db := setupTestDB(t)
+	active, expired := seedAddresses(db)
+	db.Create(&models.Message{EmailID: expired.ID, From: "sender@example.com", Subject: "Expired"})
+	r := setupCompatRouter(db)
+
+	// messages of expired addresses are not listed
+	w := doRequest(r, http.MethodGet, "/api/v1/messages", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list MailpitMessagesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Equal(t, int64(2), list.Total)
+	assert.Equal(t, int64(2), list.Unread)
+	require.Len(t, list.Messages, 2)
+	assert.Equal(t, active.Address, list.Messages[0].To[0].Address)
+	assert.Equal(t, 1, list.Messages[0].Attachments)
+
+	w = doRequest(r, http.MethodGet, "/api/v1/search?query=subject:%22Subject+1%22+to:active", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Equal(t, int64(1), list.MessagesCount)
+	require.Len(t, list.Messages, 1)
+	assert.Equal(t, "Subject 1", list.Messages[0].Subject)
+
+	// reading a message marks it as read
+	w = doRequest(r, http.MethodGet, "/api/v1/message/latest", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var message MailpitMessage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &message))
+	assert.Equal(t, "hello", message.Text)
+	require.Len(t, message.Attachments, 1)
+	var stored models.Message
+	require.NoError(t, db.First(&stored, "id = ?", message.ID).Error)
+	assert.True(t, stored.Seen)
+
+	w = doRequest(r, http.MethodGet, "/api/v1/message/"+message.ID+"/part/"+message.Attachments[0].PartID, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0123456789", w.Body.String())
+
+	w = doRequest(r, http.MethodGet, "/api/v1/message/"+message.ID+"/raw", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Subject: ")
+
+	var expiredMessage models.Message
+	require.NoError(t, db.Where("email_id = ?", expired.ID).First(&expiredMessage).Error)
+	w = doRequest(r, http.MethodGet, "/api/v1/message/"+expiredMessage.ID.String(), "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMailpitDeleteMessages(t *testing.T) {
+	db := setupTestDB(t)
+	active, expired := seedAddresses(db)
+	db.Create(&models.Message{EmailID: expired.ID, From: "sender@example.com", Subject: "Expired"})
+	r := setupCompatRouter(db)
+
+	var messages []models.Message
+	require.NoError(t, db.Where("email_id = ?", active.ID).Find(&messages).Error)
+
+	w := doRequest(r, http.MethodPut, "/api/v1/messages", "", `{"IDs":["`+messages[0].ID.String()+`"],"Read":true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var count int64
+	db.Model(&models.Message{}).Where("seen = ?", true).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	w = doRequest(r, http.MethodDelete, "/api/v1/messages", "", `{"IDs":["`+messages[0].ID.String()+`"]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	db.Model(&models.Message{}).Where("email_id = ?", active.ID).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	// without a body every message of active addresses is deleted
+	w = doRequest(r, http.MethodDelete, "/api/v1/messages", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	db.Model(&models.Message{}).Where("email_id = ?", active.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+	db.Model(&models.Message{}).Where("email_id = ?", expired.ID).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	w = doRequest(r, http.MethodDelete, "/api/v1/messages", "", `{"IDs":["bad"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -2,7 +2,10 @@ package controllers
 
 import (
 	"net/http"
+	"secmail/audit"
+	"secmail/blob"
 	"secmail/models"
+	"secmail/pgp"
 	"strconv"
 	"time"
 
@@ -15,6 +18,7 @@ type MessageResponse struct {
 	ID        uuid.UUID `json:"id"`
 	From      string    `json:"from"`
 	Subject   string    `json:"subject"`
+	Labels    []string  `json:"labels"`
 	CreatedAt time.Time `json:"receivedAt"`
 }
 
@@ -22,6 +26,9 @@ type AttachmentResponse struct {
 	ID          uuid.UUID `json:"id"`
 	FileName    string    `json:"fileName"`
 	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	// SHA256 of the content, empty for attachments stored before hashing
+	SHA256 string `json:"sha256"`
 }
 
 type MessageDetailResponse struct {
@@ -30,8 +37,25 @@ type MessageDetailResponse struct {
 	Subject     string               `json:"subject"`
 	Content     string               `json:"content"`
 	HTMLContent string               `json:"htmlContent"`
+	Labels      []string             `json:"labels"`
 	CreatedAt   time.Time            `json:"receivedAt"`
 	Attachments []AttachmentResponse `json:"attachments"`
+	// PGP tells that Content is the armored OpenPGP ciphertext of the whole
+	// message, to decrypt with the private key of the address
+	PGP bool `json:"pgp"`
+}
+
+// getPagination reads the page and size query parameters.
+func getPagination(c *gin.Context) (page, pageSize, offset int) {
+	page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ = strconv.Atoi(c.DefaultQuery("size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	return page, pageSize, (page - 1) * pageSize
 }
 
 func GetMessages(c *gin.Context) {
@@ -45,15 +69,7 @@ func GetMessages(c *gin.Context) {
 	}
 
 	// Get pagination parameters
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	pageSize, _ := strconv.Atoi(c.DefaultQuery("size", "20"))
-	if page < 1 {
-		page = 1
-	}
-	if pageSize < 1 || pageSize > 100 {
-		pageSize = 20
-	}
-	offset := (page - 1) * pageSize
+	page, pageSize, offset := getPagination(c)
 
 	// Check if email exists and not expired
 	var email models.EmailAddress
@@ -93,10 +109,18 @@ func GetMessages(c *gin.Context) {
 			ID:        msg.ID,
 			From:      msg.From,
 			Subject:   msg.Subject,
+			Labels:    msg.LabelList(),
 			CreatedAt: msg.CreatedAt,
 		}
 	}
 
+	audit.RecordRequest(c, models.AuditLog{
+		EmailID:      email.ID,
+		EmailAddress: email.Address,
+		Action:       models.AuditActionAccess,
+		Detail:       "list messages page " + strconv.Itoa(page),
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"messages": response,
 		"total":    total,
@@ -142,17 +166,40 @@ func GetMessage(c *gin.Context) {
 			ID:          att.ID,
 			FileName:    att.FileName,
 			ContentType: att.ContentType,
+			Size:        att.Size,
+			SHA256:      att.Hash,
 		}
 	}
 
+	// an encrypted message is only stored as PGP/MIME
+	content := message.Content
+	if message.PGP {
+		var err error
+		if content, err = pgp.Ciphertext(message.Raw); err != nil {
+			log.Errorf("Failed to read ciphertext of message %s: %v", message.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read message"})
+			return
+		}
+	}
+
+	audit.RecordRequest(c, models.AuditLog{
+		EmailID:      email.ID,
+		EmailAddress: email.Address,
+		MessageID:    &message.ID,
+		Action:       models.AuditActionAccess,
+		Detail:       "read message",
+	})
+
 	c.JSON(http.StatusOK, MessageDetailResponse{
 		ID:          message.ID,
 		From:        message.From,
 		Subject:     message.Subject,
-		Content:     message.Content,
+		Content:     content,
 		HTMLContent: message.HTMLContent,
+		Labels:      message.LabelList(),
 		CreatedAt:   message.CreatedAt,
 		Attachments: attachments,
+		PGP:         message.PGP,
 	})
 }
 
@@ -180,12 +227,30 @@ func GetAttachment(c *gin.Context) {
 		return
 	}
 
+	audit.RecordRequest(c, models.AuditLog{
+		MessageID: &attachment.MessageID,
+		Action:    models.AuditActionAccess,
+		Detail:    "download attachment " + attachment.ID.String(),
+	})
+
 	// Set response headers for file download
 	c.Header("Content-Description", "File Transfer")
 	c.Header("Content-Transfer-Encoding", "binary")
 	c.Header("Content-Disposition", "attachment; filename="+attachment.FileName)
-	c.Header("Content-Type", attachment.ContentType)
-	c.Data(http.StatusOK, attachment.ContentType, attachment.Data)
+	serveAttachment(c, &attachment, attachment.ContentType)
+}
+
+// serveAttachment streams the content of an attachment from the blob store.
+func serveAttachment(c *gin.Context, attachment *models.Attachment, contentType string) {
+	blobs := c.MustGet("blobs").(blob.Store)
+	r, err := blob.OpenAttachment(c.Request.Context(), blobs, attachment)
+	if err != nil {
+		log.Errorf("Failed to open attachment %s: %v", attachment.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read attachment"})
+		return
+	}
+	defer r.Close()
+	c.DataFromReader(http.StatusOK, attachment.Size, contentType, r, nil)
 }
 
 func DeleteMessage(c *gin.Context) {
@@ -215,7 +280,7 @@ func DeleteMessage(c *gin.Context) {
 		return
 	}
 	// Delete message and associated attachments
-	if err := tx.Where("message_id = ?", messageID).Delete(&models.Attachment{}).Error; err != nil {
+	if err := blob.DeleteAttachments(tx, []uuid.UUID{messageID}); err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachments"})
 		return
@@ -231,5 +296,11 @@ func DeleteMessage(c *gin.Context) {
 		return
 	}
 
+	audit.RecordRequest(c, models.AuditLog{
+		EmailID:   message.EmailID,
+		MessageID: &message.ID,
+		Action:    models.AuditActionDeleteMessage,
+	})
+
 	c.Status(http.StatusNoContent)
 }
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -8,10 +9,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/gorm"
 
+	"secmail/audit"
+	"secmail/blob"
 	"secmail/config"
 	"secmail/models"
 )
@@ -171,8 +175,11 @@ func TestGetAttachment(t *testing.T) {
 					MessageID:   msg.ID,
 					FileName:    "test.txt",
 					ContentType: "text/plain",
-					Data:        []byte("test content"),
+					BlobKey:     blob.Hash([]byte("test content")),
+					Hash:        blob.Hash([]byte("test content")),
+					Size:        int64(len("test content")),
 				}
+				blob.PutBytes(context.Background(), testBlobs, att.BlobKey, []byte("test content"))
 				db.Create(&att)
 				return &att
 			},
@@ -180,7 +187,7 @@ func TestGetAttachment(t *testing.T) {
 			validate: func(t *testing.T, w *httptest.ResponseRecorder, att *models.Attachment) {
 				assert.Equal(t, att.ContentType, w.Header().Get("Content-Type"))
 				assert.Equal(t, "attachment; filename="+att.FileName, w.Header().Get("Content-Disposition"))
-				assert.Equal(t, string(att.Data), w.Body.String())
+				assert.Equal(t, "test content", w.Body.String())
 			},
 		},
 		{
@@ -354,3 +361,66 @@ func TestDeleteMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestAuditAccess(t *testing.T) {
+	config.GlobalConfig = config.Config{
+		EmailDomain: "test.com",
+	}
+	db := setupTestDB(t)
+
+	email := models.EmailAddress{
+		Address:   "abcd123456@test.com",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	db.Create(&email)
+	msg := models.Message{ID: uuid.New(), EmailID: email.ID, Subject: "Test"}
+	db.Create(&msg)
+
+	recorder := audit.NewRecorder(db, config.AuditConfig{})
+	router := setupTestRouter(db)
+	router.Use(func(c *gin.Context) {
+		c.Set("audit", recorder)
+	})
+	router.GET("/email/:id/messages", GetMessages)
+	router.GET("/message/:id", GetMessage)
+	router.DELETE("/message/:id", DeleteMessage)
+	router.DELETE("/email/:id", DeleteTempEmail)
+
+	for _, r := range []struct{ method, path string }{
+		{"GET", "/email/" + email.Address + "/messages"},
+		{"GET", "/message/" + msg.ID.String()},
+		{"DELETE", "/message/" + msg.ID.String()},
+		{"DELETE", "/email/" + email.Address},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(r.method, r.path, nil)
+		req.Header.Set("User-Agent", "test-agent")
+		req.RemoteAddr = "10.0.0.9:1234"
+		router.ServeHTTP(w, req)
+	}
+	recorder.Close()
+
+	var logs []models.AuditLog
+	db.Order("id").Find(&logs)
+	actions := make([]string, len(logs))
+	for i, l := range logs {
+		actions[i] = l.Action
+	}
+	// create and delete are written by the model hooks, the rest asynchronously
+	assert.ElementsMatch(t, []string{
+		models.AuditActionCreate,
+		models.AuditActionDelete,
+		models.AuditActionAccess,
+		models.AuditActionAccess,
+		models.AuditActionDeleteMessage,
+	}, actions)
+
+	for _, l := range logs {
+		if l.Action == models.AuditActionCreate {
+			continue
+		}
+		assert.Equal(t, "10.0.0.9", l.IP)
+		assert.Equal(t, "test-agent", l.UserAgent)
+		assert.Equal(t, email.Address, l.EmailAddress)
+	}
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"secmail/audit"
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type ProjectMessageResponse struct {
+	MessageResponse
+	To string `json:"to"`
+}
+
+// ListProjectMessages lists the mail sent with the SMTP credentials of a
+// project, across all of its addresses.
+func ListProjectMessages(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	project := c.Param("project")
+
+	page, pageSize, offset := getPagination(c)
+
+	query := db.Model(&models.Message{}).
+		Joins("JOIN email_addresses ON email_addresses.id = messages.email_id").
+		Where("messages.project = ? AND email_addresses.deleted_at IS NULL", project)
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var rows []struct {
+		models.Message
+		Address string
+	}
+	if err := query.Select("messages.*, email_addresses.address").
+		Order("messages.created_at DESC").
+		Offset(offset).
+		Limit(pageSize).
+		Find(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+
+	response := make([]ProjectMessageResponse, len(rows))
+	for i, row := range rows {
+		response[i] = ProjectMessageResponse{
+			MessageResponse: MessageResponse{
+				ID:        row.ID,
+				From:      row.From,
+				Subject:   row.Subject,
+				Labels:    row.LabelList(),
+				CreatedAt: row.CreatedAt,
+			},
+			To: row.Address,
+		}
+	}
+
+	audit.RecordRequest(c, models.AuditLog{
+		Action: models.AuditActionAccess,
+		Detail: "list project " + project + " messages page " + strconv.Itoa(page),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages": response,
+		"total":    total,
+		"page":     page,
+		"size":     pageSize,
+	})
+}
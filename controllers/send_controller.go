@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"secmail/audit"
+	"secmail/models"
+	"secmail/relay"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// maxSendRecipients limits the recipients of a message sent from an
+// address, each one counts against its send quota.
+const maxSendRecipients = 5
+
+type SendMessageRequest struct {
+	To      []string `json:"to" binding:"required"`
+	Subject string   `json:"subject"`
+	Text    string   `json:"text"`
+	HTML    string   `json:"html"`
+}
+
+type ReplyMessageRequest struct {
+	Text string `json:"text"`
+	HTML string `json:"html"`
+}
+
+type SendMessageResponse struct {
+	// MessageID is the Message-Id header of the message sent
+	MessageID string   `json:"messageId"`
+	To        []string `json:"to"`
+}
+
+// checkAccessToken rejects requests without the access token of the
+// address in X-Access-Token; only its owner may send from it. Admin API
+// keys are let through.
+func checkAccessToken(c *gin.Context, email *models.EmailAddress) bool {
+	if key := currentAPIKey(c); key != nil && key.HasScope(models.ScopeAdmin) {
+		return true
+	}
+	if !email.CheckAccessToken(c.GetHeader("X-Access-Token")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid access token"})
+		return false
+	}
+	return true
+}
+
+// sendMail queues a message from an address and writes the response.
+func sendMail(c *gin.Context, db *gorm.DB, email *models.EmailAddress, m *relay.Mail) {
+	messageID, err := relay.Send(db, email, m)
+	if err != nil {
+		if errors.Is(err, relay.ErrQuotaExceeded) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Send quota exceeded"})
+			return
+		}
+		log.Errorf("Failed to send message from %s: %v", email.Address, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		return
+	}
+
+	audit.RecordRequest(c, models.AuditLog{
+		EmailID:      email.ID,
+		EmailAddress: email.Address,
+		MessageID:    m.ReplyTo,
+		Action:       models.AuditActionSend,
+		Detail:       "queue " + messageID + " to " + strings.Join(m.To, ", "),
+	})
+	c.JSON(http.StatusAccepted, SendMessageResponse{MessageID: messageID, To: m.To})
+}
+
+// SendMessage composes a new message from an address.
+func SendMessage(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	email := findActiveAddress(c, db)
+	if email == nil || !checkAccessToken(c, email) {
+		return
+	}
+
+	var req SendMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if len(req.To) == 0 || len(req.To) > maxSendRecipients {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid number of recipients"})
+		return
+	}
+	for i, to := range req.To {
+		req.To[i] = strings.TrimSpace(to)
+		if !validMailbox(req.To[i]) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipient: " + to})
+			return
+		}
+	}
+
+	sendMail(c, db, email, &relay.Mail{
+		To:      req.To,
+		Subject: req.Subject,
+		Text:    req.Text,
+		HTML:    req.HTML,
+	})
+}
+
+// ReplyMessage answers a received message: it goes to the Reply-To or From
+// of the message, and continues its thread.
+func ReplyMessage(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	messageID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var message models.Message
+	if err := db.Preload("Attachments").First(&message, messageID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	var email models.EmailAddress
+	if err := db.First(&email, message.EmailID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email address not found"})
+		return
+	}
+	if time.Now().After(email.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "Email address has expired"})
+		return
+	}
+	if !checkAccessToken(c, &email) {
+		return
+	}
+
+	var req ReplyMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	source, err := message.Source(email.Address)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read message"})
+		return
+	}
+	header := mail.Header{}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(source)); err == nil {
+		header = parsed.Header
+	}
+
+	to := replyRecipient(header, message.From)
+	if to == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Message has no sender to reply to"})
+		return
+	}
+
+	m := &relay.Mail{
+		To:      []string{to},
+		Subject: replySubject(message.Subject),
+		Text:    req.Text,
+		HTML:    req.HTML,
+		ReplyTo: &message.ID,
+	}
+	if id := strings.TrimSpace(header.Get("Message-Id")); id != "" {
+		m.InReplyTo = id
+		m.References = append(strings.Fields(header.Get("References")), id)
+	}
+	sendMail(c, db, &email, m)
+}
+
+// replyRecipient returns the Reply-To or From address of a message, falling
+// back to its envelope sender.
+func replyRecipient(header mail.Header, envelopeFrom string) string {
+	for _, key := range []string{"Reply-To", "From"} {
+		if addrs, err := header.AddressList(key); err == nil && len(addrs) > 0 {
+			return addrs[0].Address
+		}
+	}
+	return envelopeFrom
+}
+
+func replySubject(subject string) string {
+	if strings.HasPrefix(strings.ToLower(subject), "re:") {
+		return subject
+	}
+	return "Re: " + subject
+}
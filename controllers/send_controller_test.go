@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/models"
+)
+
+func setupSendRouter(db *gorm.DB) *gin.Engine {
+	r := setupForwardRouter(db)
+	r.POST("/email/:id/send", SendMessage)
+	r.POST("/message/:id/reply", ReplyMessage)
+	return r
+}
+
+func doSendRequest(r *gin.Engine, path, token, body string) *httptest.ResponseRecorder {
+	return doTokenRequest(r, "POST", path, token, body)
+}
+
+// doTokenRequest makes a request with the access token of an address.
+func doTokenRequest(r *gin.Engine, method, path, token, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Access-Token", token)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// seedSender creates an address with an access token and a message for it.
+func seedSender(t *testing.T, db *gorm.DB, raw string) (string, models.Message) {
+	email := models.EmailAddress{Address: "sender1234@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	token, err := email.NewAccessToken()
+	require.NoError(t, err)
+	require.NoError(t, db.Create(&email).Error)
+
+	msg := models.Message{
+		ID:      uuid.New(),
+		EmailID: email.ID,
+		From:    "bounce@shop.example",
+		Subject: "Confirm your account",
+		Raw:     []byte(raw),
+	}
+	require.NoError(t, db.Create(&msg).Error)
+	return token, msg
+}
+
+func TestSendMessage(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupSendRouter(db)
+	token, _ := seedSender(t, db, "")
+
+	tests := []struct {
+		name       string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{"no token", "", `{"to":["bob@example.org"],"text":"hi"}`, http.StatusUnauthorized},
+		{"wrong token", "at_wrong", `{"to":["bob@example.org"],"text":"hi"}`, http.StatusUnauthorized},
+		{"no recipients", token, `{"to":[],"text":"hi"}`, http.StatusBadRequest},
+		{"invalid recipient", token, `{"to":["Bob <bob@example.org>"]}`, http.StatusBadRequest},
+		{"too many recipients", token, `{"to":["a@x.org","b@x.org","c@x.org","d@x.org","e@x.org","f@x.org"]}`, http.StatusBadRequest},
+		{"valid", token, `{"to":["bob@example.org","carol@example.org"],"subject":"Hello","text":"hi"}`, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doSendRequest(r, "/email/sender1234@test.com/send", tt.token, tt.body)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	var queued []models.OutboundMessage
+	require.NoError(t, db.Order("id").Find(&queued).Error)
+	require.Len(t, queued, 2)
+	assert.Equal(t, "sender1234@test.com", queued[0].MailFrom)
+	assert.Equal(t, "bob@example.org", queued[0].RcptTo)
+	assert.Equal(t, "carol@example.org", queued[1].RcptTo)
+	assert.Contains(t, string(queued[0].Raw), "Subject: Hello")
+
+	// the default quota is 10 messages
+	for i := 0; i < 8; i++ {
+		w := doSendRequest(r, "/email/sender1234@test.com/send", token, `{"to":["bob@example.org"]}`)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+	}
+	w := doSendRequest(r, "/email/sender1234@test.com/send", token, `{"to":["bob@example.org"]}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestReplyMessage(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupSendRouter(db)
+	token, msg := seedSender(t, db, "From: Shop <noreply@shop.example>\r\n"+
+		"Reply-To: support@shop.example\r\n"+
+		"Subject: Confirm your account\r\n"+
+		"Message-Id: <2@shop.example>\r\n"+
+		"References: <1@shop.example>\r\n"+
+		"\r\n"+
+		"Reply to confirm\r\n")
+
+	w := doSendRequest(r, "/message/"+msg.ID.String()+"/reply", "", `{"text":"confirmed"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = doSendRequest(r, "/message/"+uuid.NewString()+"/reply", token, `{"text":"confirmed"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doSendRequest(r, "/message/"+msg.ID.String()+"/reply", token, `{"text":"confirmed"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var response SendMessageResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []string{"support@shop.example"}, response.To)
+
+	var queued models.OutboundMessage
+	require.NoError(t, db.First(&queued).Error)
+	assert.Equal(t, msg.ID, *queued.MessageID)
+	raw := string(queued.Raw)
+	assert.Contains(t, raw, "Subject: Re: Confirm your account")
+	assert.Contains(t, raw, "In-Reply-To: <2@shop.example>")
+	assert.Contains(t, raw, "References: <1@shop.example> <2@shop.example>")
+	assert.Contains(t, raw, "Message-Id: "+response.MessageID)
+}
+
+func TestReplyRecipient(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string][]string
+		want   string
+	}{
+		{"reply-to", map[string][]string{"Reply-To": {"a@x.org"}, "From": {"b@x.org"}}, "a@x.org"},
+		{"from", map[string][]string{"From": {"Bob <b@x.org>"}}, "b@x.org"},
+		{"envelope", map[string][]string{}, "envelope@x.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, replyRecipient(tt.header, "envelope@x.org"))
+		})
+	}
+	assert.Equal(t, "Re: Hello", replySubject("Hello"))
+	assert.Equal(t, "RE: Hello", replySubject("RE: Hello"))
+}
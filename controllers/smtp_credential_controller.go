@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type CreateSMTPCredentialRequest struct {
+	Project  string `json:"project" binding:"required"`
+	Username string `json:"username" binding:"required"`
+}
+
+type SMTPCredentialResponse struct {
+	ID         uint       `json:"id"`
+	Project    string     `json:"project"`
+	Username   string     `json:"username"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type CreateSMTPCredentialResponse struct {
+	SMTPCredentialResponse
+	// Password is only returned once, at creation
+	Password string `json:"password"`
+}
+
+func newSMTPCredentialResponse(cred *models.SMTPCredential) SMTPCredentialResponse {
+	return SMTPCredentialResponse{
+		ID:         cred.ID,
+		Project:    cred.Project,
+		Username:   cred.Username,
+		CreatedAt:  cred.CreatedAt,
+		LastUsedAt: cred.LastUsedAt,
+	}
+}
+
+func CreateSMTPCredential(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var req CreateSMTPCredentialRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Project = strings.TrimSpace(req.Project)
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Project == "" || req.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var count int64
+	if err := db.Model(&models.SMTPCredential{}).Where("username = ?", req.Username).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
+		return
+	}
+
+	password, hash, err := models.GenerateSMTPPassword()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate password"})
+		return
+	}
+
+	cred := models.SMTPCredential{
+		Project:      req.Project,
+		Username:     req.Username,
+		PasswordHash: hash,
+	}
+	if err := db.Create(&cred).Error; err != nil {
+		log.Errorf("Failed to create SMTP credential: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create SMTP credential"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, CreateSMTPCredentialResponse{
+		SMTPCredentialResponse: newSMTPCredentialResponse(&cred),
+		Password:               password,
+	})
+}
+
+func ListSMTPCredentials(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	query := db.Order("created_at DESC")
+	if project := c.Query("project"); project != "" {
+		query = query.Where("project = ?", project)
+	}
+	var creds []models.SMTPCredential
+	if err := query.Find(&creds).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	response := make([]SMTPCredentialResponse, len(creds))
+	for i := range creds {
+		response[i] = newSMTPCredentialResponse(&creds[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"credentials": response})
+}
+
+// DeleteSMTPCredential removes a credential for good, so that its username
+// can be reused.
+func DeleteSMTPCredential(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SMTP credential ID"})
+		return
+	}
+
+	result := db.Unscoped().Delete(&models.SMTPCredential{}, id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete SMTP credential"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SMTP credential not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
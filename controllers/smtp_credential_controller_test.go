@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+
+	"secmail/models"
+)
+
+func setupSMTPCredentialRouter(db *gorm.DB) *gin.Engine {
+	r := setupAuthRouter(db)
+	admin := r.Group("/admin/smtp-credentials", RequireScope(models.ScopeAdmin))
+	admin.POST("", CreateSMTPCredential)
+	admin.GET("", ListSMTPCredentials)
+	admin.DELETE("/:id", DeleteSMTPCredential)
+	r.GET("/projects/:project/messages", RequireScope(models.ScopeProjectRead), ListProjectMessages)
+	return r
+}
+
+func TestCreateSMTPCredential(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupSMTPCredentialRouter(db)
+
+	tests := []struct {
+		name       string
+		key        string
+		body       string
+		wantStatus int
+	}{
+		{"no key", "", `{"project":"shop","username":"shop"}`, http.StatusUnauthorized},
+		{"valid", testAdminKey, `{"project":"shop","username":"shop"}`, http.StatusCreated},
+		{"duplicate username", testAdminKey, `{"project":"other","username":"shop"}`, http.StatusConflict},
+		{"missing project", testAdminKey, `{"username":"blog"}`, http.StatusBadRequest},
+		{"blank username", testAdminKey, `{"project":"blog","username":" "}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, "POST", "/admin/smtp-credentials", tt.key, tt.body)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	var cred models.SMTPCredential
+	assert.NoError(t, db.Where("username = ?", "shop").First(&cred).Error)
+	assert.Equal(t, "shop", cred.Project)
+	assert.NotEmpty(t, cred.PasswordHash)
+}
+
+func TestSMTPCredentialLifecycle(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupSMTPCredentialRouter(db)
+
+	w := doRequest(r, "POST", "/admin/smtp-credentials", testAdminKey, `{"project":"shop","username":"shop"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created CreateSMTPCredentialResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+	var cred models.SMTPCredential
+	assert.NoError(t, db.First(&cred, created.ID).Error)
+	assert.True(t, cred.CheckPassword(created.Password))
+
+	// the password is never listed
+	w = doRequest(r, "GET", "/admin/smtp-credentials?project=shop", testAdminKey, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), created.Password)
+	var list struct {
+		Credentials []SMTPCredentialResponse `json:"credentials"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Credentials, 1)
+
+	path := fmt.Sprintf("/admin/smtp-credentials/%d", created.ID)
+	assert.Equal(t, http.StatusNoContent, doRequest(r, "DELETE", path, testAdminKey, "").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(r, "DELETE", path, testAdminKey, "").Code)
+
+	// the username can be reused
+	w = doRequest(r, "POST", "/admin/smtp-credentials", testAdminKey, `{"project":"blog","username":"shop"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestListProjectMessages(t *testing.T) {
+	db := setupTestDB(t)
+	r := setupSMTPCredentialRouter(db)
+	active, _ := seedAddresses(db)
+
+	other := models.EmailAddress{Address: "other12345@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	db.Create(&other)
+	db.Create(&models.Message{ID: uuid.New(), EmailID: active.ID, Subject: "Order", Project: "shop"})
+	db.Create(&models.Message{ID: uuid.New(), EmailID: other.ID, Subject: "Invoice", Project: "shop"})
+	db.Create(&models.Message{ID: uuid.New(), EmailID: other.ID, Subject: "Post", Project: "blog"})
+
+	reader := createTestKey(t, r, `{"name":"ci","scopes":["project:read"]}`)
+	creator := createTestKey(t, r, `{"name":"web","scopes":["address:create"]}`)
+
+	tests := []struct {
+		name       string
+		key        string
+		path       string
+		wantStatus int
+		wantTotal  int64
+	}{
+		{"no key", "", "/projects/shop/messages", http.StatusUnauthorized, 0},
+		{"missing scope", creator.Key, "/projects/shop/messages", http.StatusForbidden, 0},
+		{"project reader", reader.Key, "/projects/shop/messages", http.StatusOK, 2},
+		{"admin", testAdminKey, "/projects/blog/messages", http.StatusOK, 1},
+		{"unknown project", reader.Key, "/projects/none/messages", http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, "GET", tt.path, tt.key, "")
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var response struct {
+				Messages []ProjectMessageResponse `json:"messages"`
+				Total    int64                    `json:"total"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.wantTotal, response.Total)
+			assert.Len(t, response.Messages, int(tt.wantTotal))
+		})
+	}
+
+	w := doRequest(r, "GET", "/projects/blog/messages", reader.Key, "")
+	assert.Contains(t, w.Body.String(), `"to":"other12345@test.com"`)
+}
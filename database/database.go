@@ -0,0 +1,55 @@
+// Package database opens the database named in the configuration and
+// migrates its schema with the versioned SQL migrations of its dialect.
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"secmail/config"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultSQLitePath  = "secmail.db"
+	defaultBusyTimeout = 5 * time.Second
+)
+
+// Open connects to the database of the configured driver.
+func Open(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	switch cfg.Driver {
+	case "", "postgres":
+		return gorm.Open(postgres.Open(cfg.DSN()))
+	case "sqlite":
+		return gorm.Open(sqlite.Open(SQLiteDSN(cfg)))
+	default:
+		return nil, fmt.Errorf("unknown database driver: %s", cfg.Driver)
+	}
+}
+
+// SQLiteDSN opens the database file in WAL mode, so that readers do not
+// wait for writers, with foreign keys enforced as by Postgres. Transactions
+// take the write lock when they begin: upgrading a read lock could fail
+// without waiting for the busy timeout.
+func SQLiteDSN(cfg config.DatabaseConfig) string {
+	path := cfg.Path
+	if path == "" {
+		path = defaultSQLitePath
+	}
+	timeout := cfg.BusyTimeout
+	if timeout <= 0 {
+		timeout = defaultBusyTimeout
+	}
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_synchronous", "NORMAL")
+	params.Set("_busy_timeout", strconv.FormatInt(timeout.Milliseconds(), 10))
+	params.Set("_foreign_keys", "on")
+	params.Set("_txlock", "immediate")
+	return path + "?" + params.Encode()
+}
@@ -0,0 +1,315 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+
+	"secmail/config"
+	"secmail/models"
+)
+
+func TestSQLite(t *testing.T) {
+	db, err := Open(config.DatabaseConfig{
+		Driver:      "sqlite",
+		Path:        filepath.Join(t.TempDir(), "secmail.db"),
+		BusyTimeout: 2 * time.Second,
+	})
+	require.NoError(t, err)
+	_, err = Up(db)
+	require.NoError(t, err)
+
+	pragma := func(name string) string {
+		var value string
+		require.NoError(t, db.Raw("PRAGMA "+name).Scan(&value).Error)
+		return value
+	}
+	assert.Equal(t, "wal", pragma("journal_mode"))
+	assert.Equal(t, "2000", pragma("busy_timeout"))
+	assert.Equal(t, "1", pragma("foreign_keys"))
+
+	// concurrent transactions wait for each other
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- db.Transaction(func(tx *gorm.DB) error {
+				addr := models.EmailAddress{Address: string(rune('a'+i)) + "@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+				if err := tx.Create(&addr).Error; err != nil {
+					return err
+				}
+				return tx.Create(&models.Message{EmailID: addr.ID, Subject: "Hello"}).Error
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	var count int64
+	require.NoError(t, db.Model(&models.Message{}).Count(&count).Error)
+	assert.Equal(t, int64(10), count)
+}
+
+// allModels are the models the migrations create the tables of.
+var allModels = []any{
+	&models.EmailAddress{},
+	&models.Message{},
+	&models.Attachment{},
+	&models.Blob{},
+	&models.AuditLog{},
+	&models.RateLimitBucket{},
+	&models.APIKey{},
+	&models.SMTPCredential{},
+	&models.ForwardRule{},
+	&models.OutboundMessage{},
+	&models.DKIMKey{},
+	&models.DataKey{},
+}
+
+// postgresEnv names a Postgres database the tests create their schemas
+// in, the Postgres migrations are not tested without it.
+const postgresEnv = "SECMAIL_TEST_POSTGRES_DSN"
+
+func openSQLite(t *testing.T) *gorm.DB {
+	db, err := Open(config.DatabaseConfig{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "secmail.db")})
+	require.NoError(t, err)
+	return db
+}
+
+// openPostgres returns an empty schema of the database named by postgresEnv,
+// dropped when the test ends.
+func openPostgres(t *testing.T) *gorm.DB {
+	dsn := os.Getenv(postgresEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresEnv)
+	}
+	admin, err := gorm.Open(postgres.Open(dsn))
+	require.NoError(t, err)
+	schema := fmt.Sprintf("secmail_test_%d", time.Now().UnixNano())
+	require.NoError(t, admin.Exec("CREATE SCHEMA "+schema).Error)
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	// connections use the schema through their search path
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		require.NoError(t, err)
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db, err := gorm.Open(postgres.Open(dsn))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// forEachDialect runs a test on an empty database of each dialect.
+func forEachDialect(t *testing.T, test func(t *testing.T, db *gorm.DB)) {
+	t.Run("sqlite", func(t *testing.T) { test(t, openSQLite(t)) })
+	t.Run("postgres", func(t *testing.T) { test(t, openPostgres(t)) })
+}
+
+func TestMigrations(t *testing.T) {
+	forEachDialect(t, testMigrations)
+}
+
+func testMigrations(t *testing.T, db *gorm.DB) {
+	assert.ErrorIs(t, Check(db), ErrNotMigrated)
+
+	applied, err := Up(db)
+	require.NoError(t, err)
+	require.NotEmpty(t, applied)
+	require.NoError(t, Check(db))
+
+	// the schema has the columns and indexes of the models
+	for _, model := range allModels {
+		stmt := &gorm.Statement{DB: db}
+		require.NoError(t, stmt.Parse(model))
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" {
+				assert.True(t, db.Migrator().HasColumn(model, field.DBName), "%s.%s", stmt.Schema.Table, field.DBName)
+			}
+		}
+		for _, index := range stmt.Schema.ParseIndexes() {
+			assert.True(t, db.Migrator().HasIndex(model, index.Name), "%s.%s", stmt.Schema.Table, index.Name)
+		}
+	}
+
+	// attachments belong to a message
+	assert.Error(t, db.Exec("INSERT INTO attachments (id, blob_key) VALUES ('00000000-0000-0000-0000-00000000000a', 'h1')").Error)
+
+	applied, err = Up(db)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	status, err := Status(db)
+	require.NoError(t, err)
+	migrations, err := Migrations(db)
+	require.NoError(t, err)
+	require.Len(t, status, len(migrations))
+	for _, m := range status {
+		assert.NotNil(t, m.AppliedAt, "migration %d", m.Version)
+	}
+
+	reverted, err := Down(db, len(status))
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(status))
+	assert.ErrorIs(t, Check(db), ErrNotMigrated)
+	assert.False(t, db.Migrator().HasTable(&models.EmailAddress{}))
+
+	status, err = Status(db)
+	require.NoError(t, err)
+	for _, m := range status {
+		assert.Nil(t, m.AppliedAt, "migration %d", m.Version)
+	}
+}
+
+func TestMigrationsAdoptAutoMigrate(t *testing.T) {
+	forEachDialect(t, testMigrationsAdoptAutoMigrate)
+}
+
+func testMigrationsAdoptAutoMigrate(t *testing.T, db *gorm.DB) {
+	// the schema AutoMigrate created before versioned migrations
+	migrations, err := Migrations(db)
+	require.NoError(t, err)
+	require.NoError(t, execScript(db, migrations[0].Up))
+
+	// a deduplicated blob referenced by a live message, a deleted message and
+	// a deleted attachment, and one owned by an attachment stored before
+	// deduplication
+	now := time.Now()
+	require.NoError(t, db.Exec("INSERT INTO email_addresses (id, address, expires_at) VALUES (1, 'a@test.com', ?)",
+		now.Add(time.Hour)).Error)
+	require.NoError(t, db.Exec(`INSERT INTO messages (id, email_id, created_at, deleted_at) VALUES
+		('00000000-0000-0000-0000-000000000001', 1, ?, NULL),
+		('00000000-0000-0000-0000-000000000002', 1, ?, ?)`, now, now, now).Error)
+	// two messages delivered concurrently got the same UID
+	require.NoError(t, db.Exec(`INSERT INTO messages (id, email_id, uid, created_at) VALUES
+		('00000000-0000-0000-0000-000000000003', 1, 5, ?),
+		('00000000-0000-0000-0000-000000000004', 1, 5, ?)`, now, now).Error)
+	require.NoError(t, db.Exec(`INSERT INTO attachments (id, message_id, blob_key, hash, size, deleted_at) VALUES
+		('00000000-0000-0000-0000-00000000000a', '00000000-0000-0000-0000-000000000001', 'h1', 'h1', 3, NULL),
+		('00000000-0000-0000-0000-00000000000b', '00000000-0000-0000-0000-000000000002', 'h1', 'h1', 3, NULL),
+		('00000000-0000-0000-0000-00000000000c', '00000000-0000-0000-0000-000000000001', 'h1', 'h1', 3, ?),
+		('00000000-0000-0000-0000-00000000000d', '00000000-0000-0000-0000-000000000001', 'legacy', '', 5, NULL)`,
+		now).Error)
+	require.NoError(t, db.Exec("INSERT INTO blobs (hash, size, ref_count) VALUES ('h1', 3, 3)").Error)
+
+	_, err = Up(db)
+	require.NoError(t, err)
+	require.NoError(t, Check(db))
+
+	var count int64
+	require.NoError(t, db.Model(&models.EmailAddress{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+
+	var attachments []models.Attachment
+	require.NoError(t, db.Order("id").Find(&attachments).Error)
+	require.Len(t, attachments, 2)
+	assert.Equal(t, "h1", attachments[0].BlobKey)
+	assert.Equal(t, "legacy", attachments[1].BlobKey)
+
+	// messages without a UID or sharing one are numbered after the last one
+	var messages []models.Message
+	require.NoError(t, db.Unscoped().Order("id").Find(&messages).Error)
+	uids := make([]uint32, len(messages))
+	for i, m := range messages {
+		uids[i] = m.UID
+	}
+	assert.Equal(t, []uint32{6, 7, 5, 8}, uids)
+	uid, err := models.NextUID(db, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(9), uid)
+	assert.Error(t, db.Exec("UPDATE messages SET uid = 5 WHERE id = '00000000-0000-0000-0000-000000000004'").Error)
+
+	refs := func(key string) int {
+		var blob models.Blob
+		require.NoError(t, db.First(&blob, "hash = ?", key).Error)
+		return blob.RefCount
+	}
+	assert.Equal(t, 1, refs("h1"))
+	assert.Equal(t, 1, refs("legacy"))
+}
+
+func TestDataMigrations(t *testing.T) {
+	db := openSQLite(t)
+	migrations, err := Migrations(db)
+	require.NoError(t, err)
+	require.Greater(t, len(migrations), 2)
+
+	// a data migration runs between the migrations around its version, and
+	// again until the next one is applied
+	runs := 0
+	data := DataMigration{Version: 3, Name: "move", Run: func(db *gorm.DB) error {
+		runs++
+		applied, err := appliedVersions(db)
+		require.NoError(t, err)
+		assert.Contains(t, applied, int64(2))
+		assert.NotContains(t, applied, int64(3))
+		if runs == 1 {
+			return errors.New("store unavailable")
+		}
+		return nil
+	}}
+
+	applied, err := Up(db, data)
+	assert.ErrorContains(t, err, "data migration 3_move: store unavailable")
+	assert.Len(t, applied, 2)
+	assert.ErrorIs(t, Check(db), ErrNotMigrated)
+
+	applied, err = Up(db, data)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrations)-2)
+	require.NoError(t, Check(db))
+
+	_, err = Up(db, data)
+	require.NoError(t, err)
+	assert.Equal(t, 2, runs)
+}
+
+func TestCheckNewerSchema(t *testing.T) {
+	forEachDialect(t, testCheckNewerSchema)
+}
+
+func testCheckNewerSchema(t *testing.T, db *gorm.DB) {
+	_, err := Up(db)
+	require.NoError(t, err)
+	require.NoError(t, db.Create(&schemaMigration{Version: 99999, Name: "future", AppliedAt: time.Now()}).Error)
+
+	err = Check(db)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrNotMigrated)
+}
+
+func TestUnknownDriver(t *testing.T) {
+	_, err := Open(config.DatabaseConfig{Driver: "mysql"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,35 @@
+// Package databasetest opens databases for the tests of the other packages,
+// with the schema the migrations create in production.
+package databasetest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"secmail/config"
+	"secmail/database"
+)
+
+// Open returns a new SQLite database, opened as configured in production
+// and migrated up. It is removed when the test ends.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	db, err := database.Open(config.DatabaseConfig{
+		Driver: "sqlite",
+		Path:   filepath.Join(t.TempDir(), "secmail.db"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if _, err := database.Up(db); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return db
+}
@@ -0,0 +1,306 @@
+package database
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// ErrNotMigrated is returned by Check when migrations are pending.
+var ErrNotMigrated = errors.New("database schema is not up to date, run `secmail migrate up`")
+
+// migrationLock is the Postgres advisory lock serializing the replicas
+// migrating the same database.
+const migrationLock = 0x5ec3a11
+
+// Migration is a versioned schema change, read from
+// migrations/<dialect>/<version>_<name>.{up,down}.sql.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// DataMigration moves data the SQL migrations cannot, such as contents
+// into the blob store. Up runs it once the migrations before Version are
+// applied, outside of their transactions, and before the migration of
+// Version, which can then drop what was moved. It runs again as long as
+// that migration is pending, so it has to resume where it stopped.
+type DataMigration struct {
+	Version int64
+	Name    string
+	Run     func(db *gorm.DB) error
+}
+
+// MigrationStatus is a migration and when it was applied, nil if pending.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// schemaMigration records an applied migration.
+type schemaMigration struct {
+	Version   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Migrations returns the migrations of the dialect of db, by version.
+func Migrations(db *gorm.DB) ([]Migration, error) {
+	dir := path.Join("migrations", db.Dialector.Name())
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for database %s", db.Dialector.Name())
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		name, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		number, label, _ := strings.Cut(name, "_")
+		version, err := strconv.ParseInt(number, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		data, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d misses its up or down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies the pending migrations and returns them, running the data
+// migrations in between.
+func Up(db *gorm.DB, data ...DataMigration) ([]Migration, error) {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return nil, err
+	}
+	data = slices.Clone(data)
+	sort.Slice(data, func(i, j int) bool { return data[i].Version < data[j].Version })
+
+	var done []Migration
+	for _, d := range data {
+		applied, pending, err := upTo(db, migrations, d.Version)
+		done = append(done, applied...)
+		if err != nil {
+			return done, err
+		}
+		if !pending {
+			continue
+		}
+		if err := d.Run(db); err != nil {
+			return done, fmt.Errorf("data migration %d_%s: %w", d.Version, d.Name, err)
+		}
+	}
+	applied, _, err := upTo(db, migrations, math.MaxInt64)
+	done = append(done, applied...)
+	return done, err
+}
+
+// upTo applies the pending migrations before version, and tells whether
+// the one of version is pending.
+func upTo(db *gorm.DB, migrations []Migration, version int64) (done []Migration, pending bool, err error) {
+	err = migrate(db, func(tx *gorm.DB, applied map[int64]time.Time) error {
+		_, pending = applied[version]
+		pending = !pending
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok || m.Version >= version {
+				continue
+			}
+			if err := execScript(tx, m.Up); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			if err := tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error; err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return done, pending, nil
+}
+
+// Down reverts the last steps applied migrations and returns them.
+func Down(db *gorm.DB, steps int) ([]Migration, error) {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	err = migrate(db, func(tx *gorm.DB, applied map[int64]time.Time) error {
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := execScript(tx, m.Down); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			if err := tx.Delete(&schemaMigration{}, m.Version).Error; err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// Status lists the migrations with when they were applied.
+func Status(db *gorm.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i].Migration = m
+		if at, ok := applied[m.Version]; ok {
+			status[i].AppliedAt = &at
+		}
+	}
+	return status, nil
+}
+
+// Check returns ErrNotMigrated if migrations are pending, and an error if
+// the database was migrated by a newer version.
+func Check(db *gorm.DB) error {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return err
+	}
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return err
+	}
+	known := make(map[int64]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+		if _, ok := applied[m.Version]; !ok {
+			return ErrNotMigrated
+		}
+	}
+	for version := range applied {
+		if !known[version] {
+			return fmt.Errorf("database schema has unknown migration %d, it was migrated by a newer version", version)
+		}
+	}
+	return nil
+}
+
+// migrate runs fn in a transaction holding the migration lock, with the
+// versions applied so far. Postgres and SQLite both roll back schema
+// changes, so a failed migration leaves nothing behind.
+func migrate(db *gorm.DB, fn func(tx *gorm.DB, applied map[int64]time.Time) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// SQLite transactions take the write lock when they begin
+		if tx.Dialector.Name() == "postgres" {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)`).Error; err != nil {
+			return err
+		}
+		applied, err := appliedVersions(tx)
+		if err != nil {
+			return err
+		}
+		return fn(tx, applied)
+	})
+}
+
+func appliedVersions(db *gorm.DB) (map[int64]time.Time, error) {
+	applied := make(map[int64]time.Time)
+	if !db.Migrator().HasTable(&schemaMigration{}) {
+		return applied, nil
+	}
+	var rows []schemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+// execScript runs the statements of a migration file one by one: they end
+// with a semicolon at the end of a line, and lines starting with -- are
+// comments.
+func execScript(tx *gorm.DB, script string) error {
+	var stmt strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		stmt.WriteString(line)
+		stmt.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			if err := tx.Exec(stmt.String()).Error; err != nil {
+				return err
+			}
+			stmt.Reset()
+		}
+	}
+	if strings.TrimSpace(stmt.String()) != "" {
+		return tx.Exec(stmt.String()).Error
+	}
+	return nil
+}
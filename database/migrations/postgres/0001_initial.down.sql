@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS "data_keys";
+DROP TABLE IF EXISTS "dkim_keys";
+DROP TABLE IF EXISTS "outbound_messages";
+DROP TABLE IF EXISTS "forward_rules";
+DROP TABLE IF EXISTS "smtp_credentials";
+DROP TABLE IF EXISTS "api_keys";
+DROP TABLE IF EXISTS "rate_limit_buckets";
+DROP TABLE IF EXISTS "audit_logs";
+DROP TABLE IF EXISTS "blobs";
+DROP TABLE IF EXISTS "attachments";
+DROP TABLE IF EXISTS "messages";
+DROP TABLE IF EXISTS "email_addresses";
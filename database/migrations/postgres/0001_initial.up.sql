@@ -0,0 +1,319 @@
+-- The schema as created by AutoMigrate before versioned migrations. Tables,
+-- columns and indexes are only added when missing, so that the databases
+-- created by earlier versions are adopted as they are.
+
+CREATE TABLE IF NOT EXISTS "email_addresses" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "address" text,
+    "token_hash" text,
+    "expires_at" timestamptz,
+    "project" text,
+    "filter_rules" text,
+    "pgp_key" text,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "messages" (
+    "id" uuid,
+    "email_id" bigint,
+    "uid" bigint,
+    "from" text,
+    "subject" text,
+    "content" text,
+    "html_content" text,
+    "raw" bytea,
+    "encrypted" boolean,
+    "pgp" boolean,
+    "seen" boolean,
+    "flagged" boolean,
+    "deleted_flag" boolean,
+    "project" text,
+    "labels" text,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_email_addresses_messages" FOREIGN KEY ("email_id") REFERENCES "email_addresses"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "attachments" (
+    "id" uuid,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "message_id" uuid,
+    "file_name" text,
+    "content_type" text,
+    "blob_key" text,
+    "hash" text,
+    "size" bigint,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_messages_attachments" FOREIGN KEY ("message_id") REFERENCES "messages"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "blobs" (
+    "hash" varchar(64),
+    "size" bigint,
+    "ref_count" bigint,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("hash")
+);
+
+CREATE TABLE IF NOT EXISTS "audit_logs" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "email_id" bigint,
+    "email_address" text,
+    "message_id" uuid,
+    "action" text,
+    "ip" text,
+    "user_agent" text,
+    "detail" text,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "rate_limit_buckets" (
+    "key" varchar(255),
+    "tokens" decimal,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("key")
+);
+
+CREATE TABLE IF NOT EXISTS "api_keys" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "name" text,
+    "prefix" text,
+    "key_hash" text,
+    "scopes" text,
+    "max_ttl" bigint,
+    "rate_limit_requests" bigint,
+    "rate_limit_period" bigint,
+    "rate_limit_burst" bigint,
+    "expires_at" timestamptz,
+    "revoked_at" timestamptz,
+    "last_used_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "smtp_credentials" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "project" text,
+    "username" text,
+    "password_hash" text,
+    "last_used_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "forward_rules" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "email_id" bigint,
+    "destination" text,
+    "from_filter" text,
+    "subject_filter" text,
+    "code_hash" text,
+    "verified_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_email_addresses_forward_rules" FOREIGN KEY ("email_id") REFERENCES "email_addresses"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "outbound_messages" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "email_id" bigint,
+    "message_id" uuid,
+    "rule_id" bigint,
+    "mail_from" text,
+    "rcpt_to" text,
+    "raw" bytea,
+    "status" text,
+    "attempts" bigint,
+    "next_attempt_at" timestamptz,
+    "last_error" text,
+    "sent_at" timestamptz,
+    "bounced_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "dkim_keys" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "selector" text,
+    "algorithm" text,
+    "private_key" bytea,
+    "active" boolean,
+    PRIMARY KEY ("id")
+);
+
+CREATE TABLE IF NOT EXISTS "data_keys" (
+    "email_id" bigint,
+    "master_key_id" text,
+    "wrapped" bytea,
+    "created_at" timestamptz,
+    PRIMARY KEY ("email_id")
+);
+
+-- columns added by earlier versions to existing tables
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "address" text;
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "token_hash" text;
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "expires_at" timestamptz;
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "project" text;
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "filter_rules" text;
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "pgp_key" text;
+
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "email_id" bigint;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "uid" bigint;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "from" text;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "subject" text;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "content" text;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "html_content" text;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "raw" bytea;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "encrypted" boolean;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "pgp" boolean;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "seen" boolean;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "flagged" boolean;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "deleted_flag" boolean;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "project" text;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "labels" text;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "messages" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "message_id" uuid;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "file_name" text;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "content_type" text;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "blob_key" text;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "hash" text;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "size" bigint;
+
+ALTER TABLE "blobs" ADD COLUMN IF NOT EXISTS "size" bigint;
+ALTER TABLE "blobs" ADD COLUMN IF NOT EXISTS "ref_count" bigint;
+ALTER TABLE "blobs" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "blobs" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "email_id" bigint;
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "email_address" text;
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "message_id" uuid;
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "action" text;
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "ip" text;
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "user_agent" text;
+ALTER TABLE "audit_logs" ADD COLUMN IF NOT EXISTS "detail" text;
+
+ALTER TABLE "rate_limit_buckets" ADD COLUMN IF NOT EXISTS "tokens" decimal;
+ALTER TABLE "rate_limit_buckets" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "name" text;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "prefix" text;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "key_hash" text;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "scopes" text;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "max_ttl" bigint;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "rate_limit_requests" bigint;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "rate_limit_period" bigint;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "rate_limit_burst" bigint;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "expires_at" timestamptz;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "revoked_at" timestamptz;
+ALTER TABLE "api_keys" ADD COLUMN IF NOT EXISTS "last_used_at" timestamptz;
+
+ALTER TABLE "smtp_credentials" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "smtp_credentials" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "smtp_credentials" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+ALTER TABLE "smtp_credentials" ADD COLUMN IF NOT EXISTS "project" text;
+ALTER TABLE "smtp_credentials" ADD COLUMN IF NOT EXISTS "username" text;
+ALTER TABLE "smtp_credentials" ADD COLUMN IF NOT EXISTS "password_hash" text;
+ALTER TABLE "smtp_credentials" ADD COLUMN IF NOT EXISTS "last_used_at" timestamptz;
+
+ALTER TABLE "forward_rules" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "forward_rules" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "forward_rules" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+ALTER TABLE "forward_rules" ADD COLUMN IF NOT EXISTS "email_id" bigint;
+ALTER TABLE "forward_rules" ADD COLUMN IF NOT EXISTS "destination" text;
+ALTER TABLE "forward_rules" ADD COLUMN IF NOT EXISTS "from_filter" text;
+ALTER TABLE "forward_rules" ADD COLUMN IF NOT EXISTS "subject_filter" text;
+ALTER TABLE "forward_rules" ADD COLUMN IF NOT EXISTS "code_hash" text;
+ALTER TABLE "forward_rules" ADD COLUMN IF NOT EXISTS "verified_at" timestamptz;
+
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "email_id" bigint;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "message_id" uuid;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "rule_id" bigint;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "mail_from" text;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "rcpt_to" text;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "raw" bytea;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "status" text;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "attempts" bigint;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "next_attempt_at" timestamptz;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "last_error" text;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "sent_at" timestamptz;
+ALTER TABLE "outbound_messages" ADD COLUMN IF NOT EXISTS "bounced_at" timestamptz;
+
+ALTER TABLE "dkim_keys" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+ALTER TABLE "dkim_keys" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "dkim_keys" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+ALTER TABLE "dkim_keys" ADD COLUMN IF NOT EXISTS "selector" text;
+ALTER TABLE "dkim_keys" ADD COLUMN IF NOT EXISTS "algorithm" text;
+ALTER TABLE "dkim_keys" ADD COLUMN IF NOT EXISTS "private_key" bytea;
+ALTER TABLE "dkim_keys" ADD COLUMN IF NOT EXISTS "active" boolean;
+
+ALTER TABLE "data_keys" ADD COLUMN IF NOT EXISTS "master_key_id" text;
+ALTER TABLE "data_keys" ADD COLUMN IF NOT EXISTS "wrapped" bytea;
+ALTER TABLE "data_keys" ADD COLUMN IF NOT EXISTS "created_at" timestamptz;
+
+-- indexes, once the columns exist
+CREATE INDEX IF NOT EXISTS "idx_email_addresses_project" ON "email_addresses" ("project");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_email_addresses_address" ON "email_addresses" ("address");
+CREATE INDEX IF NOT EXISTS "idx_email_addresses_deleted_at" ON "email_addresses" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_messages_deleted_at" ON "messages" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_messages_project" ON "messages" ("project");
+CREATE INDEX IF NOT EXISTS "idx_messages_email_uid" ON "messages" ("email_id","uid");
+CREATE INDEX IF NOT EXISTS "idx_attachments_hash" ON "attachments" ("hash");
+CREATE INDEX IF NOT EXISTS "idx_attachments_deleted_at" ON "attachments" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_blobs_ref_count" ON "blobs" ("ref_count");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_created_at" ON "audit_logs" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_audit_logs_deleted_at" ON "audit_logs" ("deleted_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_api_keys_key_hash" ON "api_keys" ("key_hash");
+CREATE INDEX IF NOT EXISTS "idx_api_keys_deleted_at" ON "api_keys" ("deleted_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_smtp_credentials_username" ON "smtp_credentials" ("username");
+CREATE INDEX IF NOT EXISTS "idx_smtp_credentials_project" ON "smtp_credentials" ("project");
+CREATE INDEX IF NOT EXISTS "idx_smtp_credentials_deleted_at" ON "smtp_credentials" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_forward_rules_email_id" ON "forward_rules" ("email_id");
+CREATE INDEX IF NOT EXISTS "idx_forward_rules_deleted_at" ON "forward_rules" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_outbound_messages_next_attempt_at" ON "outbound_messages" ("next_attempt_at");
+CREATE INDEX IF NOT EXISTS "idx_outbound_messages_status" ON "outbound_messages" ("status");
+CREATE INDEX IF NOT EXISTS "idx_outbound_messages_mail_from" ON "outbound_messages" ("mail_from");
+CREATE INDEX IF NOT EXISTS "idx_outbound_messages_email_id" ON "outbound_messages" ("email_id");
+CREATE INDEX IF NOT EXISTS "idx_outbound_messages_deleted_at" ON "outbound_messages" ("deleted_at");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_dkim_keys_selector" ON "dkim_keys" ("selector");
+CREATE INDEX IF NOT EXISTS "idx_dkim_keys_deleted_at" ON "dkim_keys" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_data_keys_master_key_id" ON "data_keys" ("master_key_id");
@@ -0,0 +1,9 @@
+-- The attachments deleted by the up migration are not restored.
+DROP INDEX IF EXISTS "idx_email_addresses_expires_at";
+DROP INDEX IF EXISTS "idx_messages_email_created";
+DROP INDEX IF EXISTS "idx_attachments_message_id";
+
+ALTER TABLE "attachments" ALTER COLUMN "message_id" DROP NOT NULL;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "updated_at" timestamptz;
+ALTER TABLE "attachments" ADD COLUMN IF NOT EXISTS "deleted_at" timestamptz;
+CREATE INDEX IF NOT EXISTS "idx_attachments_deleted_at" ON "attachments" ("deleted_at");
@@ -0,0 +1,32 @@
+-- Attachments are no longer soft deleted, they are deleted with their
+-- message along with their blob reference. Blobs owned by attachments
+-- stored before deduplication are counted like the others.
+INSERT INTO "blobs" ("hash", "size", "ref_count", "created_at", "updated_at")
+SELECT "blob_key", MAX("size"), COUNT(*), NOW(), NOW() FROM "attachments"
+WHERE ("hash" IS NULL OR "hash" = '') AND "blob_key" <> ''
+    AND "blob_key" NOT IN (SELECT "hash" FROM "blobs")
+GROUP BY "blob_key";
+
+-- drop the attachments already deleted, or of deleted messages
+UPDATE "blobs" SET "ref_count" = "ref_count" - (
+    SELECT COUNT(*) FROM "attachments" WHERE "attachments"."blob_key" = "blobs"."hash"
+        AND ("deleted_at" IS NOT NULL OR "message_id" IS NULL
+            OR "message_id" IN (SELECT "id" FROM "messages" WHERE "deleted_at" IS NOT NULL))
+), "updated_at" = NOW()
+WHERE "hash" IN (
+    SELECT "blob_key" FROM "attachments"
+    WHERE "deleted_at" IS NOT NULL OR "message_id" IS NULL
+        OR "message_id" IN (SELECT "id" FROM "messages" WHERE "deleted_at" IS NOT NULL)
+);
+DELETE FROM "attachments"
+WHERE "deleted_at" IS NOT NULL OR "message_id" IS NULL
+    OR "message_id" IN (SELECT "id" FROM "messages" WHERE "deleted_at" IS NOT NULL);
+
+DROP INDEX IF EXISTS "idx_attachments_deleted_at";
+ALTER TABLE "attachments" DROP COLUMN IF EXISTS "updated_at";
+ALTER TABLE "attachments" DROP COLUMN IF EXISTS "deleted_at";
+ALTER TABLE "attachments" ALTER COLUMN "message_id" SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS "idx_attachments_message_id" ON "attachments" ("message_id");
+CREATE INDEX IF NOT EXISTS "idx_messages_email_created" ON "messages" ("email_id", "created_at");
+CREATE INDEX IF NOT EXISTS "idx_email_addresses_expires_at" ON "email_addresses" ("expires_at");
@@ -0,0 +1 @@
+-- The contents stay in the blob store, the column is not restored.
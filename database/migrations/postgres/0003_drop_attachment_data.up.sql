@@ -0,0 +1,3 @@
+-- Versions before the blob store kept the attachment contents in the
+-- database. The data migration run before moved them to the blob store.
+ALTER TABLE "attachments" DROP COLUMN IF EXISTS "data";
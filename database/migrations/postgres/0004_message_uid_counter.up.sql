@@ -0,0 +1,24 @@
+-- UIDs were MAX(uid) + 1 of the address, so concurrent deliveries could
+-- share one. Messages without a UID, and all but the first of those
+-- sharing one, are numbered after the last UID of their address.
+CREATE TEMPORARY TABLE "renumbered_messages" AS
+SELECT "id", "last" + ROW_NUMBER() OVER (PARTITION BY "email_id" ORDER BY "created_at", "id") AS "uid"
+FROM (
+    SELECT "id", "email_id", "created_at", "uid",
+        COALESCE(MAX("uid") OVER (PARTITION BY "email_id"), 0) AS "last",
+        ROW_NUMBER() OVER (PARTITION BY "email_id", "uid" ORDER BY "created_at", "id") AS "rank"
+    FROM "messages"
+) AS "numbered"
+WHERE COALESCE("uid", 0) = 0 OR "rank" > 1;
+UPDATE "messages" SET "uid" = "renumbered_messages"."uid"
+FROM "renumbered_messages" WHERE "messages"."id" = "renumbered_messages"."id";
+DROP TABLE "renumbered_messages";
+
+-- the UID counter of each address
+ALTER TABLE "email_addresses" ADD COLUMN IF NOT EXISTS "last_uid" bigint NOT NULL DEFAULT 0;
+UPDATE "email_addresses" SET "last_uid" = (
+    SELECT COALESCE(MAX("uid"), 0) FROM "messages" WHERE "messages"."email_id" = "email_addresses"."id"
+);
+
+DROP INDEX IF EXISTS "idx_messages_email_uid";
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_messages_email_uid" ON "messages" ("email_id","uid");
@@ -0,0 +1,2 @@
+-- Pending keys become retired keys, they can be deleted or activated again.
+ALTER TABLE "dkim_keys" DROP COLUMN IF EXISTS "pending";
@@ -0,0 +1,3 @@
+-- Rotated keys are stored pending and only sign mail once activated, after
+-- their TXT record is published. Existing keys have all been active.
+ALTER TABLE "dkim_keys" ADD COLUMN IF NOT EXISTS "pending" boolean NOT NULL DEFAULT false;
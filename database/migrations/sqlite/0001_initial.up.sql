@@ -0,0 +1,190 @@
+-- The schema as created by AutoMigrate before versioned migrations, kept
+-- as is for the databases it created.
+
+CREATE TABLE IF NOT EXISTS `email_addresses` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    `address` text,
+    `token_hash` text,
+    `expires_at` datetime,
+    `project` text,
+    `filter_rules` text,
+    `pgp_key` text
+);
+CREATE INDEX IF NOT EXISTS `idx_email_addresses_project` ON `email_addresses`(`project`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_email_addresses_address` ON `email_addresses`(`address`);
+CREATE INDEX IF NOT EXISTS `idx_email_addresses_deleted_at` ON `email_addresses`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `messages` (
+    `id` uuid,
+    `email_id` integer,
+    `uid` integer,
+    `from` text,
+    `subject` text,
+    `content` text,
+    `html_content` text,
+    `raw` blob,
+    `encrypted` numeric,
+    `pgp` numeric,
+    `seen` numeric,
+    `flagged` numeric,
+    `deleted_flag` numeric,
+    `project` text,
+    `labels` text,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    PRIMARY KEY (`id`),
+    CONSTRAINT `fk_email_addresses_messages` FOREIGN KEY (`email_id`) REFERENCES `email_addresses`(`id`) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS `idx_messages_deleted_at` ON `messages`(`deleted_at`);
+CREATE INDEX IF NOT EXISTS `idx_messages_project` ON `messages`(`project`);
+CREATE INDEX IF NOT EXISTS `idx_messages_email_uid` ON `messages`(`email_id`,`uid`);
+
+CREATE TABLE IF NOT EXISTS `attachments` (
+    `id` uuid,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    `message_id` uuid,
+    `file_name` text,
+    `content_type` text,
+    `blob_key` text,
+    `hash` text,
+    `size` integer,
+    PRIMARY KEY (`id`),
+    CONSTRAINT `fk_messages_attachments` FOREIGN KEY (`message_id`) REFERENCES `messages`(`id`) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS `idx_attachments_hash` ON `attachments`(`hash`);
+CREATE INDEX IF NOT EXISTS `idx_attachments_deleted_at` ON `attachments`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `blobs` (
+    `hash` text,
+    `size` integer,
+    `ref_count` integer,
+    `created_at` datetime,
+    `updated_at` datetime,
+    PRIMARY KEY (`hash`)
+);
+CREATE INDEX IF NOT EXISTS `idx_blobs_ref_count` ON `blobs`(`ref_count`);
+
+CREATE TABLE IF NOT EXISTS `audit_logs` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    `email_id` integer,
+    `email_address` text,
+    `message_id` uuid,
+    `action` text,
+    `ip` text,
+    `user_agent` text,
+    `detail` text
+);
+CREATE INDEX IF NOT EXISTS `idx_audit_logs_created_at` ON `audit_logs`(`created_at`);
+CREATE INDEX IF NOT EXISTS `idx_audit_logs_deleted_at` ON `audit_logs`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `rate_limit_buckets` (
+    `key` text,
+    `tokens` real,
+    `updated_at` datetime,
+    PRIMARY KEY (`key`)
+);
+
+CREATE TABLE IF NOT EXISTS `api_keys` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    `name` text,
+    `prefix` text,
+    `key_hash` text,
+    `scopes` text,
+    `max_ttl` integer,
+    `rate_limit_requests` integer,
+    `rate_limit_period` integer,
+    `rate_limit_burst` integer,
+    `expires_at` datetime,
+    `revoked_at` datetime,
+    `last_used_at` datetime
+);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_api_keys_key_hash` ON `api_keys`(`key_hash`);
+CREATE INDEX IF NOT EXISTS `idx_api_keys_deleted_at` ON `api_keys`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `smtp_credentials` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    `project` text,
+    `username` text,
+    `password_hash` text,
+    `last_used_at` datetime
+);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_smtp_credentials_username` ON `smtp_credentials`(`username`);
+CREATE INDEX IF NOT EXISTS `idx_smtp_credentials_project` ON `smtp_credentials`(`project`);
+CREATE INDEX IF NOT EXISTS `idx_smtp_credentials_deleted_at` ON `smtp_credentials`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `forward_rules` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    `email_id` integer,
+    `destination` text,
+    `from_filter` text,
+    `subject_filter` text,
+    `code_hash` text,
+    `verified_at` datetime,
+    CONSTRAINT `fk_email_addresses_forward_rules` FOREIGN KEY (`email_id`) REFERENCES `email_addresses`(`id`) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS `idx_forward_rules_email_id` ON `forward_rules`(`email_id`);
+CREATE INDEX IF NOT EXISTS `idx_forward_rules_deleted_at` ON `forward_rules`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `outbound_messages` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    `email_id` integer,
+    `message_id` uuid,
+    `rule_id` integer,
+    `mail_from` text,
+    `rcpt_to` text,
+    `raw` blob,
+    `status` text,
+    `attempts` integer,
+    `next_attempt_at` datetime,
+    `last_error` text,
+    `sent_at` datetime,
+    `bounced_at` datetime
+);
+CREATE INDEX IF NOT EXISTS `idx_outbound_messages_next_attempt_at` ON `outbound_messages`(`next_attempt_at`);
+CREATE INDEX IF NOT EXISTS `idx_outbound_messages_status` ON `outbound_messages`(`status`);
+CREATE INDEX IF NOT EXISTS `idx_outbound_messages_mail_from` ON `outbound_messages`(`mail_from`);
+CREATE INDEX IF NOT EXISTS `idx_outbound_messages_email_id` ON `outbound_messages`(`email_id`);
+CREATE INDEX IF NOT EXISTS `idx_outbound_messages_deleted_at` ON `outbound_messages`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `dkim_keys` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    `selector` text,
+    `algorithm` text,
+    `private_key` blob,
+    `active` numeric
+);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_dkim_keys_selector` ON `dkim_keys`(`selector`);
+CREATE INDEX IF NOT EXISTS `idx_dkim_keys_deleted_at` ON `dkim_keys`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `data_keys` (
+    `email_id` integer,
+    `master_key_id` text,
+    `wrapped` blob,
+    `created_at` datetime,
+    PRIMARY KEY (`email_id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_data_keys_master_key_id` ON `data_keys`(`master_key_id`);
@@ -0,0 +1,24 @@
+-- The attachments deleted by the up migration are not restored.
+DROP INDEX IF EXISTS `idx_email_addresses_expires_at`;
+DROP INDEX IF EXISTS `idx_messages_email_created`;
+
+CREATE TABLE `attachments_old` (
+    `id` uuid,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `deleted_at` datetime,
+    `message_id` uuid,
+    `file_name` text,
+    `content_type` text,
+    `blob_key` text,
+    `hash` text,
+    `size` integer,
+    PRIMARY KEY (`id`),
+    CONSTRAINT `fk_messages_attachments` FOREIGN KEY (`message_id`) REFERENCES `messages`(`id`) ON DELETE CASCADE ON UPDATE CASCADE
+);
+INSERT INTO `attachments_old` (`id`, `created_at`, `message_id`, `file_name`, `content_type`, `blob_key`, `hash`, `size`)
+SELECT `id`, `created_at`, `message_id`, `file_name`, `content_type`, `blob_key`, `hash`, `size` FROM `attachments`;
+DROP TABLE `attachments`;
+ALTER TABLE `attachments_old` RENAME TO `attachments`;
+CREATE INDEX `idx_attachments_hash` ON `attachments`(`hash`);
+CREATE INDEX `idx_attachments_deleted_at` ON `attachments`(`deleted_at`);
@@ -0,0 +1,46 @@
+-- Attachments are no longer soft deleted, they are deleted with their
+-- message along with their blob reference. Blobs owned by attachments
+-- stored before deduplication are counted like the others.
+INSERT INTO `blobs` (`hash`, `size`, `ref_count`, `created_at`, `updated_at`)
+SELECT `blob_key`, MAX(`size`), COUNT(*), CURRENT_TIMESTAMP, CURRENT_TIMESTAMP FROM `attachments`
+WHERE (`hash` IS NULL OR `hash` = '') AND `blob_key` <> ''
+    AND `blob_key` NOT IN (SELECT `hash` FROM `blobs`)
+GROUP BY `blob_key`;
+
+-- drop the attachments already deleted, or of deleted messages
+UPDATE `blobs` SET `ref_count` = `ref_count` - (
+    SELECT COUNT(*) FROM `attachments` WHERE `attachments`.`blob_key` = `blobs`.`hash`
+        AND (`deleted_at` IS NOT NULL OR `message_id` IS NULL
+            OR `message_id` IN (SELECT `id` FROM `messages` WHERE `deleted_at` IS NOT NULL))
+), `updated_at` = CURRENT_TIMESTAMP
+WHERE `hash` IN (
+    SELECT `blob_key` FROM `attachments`
+    WHERE `deleted_at` IS NOT NULL OR `message_id` IS NULL
+        OR `message_id` IN (SELECT `id` FROM `messages` WHERE `deleted_at` IS NOT NULL)
+);
+DELETE FROM `attachments`
+WHERE `deleted_at` IS NOT NULL OR `message_id` IS NULL
+    OR `message_id` IN (SELECT `id` FROM `messages` WHERE `deleted_at` IS NOT NULL);
+
+-- SQLite cannot make a column NOT NULL, the table is rebuilt
+CREATE TABLE `attachments_new` (
+    `id` uuid,
+    `message_id` uuid NOT NULL,
+    `file_name` text,
+    `content_type` text,
+    `blob_key` text,
+    `hash` text,
+    `size` integer,
+    `created_at` datetime,
+    PRIMARY KEY (`id`),
+    CONSTRAINT `fk_messages_attachments` FOREIGN KEY (`message_id`) REFERENCES `messages`(`id`) ON DELETE CASCADE ON UPDATE CASCADE
+);
+INSERT INTO `attachments_new` (`id`, `message_id`, `file_name`, `content_type`, `blob_key`, `hash`, `size`, `created_at`)
+SELECT `id`, `message_id`, `file_name`, `content_type`, `blob_key`, `hash`, `size`, `created_at` FROM `attachments`;
+DROP TABLE `attachments`;
+ALTER TABLE `attachments_new` RENAME TO `attachments`;
+CREATE INDEX `idx_attachments_hash` ON `attachments`(`hash`);
+CREATE INDEX `idx_attachments_message_id` ON `attachments`(`message_id`);
+
+CREATE INDEX IF NOT EXISTS `idx_messages_email_created` ON `messages`(`email_id`,`created_at`);
+CREATE INDEX IF NOT EXISTS `idx_email_addresses_expires_at` ON `email_addresses`(`expires_at`);
@@ -0,0 +1,2 @@
+-- SQLite databases were created after the attachment contents moved to
+-- the blob store, they have no data column to drop.
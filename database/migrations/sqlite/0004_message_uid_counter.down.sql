@@ -0,0 +1,4 @@
+-- The messages renumbered by the up migration keep their new UID.
+DROP INDEX IF EXISTS `idx_messages_email_uid`;
+CREATE INDEX IF NOT EXISTS `idx_messages_email_uid` ON `messages`(`email_id`,`uid`);
+ALTER TABLE `email_addresses` DROP COLUMN `last_uid`;
@@ -0,0 +1,89 @@
+package dkim
+
+import (
+	"secmail/models"
+
+	"gorm.io/gorm"
+)
+
+// DatabaseStore keeps keys in the dkim_keys table, shared by all replicas.
+type DatabaseStore struct {
+	db *gorm.DB
+}
+
+func NewDatabaseStore(db *gorm.DB) *DatabaseStore {
+	return &DatabaseStore{db: db}
+}
+
+func (s *DatabaseStore) Keys() ([]*Key, error) {
+	var rows []models.DKIMKey
+	if err := s.db.Order("created_at DESC, id DESC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	keys := make([]*Key, 0, len(rows))
+	for _, row := range rows {
+		signer, algorithm, err := parseKey(row.PrivateKey)
+		if err != nil {
+			log.Errorf("Skipping invalid DKIM key %s: %v", row.Selector, err)
+			continue
+		}
+		keys = append(keys, &Key{
+			Selector:  row.Selector,
+			Algorithm: algorithm,
+			Signer:    signer,
+			Active:    row.Active,
+			Pending:   row.Pending,
+			CreatedAt: row.CreatedAt,
+		})
+	}
+	return keys, nil
+}
+
+func (s *DatabaseStore) Add(key *Key) error {
+	der, err := marshalKey(key.Signer)
+	if err != nil {
+		return err
+	}
+	row := models.DKIMKey{
+		Selector:   key.Selector,
+		Algorithm:  key.Algorithm,
+		PrivateKey: der,
+		Pending:    true,
+	}
+	if err := s.db.Create(&row).Error; err != nil {
+		return err
+	}
+	key.Active, key.Pending = false, true
+	key.CreatedAt = row.CreatedAt
+	return nil
+}
+
+func (s *DatabaseStore) Activate(selector string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var row models.DKIMKey
+		if err := tx.Where("selector = ?", selector).First(&row).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return ErrKeyNotFound
+			}
+			return err
+		}
+		if err := tx.Model(&models.DKIMKey{}).Where("active = ? AND id <> ?", true, row.ID).Update("active", false).Error; err != nil {
+			return err
+		}
+		return tx.Model(&row).Updates(map[string]any{"active": true, "pending": false}).Error
+	})
+}
+
+func (s *DatabaseStore) Delete(selector string) error {
+	var row models.DKIMKey
+	if err := s.db.Where("selector = ?", selector).First(&row).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+	if row.Active {
+		return ErrActiveKey
+	}
+	return s.db.Unscoped().Delete(&row).Error
+}
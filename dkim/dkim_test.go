@@ -0,0 +1,153 @@
+package dkim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	msgauth "github.com/emersion/go-msgauth/dkim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"secmail/database/databasetest"
+)
+
+const testMessage = "From: abcd123456@test.com\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hi Bob\r\n"
+
+func setupStores(t *testing.T) map[string]Store {
+	db := databasetest.Open(t)
+	files, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	return map[string]Store{"database": NewDatabaseStore(db), "file": files}
+}
+
+func TestRotate(t *testing.T) {
+	for name, store := range setupStores(t) {
+		t.Run(name, func(t *testing.T) {
+			active, err := Active(store)
+			require.NoError(t, err)
+			assert.Nil(t, active)
+
+			require.NoError(t, EnsureKey(store, AlgorithmEd25519, "test.com"))
+			first, err := Active(store)
+			require.NoError(t, err)
+			require.NotNil(t, first)
+			assert.Equal(t, AlgorithmEd25519, first.Algorithm)
+			assert.Equal(t, "s"+time.Now().Format("20060102"), first.Selector)
+
+			// an active key is kept
+			require.NoError(t, EnsureKey(store, AlgorithmEd25519, "test.com"))
+			second, err := Rotate(store, AlgorithmRSA)
+			require.NoError(t, err)
+			assert.Equal(t, first.Selector+"-2", second.Selector)
+
+			assert.True(t, second.Pending)
+
+			// the rotated key waits for its record to be published
+			keys, err := store.Keys()
+			require.NoError(t, err)
+			require.Len(t, keys, 2)
+			assert.Equal(t, second.Selector, keys[0].Selector)
+			assert.False(t, keys[0].Active)
+			assert.True(t, keys[0].Pending)
+			assert.Equal(t, AlgorithmRSA, keys[0].Algorithm)
+			assert.True(t, keys[1].Active)
+			assert.False(t, keys[1].Pending)
+
+			assert.ErrorIs(t, store.Activate("unknown"), ErrKeyNotFound)
+			require.NoError(t, store.Activate(second.Selector))
+			keys, err = store.Keys()
+			require.NoError(t, err)
+			require.Len(t, keys, 2)
+			assert.True(t, keys[0].Active)
+			assert.False(t, keys[0].Pending)
+			assert.False(t, keys[1].Active)
+			assert.False(t, keys[1].Pending)
+
+			// a retired key can be activated again
+			require.NoError(t, store.Activate(first.Selector))
+			active, err = Active(store)
+			require.NoError(t, err)
+			assert.Equal(t, first.Selector, active.Selector)
+			require.NoError(t, store.Activate(second.Selector))
+
+			assert.ErrorIs(t, store.Delete(second.Selector), ErrActiveKey)
+			assert.ErrorIs(t, store.Delete("unknown"), ErrKeyNotFound)
+			require.NoError(t, store.Delete(first.Selector))
+
+			// a pending key can be dropped before it is ever used
+			third, err := Rotate(store, AlgorithmEd25519)
+			require.NoError(t, err)
+			require.NoError(t, store.Delete(third.Selector))
+			keys, err = store.Keys()
+			require.NoError(t, err)
+			require.Len(t, keys, 1)
+			assert.Equal(t, second.Selector, keys[0].Selector)
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmRSA, AlgorithmEd25519} {
+		t.Run(algorithm, func(t *testing.T) {
+			store := setupStores(t)["database"]
+
+			// without a key, messages are not signed
+			raw, err := Sign(store, "test.com", []byte(testMessage))
+			require.NoError(t, err)
+			assert.Equal(t, testMessage, string(raw))
+
+			key, err := Rotate(store, algorithm)
+			require.NoError(t, err)
+			// nor with a pending key
+			raw, err = Sign(store, "test.com", []byte(testMessage))
+			require.NoError(t, err)
+			assert.Equal(t, testMessage, string(raw))
+
+			require.NoError(t, store.Activate(key.Selector))
+			signed, err := Sign(store, "test.com", []byte(testMessage))
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(signed), "DKIM-Signature:"))
+
+			txt, err := key.TXTStrings()
+			require.NoError(t, err)
+			for _, s := range txt {
+				assert.LessOrEqual(t, len(s), maxTXTString)
+			}
+			verifications, err := msgauth.VerifyWithOptions(bytes.NewReader(signed), &msgauth.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					assert.Equal(t, key.RecordName("test.com"), domain)
+					// resolvers join the strings of a record
+					return []string{strings.Join(txt, "")}, nil
+				},
+			})
+			require.NoError(t, err)
+			require.Len(t, verifications, 1)
+			assert.NoError(t, verifications[0].Err)
+		})
+	}
+}
+
+func TestNewSelector(t *testing.T) {
+	now := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		keys []*Key
+		want string
+	}{
+		{"first", nil, "s20250102"},
+		{"other day", []*Key{{Selector: "s20250101"}}, "s20250102"},
+		{"same day", []*Key{{Selector: "s20250102"}}, "s20250102-2"},
+		{"third", []*Key{{Selector: "s20250102"}, {Selector: "s20250102-2"}}, "s20250102-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, newSelector(tt.keys, now))
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package dkim
+
+import (
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	keyFileExt = ".pem"
+	// pendingFileExt names the PEM files of keys not activated yet
+	pendingFileExt = ".pending"
+	// activeFile holds the selector of the active key
+	activeFile = "active"
+)
+
+var selectorRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// FileStore keeps keys in a directory, one PEM file per selector, named
+// <selector>.pending until the key is activated. Replicas have to share the
+// directory.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, errors.New("DKIM key directory is not configured")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(selector string) string {
+	return filepath.Join(s.dir, selector+keyFileExt)
+}
+
+func (s *FileStore) pendingPath(selector string) string {
+	return filepath.Join(s.dir, selector+pendingFileExt)
+}
+
+// setActive replaces the active selector atomically.
+func (s *FileStore) setActive(selector string) error {
+	tmp := filepath.Join(s.dir, activeFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(selector+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, activeFile))
+}
+
+func (s *FileStore) active() (string, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, activeFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+func (s *FileStore) Keys() ([]*Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	active, err := s.active()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+keyFileExt))
+	if err != nil {
+		return nil, err
+	}
+	pending, err := filepath.Glob(filepath.Join(s.dir, "*"+pendingFileExt))
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, pending...)
+
+	keys := make([]*Key, 0, len(files))
+	for _, file := range files {
+		ext := filepath.Ext(file)
+		selector := strings.TrimSuffix(filepath.Base(file), ext)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			log.Errorf("Skipping invalid DKIM key file %s", file)
+			continue
+		}
+		signer, algorithm, err := parseKey(block.Bytes)
+		if err != nil {
+			log.Errorf("Skipping invalid DKIM key file %s: %v", file, err)
+			continue
+		}
+		keys = append(keys, &Key{
+			Selector:  selector,
+			Algorithm: algorithm,
+			Signer:    signer,
+			Active:    selector == active,
+			Pending:   ext == pendingFileExt,
+			CreatedAt: info.ModTime(),
+		})
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		}
+		return keys[i].Selector > keys[j].Selector
+	})
+	return keys, nil
+}
+
+func (s *FileStore) Add(key *Key) error {
+	if !selectorRegexp.MatchString(key.Selector) {
+		return errors.New("invalid DKIM selector: " + key.Selector)
+	}
+	der, err := marshalKey(key.Signer)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.path(key.Selector)); err == nil {
+		return os.ErrExist
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	f, err := os.OpenFile(s.pendingPath(key.Selector), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	key.Active, key.Pending = false, true
+	return nil
+}
+
+func (s *FileStore) Activate(selector string) error {
+	if !selectorRegexp.MatchString(selector) {
+		return ErrKeyNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Rename(s.pendingPath(selector), s.path(selector))
+	if errors.Is(err, os.ErrNotExist) {
+		// an activated key, made active again
+		_, err = os.Stat(s.path(selector))
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrKeyNotFound
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.setActive(selector)
+}
+
+func (s *FileStore) Delete(selector string) error {
+	if !selectorRegexp.MatchString(selector) {
+		return ErrKeyNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	active, err := s.active()
+	if err != nil {
+		return err
+	}
+	if selector == active {
+		return ErrActiveKey
+	}
+	err = os.Remove(s.path(selector))
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.Remove(s.pendingPath(selector))
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrKeyNotFound
+		}
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	AlgorithmRSA     = "rsa"
+	AlgorithmEd25519 = "ed25519"
+
+	rsaBits = 2048
+	// maxTXTString is the longest string of a TXT record, longer records
+	// are published as several strings
+	maxTXTString = 255
+)
+
+// Key is a DKIM signing key, published as <selector>._domainkey.<domain>.
+type Key struct {
+	Selector  string
+	Algorithm string
+	Signer    crypto.Signer
+	// Active is set on the key signing new mail
+	Active bool
+	// Pending is set on a key that has not been activated yet, while its
+	// TXT record is being published
+	Pending   bool
+	CreatedAt time.Time
+}
+
+// GenerateKey creates a key of the given algorithm, RSA by default.
+func GenerateKey(algorithm, selector string) (*Key, error) {
+	key := &Key{Selector: selector, Algorithm: algorithm, CreatedAt: time.Now()}
+	switch algorithm {
+	case "", AlgorithmRSA:
+		k, err := rsa.GenerateKey(rand.Reader, rsaBits)
+		if err != nil {
+			return nil, err
+		}
+		key.Algorithm, key.Signer = AlgorithmRSA, k
+	case AlgorithmEd25519:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key.Signer = k
+	default:
+		return nil, fmt.Errorf("unknown DKIM algorithm: %s", algorithm)
+	}
+	return key, nil
+}
+
+// marshalKey encodes a private key as PKCS #8.
+func marshalKey(signer crypto.Signer) ([]byte, error) {
+	return x509.MarshalPKCS8PrivateKey(signer)
+}
+
+// parseKey decodes a PKCS #8 private key and returns its algorithm.
+func parseKey(der []byte) (crypto.Signer, string, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, "", err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, AlgorithmRSA, nil
+	case ed25519.PrivateKey:
+		return k, AlgorithmEd25519, nil
+	}
+	return nil, "", errors.New("unsupported DKIM key type")
+}
+
+// RecordName is the DNS name the key is published at.
+func (k *Key) RecordName(domain string) string {
+	return k.Selector + "._domainkey." + domain
+}
+
+// TXTRecord is the value of the DNS TXT record publishing the key.
+func (k *Key) TXTRecord() (string, error) {
+	var public []byte
+	switch pub := k.Signer.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		public = der
+	case ed25519.PublicKey:
+		public = pub
+	default:
+		return "", errors.New("unsupported DKIM key type")
+	}
+	return "v=DKIM1; k=" + k.Algorithm + "; p=" + base64.StdEncoding.EncodeToString(public), nil
+}
+
+// splitTXT cuts a record into the strings of a TXT record.
+func splitTXT(record string) []string {
+	var parts []string
+	for len(record) > maxTXTString {
+		parts = append(parts, record[:maxTXTString])
+		record = record[maxTXTString:]
+	}
+	return append(parts, record)
+}
+
+// TXTStrings is TXTRecord cut into strings short enough for DNS.
+func (k *Key) TXTStrings() ([]string, error) {
+	record, err := k.TXTRecord()
+	if err != nil {
+		return nil, err
+	}
+	return splitTXT(record), nil
+}
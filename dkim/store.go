@@ -0,0 +1,151 @@
+package dkim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"secmail/config"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/kuun/slog"
+	"gorm.io/gorm"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+var (
+	ErrKeyNotFound = errors.New("DKIM key not found")
+	ErrActiveKey   = errors.New("the active DKIM key cannot be deleted")
+)
+
+// headerKeys are the signed header fields, as recommended by RFC 6376
+// section 5.4.1.
+var headerKeys = []string{
+	"From", "To", "Cc", "Subject", "Date", "Message-Id",
+	"In-Reply-To", "References", "Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// Store keeps the DKIM keys. One key is active and signs new mail; the
+// others stay published until they are deleted, so that mail signed with
+// them still verifies while it is in transit. A new key is pending until it
+// is activated, once its TXT record is published: mail signed with a key
+// receivers cannot resolve yet would fail verification.
+type Store interface {
+	// Keys returns all keys, newest first.
+	Keys() ([]*Key, error)
+	// Add stores a pending key.
+	Add(key *Key) error
+	// Activate makes a key the active one. The previously active key stays
+	// published.
+	Activate(selector string) error
+	// Delete removes a key that is not active.
+	Delete(selector string) error
+}
+
+// NewStore creates the store named in the configuration.
+func NewStore(cfg config.DKIMConfig, db *gorm.DB) (Store, error) {
+	switch cfg.Store {
+	case "", "database":
+		return NewDatabaseStore(db), nil
+	case "file":
+		return NewFileStore(cfg.Dir)
+	default:
+		return nil, fmt.Errorf("unknown DKIM store: %s", cfg.Store)
+	}
+}
+
+// Active returns the key signing new mail, nil if there is none.
+func Active(s Store) (*Key, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.Active {
+			return k, nil
+		}
+	}
+	return nil, nil
+}
+
+// newSelector names a key after the day it is created, s20250102, with a
+// suffix for further keys of the same day.
+func newSelector(keys []*Key, now time.Time) string {
+	base := "s" + now.Format("20060102")
+	taken := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		taken[k.Selector] = true
+	}
+	selector := base
+	for i := 2; taken[selector]; i++ {
+		selector = base + "-" + strconv.Itoa(i)
+	}
+	return selector
+}
+
+// Rotate generates a new pending key. The active key keeps signing mail
+// until the new one is activated.
+func Rotate(s Store, algorithm string) (*Key, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	key, err := GenerateKey(algorithm, newSelector(keys, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Add(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EnsureKey generates a first key when the store has no active one. It is
+// activated right away: no mail is signed until then anyway.
+func EnsureKey(s Store, algorithm, domain string) error {
+	active, err := Active(s)
+	if err != nil || active != nil {
+		return err
+	}
+	key, err := Rotate(s, algorithm)
+	if err != nil {
+		return err
+	}
+	if err := s.Activate(key.Selector); err != nil {
+		return err
+	}
+	key.Active, key.Pending = true, false
+	record, err := key.TXTRecord()
+	if err != nil {
+		return err
+	}
+	log.Warnf("Generated DKIM key, publish the TXT record %s: %s", key.RecordName(domain), record)
+	return nil
+}
+
+// Sign prepends the DKIM-Signature of the active key to a message. Without
+// an active key, the message is returned unchanged.
+func Sign(s Store, domain string, raw []byte) ([]byte, error) {
+	key, err := Active(s)
+	if err != nil || key == nil {
+		return raw, err
+	}
+
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(raw), &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               key.Selector,
+		Signer:                 key.Signer,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             headerKeys,
+	}); err != nil {
+		return nil, err
+	}
+	return signed.Bytes(), nil
+}
@@ -0,0 +1,210 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/blob"
+	"secmail/database/databasetest"
+	"secmail/models"
+)
+
+var (
+	masterKey1 = bytes.Repeat([]byte{1}, keySize)
+	masterKey2 = bytes.Repeat([]byte{2}, keySize)
+)
+
+func setupDB(t *testing.T) *gorm.DB {
+	return databasetest.Open(t)
+}
+
+func setupStores(t *testing.T) map[string]KeyStore {
+	files, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	return map[string]KeyStore{"database": NewDatabaseStore(setupDB(t)), "file": files}
+}
+
+func TestKeyring(t *testing.T) {
+	for name, store := range setupStores(t) {
+		t.Run(name, func(t *testing.T) {
+			k, err := NewKeyring(store, masterKey1)
+			require.NoError(t, err)
+
+			sealed, err := k.Seal(7, []byte("secret"))
+			require.NoError(t, err)
+			assert.True(t, models.IsSealed(sealed))
+			assert.NotContains(t, string(sealed), "secret")
+			plaintext, err := k.Open(sealed)
+			require.NoError(t, err)
+			assert.Equal(t, "secret", string(plaintext))
+
+			// a new keyring loads the stored key
+			other, err := NewKeyring(store, masterKey1)
+			require.NoError(t, err)
+			plaintext, err = other.Open(sealed)
+			require.NoError(t, err)
+			assert.Equal(t, "secret", string(plaintext))
+
+			// the address id is authenticated
+			tampered := bytes.Clone(sealed)
+			tampered[len(models.SealedMagic)+7] = 8
+			_, err = k.Seal(8, []byte("other"))
+			require.NoError(t, err)
+			_, err = k.Open(tampered)
+			assert.ErrorIs(t, err, ErrInvalid)
+
+			key1, err := k.BlobKey(7, []byte("report"))
+			require.NoError(t, err)
+			key2, err := k.BlobKey(7, []byte("report"))
+			require.NoError(t, err)
+			assert.Equal(t, key1, key2)
+			key3, err := k.BlobKey(8, []byte("report"))
+			require.NoError(t, err)
+			assert.NotEqual(t, key1, key3)
+			assert.NotEqual(t, blob.Hash([]byte("report")), key1)
+
+			require.NoError(t, k.Shred(7))
+			require.NoError(t, k.Shred(7))
+			_, err = k.Open(sealed)
+			assert.ErrorIs(t, err, ErrKeyNotFound)
+		})
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	for name, store := range setupStores(t) {
+		t.Run(name, func(t *testing.T) {
+			old, err := NewKeyring(store, masterKey1)
+			require.NoError(t, err)
+			sealed, err := old.Seal(7, []byte("secret"))
+			require.NoError(t, err)
+
+			// without the previous master key, the data key cannot be unwrapped
+			k, err := NewKeyring(store, masterKey2)
+			require.NoError(t, err)
+			_, err = k.Open(sealed)
+			assert.Error(t, err)
+
+			k, err = NewKeyring(store, masterKey2, masterKey1)
+			require.NoError(t, err)
+			n, err := k.Rewrap()
+			require.NoError(t, err)
+			assert.Equal(t, 1, n)
+
+			k, err = NewKeyring(store, masterKey2)
+			require.NoError(t, err)
+			plaintext, err := k.Open(sealed)
+			require.NoError(t, err)
+			assert.Equal(t, "secret", string(plaintext))
+		})
+	}
+}
+
+func TestEncryptExisting(t *testing.T) {
+	db := setupDB(t)
+	s := blob.NewMemoryStore()
+	ctx := context.Background()
+
+	addr := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&addr).Error)
+	msg := models.Message{EmailID: addr.ID, Subject: "Report", Content: "See attached",
+		Raw: []byte("Subject: Report\r\n\r\nSee attached\r\n")}
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		key, _, err := blob.RefContent(ctx, tx, s, addr.ID, []byte("a,b\n"))
+		if err != nil {
+			return err
+		}
+		msg.Attachments = []models.Attachment{{ID: uuid.New(), FileName: "report.csv", BlobKey: key, Hash: key, Size: 4}}
+		return tx.Create(&msg).Error
+	}))
+	assert.False(t, msg.Encrypted)
+
+	// keys are created outside of the transactions storing the contents,
+	// which hold the only connection to the database
+	k, err := NewKeyring(NewDatabaseStore(setupDB(t)), masterKey1)
+	require.NoError(t, err)
+	models.SetCipher(k)
+	t.Cleanup(func() { models.SetCipher(nil) })
+	require.NoError(t, EncryptExisting(db, s))
+
+	var stored struct {
+		Content string
+		Raw     []byte
+	}
+	require.NoError(t, db.Table("messages").Select("content", "raw").Where("id = ?", msg.ID).Scan(&stored).Error)
+	assert.NotContains(t, stored.Content, "See attached")
+	assert.True(t, models.IsSealed(stored.Raw))
+
+	var loaded models.Message
+	require.NoError(t, db.Preload("Attachments").First(&loaded, "id = ?", msg.ID).Error)
+	assert.True(t, loaded.Encrypted)
+	assert.Equal(t, "See attached", loaded.Content)
+	assert.Equal(t, "Subject: Report\r\n\r\nSee attached\r\n", string(loaded.Raw))
+
+	// the attachment is sealed under a key of the address, the plaintext
+	// blob is released
+	a := loaded.Attachments[0]
+	assert.Equal(t, blob.Hash([]byte("a,b\n")), a.Hash)
+	assert.NotEqual(t, a.Hash, a.BlobKey)
+	r, err := blob.OpenAttachment(ctx, s, &a)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "a,b\n", string(data))
+	n, err := blob.Collect(ctx, db, s)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// new messages are encrypted as they are stored
+	created := models.Message{EmailID: addr.ID, Content: "Hello"}
+	require.NoError(t, db.Create(&created).Error)
+	assert.True(t, created.Encrypted)
+	require.NoError(t, db.Table("messages").Select("content", "raw").Where("id = ?", created.ID).Scan(&stored).Error)
+	assert.NotContains(t, stored.Content, "Hello")
+
+	// shredding the key makes the contents unreadable
+	require.NoError(t, models.Shred(addr.ID))
+	assert.Error(t, db.First(&loaded, "id = ?", msg.ID).Error)
+}
+
+func TestCreateKey(t *testing.T) {
+	db := setupDB(t)
+	store := NewDatabaseStore(db)
+	k, err := NewKeyring(store, masterKey1)
+	require.NoError(t, err)
+	models.SetCipher(k)
+	t.Cleanup(func() { models.SetCipher(nil) })
+
+	// the key is created with the address
+	addr := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&addr).Error)
+	_, err = store.Get(addr.ID)
+	require.NoError(t, err)
+
+	// and rolled back with it
+	rolledBack := models.EmailAddress{Address: "rollback12@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	assert.Error(t, db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&rolledBack).Error; err != nil {
+			return err
+		}
+		return gorm.ErrInvalidData
+	}))
+	_, err = store.Get(rolledBack.ID)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// addresses created before encryption was enabled get one on start
+	models.SetCipher(nil)
+	old := models.EmailAddress{Address: "old1234567@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&old).Error)
+	require.NoError(t, k.EnsureKeys(db))
+	_, err = store.Get(old.ID)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,139 @@
+package encryption
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"secmail/models"
+)
+
+const keyFileExt = ".key"
+
+// FileStore keeps keys in a directory, one JSON file per address, so that
+// they can be kept out of the database and its backups. Replicas have to
+// share the directory.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, errors.New("data key directory is not configured")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(emailID uint) string {
+	return filepath.Join(s.dir, strconv.FormatUint(uint64(emailID), 10)+keyFileExt)
+}
+
+func (s *FileStore) read(path string) (*models.DataKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var key models.DataKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *FileStore) Get(emailID uint) (*models.DataKey, error) {
+	return s.read(s.path(emailID))
+}
+
+func (s *FileStore) Create(key *models.DataKey) (*models.DataKey, error) {
+	key.CreatedAt = time.Now()
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	// write the key aside and link it, so that no replica reads it partially
+	// and an existing key is kept
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Link(tmp.Name(), s.path(key.EmailID)); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	return s.Get(key.EmailID)
+}
+
+func (s *FileStore) Update(key *models.DataKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key.EmailID))
+}
+
+func (s *FileStore) Delete(emailID uint) error {
+	if err := os.Remove(s.path(emailID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) WrappedBy(masterKeyID string, limit int) ([]*models.DataKey, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+keyFileExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var keys []*models.DataKey
+	for _, file := range files {
+		if len(keys) == limit {
+			break
+		}
+		if _, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), keyFileExt), 10, 64); err != nil {
+			continue
+		}
+		key, err := s.read(file)
+		if errors.Is(err, ErrKeyNotFound) {
+			// shredded meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key.MasterKeyID == masterKeyID {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,362 @@
+// Package encryption encrypts the contents of addresses at rest. Each
+// address has a data key, wrapped by the master key, so that deleting the
+// data key makes the contents of the address unreadable.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"secmail/config"
+	"secmail/models"
+
+	"github.com/kuun/slog"
+	"gorm.io/gorm"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+var (
+	ErrKeyNotFound = errors.New("data key not found")
+	ErrInvalid     = errors.New("invalid encrypted content")
+)
+
+const (
+	keySize = 32
+	// headerSize is the magic and the address id, authenticated with the
+	// content
+	headerSize = len(models.SealedMagic) + 8
+	// cacheTTL bounds how long a replica keeps using a data key shredded by
+	// another one
+	cacheTTL     = 5 * time.Minute
+	cacheSize    = 10000
+	rewrapBatch  = 100
+	blobKeyLabel = "secmail blob key"
+)
+
+// masterKey wraps data keys.
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newMasterKey(key []byte) (*masterKey, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", keySize, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// wrappingData binds a wrapped key to its address.
+func wrappingData(emailID uint) []byte {
+	return binary.BigEndian.AppendUint64([]byte("secmail data key "), uint64(emailID))
+}
+
+func (m *masterKey) wrap(emailID uint, key []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return m.aead.Seal(nonce, nonce, key, wrappingData(emailID)), nil
+}
+
+func (m *masterKey) unwrap(emailID uint, wrapped []byte) ([]byte, error) {
+	n := m.aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, fmt.Errorf("invalid data key of address %d", emailID)
+	}
+	key, err := m.aead.Open(nil, wrapped[:n], wrapped[n:], wrappingData(emailID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the data key of address %d: %w", emailID, err)
+	}
+	return key, nil
+}
+
+// dataKey is an unwrapped data key.
+type dataKey struct {
+	aead cipher.AEAD
+	// blobKey keys the HMAC naming the blobs of the address
+	blobKey  []byte
+	loadedAt time.Time
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Keyring seals contents with AES-256-GCM under the data key of their
+// address. It implements models.Cipher.
+type Keyring struct {
+	store   KeyStore
+	master  *masterKey
+	masters map[string]*masterKey
+
+	mu    sync.Mutex
+	cache map[uint]*dataKey
+}
+
+// NewKeyring creates a keyring wrapping new data keys with master; the
+// previous master keys still unwrap the keys they wrapped.
+func NewKeyring(store KeyStore, master []byte, previous ...[]byte) (*Keyring, error) {
+	current, err := newMasterKey(master)
+	if err != nil {
+		return nil, err
+	}
+	k := &Keyring{
+		store:   store,
+		master:  current,
+		masters: map[string]*masterKey{current.id: current},
+		cache:   make(map[uint]*dataKey),
+	}
+	for _, key := range previous {
+		m, err := newMasterKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("previous %w", err)
+		}
+		if _, ok := k.masters[m.id]; !ok {
+			k.masters[m.id] = m
+		}
+	}
+	return k, nil
+}
+
+// New creates the keyring described in the configuration.
+func New(cfg config.EncryptionConfig, db *gorm.DB) (*Keyring, error) {
+	// master_key_file is read by config.Load
+	if strings.TrimSpace(cfg.MasterKey) == "" {
+		return nil, errors.New("encryption master key is not configured")
+	}
+	master, err := decodeKey(cfg.MasterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	previous := make([][]byte, 0, len(cfg.PreviousMasterKeys))
+	for _, encoded := range cfg.PreviousMasterKeys {
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous master key: %w", err)
+		}
+		previous = append(previous, key)
+	}
+
+	store, err := NewKeyStore(cfg, db)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(store, master, previous...)
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+}
+
+// key returns the data key of an address, creating it if create is set.
+func (k *Keyring) key(emailID uint, create bool) (*dataKey, error) {
+	k.mu.Lock()
+	cached, ok := k.cache[emailID]
+	k.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < cacheTTL {
+		return cached, nil
+	}
+
+	row, err := k.store.Get(emailID)
+	if errors.Is(err, ErrKeyNotFound) && create {
+		row, err = k.create(k.store, emailID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	master, ok := k.masters[row.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("data key of address %d is wrapped by unknown master key %s", emailID, row.MasterKeyID)
+	}
+	raw, err := master.unwrap(emailID, row.Wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte(blobKeyLabel))
+	dk := &dataKey{aead: aead, blobKey: mac.Sum(nil), loadedAt: time.Now()}
+
+	k.mu.Lock()
+	if len(k.cache) >= cacheSize {
+		clear(k.cache)
+	}
+	k.cache[emailID] = dk
+	k.mu.Unlock()
+	return dk, nil
+}
+
+// create stores a new data key for an address. Another replica may create
+// one first, the stored key wins.
+func (k *Keyring) create(store KeyStore, emailID uint) (*models.DataKey, error) {
+	raw := make([]byte, keySize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	wrapped, err := k.master.wrap(emailID, raw)
+	if err != nil {
+		return nil, err
+	}
+	return store.Create(&models.DataKey{
+		EmailID:     emailID,
+		MasterKeyID: k.master.id,
+		Wrapped:     wrapped,
+	})
+}
+
+// CreateKey creates the data key of an address unless it has one. The
+// database store writes it in tx, which may be rolled back, so it is not
+// cached.
+func (k *Keyring) CreateKey(tx *gorm.DB, emailID uint) error {
+	store := k.store
+	if _, ok := store.(*DatabaseStore); ok {
+		store = NewDatabaseStore(tx)
+	}
+	if _, err := store.Get(emailID); !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	_, err := k.create(store, emailID)
+	return err
+}
+
+// EnsureKeys creates the data keys of the addresses that do not expire yet
+// and have none, as those created before encryption at rest was enabled, so
+// that contents are never stored while a key is being created.
+func (k *Keyring) EnsureKeys(db *gorm.DB) error {
+	var ids []uint
+	if err := db.Model(&models.EmailAddress{}).Where("expires_at > ?", time.Now()).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := k.CreateKey(db, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Keyring) Seal(emailID uint, plaintext []byte) ([]byte, error) {
+	dk, err := k.key(emailID, true)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := dk.aead.NonceSize()
+	out := make([]byte, headerSize+nonceSize, headerSize+nonceSize+len(plaintext)+dk.aead.Overhead())
+	copy(out, models.SealedMagic)
+	binary.BigEndian.PutUint64(out[len(models.SealedMagic):], uint64(emailID))
+	if _, err := rand.Read(out[headerSize:]); err != nil {
+		return nil, err
+	}
+	return dk.aead.Seal(out, out[headerSize:], plaintext, out[:headerSize]), nil
+}
+
+func (k *Keyring) Open(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < headerSize || !models.IsSealed(ciphertext) {
+		return nil, ErrInvalid
+	}
+	emailID := uint(binary.BigEndian.Uint64(ciphertext[len(models.SealedMagic):headerSize]))
+	dk, err := k.key(emailID, false)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil, fmt.Errorf("data key of address %d was shredded: %w", emailID, err)
+		}
+		return nil, err
+	}
+	nonceSize := dk.aead.NonceSize()
+	if len(ciphertext) < headerSize+nonceSize {
+		return nil, ErrInvalid
+	}
+	plaintext, err := dk.aead.Open(nil, ciphertext[headerSize:headerSize+nonceSize],
+		ciphertext[headerSize+nonceSize:], ciphertext[:headerSize])
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	return plaintext, nil
+}
+
+// BlobKey names the blob of a content with an HMAC under the data key of the
+// address, so that the key reveals nothing about the content to whoever
+// does not hold it.
+func (k *Keyring) BlobKey(emailID uint, content []byte) (string, error) {
+	dk, err := k.key(emailID, true)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, dk.blobKey)
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (k *Keyring) Shred(emailID uint) error {
+	k.mu.Lock()
+	delete(k.cache, emailID)
+	k.mu.Unlock()
+	return k.store.Delete(emailID)
+}
+
+// Rewrap wraps the data keys wrapped by previous master keys with the
+// current one and returns their number, so that the previous master keys
+// can be dropped.
+func (k *Keyring) Rewrap() (int, error) {
+	total := 0
+	for id, master := range k.masters {
+		if master == k.master {
+			continue
+		}
+		for {
+			rows, err := k.store.WrappedBy(id, rewrapBatch)
+			if err != nil {
+				return total, err
+			}
+			for _, row := range rows {
+				raw, err := master.unwrap(row.EmailID, row.Wrapped)
+				if err != nil {
+					return total, err
+				}
+				wrapped, err := k.master.wrap(row.EmailID, raw)
+				if err != nil {
+					return total, err
+				}
+				row.MasterKeyID = k.master.id
+				row.Wrapped = wrapped
+				if err := k.store.Update(row); err != nil {
+					return total, err
+				}
+				total++
+			}
+			if len(rows) < rewrapBatch {
+				break
+			}
+		}
+	}
+	return total, nil
+}
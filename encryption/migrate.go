@@ -0,0 +1,90 @@
+package encryption
+
+import (
+	"context"
+
+	"secmail/blob"
+	"secmail/models"
+
+	"gorm.io/gorm"
+)
+
+const migrateBatchSize = 100
+
+// EncryptExisting encrypts the messages stored before encryption at rest
+// was enabled, with their attachments. The plaintext blobs are released to
+// the next collection.
+func EncryptExisting(db *gorm.DB, blobs blob.Store) error {
+	if !models.Encrypting() {
+		return nil
+	}
+	ctx := context.Background()
+
+	encrypted := 0
+	for {
+		var messages []models.Message
+		if err := db.Unscoped().
+			Preload("Attachments").
+			Where("encrypted = ?", false).
+			Limit(migrateBatchSize).
+			Find(&messages).Error; err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			break
+		}
+		for i := range messages {
+			if err := encryptMessage(ctx, db, blobs, &messages[i]); err != nil {
+				return err
+			}
+			encrypted++
+		}
+	}
+	if encrypted > 0 {
+		log.Infof("Encrypted %d messages stored before encryption at rest was enabled", encrypted)
+	}
+	return nil
+}
+
+func encryptMessage(ctx context.Context, db *gorm.DB, blobs blob.Store, msg *models.Message) error {
+	// the key of an expired address may be missing, create it beforehand
+	if err := models.CreateKey(db, msg.EmailID); err != nil {
+		return err
+	}
+	var stored []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, a := range msg.Attachments {
+			content, err := blob.ReadAll(ctx, blobs, a.BlobKey)
+			if err != nil {
+				return err
+			}
+			key, isNew, err := blob.RefContent(ctx, tx, blobs, msg.EmailID, content)
+			if err != nil {
+				return err
+			}
+			if isNew {
+				stored = append(stored, key)
+			}
+			if err := blob.Unref(tx, map[string]int{a.BlobKey: 1}); err != nil {
+				return err
+			}
+			if err := tx.Model(&models.Attachment{}).Where("id = ?", a.ID).UpdateColumns(map[string]any{
+				"blob_key": key,
+				"hash":     blob.Hash(content),
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		// the serializer seals the contents
+		msg.Encrypted = true
+		return tx.Unscoped().Model(msg).
+			Select("content", "html_content", "raw", "encrypted").
+			UpdateColumns(msg).Error
+	})
+	if err != nil {
+		blob.Abandon(db, stored)
+		return err
+	}
+	return nil
+}
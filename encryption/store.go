@@ -0,0 +1,83 @@
+package encryption
+
+import (
+	"fmt"
+
+	"secmail/config"
+	"secmail/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// KeyStore keeps the wrapped data keys. Replicas have to share it.
+type KeyStore interface {
+	// Get returns the key of an address, ErrKeyNotFound if there is none.
+	Get(emailID uint) (*models.DataKey, error)
+	// Create stores a new key and returns the stored one, which is the
+	// existing key if another was stored first.
+	Create(key *models.DataKey) (*models.DataKey, error)
+	// Update replaces the wrapped key after a master key rotation.
+	Update(key *models.DataKey) error
+	// Delete removes the key of an address, it is not an error if there is
+	// none.
+	Delete(emailID uint) error
+	// WrappedBy returns up to limit keys wrapped by a master key.
+	WrappedBy(masterKeyID string, limit int) ([]*models.DataKey, error)
+}
+
+// NewKeyStore creates the store named in the configuration.
+func NewKeyStore(cfg config.EncryptionConfig, db *gorm.DB) (KeyStore, error) {
+	switch cfg.KeyStore {
+	case "", "database":
+		return NewDatabaseStore(db), nil
+	case "file":
+		return NewFileStore(cfg.KeyDir)
+	default:
+		return nil, fmt.Errorf("unknown key store: %s", cfg.KeyStore)
+	}
+}
+
+// DatabaseStore keeps keys in the data_keys table, shared by all replicas.
+type DatabaseStore struct {
+	db *gorm.DB
+}
+
+func NewDatabaseStore(db *gorm.DB) *DatabaseStore {
+	return &DatabaseStore{db: db}
+}
+
+func (s *DatabaseStore) Get(emailID uint) (*models.DataKey, error) {
+	var row models.DataKey
+	if err := s.db.Where("email_id = ?", emailID).First(&row).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (s *DatabaseStore) Create(key *models.DataKey) (*models.DataKey, error) {
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(key).Error; err != nil {
+		return nil, err
+	}
+	return s.Get(key.EmailID)
+}
+
+func (s *DatabaseStore) Update(key *models.DataKey) error {
+	return s.db.Model(&models.DataKey{}).Where("email_id = ?", key.EmailID).Updates(map[string]any{
+		"master_key_id": key.MasterKeyID,
+		"wrapped":       key.Wrapped,
+	}).Error
+}
+
+func (s *DatabaseStore) Delete(emailID uint) error {
+	return s.db.Where("email_id = ?", emailID).Delete(&models.DataKey{}).Error
+}
+
+func (s *DatabaseStore) WrappedBy(masterKeyID string, limit int) ([]*models.DataKey, error) {
+	var rows []*models.DataKey
+	err := s.db.Where("master_key_id = ?", masterKeyID).Order("email_id").Limit(limit).Find(&rows).Error
+	return rows, err
+}
@@ -0,0 +1,324 @@
+// Package filter evaluates the Sieve-like rules of an inbox against incoming
+// mail.
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	FieldFrom          = "from"
+	FieldSubject       = "subject"
+	FieldHeader        = "header"
+	FieldSize          = "size"
+	FieldHasAttachment = "has_attachment"
+
+	OpContains = "contains"
+	OpIs       = "is"
+	OpMatches  = "matches"
+	OpExists   = "exists"
+	OpOver     = "over"
+	OpUnder    = "under"
+
+	ActionDiscard  = "discard"
+	ActionReject   = "reject"
+	ActionLabel    = "label"
+	ActionMarkRead = "mark_read"
+	ActionStar     = "star"
+
+	MatchAll = "all"
+	MatchAny = "any"
+
+	MaxRules      = 50
+	maxConditions = 10
+	maxActions    = 10
+	maxLabelLen   = 64
+	// maxRejectMessageLen bounds the text of the SMTP reply refusing a
+	// message
+	maxRejectMessageLen = 200
+
+	defaultRejectCode    = 550
+	defaultRejectMessage = "Message rejected by the recipient's filter rules"
+)
+
+// Rule applies its actions to messages meeting all, or any, of its
+// conditions.
+type Rule struct {
+	Name string `json:"name,omitempty"`
+	// Match is "all" (default) or "any"
+	Match      string      `json:"match,omitempty"`
+	Conditions []Condition `json:"conditions"`
+	Actions    []Action    `json:"actions"`
+	// Stop skips the following rules when this one matches
+	Stop bool `json:"stop,omitempty"`
+}
+
+// Condition tests a field of a message:
+//
+//	from, subject, header: contains, is or matches (a regular expression)
+//	  Value; header also supports exists
+//	size: over or under Size bytes
+//	has_attachment: no operator
+//
+// Text comparisons ignore case. Not negates the condition.
+type Condition struct {
+	Field string `json:"field"`
+	// Header is the name of the header field tested by "header"
+	Header string `json:"header,omitempty"`
+	Op     string `json:"op,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Not    bool   `json:"not,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Action is discard, reject (with an SMTP Code and Message), label (with a
+// Label), mark_read or star. A rejected message is refused to the sender
+// when no other recipient of the transaction takes it, and otherwise only
+// kept out of the inbox.
+type Action struct {
+	Type    string `json:"type"`
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Label   string `json:"label,omitempty"`
+}
+
+// Message is what conditions are tested against.
+type Message struct {
+	// From holds the envelope sender and the addresses of the From header
+	From    []string
+	Subject string
+	// Header has canonical keys, as textproto.MIMEHeader and mail.Header
+	Header        map[string][]string
+	Size          int64
+	HasAttachment bool
+}
+
+type Reject struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Result is the combined outcome of the matching rules.
+type Result struct {
+	// Matched are the indices of the rules that matched
+	Matched []int    `json:"matched"`
+	Discard bool     `json:"discard"`
+	Reject  *Reject  `json:"reject,omitempty"`
+	Labels  []string `json:"labels"`
+	Seen    bool     `json:"seen"`
+	Flagged bool     `json:"flagged"`
+}
+
+// Parse decodes and validates stored rules. Empty data has no rules.
+func Parse(data string) ([]Rule, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var rules []Rule
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, err
+	}
+	return rules, Validate(rules)
+}
+
+// Validate checks rules and compiles their regular expressions.
+func Validate(rules []Rule) error {
+	if len(rules) > MaxRules {
+		return fmt.Errorf("at most %d rules are allowed", MaxRules)
+	}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) validate() error {
+	switch r.Match {
+	case "", MatchAll, MatchAny:
+	default:
+		return fmt.Errorf("unknown match %q", r.Match)
+	}
+	if len(r.Conditions) > maxConditions {
+		return fmt.Errorf("at most %d conditions are allowed", maxConditions)
+	}
+	if len(r.Actions) == 0 || len(r.Actions) > maxActions {
+		return fmt.Errorf("between 1 and %d actions are required", maxActions)
+	}
+	for i := range r.Conditions {
+		if err := r.Conditions[i].validate(); err != nil {
+			return fmt.Errorf("condition %d: %w", i+1, err)
+		}
+	}
+	for i := range r.Actions {
+		if err := r.Actions[i].validate(); err != nil {
+			return fmt.Errorf("action %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (c *Condition) validate() error {
+	switch c.Field {
+	case FieldFrom, FieldSubject, FieldHeader:
+		if c.Field == FieldHeader && c.Header == "" {
+			return errors.New("header name is required")
+		}
+		switch c.Op {
+		case OpContains, OpIs:
+		case OpMatches:
+			re, err := regexp.Compile("(?i)" + c.Value)
+			if err != nil {
+				return fmt.Errorf("invalid regular expression: %w", err)
+			}
+			c.re = re
+		case OpExists:
+			if c.Field != FieldHeader {
+				return fmt.Errorf("%s does not support exists", c.Field)
+			}
+		default:
+			return fmt.Errorf("unknown operator %q for %s", c.Op, c.Field)
+		}
+	case FieldSize:
+		if c.Op != OpOver && c.Op != OpUnder {
+			return fmt.Errorf("unknown operator %q for size", c.Op)
+		}
+	case FieldHasAttachment:
+	default:
+		return fmt.Errorf("unknown field %q", c.Field)
+	}
+	return nil
+}
+
+func (a *Action) validate() error {
+	switch a.Type {
+	case ActionDiscard, ActionMarkRead, ActionStar:
+	case ActionReject:
+		if a.Code != 0 && (a.Code < 500 || a.Code > 599) {
+			return errors.New("reject code must be a 5xx code")
+		}
+		// the message is the text of an SMTP reply: a line break would
+		// inject reply lines
+		if len(a.Message) > maxRejectMessageLen || strings.IndexFunc(a.Message, unicode.IsControl) >= 0 {
+			return fmt.Errorf("reject message must be at most %d bytes, without control characters", maxRejectMessageLen)
+		}
+	case ActionLabel:
+		if a.Label == "" || len(a.Label) > maxLabelLen || strings.ContainsAny(a.Label, ", \t\r\n") {
+			return errors.New("invalid label")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", a.Type)
+	}
+	return nil
+}
+
+func (c *Condition) matchText(s string) bool {
+	switch c.Op {
+	case OpContains:
+		return strings.Contains(strings.ToLower(s), strings.ToLower(c.Value))
+	case OpIs:
+		return strings.EqualFold(strings.TrimSpace(s), c.Value)
+	case OpMatches:
+		return c.re.MatchString(s)
+	}
+	return false
+}
+
+func (c *Condition) matchAny(values []string) bool {
+	for _, v := range values {
+		if c.matchText(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Condition) matches(m *Message) bool {
+	var ok bool
+	switch c.Field {
+	case FieldFrom:
+		ok = c.matchAny(m.From)
+	case FieldSubject:
+		ok = c.matchText(m.Subject)
+	case FieldHeader:
+		values := m.Header[textproto.CanonicalMIMEHeaderKey(c.Header)]
+		if c.Op == OpExists {
+			ok = len(values) > 0
+		} else {
+			ok = c.matchAny(values)
+		}
+	case FieldSize:
+		if c.Op == OpOver {
+			ok = m.Size > c.Size
+		} else {
+			ok = m.Size < c.Size
+		}
+	case FieldHasAttachment:
+		ok = m.HasAttachment
+	}
+	return ok != c.Not
+}
+
+// Matches reports whether a message meets the conditions of the rule. A
+// rule without conditions matches every message.
+func (r *Rule) Matches(m *Message) bool {
+	if len(r.Conditions) == 0 {
+		return true
+	}
+	anyOf := r.Match == MatchAny
+	for i := range r.Conditions {
+		if r.Conditions[i].matches(m) == anyOf {
+			return anyOf
+		}
+	}
+	return !anyOf
+}
+
+// Evaluate applies validated rules to a message, in order.
+func Evaluate(rules []Rule, m *Message) Result {
+	result := Result{Matched: []int{}, Labels: []string{}}
+	for i := range rules {
+		if !rules[i].Matches(m) {
+			continue
+		}
+		result.Matched = append(result.Matched, i)
+		for _, a := range rules[i].Actions {
+			switch a.Type {
+			case ActionDiscard:
+				result.Discard = true
+			case ActionReject:
+				if result.Reject == nil {
+					result.Reject = &Reject{Code: a.Code, Message: a.Message}
+					if result.Reject.Code == 0 {
+						result.Reject.Code = defaultRejectCode
+					}
+					if result.Reject.Message == "" {
+						result.Reject.Message = defaultRejectMessage
+					}
+				}
+			case ActionLabel:
+				if !slices.Contains(result.Labels, a.Label) {
+					result.Labels = append(result.Labels, a.Label)
+				}
+			case ActionMarkRead:
+				result.Seen = true
+			case ActionStar:
+				result.Flagged = true
+			}
+		}
+		if rules[i].Stop {
+			break
+		}
+	}
+	return result
+}
@@ -0,0 +1,128 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRaw = "From: News <news@shop.example>\r\n" +
+	"Subject: =?UTF-8?Q?Weekly_deals_=E2=82=AC?=\r\n" +
+	"List-Id: <deals.shop.example>\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func TestNewMessage(t *testing.T) {
+	m := NewMessage("bounce@shop.example", []byte(testRaw), true)
+	assert.Equal(t, []string{"bounce@shop.example", "news@shop.example"}, m.From)
+	assert.Equal(t, "Weekly deals €", m.Subject)
+	assert.Equal(t, []string{"<deals.shop.example>"}, m.Header["List-Id"])
+	assert.Equal(t, int64(len(testRaw)), m.Size)
+	assert.True(t, m.HasAttachment)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"empty", ``, false},
+		{"valid", `[{"conditions":[{"field":"from","op":"contains","value":"shop"}],"actions":[{"type":"discard"}]}]`, false},
+		{"no conditions", `[{"actions":[{"type":"star"}]}]`, false},
+		{"no actions", `[{"conditions":[{"field":"has_attachment"}],"actions":[]}]`, true},
+		{"unknown field", `[{"conditions":[{"field":"to","op":"is","value":"a"}],"actions":[{"type":"star"}]}]`, true},
+		{"unknown match", `[{"match":"none","actions":[{"type":"star"}]}]`, true},
+		{"header without name", `[{"conditions":[{"field":"header","op":"exists"}],"actions":[{"type":"star"}]}]`, true},
+		{"exists on subject", `[{"conditions":[{"field":"subject","op":"exists"}],"actions":[{"type":"star"}]}]`, true},
+		{"invalid regexp", `[{"conditions":[{"field":"subject","op":"matches","value":"("}],"actions":[{"type":"star"}]}]`, true},
+		{"size operator", `[{"conditions":[{"field":"size","op":"contains"}],"actions":[{"type":"star"}]}]`, true},
+		{"reject code", `[{"actions":[{"type":"reject","code":450}]}]`, true},
+		{"reject message", `[{"actions":[{"type":"reject","message":"Go away"}]}]`, false},
+		{"reject message with CRLF", `[{"actions":[{"type":"reject","message":"No\r\n250 OK"}]}]`, true},
+		{"reject message with tab", `[{"actions":[{"type":"reject","message":"No\tthanks"}]}]`, true},
+		{"long reject message", `[{"actions":[{"type":"reject","message":"` + strings.Repeat("a", 201) + `"}]}]`, true},
+		{"label with comma", `[{"actions":[{"type":"label","label":"a,b"}]}]`, true},
+		{"not json", `{`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.data)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	m := NewMessage("bounce@shop.example", []byte(testRaw), false)
+
+	tests := []struct {
+		name string
+		data string
+		want Result
+	}{
+		{
+			"no rules",
+			``,
+			Result{Matched: []int{}, Labels: []string{}},
+		},
+		{
+			"from contains",
+			`[{"conditions":[{"field":"from","op":"contains","value":"@SHOP.example"}],"actions":[{"type":"discard"}]}]`,
+			Result{Matched: []int{0}, Discard: true, Labels: []string{}},
+		},
+		{
+			"subject matches",
+			`[{"conditions":[{"field":"subject","op":"matches","value":"^weekly"}],"actions":[{"type":"label","label":"deals"},{"type":"mark_read"}]}]`,
+			Result{Matched: []int{0}, Labels: []string{"deals"}, Seen: true},
+		},
+		{
+			"header exists",
+			`[{"conditions":[{"field":"header","header":"list-id","op":"exists"}],"actions":[{"type":"star"}]}]`,
+			Result{Matched: []int{0}, Labels: []string{}, Flagged: true},
+		},
+		{
+			"not",
+			`[{"conditions":[{"field":"has_attachment","not":true}],"actions":[{"type":"star"}]}]`,
+			Result{Matched: []int{0}, Labels: []string{}, Flagged: true},
+		},
+		{
+			"all conditions",
+			`[{"conditions":[{"field":"size","op":"under","size":10},{"field":"from","op":"contains","value":"shop"}],"actions":[{"type":"star"}]}]`,
+			Result{Matched: []int{}, Labels: []string{}},
+		},
+		{
+			"any condition",
+			`[{"match":"any","conditions":[{"field":"size","op":"under","size":10},{"field":"from","op":"is","value":"news@shop.example"}],"actions":[{"type":"star"}]}]`,
+			Result{Matched: []int{0}, Labels: []string{}, Flagged: true},
+		},
+		{
+			"reject default",
+			`[{"conditions":[{"field":"size","op":"over","size":10}],"actions":[{"type":"reject"}]}]`,
+			Result{Matched: []int{0}, Reject: &Reject{Code: 550, Message: defaultRejectMessage}, Labels: []string{}},
+		},
+		{
+			"stop",
+			`[{"actions":[{"type":"label","label":"a"}],"stop":true},{"actions":[{"type":"label","label":"b"}]}]`,
+			Result{Matched: []int{0}, Labels: []string{"a"}},
+		},
+		{
+			"labels are unique",
+			`[{"actions":[{"type":"label","label":"a"}]},{"actions":[{"type":"label","label":"a"},{"type":"reject","code":554,"message":"No"}]}]`,
+			Result{Matched: []int{0, 1}, Reject: &Reject{Code: 554, Message: "No"}, Labels: []string{"a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := Parse(tt.data)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, Evaluate(rules, m))
+		})
+	}
+}
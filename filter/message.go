@@ -0,0 +1,37 @@
+package filter
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+)
+
+// NewMessage describes a message for the rules from its source and
+// envelope sender.
+func NewMessage(sender string, raw []byte, hasAttachment bool) *Message {
+	m := &Message{
+		Header:        map[string][]string{},
+		Size:          int64(len(raw)),
+		HasAttachment: hasAttachment,
+	}
+	if sender != "" {
+		m.From = append(m.From, sender)
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return m
+	}
+	m.Header = parsed.Header
+	if addrs, err := parsed.Header.AddressList("From"); err == nil {
+		for _, a := range addrs {
+			m.From = append(m.From, a.Address)
+		}
+	}
+	subject := parsed.Header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	m.Subject = subject
+	return m
+}
@@ -0,0 +1,135 @@
+package imap
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"secmail/audit"
+	"secmail/blob"
+	"secmail/models"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"gorm.io/gorm"
+)
+
+const inboxName = "INBOX"
+
+var errReadOnlyMailboxes = errors.New("mailboxes can't be created, deleted or renamed")
+
+// Backend logs in with the temporary address as username and its access
+// token as password. Every address has a single INBOX.
+type Backend struct {
+	db    *gorm.DB
+	audit *audit.Recorder
+	blobs blob.Store
+}
+
+func NewBackend(db *gorm.DB, recorder *audit.Recorder, blobs blob.Store) *Backend {
+	return &Backend{db: db, audit: recorder, blobs: blobs}
+}
+
+func (b *Backend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	var addr models.EmailAddress
+	if err := b.db.Where("address = ? AND expires_at > ?", strings.ToLower(username), time.Now()).
+		First(&addr).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Errorf("Database error: %+v", err)
+		}
+		return nil, backend.ErrInvalidCredentials
+	}
+	if !addr.CheckAccessToken(password) {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	if err := assignMissingUIDs(b.db, addr.ID); err != nil {
+		log.Errorf("Failed to assign UIDs for %s: %v", addr.Address, err)
+		return nil, err
+	}
+
+	ip := remoteIP(connInfo)
+	b.audit.Record(models.AuditLog{
+		EmailID:      addr.ID,
+		EmailAddress: addr.Address,
+		Action:       models.AuditActionAccess,
+		IP:           ip,
+		Detail:       "imap login",
+	})
+
+	return &User{backend: b, address: addr, ip: ip}, nil
+}
+
+// remoteIP is the client IP of a connection, without the port.
+func remoteIP(connInfo *imap.ConnInfo) string {
+	if connInfo == nil || connInfo.RemoteAddr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(connInfo.RemoteAddr.String())
+	if err != nil {
+		return connInfo.RemoteAddr.String()
+	}
+	return host
+}
+
+// assignMissingUIDs numbers messages stored before UIDs were introduced.
+func assignMissingUIDs(db *gorm.DB, emailID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var messages []models.Message
+		if err := tx.Unscoped().Select("id").Where("email_id = ? AND uid = 0", emailID).
+			Order("created_at").Find(&messages).Error; err != nil || len(messages) == 0 {
+			return err
+		}
+
+		uid, err := models.AllocateUIDs(tx, emailID, len(messages))
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			if err := tx.Unscoped().Model(&m).UpdateColumn("uid", uid).Error; err != nil {
+				return err
+			}
+			uid++
+		}
+		return nil
+	})
+}
+
+type User struct {
+	backend *Backend
+	address models.EmailAddress
+	// ip is the client IP of the session, for the audit log
+	ip string
+}
+
+func (u *User) Username() string {
+	return u.address.Address
+}
+
+func (u *User) ListMailboxes(_ bool) ([]backend.Mailbox, error) {
+	return []backend.Mailbox{&Mailbox{user: u}}, nil
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	if !strings.EqualFold(name, inboxName) {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return &Mailbox{user: u}, nil
+}
+
+func (u *User) CreateMailbox(_ string) error {
+	return errReadOnlyMailboxes
+}
+
+func (u *User) DeleteMailbox(_ string) error {
+	return errReadOnlyMailboxes
+}
+
+func (u *User) RenameMailbox(_, _ string) error {
+	return errReadOnlyMailboxes
+}
+
+func (u *User) Logout() error {
+	return nil
+}
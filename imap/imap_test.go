@@ -0,0 +1,171 @@
+package imap
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/audit"
+	"secmail/blob"
+	"secmail/config"
+	"secmail/database/databasetest"
+	"secmail/models"
+)
+
+const testRaw = "From: sender@example.com\r\n" +
+	"To: abcd123456@test.com\r\n" +
+	"Subject: Hello IMAP\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your code is 123456\r\n"
+
+func setupTestServer(t *testing.T) (*gorm.DB, *client.Client, string) {
+	db := databasetest.Open(t)
+
+	email := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	token, err := email.NewAccessToken()
+	require.NoError(t, err)
+	require.NoError(t, db.Create(&email).Error)
+
+	// one message received over SMTP and one stored before raw sources were kept
+	require.NoError(t, db.Create(&models.Message{EmailID: email.ID, From: "sender@example.com", Subject: "Hello IMAP", Raw: []byte(testRaw)}).Error)
+	require.NoError(t, db.Create(&models.Message{ID: uuid.New(), EmailID: email.ID, From: "other@example.com", Subject: "Legacy", Content: "old body"}).Error)
+	require.NoError(t, db.Model(&models.Message{}).Where("subject = ?", "Legacy").Update("uid", 0).Error)
+	require.NoError(t, db.Model(&email).Update("last_uid", 1).Error)
+
+	recorder := audit.NewRecorder(db, config.AuditConfig{FlushInterval: 10 * time.Millisecond})
+	t.Cleanup(recorder.Close)
+	s := server.New(NewBackend(db, recorder, blob.NewMemoryStore()))
+	s.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c, err := client.Dial(l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Logout() })
+
+	return db, c, token
+}
+
+func TestLogin(t *testing.T) {
+	_, c, _ := setupTestServer(t)
+	assert.Error(t, c.Login("abcd123456@test.com", "wrong"))
+	assert.Error(t, c.Login("unknown123@test.com", "wrong"))
+}
+
+func TestFetchAndFlags(t *testing.T) {
+	db, c, token := setupTestServer(t)
+	require.NoError(t, c.Login("abcd123456@test.com", token))
+
+	mbox, err := c.Select("INBOX", false)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), mbox.Messages)
+
+	// the legacy message got the next UID
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 2)
+	section := &imap.BodySectionName{}
+	ch := make(chan *imap.Message, 2)
+	require.NoError(t, c.Fetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, section.FetchItem()}, ch))
+
+	var fetched []*imap.Message
+	for m := range ch {
+		fetched = append(fetched, m)
+	}
+	require.Len(t, fetched, 2)
+	assert.Equal(t, uint32(1), fetched[0].Uid)
+	assert.Equal(t, uint32(2), fetched[1].Uid)
+	assert.Equal(t, "Hello IMAP", fetched[0].Envelope.Subject)
+	assert.Equal(t, "Legacy", fetched[1].Envelope.Subject)
+	body, err := io.ReadAll(fetched[0].GetBody(section))
+	require.NoError(t, err)
+	assert.Equal(t, testRaw, string(body))
+
+	// fetching the body marked the messages as seen
+	var unseen int64
+	db.Model(&models.Message{}).Where("seen = ?", false).Count(&unseen)
+	assert.Equal(t, int64(0), unseen)
+
+	// search
+	criteria := imap.NewSearchCriteria()
+	criteria.Body = []string{"123456"}
+	ids, err := c.UidSearch(criteria)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1}, ids)
+
+	// flag and expunge the first message
+	seqSet = new(imap.SeqSet)
+	seqSet.AddNum(1)
+	require.NoError(t, c.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true),
+		[]interface{}{imap.FlaggedFlag, imap.DeletedFlag}, nil))
+
+	var msg models.Message
+	db.Where("uid = ?", 1).First(&msg)
+	assert.True(t, msg.Flagged)
+	assert.True(t, msg.DeletedFlag)
+
+	require.NoError(t, c.Expunge(nil))
+
+	var count int64
+	db.Model(&models.Message{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	// the login and the deletion are audited with the client IP alone
+	var logs []models.AuditLog
+	require.Eventually(t, func() bool {
+		db.Where("action IN ?", []string{models.AuditActionAccess, models.AuditActionDeleteMessage}).
+			Order("id").Find(&logs)
+		return len(logs) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, models.AuditActionAccess, logs[0].Action)
+	assert.Equal(t, "127.0.0.1", logs[0].IP)
+	assert.Equal(t, models.AuditActionDeleteMessage, logs[1].Action)
+	assert.Equal(t, "127.0.0.1", logs[1].IP)
+	assert.Equal(t, "imap", logs[1].Detail)
+	require.NotNil(t, logs[1].MessageID)
+	assert.Equal(t, msg.ID, *logs[1].MessageID)
+}
+
+func TestConcurrentUIDs(t *testing.T) {
+	db := databasetest.Open(t)
+	email := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&email).Error)
+
+	const deliveries = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, deliveries)
+	for i := 0; i < deliveries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.Create(&models.Message{EmailID: email.ID, Subject: "Hello"}).Error
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	var uids []uint32
+	require.NoError(t, db.Model(&models.Message{}).Order("uid").Pluck("uid", &uids).Error)
+	require.Len(t, uids, deliveries)
+	for i, uid := range uids {
+		assert.Equal(t, uint32(i+1), uid)
+	}
+	next, err := models.NextUID(db, email.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(deliveries+1), next)
+}
@@ -0,0 +1,347 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"secmail/blob"
+	"secmail/models"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	errExpired        = errors.New("address has expired")
+	errNotSupported   = errors.New("only INBOX exists, messages can't be copied or appended")
+	permanentFlags    = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}
+	flagsOnlyFetchSet = map[imap.FetchItem]bool{
+		imap.FetchFlags:        true,
+		imap.FetchUid:          true,
+		imap.FetchInternalDate: true,
+	}
+)
+
+// Mailbox is the INBOX of a temporary address, backed by the messages table.
+// Sequence numbers are the position of a message in UID order.
+type Mailbox struct {
+	user *User
+}
+
+func (mbox *Mailbox) db() *gorm.DB {
+	return mbox.user.backend.db
+}
+
+func (mbox *Mailbox) Name() string {
+	return inboxName
+}
+
+func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{
+		Attributes: []string{imap.NoInferiorsAttr},
+		Delimiter:  "/",
+		Name:       inboxName,
+	}, nil
+}
+
+// messages loads the messages of the inbox in UID order. Bodies are only
+// loaded when withBody is set.
+func (mbox *Mailbox) messages(withBody bool) ([]models.Message, error) {
+	var addr models.EmailAddress
+	if err := mbox.db().Select("expires_at").First(&addr, mbox.user.address.ID).Error; err != nil {
+		return nil, err
+	}
+	if time.Now().After(addr.ExpiresAt) {
+		return nil, errExpired
+	}
+
+	query := mbox.db().Where("email_id = ?", mbox.user.address.ID).Order("uid")
+	if withBody {
+		query = query.Preload("Attachments")
+	} else {
+		query = query.Select("id", "email_id", "uid", "seen", "flagged", "deleted_flag", "created_at")
+	}
+
+	var messages []models.Message
+	err := query.Find(&messages).Error
+	return messages, err
+}
+
+func (mbox *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	messages, err := mbox.messages(false)
+	if err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus(inboxName, items)
+	status.Flags = permanentFlags
+	status.PermanentFlags = permanentFlags
+	for i, m := range messages {
+		if !m.Seen && status.UnseenSeqNum == 0 {
+			status.UnseenSeqNum = uint32(i + 1)
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(messages))
+		case imap.StatusUidNext:
+			uid, err := models.NextUID(mbox.db(), mbox.user.address.ID)
+			if err != nil {
+				return nil, err
+			}
+			status.UidNext = uid
+		case imap.StatusUidValidity:
+			status.UidValidity = mbox.user.address.UIDValidity()
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			for _, m := range messages {
+				if !m.Seen {
+					status.Unseen++
+				}
+			}
+		}
+	}
+	return status, nil
+}
+
+func (mbox *Mailbox) SetSubscribed(_ bool) error {
+	return nil
+}
+
+func (mbox *Mailbox) Check() error {
+	return nil
+}
+
+func needsBody(items []imap.FetchItem) bool {
+	for _, item := range items {
+		if !flagsOnlyFetchSet[item] {
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	messages, err := mbox.messages(needsBody(items))
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		m := &messages[i]
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = m.UID
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		fetched, err := mbox.fetch(m, seqNum, items)
+		if err != nil {
+			log.Warnf("Failed to fetch message %s: %v", m.ID, err)
+			continue
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+func (mbox *Mailbox) fetch(m *models.Message, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	var source []byte
+	if needsBody(items) {
+		var err error
+		if source, err = blob.Source(context.Background(), mbox.user.backend.blobs, m, mbox.user.address.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, err := readHeader(source)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, err := readHeader(source)
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = flags(m)
+		case imap.FetchInternalDate:
+			fetched.InternalDate = m.CreatedAt
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(source))
+		case imap.FetchUid:
+			fetched.Uid = m.UID
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			hdr, body, err := readHeader(source)
+			if err != nil {
+				return nil, err
+			}
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+
+			// fetching a body without PEEK marks the message as seen
+			if !section.Peek && !m.Seen {
+				if err := mbox.db().Model(m).Update("seen", true).Error; err != nil {
+					return nil, err
+				}
+				m.Seen = true
+			}
+		}
+	}
+	return fetched, nil
+}
+
+func readHeader(source []byte) (textproto.Header, *bufio.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(source))
+	hdr, err := textproto.ReadHeader(body)
+	return hdr, body, err
+}
+
+func flags(m *models.Message) []string {
+	var f []string
+	if m.Seen {
+		f = append(f, imap.SeenFlag)
+	}
+	if m.Flagged {
+		f = append(f, imap.FlaggedFlag)
+	}
+	if m.DeletedFlag {
+		f = append(f, imap.DeletedFlag)
+	}
+	return f
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	messages, err := mbox.messages(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for i := range messages {
+		m := &messages[i]
+		seqNum := uint32(i + 1)
+
+		source, err := blob.Source(context.Background(), mbox.user.backend.blobs, m, mbox.user.address.Address)
+		if err != nil {
+			log.Warnf("Failed to build source of message %s: %v", m.ID, err)
+			continue
+		}
+		e, err := message.Read(bytes.NewReader(source))
+		if err != nil && !message.IsUnknownCharset(err) {
+			continue
+		}
+		ok, err := backendutil.Match(e, seqNum, m.UID, m.CreatedAt, flags(m), criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		if uid {
+			ids = append(ids, m.UID)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return ids, nil
+}
+
+func (mbox *Mailbox) CreateMessage(_ []string, _ time.Time, _ imap.Literal) error {
+	return errNotSupported
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, newFlags []string) error {
+	messages, err := mbox.messages(false)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		m := &messages[i]
+		id := uint32(i + 1)
+		if uid {
+			id = m.UID
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		updated := backendutil.UpdateFlags(flags(m), op, newFlags)
+		if err := mbox.db().Model(m).Updates(map[string]any{
+			"seen":         hasFlag(updated, imap.SeenFlag),
+			"flagged":      hasFlag(updated, imap.FlaggedFlag),
+			"deleted_flag": hasFlag(updated, imap.DeletedFlag),
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *Mailbox) CopyMessages(_ bool, _ *imap.SeqSet, _ string) error {
+	return errNotSupported
+}
+
+// Expunge deletes the messages flagged \Deleted, like DELETE /api/message/:id.
+func (mbox *Mailbox) Expunge() error {
+	var ids []uuid.UUID
+	err := mbox.db().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Message{}).
+			Where("email_id = ? AND deleted_flag = ?", mbox.user.address.ID, true).
+			Pluck("id", &ids).Error; err != nil || len(ids) == 0 {
+			return err
+		}
+		if err := blob.DeleteAttachments(tx, ids); err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.Message{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range ids {
+		mbox.user.backend.audit.Record(models.AuditLog{
+			EmailID:      mbox.user.address.ID,
+			EmailAddress: mbox.user.address.Address,
+			MessageID:    &ids[i],
+			Action:       models.AuditActionDeleteMessage,
+			IP:           mbox.user.ip,
+			Detail:       "imap",
+		})
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package imap
+
+import (
+	"fmt"
+
+	"secmail/audit"
+	"secmail/blob"
+	"secmail/config"
+
+	"github.com/emersion/go-imap/server"
+	"github.com/kuun/slog"
+	"gorm.io/gorm"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+func createIMAPServer(be *Backend) (*server.Server, error) {
+	s := server.New(be)
+	s.AllowInsecureAuth = config.GlobalConfig.IMAP.AllowInsecureAuth
+
+	tlsConfig, err := config.GlobalConfig.SMTP.LoadTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	s.TLSConfig = tlsConfig
+
+	return s, nil
+}
+
+// NewIMAPServer creates the configured IMAP server.
+func NewIMAPServer(db *gorm.DB, recorder *audit.Recorder, blobs blob.Store) (*server.Server, error) {
+	be := NewBackend(db, recorder, blobs)
+	server, err := createIMAPServer(be)
+	if err != nil {
+		return nil, err
+	}
+	server.Addr = fmt.Sprintf("%s:%d",
+		config.GlobalConfig.IMAP.Host,
+		config.GlobalConfig.IMAP.Port)
+
+	log.Infof("Starting IMAP server at %s (STARTTLS: %v)",
+		server.Addr,
+		server.TLSConfig != nil)
+	return server, nil
+}
@@ -0,0 +1,305 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Invocation is a method call or response: [name, arguments, call id].
+type Invocation struct {
+	Name   string
+	Args   any
+	CallID string
+}
+
+func (inv Invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{inv.Name, inv.Args, inv.CallID})
+}
+
+func (inv *Invocation) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return errors.New("invocation must have 3 elements")
+	}
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(raw[1], &args); err != nil || args == nil {
+		return errors.New("invocation arguments must be an object")
+	}
+	inv.Args = args
+	if err := json.Unmarshal(raw[0], &inv.Name); err != nil {
+		return err
+	}
+	return json.Unmarshal(raw[2], &inv.CallID)
+}
+
+type Request struct {
+	Using       []string     `json:"using"`
+	MethodCalls []Invocation `json:"methodCalls"`
+}
+
+type Response struct {
+	MethodResponses []Invocation `json:"methodResponses"`
+	SessionState    string       `json:"sessionState"`
+}
+
+// MethodError is returned in place of a method response (RFC 8620 section 3.6.2).
+type MethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *MethodError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func invalidArguments(format string, args ...any) *MethodError {
+	return &MethodError{Type: "invalidArguments", Description: fmt.Sprintf(format, args...)}
+}
+
+func serverFail(err error) *MethodError {
+	log.Errorf("JMAP method failed: %v", err)
+	return &MethodError{Type: "serverFail"}
+}
+
+// call is the context of a method call.
+type call struct {
+	c       *gin.Context
+	db      *gorm.DB
+	account *models.EmailAddress
+}
+
+// checkAccount validates the accountId argument of a method.
+func (cl *call) checkAccount(id string) *MethodError {
+	if id != accountID(cl.account) {
+		return &MethodError{Type: "accountNotFound"}
+	}
+	return nil
+}
+
+type method func(cl *call, args json.RawMessage) (any, *MethodError)
+
+var methods = map[string]method{
+	"Core/echo": func(_ *call, args json.RawMessage) (any, *MethodError) {
+		return args, nil
+	},
+	"Mailbox/get":     mailboxGet,
+	"Mailbox/changes": mailboxChanges,
+	"Email/get":       emailGet,
+	"Email/query":     emailQuery,
+	"Email/set":       emailSet,
+	"Email/changes":   emailChanges,
+}
+
+// problem writes a request level error (RFC 8620 section 3.6.1).
+func problem(c *gin.Context, errType, detail string) {
+	c.Header("Content-Type", "application/problem+json")
+	c.JSON(http.StatusBadRequest, gin.H{
+		"type":   "urn:ietf:params:jmap:error:" + errType,
+		"status": http.StatusBadRequest,
+		"detail": detail,
+	})
+}
+
+// HandleAPI processes a JMAP request (RFC 8620 section 3.3).
+func HandleAPI(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSizeRequest+1))
+	if err != nil {
+		problem(c, "notRequest", "Failed to read request")
+		return
+	}
+	if len(body) > maxSizeRequest {
+		problem(c, "limit", "maxSizeRequest")
+		return
+	}
+	if !json.Valid(body) {
+		problem(c, "notJSON", "Request is not valid JSON")
+		return
+	}
+
+	var req Request
+	if err := json.Unmarshal(body, &req); err != nil || req.Using == nil || req.MethodCalls == nil {
+		problem(c, "notRequest", "Request does not match the Request object")
+		return
+	}
+	for _, capability := range req.Using {
+		if capability != CapabilityCore && capability != CapabilityMail {
+			problem(c, "unknownCapability", "Unknown capability "+capability)
+			return
+		}
+	}
+	if len(req.MethodCalls) > maxCallsInRequest {
+		problem(c, "limit", "maxCallsInRequest")
+		return
+	}
+
+	cl := &call{
+		c:       c,
+		db:      c.MustGet("db").(*gorm.DB),
+		account: currentAccount(c),
+	}
+	resp := Response{
+		MethodResponses: make([]Invocation, 0, len(req.MethodCalls)),
+		SessionState:    sessionState(cl.account),
+	}
+
+	for _, inv := range req.MethodCalls {
+		result, merr := dispatch(cl, &req, inv, resp.MethodResponses)
+		if merr != nil {
+			resp.MethodResponses = append(resp.MethodResponses, Invocation{"error", merr, inv.CallID})
+			continue
+		}
+		resp.MethodResponses = append(resp.MethodResponses, Invocation{inv.Name, result, inv.CallID})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func dispatch(cl *call, req *Request, inv Invocation, responses []Invocation) (any, *MethodError) {
+	m, ok := methods[inv.Name]
+	if !ok || (inv.Name != "Core/echo" && !slices.Contains(req.Using, CapabilityMail)) {
+		return nil, &MethodError{Type: "unknownMethod"}
+	}
+
+	args, merr := resolveReferences(inv.Args.(map[string]json.RawMessage), responses)
+	if merr != nil {
+		return nil, merr
+	}
+	return m(cl, args)
+}
+
+// resultReference points into the response of a previous method call.
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// resolveReferences replaces the "#name" arguments with the values they
+// reference (RFC 8620 section 3.7).
+func resolveReferences(args map[string]json.RawMessage, responses []Invocation) (json.RawMessage, *MethodError) {
+	resolved := make(map[string]json.RawMessage, len(args))
+	for name, value := range args {
+		refName, isRef := strings.CutPrefix(name, "#")
+		if !isRef {
+			resolved[name] = value
+			continue
+		}
+		if _, ok := args[refName]; ok {
+			return nil, invalidArguments("both %s and #%s are given", refName, refName)
+		}
+
+		var ref resultReference
+		if err := json.Unmarshal(value, &ref); err != nil {
+			return nil, &MethodError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		v, err := evaluateReference(ref, responses)
+		if err != nil {
+			return nil, &MethodError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		resolved[refName] = v
+	}
+
+	data, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+	return data, nil
+}
+
+func evaluateReference(ref resultReference, responses []Invocation) (json.RawMessage, error) {
+	for _, resp := range responses {
+		if resp.CallID != ref.ResultOf {
+			continue
+		}
+		if resp.Name != ref.Name {
+			return nil, fmt.Errorf("%s is not a response of %s", ref.ResultOf, ref.Name)
+		}
+
+		data, err := json.Marshal(resp.Args)
+		if err != nil {
+			return nil, err
+		}
+		var value any
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		value, err = evaluatePointer(value, ref.Path)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	}
+	return nil, fmt.Errorf("no response for %s", ref.ResultOf)
+}
+
+// evaluatePointer evaluates a JSON pointer where "*" maps over an array,
+// flattening arrays of arrays.
+func evaluatePointer(value any, path string) (any, error) {
+	if path == "" {
+		return value, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid path %q", path)
+	}
+	token, rest, _ := strings.Cut(path[1:], "/")
+	if rest != "" || strings.HasSuffix(path, "/") {
+		rest = "/" + rest
+	}
+	token = unescapePointer(token)
+
+	switch v := value.(type) {
+	case map[string]any:
+		child, ok := v[token]
+		if !ok {
+			return nil, fmt.Errorf("property %q not found", token)
+		}
+		return evaluatePointer(child, rest)
+	case []any:
+		if token == "*" {
+			result := []any{}
+			for _, item := range v {
+				child, err := evaluatePointer(item, rest)
+				if err != nil {
+					return nil, err
+				}
+				if list, ok := child.([]any); ok {
+					result = append(result, list...)
+				} else {
+					result = append(result, child)
+				}
+			}
+			return result, nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, fmt.Errorf("invalid index %q", token)
+		}
+		return evaluatePointer(v[i], rest)
+	}
+	return nil, fmt.Errorf("can't evaluate %q", path)
+}
+
+// decodeArgs decodes method arguments, rejecting unknown ones.
+func decodeArgs(args json.RawMessage, v any) *MethodError {
+	dec := json.NewDecoder(bytes.NewReader(args))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return invalidArguments("%v", err)
+	}
+	return nil
+}
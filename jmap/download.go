@@ -0,0 +1,81 @@
+package jmap
+
+import (
+	"net/http"
+
+	"secmail/audit"
+	"secmail/blob"
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Download returns the source of a message, or an attachment, of the account.
+func Download(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	addr := currentAccount(c)
+
+	if c.Param("accountId") != accountID(addr) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	blobID, err := uuid.Parse(c.Param("blobId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Blob not found"})
+		return
+	}
+
+	// the type parameter of the download URL is ignored: the content is
+	// served with the type it was stored with, never sniffed
+	c.Header("Content-Disposition", "attachment; filename="+c.Param("name"))
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	var message models.Message
+	err = db.Preload("Attachments").Where("id = ? AND email_id = ?", blobID, addr.ID).First(&message).Error
+	if err == nil {
+		source, err := blob.Source(c.Request.Context(), c.MustGet("blobs").(blob.Store), &message, addr.Address)
+		if err != nil {
+			log.Errorf("Failed to build source of message %s: %v", message.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build message"})
+			return
+		}
+		c.Data(http.StatusOK, "message/rfc822", source)
+		return
+	}
+	if err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var attachment models.Attachment
+	if err := db.Joins("JOIN messages ON messages.id = attachments.message_id").
+		Where("attachments.id = ? AND messages.email_id = ? AND messages.deleted_at IS NULL", blobID, addr.ID).
+		First(&attachment).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Blob not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	audit.RecordRequest(c, models.AuditLog{
+		MessageID: &attachment.MessageID,
+		Action:    models.AuditActionAccess,
+		Detail:    "download attachment " + attachment.ID.String(),
+	})
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	r, err := blob.OpenAttachment(c.Request.Context(), c.MustGet("blobs").(blob.Store), &attachment)
+	if err != nil {
+		log.Errorf("Failed to open attachment %s: %v", attachment.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read blob"})
+		return
+	}
+	defer r.Close()
+	c.DataFromReader(http.StatusOK, attachment.Size, contentType, r, nil)
+}
@@ -0,0 +1,476 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"secmail/audit"
+	"secmail/blob"
+	"secmail/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const previewLength = 256
+
+// keywordColumns maps the supported keywords to message columns.
+var keywordColumns = map[string]string{
+	"$seen":    "seen",
+	"$flagged": "flagged",
+}
+
+func keywords(m *models.Message) map[string]bool {
+	kw := map[string]bool{}
+	if m.Seen {
+		kw["$seen"] = true
+	}
+	if m.Flagged {
+		kw["$flagged"] = true
+	}
+	return kw
+}
+
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+// addressList parses an address header, nil if it is missing.
+func addressList(header mail.Header, name string) []emailAddress {
+	list, err := header.AddressList(name)
+	if err != nil || len(list) == 0 {
+		return nil
+	}
+	addrs := make([]emailAddress, len(list))
+	for i, a := range list {
+		addrs[i] = emailAddress{Email: a.Address}
+		if a.Name != "" {
+			addrs[i].Name = &list[i].Name
+		}
+	}
+	return addrs
+}
+
+// messageIDs parses a list of message ids, nil if the header is missing.
+func messageIDs(header mail.Header, name string) []string {
+	var ids []string
+	for _, field := range strings.Fields(header.Get(name)) {
+		ids = append(ids, strings.Trim(field, "<>"))
+	}
+	return ids
+}
+
+func preview(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) <= previewLength {
+		return text
+	}
+	text = text[:previewLength]
+	for !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+	return text
+}
+
+// pick keeps the requested properties of an object.
+func pick(obj map[string]any, properties *[]string) map[string]any {
+	if properties == nil {
+		return obj
+	}
+	picked := map[string]any{}
+	for _, p := range *properties {
+		if v, ok := obj[p]; ok {
+			picked[p] = v
+		}
+	}
+	return picked
+}
+
+func bodyValue(value string, maxBytes int) map[string]any {
+	truncated := false
+	if maxBytes > 0 && len(value) > maxBytes {
+		value = value[:maxBytes]
+		for !utf8.ValidString(value) {
+			value = value[:len(value)-1]
+		}
+		truncated = true
+	}
+	return map[string]any{
+		"value":             value,
+		"isEncodingProblem": false,
+		"isTruncated":       truncated,
+	}
+}
+
+// email converts a message to a JMAP Email object (RFC 8621 section 4.1).
+// The header fields come from the source of the message, the bodies from the
+// parsed parts stored on delivery.
+func email(m *models.Message, address string, args *getArgs) (map[string]any, error) {
+	source, err := m.Source(address)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	header := msg.Header
+
+	from := addressList(header, "From")
+	if from == nil && m.From != "" {
+		from = []emailAddress{{Email: m.From}}
+	}
+	var sentAt any
+	if date, err := header.Date(); err == nil {
+		sentAt = date.UTC().Format(time.RFC3339)
+	}
+
+	part := func(partID, contentType, content string) map[string]any {
+		return pick(map[string]any{
+			"partId":      partID,
+			"blobId":      nil,
+			"size":        len(content),
+			"name":        nil,
+			"type":        contentType,
+			"charset":     "utf-8",
+			"disposition": nil,
+			"cid":         nil,
+			"language":    nil,
+			"location":    nil,
+		}, args.BodyProperties)
+	}
+	textBody := []map[string]any{part("text", "text/plain", m.Content)}
+	htmlBody := textBody
+	if m.HTMLContent != "" {
+		htmlBody = []map[string]any{part("html", "text/html", m.HTMLContent)}
+	}
+
+	bodyValues := map[string]any{}
+	if args.FetchTextBodyValues || args.FetchAllBodyValues {
+		bodyValues["text"] = bodyValue(m.Content, args.MaxBodyValueBytes)
+	}
+	if (args.FetchHTMLBodyValues || args.FetchAllBodyValues) && m.HTMLContent != "" {
+		bodyValues["html"] = bodyValue(m.HTMLContent, args.MaxBodyValueBytes)
+	}
+	if args.FetchHTMLBodyValues && m.HTMLContent == "" {
+		bodyValues["text"] = bodyValue(m.Content, args.MaxBodyValueBytes)
+	}
+
+	attachments := make([]map[string]any, len(m.Attachments))
+	for i, a := range m.Attachments {
+		attachments[i] = pick(map[string]any{
+			"partId":      "attachment-" + strconv.Itoa(i+1),
+			"blobId":      a.ID.String(),
+			"size":        a.Size,
+			"name":        a.FileName,
+			"type":        a.ContentType,
+			"charset":     nil,
+			"disposition": "attachment",
+			"cid":         nil,
+			"language":    nil,
+			"location":    nil,
+		}, args.BodyProperties)
+	}
+
+	id := m.ID.String()
+	return filterProperties(map[string]any{
+		"id":            id,
+		"blobId":        id,
+		"threadId":      id,
+		"mailboxIds":    mailboxIDs,
+		"keywords":      keywords(m),
+		"size":          blob.SourceSize(m, source),
+		"receivedAt":    m.CreatedAt.UTC().Format(time.RFC3339),
+		"messageId":     messageIDs(header, "Message-Id"),
+		"inReplyTo":     messageIDs(header, "In-Reply-To"),
+		"references":    messageIDs(header, "References"),
+		"sender":        addressList(header, "Sender"),
+		"from":          from,
+		"to":            addressList(header, "To"),
+		"cc":            addressList(header, "Cc"),
+		"bcc":           addressList(header, "Bcc"),
+		"replyTo":       addressList(header, "Reply-To"),
+		"subject":       m.Subject,
+		"sentAt":        sentAt,
+		"hasAttachment": len(m.Attachments) > 0,
+		"preview":       preview(m.Content),
+		"bodyValues":    bodyValues,
+		"textBody":      textBody,
+		"htmlBody":      htmlBody,
+		"attachments":   attachments,
+	}, args.Properties), nil
+}
+
+// emailGet implements Email/get (RFC 8621 section 4.2).
+func emailGet(cl *call, raw json.RawMessage) (any, *MethodError) {
+	var args getArgs
+	if merr := decodeArgs(raw, &args); merr != nil {
+		return nil, merr
+	}
+	if merr := cl.checkAccount(args.AccountID); merr != nil {
+		return nil, merr
+	}
+	if args.IDs != nil && len(*args.IDs) > maxObjectsInGet {
+		return nil, &MethodError{Type: "requestTooLarge"}
+	}
+
+	state, err := emailState(cl.db, cl.account.ID)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+
+	query := cl.db.Preload("Attachments").Where("email_id = ?", cl.account.ID)
+	if args.IDs != nil {
+		query = query.Where("id IN ?", parseIDs(*args.IDs))
+	} else {
+		query = query.Order("created_at DESC").Limit(maxObjectsInGet)
+	}
+	var messages []models.Message
+	if err := query.Find(&messages).Error; err != nil {
+		return nil, serverFail(err)
+	}
+
+	resp := &getResponse{
+		AccountID: args.AccountID,
+		State:     state,
+		List:      make([]map[string]any, 0, len(messages)),
+		NotFound:  []string{},
+	}
+	found := make(map[string]bool, len(messages))
+	for i := range messages {
+		obj, err := email(&messages[i], cl.account.Address, &args)
+		if err != nil {
+			return nil, serverFail(err)
+		}
+		resp.List = append(resp.List, obj)
+		found[messages[i].ID.String()] = true
+	}
+	if args.IDs != nil {
+		for _, id := range *args.IDs {
+			if !found[id] {
+				resp.NotFound = append(resp.NotFound, id)
+			}
+		}
+	}
+
+	if len(messages) > 0 {
+		audit.RecordRequest(cl.c, models.AuditLog{
+			EmailID:      cl.account.ID,
+			EmailAddress: cl.account.Address,
+			Action:       models.AuditActionAccess,
+			Detail:       "jmap get " + strconv.Itoa(len(messages)) + " messages",
+		})
+	}
+	return resp, nil
+}
+
+type setError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+type setArgs struct {
+	AccountID string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+type setResponse struct {
+	AccountID    string               `json:"accountId"`
+	OldState     string               `json:"oldState"`
+	NewState     string               `json:"newState"`
+	Created      map[string]any       `json:"created"`
+	Updated      map[string]any       `json:"updated"`
+	Destroyed    []string             `json:"destroyed"`
+	NotCreated   map[string]*setError `json:"notCreated"`
+	NotUpdated   map[string]*setError `json:"notUpdated"`
+	NotDestroyed map[string]*setError `json:"notDestroyed"`
+}
+
+// emailSet implements Email/set (RFC 8621 section 4.6). Emails only arrive
+// over SMTP, so they can't be created; updates are limited to keywords.
+func emailSet(cl *call, raw json.RawMessage) (any, *MethodError) {
+	var args setArgs
+	if merr := decodeArgs(raw, &args); merr != nil {
+		return nil, merr
+	}
+	if merr := cl.checkAccount(args.AccountID); merr != nil {
+		return nil, merr
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > maxObjectsInSet {
+		return nil, &MethodError{Type: "requestTooLarge"}
+	}
+
+	oldState, err := emailState(cl.db, cl.account.ID)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+	if args.IfInState != nil && *args.IfInState != oldState {
+		return nil, &MethodError{Type: "stateMismatch"}
+	}
+
+	resp := &setResponse{AccountID: args.AccountID, OldState: oldState}
+
+	for id := range args.Create {
+		if resp.NotCreated == nil {
+			resp.NotCreated = map[string]*setError{}
+		}
+		resp.NotCreated[id] = &setError{Type: "forbidden", Description: "Emails can't be created"}
+	}
+
+	for id, patch := range args.Update {
+		if serr := updateEmail(cl, id, patch); serr != nil {
+			if resp.NotUpdated == nil {
+				resp.NotUpdated = map[string]*setError{}
+			}
+			resp.NotUpdated[id] = serr
+			continue
+		}
+		if resp.Updated == nil {
+			resp.Updated = map[string]any{}
+		}
+		resp.Updated[id] = nil
+	}
+
+	for _, id := range args.Destroy {
+		if serr := destroyEmail(cl, id); serr != nil {
+			if resp.NotDestroyed == nil {
+				resp.NotDestroyed = map[string]*setError{}
+			}
+			resp.NotDestroyed[id] = serr
+			continue
+		}
+		resp.Destroyed = append(resp.Destroyed, id)
+	}
+
+	resp.NewState, err = emailState(cl.db, cl.account.ID)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+	return resp, nil
+}
+
+func findMessage(cl *call, id string) (*models.Message, *setError) {
+	ids := parseIDs([]string{id})
+	if len(ids) == 0 {
+		return nil, &setError{Type: "notFound"}
+	}
+	var m models.Message
+	if err := cl.db.Select("id", "email_id").Where("id = ? AND email_id = ?", ids[0], cl.account.ID).
+		First(&m).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Errorf("Database error: %+v", err)
+		}
+		return nil, &setError{Type: "notFound"}
+	}
+	return &m, nil
+}
+
+// updateEmail applies a patch to the keywords of a message. The mailbox can
+// only be set to the Inbox.
+func updateEmail(cl *call, id string, patch map[string]json.RawMessage) *setError {
+	m, serr := findMessage(cl, id)
+	if serr != nil {
+		return serr
+	}
+
+	updates := map[string]any{}
+	var invalid []string
+	for path, value := range patch {
+		switch {
+		case path == "keywords":
+			var kw map[string]bool
+			if err := json.Unmarshal(value, &kw); err != nil {
+				invalid = append(invalid, path)
+				continue
+			}
+			for _, column := range keywordColumns {
+				updates[column] = false
+			}
+			for keyword, set := range kw {
+				column, ok := keywordColumns[strings.ToLower(keyword)]
+				if !ok || !set {
+					invalid = append(invalid, path)
+					continue
+				}
+				updates[column] = true
+			}
+
+		case strings.HasPrefix(path, "keywords/"):
+			keyword := strings.ToLower(unescapePointer(strings.TrimPrefix(path, "keywords/")))
+			column, ok := keywordColumns[keyword]
+			var set *bool
+			if !ok || json.Unmarshal(value, &set) != nil || (set != nil && !*set) {
+				invalid = append(invalid, path)
+				continue
+			}
+			updates[column] = set != nil
+
+		case path == "mailboxIds":
+			var ids map[string]bool
+			if json.Unmarshal(value, &ids) != nil || !isInbox(ids) {
+				invalid = append(invalid, path)
+			}
+
+		case path == "mailboxIds/"+inboxID:
+			if string(value) != "true" {
+				invalid = append(invalid, path)
+			}
+
+		default:
+			invalid = append(invalid, path)
+		}
+	}
+	if len(invalid) > 0 {
+		return &setError{Type: "invalidProperties", Properties: invalid}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	if err := cl.db.Model(m).Updates(updates).Error; err != nil {
+		log.Errorf("Failed to update message %s: %v", id, err)
+		return &setError{Type: "serverFail"}
+	}
+	return nil
+}
+
+func unescapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+}
+
+func destroyEmail(cl *call, id string) *setError {
+	m, serr := findMessage(cl, id)
+	if serr != nil {
+		return serr
+	}
+
+	err := cl.db.Transaction(func(tx *gorm.DB) error {
+		if err := blob.DeleteAttachments(tx, []uuid.UUID{m.ID}); err != nil {
+			return err
+		}
+		return tx.Delete(m).Error
+	})
+	if err != nil {
+		log.Errorf("Failed to delete message %s: %v", id, err)
+		return &setError{Type: "serverFail"}
+	}
+
+	audit.RecordRequest(cl.c, models.AuditLog{
+		EmailID:      cl.account.ID,
+		EmailAddress: cl.account.Address,
+		MessageID:    &m.ID,
+		Action:       models.AuditActionDeleteMessage,
+		Detail:       "jmap",
+	})
+	return nil
+}
@@ -0,0 +1,321 @@
+package jmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/blob"
+	"secmail/config"
+	"secmail/database/databasetest"
+	"secmail/models"
+)
+
+const testRaw = "From: Sender <sender@example.com>\r\n" +
+	"To: abcd123456@test.com\r\n" +
+	"Subject: Hello JMAP\r\n" +
+	"Message-Id: <hello@example.com>\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"\r\n" +
+	"Your code is 123456\r\n"
+
+type testAccount struct {
+	db     *gorm.DB
+	router *gin.Engine
+	blobs  blob.Store
+	email  models.EmailAddress
+	token  string
+	id     string
+}
+
+func setupTestAccount(t *testing.T) *testAccount {
+	gin.SetMode(gin.TestMode)
+	db := databasetest.Open(t)
+
+	email := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	token, err := email.NewAccessToken()
+	require.NoError(t, err)
+	require.NoError(t, db.Create(&email).Error)
+
+	blobs := blob.NewMemoryStore()
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("db", db)
+		c.Set("blobs", blobs)
+		c.Next()
+	})
+	RegisterRoutes(r)
+
+	return &testAccount{db: db, router: r, blobs: blobs, email: email, token: token, id: strconv.Itoa(int(email.ID))}
+}
+
+func (a *testAccount) addMessage(t *testing.T, m models.Message) models.Message {
+	m.EmailID = a.email.ID
+	require.NoError(t, a.db.Create(&m).Error)
+	return m
+}
+
+func (a *testAccount) request(method, path string, body any) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.SetBasicAuth(a.email.Address, a.token)
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	return w
+}
+
+// call runs method calls and returns the responses by call id.
+func (a *testAccount) call(t *testing.T, calls ...[]any) map[string][]any {
+	w := a.request(http.MethodPost, "/jmap/api", gin.H{
+		"using":       []string{CapabilityCore, CapabilityMail},
+		"methodCalls": calls,
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		MethodResponses [][]any `json:"methodResponses"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	results := map[string][]any{}
+	for _, r := range resp.MethodResponses {
+		results[r[2].(string)] = r
+	}
+	return results
+}
+
+func args(r []any) map[string]any {
+	return r[1].(map[string]any)
+}
+
+func TestSession(t *testing.T) {
+	a := setupTestAccount(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/jmap/session", nil)
+	req.SetBasicAuth(a.email.Address, "wrong")
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = a.request(http.MethodGet, "/jmap/session", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var session map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	assert.Equal(t, a.email.Address, session["username"])
+	assert.Equal(t, a.id, session["primaryAccounts"].(map[string]any)[CapabilityMail])
+	assert.Equal(t, "http://example.com/jmap/api", session["apiUrl"])
+	assert.Contains(t, session["accounts"], a.id)
+
+	w = a.request(http.MethodPost, "/jmap/api", gin.H{"using": []string{"urn:example"}, "methodCalls": []any{}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknownCapability")
+}
+
+func TestSessionForwardedProto(t *testing.T) {
+	a := setupTestAccount(t)
+	saved := config.GlobalConfig
+	t.Cleanup(func() { config.GlobalConfig = saved })
+
+	tests := []struct {
+		name    string
+		proxies []string
+		proto   string
+		want    string
+	}{
+		{"untrusted peer", nil, "https", "http://example.com/jmap/api"},
+		{"trusted proxy", []string{"192.0.2.0/24"}, "https", "https://example.com/jmap/api"},
+		{"trusted proxy address", []string{"192.0.2.1"}, "HTTPS", "https://example.com/jmap/api"},
+		{"invalid scheme", []string{"192.0.2.0/24"}, "javascript", "http://example.com/jmap/api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.GlobalConfig.HTTP.TrustedProxies = tt.proxies
+			// httptest requests come from 192.0.2.1
+			req := httptest.NewRequest(http.MethodGet, "/jmap/session", nil)
+			req.SetBasicAuth(a.email.Address, a.token)
+			req.Header.Set("X-Forwarded-Proto", tt.proto)
+			w := httptest.NewRecorder()
+			a.router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var session map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+			assert.Equal(t, tt.want, session["apiUrl"])
+		})
+	}
+}
+
+func TestDownload(t *testing.T) {
+	a := setupTestAccount(t)
+	content := []byte("<script>alert(1)</script>")
+	hash := blob.Hash(content)
+	require.NoError(t, blob.PutBytes(context.Background(), a.blobs, hash, content))
+	m := a.addMessage(t, models.Message{Subject: "Report", Raw: []byte(testRaw), Attachments: []models.Attachment{
+		{FileName: "report.csv", ContentType: "text/csv", BlobKey: hash, Hash: hash, Size: int64(len(content))},
+	}})
+
+	// the type parameter cannot make the content served as HTML
+	w := a.request(http.MethodGet, "/jmap/download/"+a.id+"/"+m.Attachments[0].ID.String()+"/report.csv?type=text/html", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, string(content), w.Body.String())
+
+	w = a.request(http.MethodGet, "/jmap/download/"+a.id+"/"+m.ID.String()+"/message.eml?type=text/html", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "message/rfc822", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, testRaw, w.Body.String())
+}
+
+func TestQueryAndGet(t *testing.T) {
+	a := setupTestAccount(t)
+	hello := a.addMessage(t, models.Message{From: "sender@example.com", Subject: "Hello JMAP", Content: "Your code is 123456", Raw: []byte(testRaw)})
+	a.addMessage(t, models.Message{From: "other@example.com", Subject: "Legacy", Content: "old body", Seen: true, CreatedAt: time.Now().Add(-time.Minute)})
+
+	results := a.call(t,
+		[]any{"Email/query", gin.H{"accountId": a.id, "filter": gin.H{"notKeyword": "$seen"}, "calculateTotal": true}, "q"},
+		[]any{"Email/get", gin.H{
+			"accountId":           a.id,
+			"#ids":                gin.H{"resultOf": "q", "name": "Email/query", "path": "/ids"},
+			"properties":          []string{"subject", "from", "keywords", "messageId", "sentAt", "textBody", "bodyValues"},
+			"fetchTextBodyValues": true,
+		}, "g"},
+		[]any{"Mailbox/get", gin.H{"accountId": a.id, "ids": nil}, "m"},
+		[]any{"Email/query", gin.H{"accountId": a.id, "filter": gin.H{"text": "OLD"}, "sort": []gin.H{{"property": "receivedAt"}}}, "t"},
+		[]any{"Email/get", gin.H{"accountId": "unknown", "ids": []string{}}, "e"},
+	)
+
+	assert.Equal(t, []any{hello.ID.String()}, args(results["q"])["ids"])
+	assert.Equal(t, float64(1), args(results["q"])["total"])
+
+	list := args(results["g"])["list"].([]any)
+	require.Len(t, list, 1)
+	email := list[0].(map[string]any)
+	assert.Equal(t, hello.ID.String(), email["id"])
+	assert.Equal(t, "Hello JMAP", email["subject"])
+	assert.Equal(t, []any{map[string]any{"name": "Sender", "email": "sender@example.com"}}, email["from"])
+	assert.Equal(t, []any{"hello@example.com"}, email["messageId"])
+	assert.Equal(t, "2006-01-02T15:04:05Z", email["sentAt"])
+	assert.Equal(t, map[string]any{}, email["keywords"])
+	assert.Equal(t, "Your code is 123456", email["bodyValues"].(map[string]any)["text"].(map[string]any)["value"])
+
+	inbox := args(results["m"])["list"].([]any)[0].(map[string]any)
+	assert.Equal(t, "inbox", inbox["role"])
+	assert.Equal(t, float64(2), inbox["totalEmails"])
+	assert.Equal(t, float64(1), inbox["unreadEmails"])
+
+	assert.Len(t, args(results["t"])["ids"], 1)
+	assert.Equal(t, "error", results["e"][0])
+	assert.Equal(t, "accountNotFound", args(results["e"])["type"])
+}
+
+func TestSetAndChanges(t *testing.T) {
+	a := setupTestAccount(t)
+	first := a.addMessage(t, models.Message{From: "sender@example.com", Subject: "First", Content: "one"})
+	second := a.addMessage(t, models.Message{From: "sender@example.com", Subject: "Second", Content: "two"})
+
+	results := a.call(t, []any{"Email/get", gin.H{"accountId": a.id, "ids": []string{}}, "s"})
+	state := args(results["s"])["state"].(string)
+
+	third := a.addMessage(t, models.Message{From: "sender@example.com", Subject: "Third", Content: "three"})
+	results = a.call(t,
+		[]any{"Email/set", gin.H{"accountId": a.id, "ifInState": "1"}, "mismatch"},
+		[]any{"Email/set", gin.H{
+			"accountId": a.id,
+			"update": gin.H{
+				first.ID.String(): gin.H{"keywords/$seen": true, "keywords/$flagged": true},
+				"unknown":         gin.H{"keywords/$seen": true},
+				third.ID.String(): gin.H{"keywords/$draft": true},
+			},
+			"destroy": []string{second.ID.String()},
+			"create":  gin.H{"k1": gin.H{}},
+		}, "set"},
+		[]any{"Email/changes", gin.H{"accountId": a.id, "sinceState": state}, "changes"},
+	)
+
+	assert.Equal(t, "stateMismatch", args(results["mismatch"])["type"])
+
+	set := args(results["set"])
+	assert.Contains(t, set["updated"], first.ID.String())
+	assert.Equal(t, "notFound", set["notUpdated"].(map[string]any)["unknown"].(map[string]any)["type"])
+	assert.Equal(t, "invalidProperties", set["notUpdated"].(map[string]any)[third.ID.String()].(map[string]any)["type"])
+	assert.Equal(t, []any{second.ID.String()}, set["destroyed"])
+	assert.Contains(t, set["notCreated"], "k1")
+	assert.NotEqual(t, set["oldState"], set["newState"])
+
+	var m models.Message
+	require.NoError(t, a.db.First(&m, "id = ?", first.ID).Error)
+	assert.True(t, m.Seen)
+	assert.True(t, m.Flagged)
+
+	changes := args(results["changes"])
+	assert.Equal(t, []any{third.ID.String()}, changes["created"])
+	assert.Equal(t, []any{first.ID.String()}, changes["updated"])
+	assert.Equal(t, []any{second.ID.String()}, changes["destroyed"])
+	assert.Equal(t, set["newState"], changes["newState"])
+
+	// one change at a time
+	results = a.call(t, []any{"Email/changes", gin.H{"accountId": a.id, "sinceState": state, "maxChanges": 1}, "c"})
+	changes = args(results["c"])
+	assert.Equal(t, true, changes["hasMoreChanges"])
+	assert.Equal(t, []any{third.ID.String()}, changes["created"])
+
+	results = a.call(t, []any{"Email/changes", gin.H{"accountId": a.id, "sinceState": set["newState"]}, "c"})
+	changes = args(results["c"])
+	assert.Empty(t, changes["created"])
+	assert.Empty(t, changes["updated"])
+	assert.Empty(t, changes["destroyed"])
+}
+
+func TestEventSource(t *testing.T) {
+	a := setupTestAccount(t)
+	pollInterval = 10 * time.Millisecond
+
+	server := httptest.NewServer(a.router)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/jmap/eventsource?types=Email&closeafter=state&ping=0", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth(a.email.Address, a.token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	a.addMessage(t, models.Message{From: "sender@example.com", Subject: "Pushed", Content: "new"})
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.GreaterOrEqual(t, len(lines), 2)
+	assert.Equal(t, "event: state", lines[0])
+	data := strings.TrimPrefix(lines[1], "data: ")
+	var event map[string]any
+	require.NoError(t, json.Unmarshal([]byte(data), &event))
+	assert.Equal(t, "StateChange", event["@type"])
+	changed := event["changed"].(map[string]any)[a.id].(map[string]any)
+	assert.Contains(t, changed, "Email")
+	assert.NotContains(t, changed, "Mailbox")
+}
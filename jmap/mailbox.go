@@ -0,0 +1,157 @@
+package jmap
+
+import (
+	"encoding/json"
+	"slices"
+
+	"secmail/models"
+)
+
+type getArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties *[]string `json:"properties"`
+	// Email/get only
+	BodyProperties      *[]string `json:"bodyProperties"`
+	FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+}
+
+type getResponse struct {
+	AccountID string           `json:"accountId"`
+	State     string           `json:"state"`
+	List      []map[string]any `json:"list"`
+	NotFound  []string         `json:"notFound"`
+}
+
+// filterProperties keeps the requested properties of an object, the id is
+// always returned.
+func filterProperties(obj map[string]any, properties *[]string) map[string]any {
+	if properties == nil {
+		return obj
+	}
+	filtered := map[string]any{"id": obj["id"]}
+	for _, p := range *properties {
+		if v, ok := obj[p]; ok {
+			filtered[p] = v
+		}
+	}
+	return filtered
+}
+
+// mailboxGet implements Mailbox/get (RFC 8621 section 2.1). Every account
+// has a single Inbox; its counts change with the emails, so it shares their
+// state.
+func mailboxGet(cl *call, raw json.RawMessage) (any, *MethodError) {
+	var args getArgs
+	if merr := decodeArgs(raw, &args); merr != nil {
+		return nil, merr
+	}
+	if merr := cl.checkAccount(args.AccountID); merr != nil {
+		return nil, merr
+	}
+
+	state, err := emailState(cl.db, cl.account.ID)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+	resp := &getResponse{
+		AccountID: args.AccountID,
+		State:     state,
+		List:      []map[string]any{},
+		NotFound:  []string{},
+	}
+
+	ids := []string{inboxID}
+	if args.IDs != nil {
+		ids = *args.IDs
+	}
+	for _, id := range ids {
+		if id != inboxID {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+
+		var total, unread int64
+		if err := cl.db.Model(&models.Message{}).Where("email_id = ?", cl.account.ID).Count(&total).Error; err != nil {
+			return nil, serverFail(err)
+		}
+		if err := cl.db.Model(&models.Message{}).Where("email_id = ? AND seen = ?", cl.account.ID, false).
+			Count(&unread).Error; err != nil {
+			return nil, serverFail(err)
+		}
+
+		resp.List = append(resp.List, filterProperties(map[string]any{
+			"id":            inboxID,
+			"name":          "Inbox",
+			"parentId":      nil,
+			"role":          "inbox",
+			"sortOrder":     0,
+			"totalEmails":   total,
+			"unreadEmails":  unread,
+			"totalThreads":  total,
+			"unreadThreads": unread,
+			"myRights": map[string]bool{
+				"mayReadItems":   true,
+				"mayAddItems":    false,
+				"mayRemoveItems": true,
+				"maySetSeen":     true,
+				"maySetKeywords": true,
+				"mayCreateChild": false,
+				"mayRename":      false,
+				"mayDelete":      false,
+				"maySubmit":      false,
+			},
+			"isSubscribed": true,
+		}, args.Properties))
+	}
+	return resp, nil
+}
+
+// mailboxChanges implements Mailbox/changes. The Inbox is never created or
+// destroyed, only its counts are updated.
+func mailboxChanges(cl *call, raw json.RawMessage) (any, *MethodError) {
+	var args changesArgs
+	if merr := decodeArgs(raw, &args); merr != nil {
+		return nil, merr
+	}
+	if merr := cl.checkAccount(args.AccountID); merr != nil {
+		return nil, merr
+	}
+	if _, ok := parseState(args.SinceState); !ok {
+		return nil, &MethodError{Type: "cannotCalculateChanges"}
+	}
+
+	state, err := emailState(cl.db, cl.account.ID)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+	resp := &changesResponse{
+		AccountID: args.AccountID,
+		OldState:  args.SinceState,
+		NewState:  state,
+		Created:   []string{},
+		Updated:   []string{},
+		Destroyed: []string{},
+	}
+	if state != args.SinceState {
+		resp.Updated = []string{inboxID}
+		resp.UpdatedProperties = []string{"totalEmails", "unreadEmails", "totalThreads", "unreadThreads"}
+	}
+	return resp, nil
+}
+
+// mailboxIDs is the mailboxIds property of every email.
+var mailboxIDs = map[string]bool{inboxID: true}
+
+func isInbox(ids map[string]bool) bool {
+	keys := make([]string, 0, len(ids))
+	for id, ok := range ids {
+		if ok {
+			keys = append(keys, id)
+		}
+	}
+	return slices.Equal(keys, []string{inboxID})
+}
@@ -0,0 +1,123 @@
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// pollInterval is how often the push endpoint checks for state changes.
+var pollInterval = 2 * time.Second
+
+// closing ends the event streams when the server shuts down, which would
+// otherwise wait for them until its timeout.
+var (
+	closing     = make(chan struct{})
+	closingOnce sync.Once
+)
+
+// CloseEventSources ends the open event streams; clients reconnect to
+// another server. It is meant for http.Server.RegisterOnShutdown.
+func CloseEventSources() {
+	closingOnce.Do(func() { close(closing) })
+}
+
+// EventSource pushes StateChange events for the account (RFC 8620 section
+// 7.3). Changes are detected by polling the email state.
+func EventSource(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	addr := currentAccount(c)
+
+	types := map[string]bool{}
+	for _, t := range strings.Split(c.DefaultQuery("types", "*"), ",") {
+		types[t] = true
+	}
+	closeAfter := c.DefaultQuery("closeafter", "no")
+	if closeAfter != "no" && closeAfter != "state" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "closeafter must be state or no"})
+		return
+	}
+	ping, err := strconv.Atoi(c.DefaultQuery("ping", "0"))
+	if err != nil || ping < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ping interval"})
+		return
+	}
+
+	state, err := emailState(db, addr.ID)
+	if err != nil {
+		log.Errorf("Database error: %+v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	var pings <-chan time.Time
+	if ping > 0 {
+		ticker := time.NewTicker(time.Duration(ping) * time.Second)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+
+		case <-closing:
+			return
+
+		case <-pings:
+			writeEvent(c, "ping", gin.H{"@type": "Ping", "interval": ping})
+
+		case <-poll.C:
+			newState, err := emailState(db, addr.ID)
+			if err != nil {
+				log.Errorf("Database error: %+v", err)
+				return
+			}
+			if newState == state {
+				continue
+			}
+			state = newState
+
+			changed := gin.H{}
+			for _, t := range []string{"Email", "Mailbox"} {
+				if types["*"] || types[t] {
+					changed[t] = state
+				}
+			}
+			if len(changed) > 0 {
+				writeEvent(c, "state", gin.H{
+					"@type":   "StateChange",
+					"changed": gin.H{accountID(addr): changed},
+				})
+				if closeAfter == "state" {
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeEvent(c *gin.Context, event string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, payload)
+	c.Writer.Flush()
+}
@@ -0,0 +1,239 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"secmail/models"
+)
+
+// filter is an Email/query FilterOperator or FilterCondition.
+type filter struct {
+	Operator   string   `json:"operator"`
+	Conditions []filter `json:"conditions"`
+
+	InMailbox          *string    `json:"inMailbox"`
+	InMailboxOtherThan []string   `json:"inMailboxOtherThan"`
+	Before             *time.Time `json:"before"`
+	After              *time.Time `json:"after"`
+	HasKeyword         *string    `json:"hasKeyword"`
+	NotKeyword         *string    `json:"notKeyword"`
+	HasAttachment      *bool      `json:"hasAttachment"`
+	Text               *string    `json:"text"`
+	From               *string    `json:"from"`
+	To                 *string    `json:"to"`
+	Subject            *string    `json:"subject"`
+	Body               *string    `json:"body"`
+}
+
+type comparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Collation   string `json:"collation"`
+}
+
+type queryArgs struct {
+	AccountID       string          `json:"accountId"`
+	Filter          json.RawMessage `json:"filter"`
+	Sort            []comparator    `json:"sort"`
+	Position        int             `json:"position"`
+	Anchor          *string         `json:"anchor"`
+	AnchorOffset    int             `json:"anchorOffset"`
+	Limit           *int            `json:"limit"`
+	CalculateTotal  bool            `json:"calculateTotal"`
+	CollapseThreads bool            `json:"collapseThreads"`
+}
+
+type queryResponse struct {
+	AccountID           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	IDs                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+	Limit               *int     `json:"limit,omitempty"`
+}
+
+var sortColumns = map[string]string{
+	"receivedAt": "messages.created_at",
+	"from":       `messages."from"`,
+	"subject":    "messages.subject",
+}
+
+func like(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(s))
+	return "%" + s + "%"
+}
+
+// sql converts a filter to a condition on the messages table.
+func (f *filter) sql(address string) (string, []any) {
+	if f.Operator != "" {
+		parts := make([]string, 0, len(f.Conditions))
+		var args []any
+		for i := range f.Conditions {
+			cond, condArgs := f.Conditions[i].sql(address)
+			parts = append(parts, "("+cond+")")
+			args = append(args, condArgs...)
+		}
+		if len(parts) == 0 {
+			parts = append(parts, "1 = 1")
+		}
+		switch f.Operator {
+		case "OR":
+			return strings.Join(parts, " OR "), args
+		case "NOT":
+			return "NOT (" + strings.Join(parts, " OR ") + ")", args
+		default:
+			return strings.Join(parts, " AND "), args
+		}
+	}
+
+	conds := []string{"1 = 1"}
+	var args []any
+	add := func(cond string, condArgs ...any) {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	if f.InMailbox != nil && *f.InMailbox != inboxID {
+		add("1 = 0")
+	}
+	if slices.Contains(f.InMailboxOtherThan, inboxID) {
+		add("1 = 0")
+	}
+	if f.Before != nil {
+		add("messages.created_at < ?", *f.Before)
+	}
+	if f.After != nil {
+		add("messages.created_at >= ?", *f.After)
+	}
+	if f.HasKeyword != nil {
+		if column, ok := keywordColumns[strings.ToLower(*f.HasKeyword)]; ok {
+			add("messages."+column+" = ?", true)
+		} else {
+			add("1 = 0")
+		}
+	}
+	if f.NotKeyword != nil {
+		if column, ok := keywordColumns[strings.ToLower(*f.NotKeyword)]; ok {
+			add("messages."+column+" = ?", false)
+		}
+	}
+	if f.HasAttachment != nil {
+		exists := "EXISTS (SELECT 1 FROM attachments WHERE attachments.message_id = messages.id)"
+		if *f.HasAttachment {
+			add(exists)
+		} else {
+			add("NOT " + exists)
+		}
+	}
+	if f.Text != nil {
+		p := like(*f.Text)
+		add(`LOWER(messages."from") LIKE ? ESCAPE '\' OR LOWER(messages.subject) LIKE ? ESCAPE '\' OR LOWER(messages.content) LIKE ? ESCAPE '\' OR LOWER(messages.html_content) LIKE ? ESCAPE '\'`, p, p, p, p)
+	}
+	if f.From != nil {
+		add(`LOWER(messages."from") LIKE ? ESCAPE '\'`, like(*f.From))
+	}
+	if f.To != nil && !strings.Contains(address, strings.ToLower(*f.To)) {
+		// every message was delivered to the address of the account
+		add("1 = 0")
+	}
+	if f.Subject != nil {
+		add("LOWER(messages.subject) LIKE ? ESCAPE '\\'", like(*f.Subject))
+	}
+	if f.Body != nil {
+		p := like(*f.Body)
+		add("LOWER(messages.content) LIKE ? ESCAPE '\\' OR LOWER(messages.html_content) LIKE ? ESCAPE '\\'", p, p)
+	}
+
+	for i := range conds {
+		conds[i] = "(" + conds[i] + ")"
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// emailQuery implements Email/query (RFC 8621 section 4.4). Threads are
+// single messages, so collapseThreads makes no difference.
+func emailQuery(cl *call, raw json.RawMessage) (any, *MethodError) {
+	var args queryArgs
+	if merr := decodeArgs(raw, &args); merr != nil {
+		return nil, merr
+	}
+	if merr := cl.checkAccount(args.AccountID); merr != nil {
+		return nil, merr
+	}
+	if args.Limit != nil && *args.Limit < 0 {
+		return nil, invalidArguments("limit must not be negative")
+	}
+
+	query := cl.db.Model(&models.Message{}).Where("messages.email_id = ?", cl.account.ID)
+	if len(args.Filter) > 0 && string(args.Filter) != "null" {
+		var f filter
+		dec := json.NewDecoder(bytes.NewReader(args.Filter))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&f); err != nil {
+			return nil, &MethodError{Type: "unsupportedFilter", Description: err.Error()}
+		}
+		cond, condArgs := f.sql(cl.account.Address)
+		query = query.Where(cond, condArgs...)
+	}
+
+	if len(args.Sort) == 0 {
+		query = query.Order("messages.created_at DESC")
+	}
+	for _, cmp := range args.Sort {
+		column, ok := sortColumns[cmp.Property]
+		if !ok {
+			return nil, &MethodError{Type: "unsupportedSort", Description: "can't sort by " + cmp.Property}
+		}
+		if cmp.IsAscending != nil && !*cmp.IsAscending {
+			column += " DESC"
+		}
+		query = query.Order(column)
+	}
+	query = query.Order("messages.uid")
+
+	state, err := emailState(cl.db, cl.account.ID)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+
+	var ids []string
+	if err := query.Pluck("messages.id", &ids).Error; err != nil {
+		return nil, serverFail(err)
+	}
+	total := len(ids)
+
+	position := args.Position
+	if args.Anchor != nil {
+		i := slices.Index(ids, *args.Anchor)
+		if i < 0 {
+			return nil, &MethodError{Type: "anchorNotFound"}
+		}
+		position = max(i+args.AnchorOffset, 0)
+	} else if position < 0 {
+		position = max(total+position, 0)
+	}
+	position = min(position, total)
+
+	resp := &queryResponse{
+		AccountID:  args.AccountID,
+		QueryState: state,
+		Position:   position,
+	}
+
+	limit := maxObjectsInGet
+	if args.Limit != nil && *args.Limit < limit {
+		limit = *args.Limit
+	} else if args.Limit != nil {
+		resp.Limit = &limit
+	}
+	resp.IDs = ids[position:min(position+limit, total)]
+	if args.CalculateTotal {
+		resp.Total = &total
+	}
+	return resp, nil
+}
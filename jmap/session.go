@@ -0,0 +1,163 @@
+package jmap
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"secmail/config"
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kuun/slog"
+	"gorm.io/gorm"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+const (
+	CapabilityCore = "urn:ietf:params:jmap:core"
+	CapabilityMail = "urn:ietf:params:jmap:mail"
+
+	// the only mailbox of an account
+	inboxID = "inbox"
+
+	maxObjectsInGet   = 500
+	maxObjectsInSet   = 500
+	maxCallsInRequest = 16
+	maxSizeRequest    = 10 << 20
+)
+
+// RegisterRoutes adds the JMAP session, API, download and push endpoints.
+// Every temporary address is an account, authenticated with HTTP Basic auth
+// using the address and its access token.
+func RegisterRoutes(r gin.IRouter) {
+	r.GET("/.well-known/jmap", func(c *gin.Context) {
+		c.Redirect(http.StatusPermanentRedirect, "/jmap/session")
+	})
+
+	g := r.Group("/jmap", authenticate())
+	g.GET("/session", GetSession)
+	g.POST("/api", HandleAPI)
+	g.GET("/download/:accountId/:blobId/:name", Download)
+	g.POST("/upload/:accountId/", func(c *gin.Context) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Uploads are not supported"})
+	})
+	g.GET("/eventsource", EventSource)
+}
+
+// authenticate checks the Basic credentials and stores the address of the
+// account in the context as "jmapAccount".
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, password, ok := c.Request.BasicAuth()
+		if !ok {
+			unauthorized(c)
+			return
+		}
+
+		db := c.MustGet("db").(*gorm.DB)
+		var addr models.EmailAddress
+		if err := db.Where("address = ? AND expires_at > ?", strings.ToLower(username), time.Now()).
+			First(&addr).Error; err != nil {
+			if err != gorm.ErrRecordNotFound {
+				log.Errorf("Database error: %+v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			unauthorized(c)
+			return
+		}
+		if !addr.CheckAccessToken(password) {
+			unauthorized(c)
+			return
+		}
+
+		c.Set("jmapAccount", &addr)
+		c.Next()
+	}
+}
+
+func unauthorized(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Basic realm="secmail"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+}
+
+func currentAccount(c *gin.Context) *models.EmailAddress {
+	return c.MustGet("jmapAccount").(*models.EmailAddress)
+}
+
+func accountID(addr *models.EmailAddress) string {
+	return strconv.FormatUint(uint64(addr.ID), 10)
+}
+
+// sessionState changes only when the account is recreated.
+func sessionState(addr *models.EmailAddress) string {
+	return strconv.FormatUint(uint64(addr.UIDValidity()), 10)
+}
+
+// baseURL is the URL of the server as seen by the client. X-Forwarded-Proto
+// is only believed from the trusted proxies.
+func baseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	} else if config.GlobalConfig.HTTP.TrustedProxy(c.RemoteIP()) {
+		if proto := strings.ToLower(c.GetHeader("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// GetSession returns the session resource (RFC 8620 section 2).
+func GetSession(c *gin.Context) {
+	addr := currentAccount(c)
+	id := accountID(addr)
+	base := baseURL(c)
+
+	c.JSON(http.StatusOK, gin.H{
+		"capabilities": gin.H{
+			CapabilityCore: gin.H{
+				"maxSizeUpload":         0,
+				"maxConcurrentUpload":   1,
+				"maxSizeRequest":        maxSizeRequest,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest":     maxCallsInRequest,
+				"maxObjectsInGet":       maxObjectsInGet,
+				"maxObjectsInSet":       maxObjectsInSet,
+				"collationAlgorithms":   []string{"i;ascii-casemap"},
+			},
+			CapabilityMail: gin.H{},
+		},
+		"accounts": gin.H{
+			id: gin.H{
+				"name":       addr.Address,
+				"isPersonal": true,
+				"isReadOnly": false,
+				"accountCapabilities": gin.H{
+					CapabilityMail: gin.H{
+						"maxMailboxesPerEmail":       1,
+						"maxMailboxDepth":            1,
+						"maxSizeMailboxName":         255,
+						"maxSizeAttachmentsPerEmail": 0,
+						"emailQuerySortOptions":      []string{"receivedAt", "from", "subject"},
+						"mayCreateTopLevelMailbox":   false,
+					},
+				},
+			},
+		},
+		"primaryAccounts": gin.H{
+			CapabilityMail: id,
+		},
+		"username":       addr.Address,
+		"apiUrl":         base + "/jmap/api",
+		"downloadUrl":    base + "/jmap/download/{accountId}/{blobId}/{name}?type={type}",
+		"uploadUrl":      base + "/jmap/upload/{accountId}/",
+		"eventSourceUrl": base + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		"state":          sessionState(addr),
+	})
+}
@@ -0,0 +1,173 @@
+package jmap
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"secmail/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// emailState returns the state of the emails of an account: the time of its
+// latest change in nanoseconds. Deleted messages are kept as tombstones until
+// the address is removed, so changes since any state can be calculated.
+func emailState(db *gorm.DB, emailID uint) (string, error) {
+	var updated, deleted models.Message
+	if err := db.Unscoped().Select("updated_at").Where("email_id = ?", emailID).
+		Order("updated_at DESC").Limit(1).Find(&updated).Error; err != nil {
+		return "", err
+	}
+	if err := db.Unscoped().Select("deleted_at").Where("email_id = ? AND deleted_at IS NOT NULL", emailID).
+		Order("deleted_at DESC").Limit(1).Find(&deleted).Error; err != nil {
+		return "", err
+	}
+
+	latest := updated.UpdatedAt
+	if deleted.DeletedAt.Valid && deleted.DeletedAt.Time.After(latest) {
+		latest = deleted.DeletedAt.Time
+	}
+	if latest.IsZero() {
+		return "0", nil
+	}
+	return strconv.FormatInt(latest.UnixNano(), 10), nil
+}
+
+func parseState(state string) (time.Time, bool) {
+	n, err := strconv.ParseInt(state, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+	if n == 0 {
+		return time.Time{}, true
+	}
+	return time.Unix(0, n), true
+}
+
+type change struct {
+	id        string
+	at        time.Time
+	created   bool
+	destroyed bool
+}
+
+// changesSince lists the messages created, updated or destroyed after the
+// state, ordered by the time of the change.
+func changesSince(db *gorm.DB, emailID uint, since time.Time) ([]change, error) {
+	var messages []models.Message
+	if err := db.Unscoped().Select("id", "created_at", "updated_at", "deleted_at").
+		Where("email_id = ? AND (updated_at > ? OR deleted_at > ?)", emailID, since, since).
+		Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	changes := make([]change, 0, len(messages))
+	for _, m := range messages {
+		created := m.CreatedAt.After(since)
+		if m.DeletedAt.Valid {
+			// created and destroyed since the state, the client never saw it
+			if created {
+				continue
+			}
+			changes = append(changes, change{id: m.ID.String(), at: m.DeletedAt.Time, destroyed: true})
+			continue
+		}
+		changes = append(changes, change{id: m.ID.String(), at: m.UpdatedAt, created: created})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].at.Before(changes[j].at)
+	})
+	return changes, nil
+}
+
+type changesArgs struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+type changesResponse struct {
+	AccountID      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+	// only for Mailbox/changes
+	UpdatedProperties []string `json:"updatedProperties,omitempty"`
+}
+
+// emailChanges implements Email/changes (RFC 8620 section 5.2).
+func emailChanges(cl *call, raw json.RawMessage) (any, *MethodError) {
+	var args changesArgs
+	if merr := decodeArgs(raw, &args); merr != nil {
+		return nil, merr
+	}
+	if merr := cl.checkAccount(args.AccountID); merr != nil {
+		return nil, merr
+	}
+	if args.MaxChanges != nil && *args.MaxChanges <= 0 {
+		return nil, invalidArguments("maxChanges must be positive")
+	}
+	since, ok := parseState(args.SinceState)
+	if !ok {
+		return nil, &MethodError{Type: "cannotCalculateChanges"}
+	}
+
+	newState, err := emailState(cl.db, cl.account.ID)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+	changes, err := changesSince(cl.db, cl.account.ID, since)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+
+	resp := &changesResponse{
+		AccountID: args.AccountID,
+		OldState:  args.SinceState,
+		NewState:  newState,
+		Created:   []string{},
+		Updated:   []string{},
+		Destroyed: []string{},
+	}
+
+	// Return the oldest changes and the state after them; changes made at the
+	// same instant can't be split across responses
+	if args.MaxChanges != nil && len(changes) > *args.MaxChanges {
+		cut := changes[*args.MaxChanges].at
+		n := sort.Search(len(changes), func(i int) bool { return !changes[i].at.Before(cut) })
+		if n == 0 {
+			return nil, &MethodError{Type: "cannotCalculateChanges", Description: "too many changes at once"}
+		}
+		changes = changes[:n]
+		resp.NewState = strconv.FormatInt(changes[n-1].at.UnixNano(), 10)
+		resp.HasMoreChanges = true
+	}
+
+	for _, ch := range changes {
+		switch {
+		case ch.destroyed:
+			resp.Destroyed = append(resp.Destroyed, ch.id)
+		case ch.created:
+			resp.Created = append(resp.Created, ch.id)
+		default:
+			resp.Updated = append(resp.Updated, ch.id)
+		}
+	}
+	return resp, nil
+}
+
+func parseIDs(ids []string) []uuid.UUID {
+	parsed := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		if u, err := uuid.Parse(id); err == nil {
+			parsed = append(parsed, u)
+		}
+	}
+	return parsed
+}
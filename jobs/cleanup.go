@@ -1,8 +1,10 @@
 package jobs
 
 import (
+	"context"
 	"time"
 
+	"secmail/blob"
 	"secmail/models"
 
 	"github.com/kuun/slog"
@@ -13,20 +15,104 @@ type __logger struct{}
 
 var log = slog.GetLogger(__logger{})
 
-func CleanupExpiredEmails(db *gorm.DB) {
-	result := db.Where("expires_at < ?", time.Now()).Unscoped().Delete(&models.EmailAddress{})
+// CleanupExpiredEmails removes expired addresses with their messages, drops
+// the references of their attachments and collects the blobs left without
+// any. With encryption at rest, the data keys of the addresses are shredded
+// as well.
+func CleanupExpiredEmails(db *gorm.DB, blobs blob.Store) {
+	now := time.Now()
+	expired := func(tx *gorm.DB) *gorm.DB {
+		return tx.Unscoped().Model(&models.EmailAddress{}).Select("id").Where("expires_at < ?", now)
+	}
+	messages := func(tx *gorm.DB) *gorm.DB {
+		return tx.Unscoped().Model(&models.Message{}).Select("id").Where("email_id IN (?)", expired(tx))
+	}
+
+	var ids []uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := expired(tx).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if err := blob.DeleteAttachments(tx, messages(tx)); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("email_id IN (?)", expired(tx)).Delete(&models.Message{}).Error; err != nil {
+			return err
+		}
+		if models.Encrypting() {
+			// their contents cannot be decrypted once the keys are shredded
+			if err := tx.Unscoped().Where("email_id IN (?)", expired(tx)).Delete(&models.OutboundMessage{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("id IN ?", ids).Unscoped().Delete(&models.EmailAddress{}).Error
+	})
+	if err != nil {
+		log.Warnf("Failed to cleanup expired emails: %v", err)
+		return
+	}
+	log.Warnf("Cleaned up %d expired emails", len(ids))
+	for _, id := range ids {
+		if err := models.Shred(id); err != nil {
+			log.Warnf("Failed to shred the data key of address %d: %v", id, err)
+		}
+	}
+
+	collected, err := blob.Collect(context.Background(), db, blobs)
+	if err != nil {
+		log.Warnf("Failed to collect unreferenced blobs: %v", err)
+	}
+	if collected > 0 {
+		log.Infof("Collected %d unreferenced blobs", collected)
+	}
+}
+
+// CleanupRateLimitBuckets removes rate limit buckets that have not been used
+// for a day; by then every bucket is full again, which equals a missing row.
+func CleanupRateLimitBuckets(db *gorm.DB) {
+	result := db.Where("updated_at < ?", time.Now().Add(-24*time.Hour)).Delete(&models.RateLimitBucket{})
+	if result.Error != nil {
+		log.Warnf("Failed to cleanup rate limit buckets: %v", result.Error)
+	}
+}
+
+// CleanupOutboundMessages removes relayed messages a week after they were
+// sent or bounced; the queue keeps them for the admin API until then.
+func CleanupOutboundMessages(db *gorm.DB) {
+	result := db.Unscoped().
+		Where("status <> ? AND updated_at < ?", models.OutboundQueued, time.Now().Add(-7*24*time.Hour)).
+		Delete(&models.OutboundMessage{})
+	if result.Error != nil {
+		log.Warnf("Failed to cleanup outbound messages: %v", result.Error)
+	}
+}
+
+// StartCleanupJob runs the cleanups every hour.
+func StartCleanupJob(db *gorm.DB, blobs blob.Store) *Job {
+	return startJob(time.Hour, false, func() {
+		CleanupExpiredEmails(db, blobs)
+		CleanupRateLimitBuckets(db)
+		CleanupOutboundMessages(db)
+	})
+}
+
+// CleanupAuditLogs removes audit log entries older than retention.
+func CleanupAuditLogs(db *gorm.DB, retention time.Duration) {
+	result := db.Unscoped().Where("created_at < ?", time.Now().Add(-retention)).Delete(&models.AuditLog{})
 	if result.Error != nil {
-		log.Warnf("Failed to cleanup expired emails: %v", result.Error)
+		log.Warnf("Failed to cleanup audit logs: %v", result.Error)
 		return
 	}
-	log.Warnf("Cleaned up %d expired emails", result.RowsAffected)
+	log.Infof("Cleaned up %d audit log entries", result.RowsAffected)
 }
 
-func StartCleanupJob(db *gorm.DB) {
-	ticker := time.NewTicker(1 * time.Hour)
-	go func() {
-		for range ticker.C {
-			CleanupExpiredEmails(db)
-		}
-	}()
+// StartAuditRetentionJob deletes old audit log entries once a day. A zero
+// retention keeps entries forever, and returns a nil job.
+func StartAuditRetentionJob(db *gorm.DB, retention time.Duration) *Job {
+	if retention <= 0 {
+		return nil
+	}
+	return startJob(24*time.Hour, true, func() {
+		CleanupAuditLogs(db, retention)
+	})
 }
@@ -0,0 +1,48 @@
+package jobs
+
+import (
+	"sync"
+	"time"
+)
+
+// Job runs a function periodically in the background until it is closed.
+type Job struct {
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// startJob runs fn every interval, and once right away if now is set.
+func startJob(interval time.Duration, now bool, fn func()) *Job {
+	j := &Job{done: make(chan struct{})}
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		if now {
+			fn()
+		}
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-j.done:
+				return
+			}
+		}
+	}()
+	return j
+}
+
+// Close stops the job, waiting for a running pass to finish. A nil job is
+// already stopped.
+func (j *Job) Close() {
+	if j == nil {
+		return
+	}
+	j.closeOnce.Do(func() {
+		close(j.done)
+		j.wg.Wait()
+	})
+}
@@ -0,0 +1,119 @@
+// Package lifecycle runs the servers and background jobs of the application
+// until it receives SIGINT or SIGTERM or one of them fails, then stops them
+// in the reverse order they were started.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/kuun/slog"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+// DefaultTimeout bounds the shutdown of all components.
+const DefaultTimeout = 30 * time.Second
+
+type component struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// Lifecycle starts and stops the components of the application.
+type Lifecycle struct {
+	// Timeout bounds the shutdown, components still running afterwards are
+	// abandoned
+	Timeout time.Duration
+
+	components []component
+	failed     chan error
+	stopping   atomic.Bool
+}
+
+func New() *Lifecycle {
+	return &Lifecycle{
+		Timeout: DefaultTimeout,
+		failed:  make(chan error, 1),
+	}
+}
+
+// OnStop registers the function stopping a component started before the
+// next ones.
+func (l *Lifecycle) OnStop(name string, stop func(ctx context.Context) error) {
+	l.components = append(l.components, component{name: name, stop: stop})
+}
+
+// Go runs serve in the background until shutdown is called. If serve
+// returns before, as when it cannot listen, the application stops.
+func (l *Lifecycle) Go(name string, serve func() error, shutdown func(ctx context.Context) error) {
+	l.OnStop(name, shutdown)
+	go func() {
+		err := serve()
+		if l.stopping.Load() {
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped unexpectedly")
+		}
+		select {
+		case l.failed <- fmt.Errorf("%s: %w", name, err):
+		default:
+		}
+	}()
+}
+
+// Run waits for SIGINT, SIGTERM, the end of ctx or a failing component, then
+// stops the components. It returns the failure, or the first error stopping
+// a component.
+func (l *Lifecycle) Run(ctx context.Context) error {
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Infof("Shutting down")
+	case err = <-l.failed:
+		log.Errorf("Shutting down after a failure: %v", err)
+	}
+	l.stopping.Store(true)
+
+	stopCtx, cancelStop := context.WithTimeout(context.Background(), l.Timeout)
+	defer cancelStop()
+	for i := len(l.components) - 1; i >= 0; i-- {
+		c := l.components[i]
+		if stopErr := c.stop(stopCtx); stopErr != nil {
+			log.Errorf("Failed to stop %s: %v", c.name, stopErr)
+			if err == nil {
+				err = fmt.Errorf("%s: %w", c.name, stopErr)
+			}
+		}
+	}
+	return err
+}
+
+// Close adapts a Close method that waits for a component to stop, giving
+// up when ctx is done.
+func Close(fn func()) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			fn()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	l := New()
+	var stopped []string
+	stop := func(name string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			stopped = append(stopped, name)
+			return nil
+		}
+	}
+
+	done := make(chan struct{})
+	l.OnStop("database", stop("database"))
+	l.Go("server", func() error {
+		<-done
+		return errors.New("server closed")
+	}, func(ctx context.Context) error {
+		close(done)
+		return stop("server")(ctx)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, l.Run(ctx))
+	assert.Equal(t, []string{"server", "database"}, stopped)
+}
+
+func TestRunFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		serve   func() error
+		wantErr string
+	}{
+		{
+			name:    "error",
+			serve:   func() error { return errors.New("address already in use") },
+			wantErr: "smtp: address already in use",
+		},
+		{
+			name:    "returns",
+			serve:   func() error { return nil },
+			wantErr: "smtp: stopped unexpectedly",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New()
+			stopped := false
+			l.OnStop("http", func(ctx context.Context) error {
+				stopped = true
+				return nil
+			})
+			l.Go("smtp", tt.serve, func(ctx context.Context) error { return nil })
+
+			err := l.Run(context.Background())
+			assert.EqualError(t, err, tt.wantErr)
+			assert.True(t, stopped)
+		})
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	l := New()
+	l.Timeout = 10 * time.Millisecond
+	l.OnStop("relay", Close(func() { time.Sleep(time.Second) }))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := l.Run(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -1,16 +1,34 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
+	"secmail/audit"
+	"secmail/blob"
+	"secmail/challenge"
 	"secmail/config"
 	"secmail/controllers"
+	"secmail/database"
+	"secmail/dkim"
+	"secmail/encryption"
+	"secmail/imap"
+	"secmail/jmap"
 	"secmail/jobs"
+	"secmail/lifecycle"
 	"secmail/models"
+	"secmail/pop3"
+	"secmail/ratelimit"
+	"secmail/relay"
 	"secmail/smtp"
 )
 
@@ -22,47 +40,374 @@ func injectDB(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+// Middleware to inject the audit recorder into context
+func injectAudit(recorder *audit.Recorder) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("audit", recorder)
+		c.Next()
+	}
+}
+
+// Middleware to inject the DKIM key store into context
+func injectDKIM(store dkim.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("dkim", store)
+		c.Next()
+	}
+}
+
+// Middleware to inject the rate limiter into context, for the limits
+// applied by handlers
+func injectLimiter(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("limiter", limiter)
+		c.Next()
+	}
+}
+
+// Middleware to inject the blob store into context
+func injectBlobs(store blob.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("blobs", store)
+		c.Next()
+	}
+}
+
+// Middleware to inject the challenge verifier into context
+func injectVerifier(v challenge.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("challenge", v)
+		c.Next()
+	}
+}
+
+// newHTTPServer creates the HTTP server described in the configuration.
+func newHTTPServer(cfg config.HTTPConfig, handler http.Handler) (*http.Server, error) {
+	tlsConfig, err := cfg.LoadTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	server := &http.Server{
+		Addr:           cfg.Listen,
+		Handler:        handler,
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	if server.Addr == "" {
+		server.Addr = ":8080"
+	}
+	if server.ReadTimeout <= 0 {
+		server.ReadTimeout = 30 * time.Second
+	}
+	if server.IdleTimeout <= 0 {
+		server.IdleTimeout = 2 * time.Minute
+	}
+	return server, nil
+}
+
+// runMigrate runs `secmail migrate up|down [steps]|status`.
+func runMigrate(db *gorm.DB, blobs blob.Store, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: secmail migrate up|down [steps]|status")
+	}
+	switch args[0] {
+	case "up":
+		applied, err := database.Up(db, blob.DataMigrations(blobs)...)
+		for _, m := range applied {
+			log.Printf("Applied migration %d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			log.Printf("Database schema is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+			steps = n
+		}
+		reverted, err := database.Down(db, steps)
+		if err != nil {
+			return err
+		}
+		for _, m := range reverted {
+			log.Printf("Reverted migration %d_%s", m.Version, m.Name)
+		}
+	case "status":
+		status, err := database.Status(db)
+		if err != nil {
+			return err
+		}
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", m.Version, m.Name, applied)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+	return nil
+}
+
 func main() {
-	if err := config.InitConfig(); err != nil {
-		panic("Failed to load configuration: " + err.Error())
+	configPath := flag.String("config", "", "configuration file (default etc/secmail.yaml)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--config file] [migrate up|down [steps]|status]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) > 0 && args[0] != "migrate" {
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	db, err := gorm.Open(postgres.Open(config.GlobalConfig.Database.DSN()))
+	if err := config.InitConfig(*configPath); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	db, err := database.Open(config.GlobalConfig.Database)
+	if err != nil {
+		panic("Failed to connect to database: " + err.Error())
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		panic("Failed to connect to database: " + err.Error())
+	}
+	blobs, err := blob.NewStore(config.GlobalConfig.Blob)
 	if err != nil {
-		panic("Failed to connect to database")
+		panic("Failed to create blob store: " + err.Error())
 	}
+	if len(args) > 0 {
+		if err := runMigrate(db, blobs, args[1:]); err != nil {
+			panic("Failed to migrate database: " + err.Error())
+		}
+		sqlDB.Close()
+		return
+	}
+	if err := database.Check(db); err != nil {
+		panic("Refusing to start: " + err.Error())
+	}
+
+	if config.GlobalConfig.Encryption.Enable {
+		keyring, err := encryption.New(config.GlobalConfig.Encryption, db)
+		if err != nil {
+			panic("Failed to create encryption keyring: " + err.Error())
+		}
+		if n, err := keyring.Rewrap(); err != nil {
+			panic("Failed to rewrap data keys: " + err.Error())
+		} else if n > 0 {
+			log.Printf("Rewrapped %d data keys with the current master key", n)
+		}
+		if err := keyring.EnsureKeys(db); err != nil {
+			panic("Failed to create data keys: " + err.Error())
+		}
+		models.SetCipher(keyring)
+		if err := encryption.EncryptExisting(db, blobs); err != nil {
+			panic("Failed to encrypt existing messages: " + err.Error())
+		}
+	}
+
+	var limiter *ratelimit.Limiter
+	if config.GlobalConfig.RateLimit.Enable {
+		store, err := ratelimit.NewStore(config.GlobalConfig.RateLimit.Store, db)
+		if err != nil {
+			panic("Failed to create rate limiter: " + err.Error())
+		}
+		limiter = ratelimit.New(store)
+	}
+	limits := config.GlobalConfig.RateLimit
+
+	lc := lifecycle.New()
+	// components stop in the reverse order
+	lc.OnStop("database", func(ctx context.Context) error { return sqlDB.Close() })
 
-	// Auto migrate models
-	db.AutoMigrate(
-		&models.EmailAddress{},
-		&models.Message{},
-		&models.Attachment{},
-		&models.AuditLog{},
-	)
+	recorder := audit.NewRecorder(db, config.GlobalConfig.Audit)
+	lc.OnStop("audit recorder", lifecycle.Close(recorder.Close))
 
 	r := gin.Default()
+	// X-Forwarded-For is only read from these, the client IP is audited
+	if err := r.SetTrustedProxies(config.GlobalConfig.HTTP.TrustedProxies); err != nil {
+		panic("Invalid trusted proxies: " + err.Error())
+	}
+	r.Use(controllers.CORS(config.GlobalConfig.HTTP.CORSOrigins))
 
 	// Add DB middleware to all routes
 	r.Use(injectDB(db))
+	r.Use(injectAudit(recorder))
+	r.Use(injectBlobs(blobs))
+	r.Use(controllers.APIKeyAuth())
+
+	if config.GlobalConfig.Challenge.Enable {
+		verifier, err := challenge.NewVerifier(config.GlobalConfig.Challenge)
+		if err != nil {
+			panic("Failed to create challenge verifier: " + err.Error())
+		}
+		r.Use(injectVerifier(verifier))
+	}
+
+	var keys dkim.Store
+	if config.GlobalConfig.DKIM.Enable {
+		keys, err = dkim.NewStore(config.GlobalConfig.DKIM, db)
+		if err != nil {
+			panic("Failed to create DKIM key store: " + err.Error())
+		}
+		if err := dkim.EnsureKey(keys, config.GlobalConfig.DKIM.Algorithm, config.GlobalConfig.EmailDomain); err != nil {
+			panic("Failed to create DKIM key: " + err.Error())
+		}
+	}
+
+	createLimit := ratelimit.Middleware(limiter, "create_address", limits.CreateAddress)
+	readLimit := ratelimit.Middleware(limiter, "api_read", limits.APIRead)
 
 	// Routes
-	r.POST("/api/email", controllers.CreateTempEmail)
-	r.GET("/api/email/:id", controllers.GetTempEmail)
-	r.GET("/api/email/:id/messages", controllers.GetMessages)
-	r.GET("/api/message/:id", controllers.GetMessage)
-	r.DELETE("/api/message/:id", controllers.DeleteMessage)
-	r.GET("/api/message/:id/attachment/:attachmentId", controllers.GetAttachment)
-	r.DELETE("/api/email/:id", controllers.DeleteTempEmail)
+	r.GET("/api/email/challenge", readLimit, controllers.GetChallenge)
+	r.POST("/api/email", controllers.AllowScope(models.ScopeAddressCreate), createLimit, controllers.CreateTempEmail)
+
+	address := r.Group("/api", controllers.AllowScope(models.ScopeAddressRead))
+	address.GET("/email/:id", readLimit, controllers.GetTempEmail)
+	address.GET("/email/:id/messages", readLimit, controllers.GetMessages)
+	address.GET("/message/:id", readLimit, controllers.GetMessage)
+	address.DELETE("/message/:id", controllers.DeleteMessage)
+	address.GET("/message/:id/attachment/:attachmentId", readLimit, controllers.GetAttachment)
+	address.DELETE("/email/:id", controllers.DeleteTempEmail)
+	address.GET("/email/:id/rules", readLimit, controllers.GetFilterRules)
+	address.PUT("/email/:id/rules", controllers.PutFilterRules)
+	address.POST("/email/:id/rules/test", readLimit, controllers.TestFilterRules)
 
-	// Start SMTP server in a goroutine
-	go func() {
-		if err := smtp.StartSMTPServer(db); err != nil {
-			log.Printf("SMTP server error: %v", err)
+	r.GET("/api/projects/:project/messages", controllers.RequireScope(models.ScopeProjectRead), readLimit,
+		controllers.ListProjectMessages)
+
+	admin := r.Group("/api/admin", controllers.RequireScope(models.ScopeAdmin))
+	admin.POST("/keys", controllers.CreateAPIKey)
+	admin.GET("/keys", controllers.ListAPIKeys)
+	admin.DELETE("/keys/:id", controllers.RevokeAPIKey)
+	admin.POST("/smtp-credentials", controllers.CreateSMTPCredential)
+	admin.GET("/smtp-credentials", controllers.ListSMTPCredentials)
+	admin.DELETE("/smtp-credentials/:id", controllers.DeleteSMTPCredential)
+	admin.GET("/addresses", controllers.AdminListAddresses)
+	admin.GET("/addresses/:id", controllers.AdminGetAddress)
+	admin.DELETE("/addresses/:id", controllers.AdminDeleteAddress)
+	admin.POST("/addresses/:id/expire", controllers.AdminExpireAddress)
+	admin.GET("/audit", controllers.AdminSearchAuditLogs)
+	admin.GET("/outbound", controllers.AdminListOutbound)
+
+	if keys != nil {
+		dkimAdmin := admin.Group("/dkim", injectDKIM(keys))
+		dkimAdmin.GET("", controllers.AdminListDKIMKeys)
+		dkimAdmin.POST("/rotate", controllers.AdminRotateDKIMKey)
+		dkimAdmin.POST("/:selector/activate", controllers.AdminActivateDKIMKey)
+		dkimAdmin.DELETE("/:selector", controllers.AdminDeleteDKIMKey)
+	}
+
+	if config.GlobalConfig.Relay.Enable {
+		forwardLimit := ratelimit.Middleware(limiter, "forward_rule", limits.ForwardRule)
+		address.POST("/email/:id/forward", forwardLimit, injectLimiter(limiter), controllers.CreateForwardRule)
+		address.GET("/email/:id/forward", readLimit, controllers.ListForwardRules)
+		address.POST("/email/:id/forward/:ruleId/verify", controllers.VerifyForwardRule)
+		address.DELETE("/email/:id/forward/:ruleId", controllers.DeleteForwardRule)
+		address.POST("/email/:id/send", controllers.SendMessage)
+		address.POST("/message/:id/reply", controllers.ReplyMessage)
+	}
+
+	if config.GlobalConfig.Compat.Enable {
+		compat := r.Group("/api", readLimit)
+		if config.GlobalConfig.Compat.RequireAPIKey {
+			compat.Use(controllers.RequireScope(models.ScopeAdmin))
 		}
-	}()
+		// MailHog v2
+		compat.GET("/v2/messages", controllers.MailHogListMessages)
+		compat.GET("/v2/search", controllers.MailHogSearch)
+		compat.DELETE("/v1/messages/:id", controllers.MailHogDeleteMessage)
+		// Mailpit v1
+		compat.GET("/v1/messages", controllers.MailpitListMessages)
+		compat.PUT("/v1/messages", controllers.MailpitSetReadStatus)
+		compat.DELETE("/v1/messages", controllers.MailpitDeleteMessages)
+		compat.GET("/v1/search", controllers.MailpitSearch)
+		compat.GET("/v1/message/:id", controllers.MailpitGetMessage)
+		compat.GET("/v1/message/:id/raw", controllers.MailpitGetRaw)
+		compat.GET("/v1/message/:id/part/:partId", controllers.MailpitGetPart)
+	}
 
-	// Start cleanup job
-	jobs.StartCleanupJob(db)
+	if config.GlobalConfig.JMAP.Enable {
+		jmap.RegisterRoutes(r.Group("", readLimit))
+	}
+
+	if config.GlobalConfig.Relay.Enable {
+		rl, err := relay.StartRelay(db, recorder, keys)
+		if err != nil {
+			panic("Failed to start relay: " + err.Error())
+		}
+		lc.OnStop("relay", lifecycle.Close(rl.Close))
+	}
+
+	// Start cleanup jobs
+	lc.OnStop("cleanup job", lifecycle.Close(jobs.StartCleanupJob(db, blobs).Close))
+	lc.OnStop("audit retention job",
+		lifecycle.Close(jobs.StartAuditRetentionJob(db, config.GlobalConfig.Audit.Retention).Close))
+
+	smtpServer, err := smtp.NewSMTPServer(db, limiter, recorder, blobs)
+	if err != nil {
+		panic("Failed to create SMTP server: " + err.Error())
+	}
+	// in-flight deliveries complete, idle sessions end with their timeout
+	lc.Go("SMTP server", smtpServer.ListenAndServe, func(ctx context.Context) error {
+		if err := smtpServer.Shutdown(ctx); err != nil {
+			smtpServer.Close()
+			return err
+		}
+		return nil
+	})
 
-	r.Run(":8080")
+	if config.GlobalConfig.IMAP.Enable {
+		imapServer, err := imap.NewIMAPServer(db, recorder, blobs)
+		if err != nil {
+			panic("Failed to create IMAP server: " + err.Error())
+		}
+		lc.Go("IMAP server", imapServer.ListenAndServe, func(ctx context.Context) error {
+			return imapServer.Close()
+		})
+	}
+
+	if config.GlobalConfig.POP3.Enable {
+		pop3Server, err := pop3.NewPOP3Server(db, recorder, blobs)
+		if err != nil {
+			panic("Failed to create POP3 server: " + err.Error())
+		}
+		lc.Go("POP3 server", pop3Server.ListenAndServe, pop3Server.Shutdown)
+	}
+
+	httpServer, err := newHTTPServer(config.GlobalConfig.HTTP, r)
+	if err != nil {
+		panic("Failed to create HTTP server: " + err.Error())
+	}
+	httpServer.RegisterOnShutdown(jmap.CloseEventSources)
+	log.Printf("Starting HTTP server at %s (TLS: %v)", httpServer.Addr, httpServer.TLSConfig != nil)
+	lc.Go("HTTP server", func() error {
+		if httpServer.TLSConfig != nil {
+			return httpServer.ListenAndServeTLS("", "")
+		}
+		return httpServer.ListenAndServe()
+	}, func(ctx context.Context) error {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			httpServer.Close()
+			return err
+		}
+		return nil
+	})
+
+	if err := lc.Run(context.Background()); err != nil {
+		log.Printf("Stopped with error: %v", err)
+		os.Exit(1)
+	}
 }
@@ -1,25 +1,69 @@
 package models
 
 import (
+	"crypto/subtle"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+const accessTokenPrefix = "at_"
+
 type EmailAddress struct {
 	gorm.Model
-	Address      string `gorm:"uniqueIndex"`
-	ExpiresAt    time.Time
-	Messages     []Message `gorm:"foreignKey:EmailID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
-	CreatorIP    string    `gorm:"-"`
-	CreatorAgent string    `gorm:"-"`
+	Address string `gorm:"uniqueIndex"`
+	// TokenHash is the hash of the access token used by IMAP and other
+	// mailbox protocols
+	TokenHash string
+	ExpiresAt time.Time `gorm:"index"`
+	// Project is the sandbox project whose mail provisioned the address
+	Project string `gorm:"index"`
+	// FilterRules is the JSON list of filter.Rule applied to incoming mail
+	FilterRules string `gorm:"type:text"`
+	// PGPKey is the armored OpenPGP public key incoming mail is encrypted
+	// to, the plaintext is never stored
+	PGPKey string `gorm:"type:text"`
+	// LastUID is the UID of the last message of the address, see AllocateUIDs
+	LastUID      uint32        `gorm:"not null;default:0"`
+	Messages     []Message     `gorm:"foreignKey:EmailID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	ForwardRules []ForwardRule `gorm:"foreignKey:EmailID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
+	CreatorIP    string        `gorm:"-"`
+	CreatorAgent string        `gorm:"-"`
+	DeleterIP    string        `gorm:"-"`
+	DeleterAgent string        `gorm:"-"`
+}
+
+// NewAccessToken generates an access token for the address and stores its
+// hash in TokenHash. The token itself is only returned here.
+func (e *EmailAddress) NewAccessToken() (string, error) {
+	token, hash, err := generateToken(accessTokenPrefix)
+	if err != nil {
+		return "", err
+	}
+	e.TokenHash = hash
+	return token, nil
+}
+
+func (e *EmailAddress) CheckAccessToken(token string) bool {
+	if e.TokenHash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(e.TokenHash)) == 1
+}
+
+// UIDValidity is the IMAP UIDVALIDITY of the address' inbox.
+func (e *EmailAddress) UIDValidity() uint32 {
+	return uint32(e.CreatedAt.Unix())
 }
 
 func (e *EmailAddress) AfterCreate(tx *gorm.DB) error {
+	if err := CreateKey(tx, e.ID); err != nil {
+		return err
+	}
 	return tx.Create(&AuditLog{
 		EmailID:      e.ID,
 		EmailAddress: e.Address,
-		Action:       "create",
+		Action:       AuditActionCreate,
 		IP:           e.CreatorIP,
 		UserAgent:    e.CreatorAgent,
 		CreatedAt:    time.Now(),
@@ -30,9 +74,9 @@ func (e *EmailAddress) BeforeDelete(tx *gorm.DB) error {
 	return tx.Create(&AuditLog{
 		EmailID:      e.ID,
 		EmailAddress: e.Address,
-		Action:       "delete",
-		IP:           e.CreatorIP,
-		UserAgent:    e.CreatorAgent,
+		Action:       AuditActionDelete,
+		IP:           e.DeleterIP,
+		UserAgent:    e.DeleterAgent,
 		CreatedAt:    time.Now(),
 	}).Error
 }
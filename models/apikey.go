@@ -0,0 +1,62 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ScopeAddressCreate = "address:create"
+	ScopeAddressRead   = "address:read"
+	ScopeProjectRead   = "project:read"
+	ScopeAdmin         = "admin"
+
+	apiKeyPrefix = "sm_"
+)
+
+var APIKeyScopes = []string{ScopeAddressCreate, ScopeAddressRead, ScopeProjectRead, ScopeAdmin}
+
+// APIKey authenticates programmatic clients. Only the SHA-256 of the key is
+// stored; the key itself is shown once when it is created.
+type APIKey struct {
+	gorm.Model
+	Name    string
+	Prefix  string
+	KeyHash string `gorm:"uniqueIndex"`
+	Scopes  string // space separated
+	// MaxTTL is the longest lifetime of addresses created with this key,
+	// zero means the default lifetime
+	MaxTTL time.Duration
+	// rate limit replacing the per-IP limits, zero requests means unlimited
+	RateLimitRequests int
+	RateLimitPeriod   time.Duration
+	RateLimitBurst    int
+	ExpiresAt         *time.Time
+	RevokedAt         *time.Time
+	LastUsedAt        *time.Time
+}
+
+// GenerateAPIKey returns a new random key and its hash.
+func GenerateAPIKey() (string, string, error) {
+	return generateToken(apiKeyPrefix)
+}
+
+func (k *APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// HasScope reports whether the key grants scope; admin grants everything.
+func (k *APIKey) HasScope(scope string) bool {
+	scopes := k.ScopeList()
+	return slices.Contains(scopes, scope) || slices.Contains(scopes, ScopeAdmin)
+}
+
+func (k *APIKey) Active(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
@@ -3,15 +3,30 @@ package models
 import (
 	"time"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+const (
+	AuditActionCreate        = "create"
+	AuditActionDelete        = "delete"
+	AuditActionAccess        = "access"
+	AuditActionDeleteMessage = "delete_message"
+	AuditActionDeliver       = "deliver"
+	AuditActionForward       = "forward"
+	AuditActionBounce        = "bounce"
+	AuditActionSend          = "send"
+	AuditActionFilter        = "filter"
+)
+
 type AuditLog struct {
 	gorm.Model
 	EmailID      uint
 	EmailAddress string
-	Action       string // e.g. "create", "delete", "access"
+	MessageID    *uuid.UUID `gorm:"type:uuid"`
+	Action       string     // see the AuditAction constants
 	IP           string
 	UserAgent    string
-	CreatedAt    time.Time
+	Detail       string
+	CreatedAt    time.Time `gorm:"index"`
 }
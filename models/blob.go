@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// Blob counts the attachments referencing a content of the blob store, which
+// is keyed by its SHA-256 hash. Blobs without references are deleted by the
+// cleanup job.
+type Blob struct {
+	Hash      string `gorm:"primaryKey;size:64"`
+	Size      int64
+	RefCount  int `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
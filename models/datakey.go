@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// DataKey is the data key encrypting the contents of an address, wrapped by
+// a master key, as kept by the database key store.
+type DataKey struct {
+	EmailID uint `gorm:"primaryKey;autoIncrement:false"`
+	// MasterKeyID identifies the master key that wrapped the key
+	MasterKeyID string `gorm:"index"`
+	Wrapped     []byte
+	CreatedAt   time.Time
+}
@@ -0,0 +1,15 @@
+package models
+
+import "gorm.io/gorm"
+
+// DKIMKey is a DKIM signing key of the database key store.
+type DKIMKey struct {
+	gorm.Model
+	Selector  string `gorm:"uniqueIndex"`
+	Algorithm string
+	// PrivateKey is PKCS #8 DER
+	PrivateKey []byte
+	Active     bool
+	// Pending is set until the key is activated for the first time
+	Pending bool `gorm:"not null;default:false"`
+}
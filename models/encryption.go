@@ -0,0 +1,197 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Cipher encrypts the contents of an address at rest with the data key of
+// the address.
+type Cipher interface {
+	// Seal encrypts plaintext for an address. The result carries the id of
+	// the address, so that Open needs nothing else.
+	Seal(emailID uint, plaintext []byte) ([]byte, error)
+	// Open decrypts the result of Seal.
+	Open(ciphertext []byte) ([]byte, error)
+	// BlobKey derives the blob store key of an attachment content of an
+	// address, so that identical contents are stored once per address.
+	BlobKey(emailID uint, content []byte) (string, error)
+	// CreateKey creates the data key of a new address in the transaction
+	// creating it, so that it exists before any content is stored.
+	CreateKey(tx *gorm.DB, emailID uint) error
+	// Shred deletes the data key of an address, its contents cannot be
+	// decrypted anymore.
+	Shred(emailID uint) error
+}
+
+var (
+	cipher Cipher
+
+	ErrNoCipher = errors.New("encrypted content but encryption at rest is not configured")
+)
+
+const (
+	// SealedMagic starts the contents sealed by a Cipher
+	SealedMagic = "SME1"
+	// SealedPrefix starts sealed contents of string columns, in base64
+	SealedPrefix = "$sme1$"
+)
+
+// SetCipher enables encryption at rest for the contents stored from now on.
+func SetCipher(c Cipher) {
+	cipher = c
+}
+
+// Encrypting reports whether contents are encrypted at rest.
+func Encrypting() bool {
+	return cipher != nil
+}
+
+// IsSealed reports whether data is the result of Seal.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(SealedMagic))
+}
+
+// Seal encrypts data for an address, it returns data unchanged when
+// encryption at rest is disabled.
+func Seal(emailID uint, data []byte) ([]byte, error) {
+	if cipher == nil {
+		return data, nil
+	}
+	return cipher.Seal(emailID, data)
+}
+
+// Open decrypts data sealed by Seal, other data is returned unchanged.
+func Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	if cipher == nil {
+		return nil, ErrNoCipher
+	}
+	return cipher.Open(data)
+}
+
+// BlobKey returns the blob store key of an attachment content of an
+// address, which is sealed with Seal.
+func BlobKey(emailID uint, content []byte) (string, error) {
+	if cipher == nil {
+		return "", ErrNoCipher
+	}
+	return cipher.BlobKey(emailID, content)
+}
+
+// CreateKey creates the data key of an address, if encryption at rest is
+// enabled and it has none.
+func CreateKey(tx *gorm.DB, emailID uint) error {
+	if cipher == nil {
+		return nil
+	}
+	return cipher.CreateKey(tx, emailID)
+}
+
+// Shred deletes the data key of an address, if encryption at rest is
+// enabled.
+func Shred(emailID uint) error {
+	if cipher == nil {
+		return nil
+	}
+	return cipher.Shred(emailID)
+}
+
+func init() {
+	schema.RegisterSerializer("encrypted", EncryptedSerializer{})
+}
+
+// EncryptedSerializer seals string and []byte fields of a model with an
+// EmailID field. Values stored before encryption was enabled are read as
+// they are.
+type EncryptedSerializer struct{}
+
+func (EncryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue any) error {
+	var data []byte
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported type %T for encrypted field %s", dbValue, field.Name)
+	}
+
+	fieldValue := field.ReflectValueOf(ctx, dst)
+	switch fieldValue.Kind() {
+	case reflect.String:
+		encoded, ok := strings.CutPrefix(string(data), SealedPrefix)
+		if !ok {
+			fieldValue.SetString(string(data))
+			return nil
+		}
+		sealed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || !IsSealed(sealed) {
+			return fmt.Errorf("invalid encrypted field %s", field.Name)
+		}
+		plaintext, err := Open(sealed)
+		if err != nil {
+			return err
+		}
+		fieldValue.SetString(string(plaintext))
+	case reflect.Slice:
+		plaintext, err := Open(data)
+		if err != nil {
+			return err
+		}
+		fieldValue.SetBytes(plaintext)
+	default:
+		return fmt.Errorf("unsupported encrypted field %s", field.Name)
+	}
+	return nil
+}
+
+func (EncryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue any) (any, error) {
+	var data []byte
+	isString := false
+	switch v := fieldValue.(type) {
+	case string:
+		data, isString = []byte(v), true
+	case []byte:
+		if v == nil {
+			return nil, nil
+		}
+		data = v
+	default:
+		return nil, fmt.Errorf("unsupported type %T for encrypted field %s", fieldValue, field.Name)
+	}
+	if cipher == nil || len(data) == 0 {
+		if isString {
+			return string(data), nil
+		}
+		return data, nil
+	}
+
+	emailField := field.Schema.LookUpField("EmailID")
+	if emailField == nil {
+		return nil, fmt.Errorf("encrypted field %s needs an EmailID field", field.Name)
+	}
+	emailID, zero := emailField.ValueOf(ctx, dst)
+	if zero {
+		return nil, fmt.Errorf("encrypted field %s without EmailID", field.Name)
+	}
+	sealed, err := cipher.Seal(emailID.(uint), data)
+	if err != nil {
+		return nil, err
+	}
+	if isString {
+		return SealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+	}
+	return sealed, nil
+}
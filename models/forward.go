@@ -0,0 +1,77 @@
+package models
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const forwardCodePrefix = "fc_"
+
+// ForwardRule forwards the mail of an address to a real mailbox. The
+// destination has to confirm the rule with the code mailed to it first.
+type ForwardRule struct {
+	gorm.Model
+	EmailID     uint `gorm:"index"`
+	Destination string
+	// FromFilter and SubjectFilter restrict the rule to messages whose
+	// sender or subject contain them, ignoring case
+	FromFilter    string
+	SubjectFilter string
+	CodeHash      string
+	VerifiedAt    *time.Time
+}
+
+// NewVerificationCode generates the code confirming the destination and
+// stores its hash.
+func (r *ForwardRule) NewVerificationCode() (string, error) {
+	code, hash, err := generateToken(forwardCodePrefix)
+	if err != nil {
+		return "", err
+	}
+	r.CodeHash = hash
+	return code, nil
+}
+
+func (r *ForwardRule) CheckVerificationCode(code string) bool {
+	if r.CodeHash == "" || code == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashToken(code)), []byte(r.CodeHash)) == 1
+}
+
+// Matches reports whether a message passes the filters of the rule.
+func (r *ForwardRule) Matches(from, subject string) bool {
+	return strings.Contains(strings.ToLower(from), strings.ToLower(r.FromFilter)) &&
+		strings.Contains(strings.ToLower(subject), strings.ToLower(r.SubjectFilter))
+}
+
+const (
+	OutboundQueued  = "queued"
+	OutboundSent    = "sent"
+	OutboundBounced = "bounced"
+)
+
+// OutboundMessage is an entry of the relay queue: mail forwarded by a rule,
+// its verification code, or mail sent by the address itself.
+type OutboundMessage struct {
+	gorm.Model
+	EmailID uint `gorm:"index"`
+	// MessageID is the message forwarded or replied to
+	MessageID *uuid.UUID `gorm:"type:uuid"`
+	RuleID    *uint
+	// MailFrom is the envelope sender, SRS rewritten for forwarded mail
+	MailFrom string `gorm:"index"`
+	RcptTo   string
+	Raw      []byte `gorm:"serializer:encrypted;type:bytes"`
+	// Status is one of the Outbound constants
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string
+	SentAt        *time.Time
+	BouncedAt     *time.Time
+}
@@ -1,37 +1,119 @@
 package models
 
 import (
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+// Message is a message received by an address. Deleting a message soft
+// deletes it, so that its UID is not reused, and hard deletes its
+// attachments; the row goes with its address.
 type Message struct {
-	ID          uuid.UUID `gorm:"type:uuid;primary_key"`
-	EmailID     uint
-	From        string
-	Subject     string
-	Content     string
-	HTMLContent string `gorm:"type:text"`
-	CreatedAt   time.Time
+	ID      uuid.UUID `gorm:"type:uuid;primaryKey"`
+	EmailID uint      `gorm:"uniqueIndex:idx_messages_email_uid;index:idx_messages_email_created,priority:1"`
+	// UID numbers the messages of an address in arrival order, as used by IMAP
+	UID     uint32 `gorm:"uniqueIndex:idx_messages_email_uid"`
+	From    string
+	Subject string
+	// Content, HTMLContent and Raw are encrypted at rest when it is enabled
+	Content     string `gorm:"serializer:encrypted"`
+	HTMLContent string `gorm:"serializer:encrypted;type:text"`
+	// Raw is the message as received over SMTP, without the attachment
+	// contents the blob store keeps (see blob.Source)
+	Raw []byte `gorm:"serializer:encrypted;type:bytes"`
+	// Encrypted tells whether the message was stored with encryption at rest
+	Encrypted bool
+	// PGP tells whether the message was encrypted to the OpenPGP key of the
+	// address: Raw is PGP/MIME and Content the armored ciphertext
+	PGP         bool
+	Seen        bool
+	Flagged     bool
+	DeletedFlag bool // IMAP \Deleted, the message is removed on EXPUNGE
+	// Project of the SMTP credentials the message was sent with
+	Project string `gorm:"index"`
+	// Labels set by filter rules, comma separated
+	Labels      string
+	CreatedAt   time.Time `gorm:"index:idx_messages_email_created,priority:2"`
 	UpdatedAt   time.Time
 	DeletedAt   gorm.DeletedAt `gorm:"index"`
 	Attachments []Attachment   `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE,OnUpdate:CASCADE;"`
 }
 
+// LabelList returns the labels of the message.
+func (m *Message) LabelList() []string {
+	if m.Labels == "" {
+		return []string{}
+	}
+	return strings.Split(m.Labels, ",")
+}
+
+// Attachment is a file attached to a message. It is never soft deleted:
+// blob.DeleteAttachments deletes it with its blob reference.
 type Attachment struct {
-	gorm.Model
-	ID          uuid.UUID `gorm:"type:uuid;primary_key"`
-	MessageID   uuid.UUID
+	ID          uuid.UUID `gorm:"type:uuid;primaryKey"`
+	MessageID   uuid.UUID `gorm:"type:uuid;not null;index"`
 	FileName    string
 	ContentType string
-	Data        []byte
+	// BlobKey locates the content in the blob store
+	BlobKey string
+	// Hash is the SHA-256 of the content, which is also its key unless it is
+	// encrypted at rest; attachments moved to the blob store before
+	// deduplication have none
+	Hash      string `gorm:"index"`
+	Size      int64
+	CreatedAt time.Time
+	// Data is the content, only loaded while migrating attachments stored
+	// in the database
+	Data []byte `gorm:"-"`
 }
 
 func (m *Message) BeforeCreate(tx *gorm.DB) error {
 	if m.ID == uuid.Nil {
 		m.ID = uuid.New()
 	}
+	m.Encrypted = Encrypting()
+	if m.UID == 0 && m.EmailID != 0 {
+		uid, err := AllocateUIDs(tx.Session(&gorm.Session{NewDB: true}), m.EmailID, 1)
+		if err != nil {
+			return err
+		}
+		m.UID = uid
+	}
+	return nil
+}
+
+func (a *Attachment) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
 	return nil
 }
+
+// AllocateUIDs takes n UIDs for new messages of an address and returns the
+// first one. The counter of the address is incremented in place, so its row
+// stays locked until the transaction commits and concurrent deliveries get
+// distinct UIDs. UIDs are never reused, even once messages are deleted.
+func AllocateUIDs(db *gorm.DB, emailID uint, n int) (uint32, error) {
+	var last uint32
+	if err := db.Raw("UPDATE email_addresses SET last_uid = last_uid + ? WHERE id = ? RETURNING last_uid",
+		n, emailID).Scan(&last).Error; err != nil {
+		return 0, err
+	}
+	if last == 0 {
+		return 0, gorm.ErrRecordNotFound
+	}
+	return last - uint32(n) + 1, nil
+}
+
+// NextUID returns the UID the next message of an address will get.
+func NextUID(db *gorm.DB, emailID uint) (uint32, error) {
+	var last uint32
+	err := db.Unscoped().Model(&EmailAddress{}).
+		Where("id = ?", emailID).
+		Select("last_uid").
+		Scan(&last).Error
+	return last + 1, err
+}
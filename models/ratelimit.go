@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// RateLimitBucket is the persisted state of a token bucket, used when the
+// rate limiter has to be shared between several secmail instances.
+type RateLimitBucket struct {
+	Key       string `gorm:"primaryKey;size:255"`
+	Tokens    float64
+	UpdatedAt time.Time
+}
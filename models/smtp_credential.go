@@ -0,0 +1,33 @@
+package models
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const smtpPasswordPrefix = "sp_"
+
+// SMTPCredential authenticates SMTP clients with AUTH PLAIN or LOGIN; the
+// mail they send is tagged with Project. Only the SHA-256 of the password is
+// stored; the password itself is shown once when it is created.
+type SMTPCredential struct {
+	gorm.Model
+	Project      string `gorm:"index"`
+	Username     string `gorm:"uniqueIndex"`
+	PasswordHash string
+	LastUsedAt   *time.Time
+}
+
+// GenerateSMTPPassword returns a new random password and its hash.
+func GenerateSMTPPassword() (string, string, error) {
+	return generateToken(smtpPasswordPrefix)
+}
+
+func (c *SMTPCredential) CheckPassword(password string) bool {
+	if c.PasswordHash == "" || password == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashToken(password)), []byte(c.PasswordHash)) == 1
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"bytes"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// placeholder sender for messages received with an empty reverse path
+const nullSender = "mailer-daemon@invalid"
+
+// Source returns the RFC 822 source of the message. Messages stored before
+// the raw source was kept are rebuilt from their parts, including the
+// attachments whose Data is loaded.
+func (m *Message) Source(to string) ([]byte, error) {
+	if len(m.Raw) > 0 {
+		return m.Raw, nil
+	}
+
+	from := m.From
+	if from == "" {
+		from = nullSender
+	}
+	b := enmime.Builder().
+		From("", from).
+		To("", to).
+		Subject(m.Subject).
+		Date(m.CreatedAt).
+		Header("Message-Id", "<"+m.ID.String()+"@secmail>").
+		Text([]byte(m.Content))
+	if m.HTMLContent != "" {
+		b = b.HTML([]byte(m.HTMLContent))
+	}
+	for _, a := range m.Attachments {
+		if a.Data != nil {
+			b = b.AddAttachment(a.Data, a.ContentType, a.FileName)
+		}
+	}
+
+	part, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := part.Encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
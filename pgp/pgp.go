@@ -0,0 +1,158 @@
+// Package pgp encrypts incoming mail to the OpenPGP public key of an
+// address, so that only the holder of the private key can read it.
+package pgp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// MaxKeySize bounds the armored public keys accepted for an address.
+const MaxKeySize = 64 * 1024
+
+const (
+	beginMessage = "-----BEGIN PGP MESSAGE-----"
+	endMessage   = "-----END PGP MESSAGE-----"
+)
+
+// HiddenSubject replaces the subject of encrypted messages, the original
+// one is in the encrypted part.
+const HiddenSubject = "..."
+
+var (
+	ErrInvalidKey = errors.New("invalid OpenPGP public key")
+	ErrPrivateKey = errors.New("an OpenPGP private key was given, only the public key is needed")
+	ErrNoSubkey   = errors.New("the OpenPGP key has no valid encryption key")
+	ErrNoMessage  = errors.New("no OpenPGP message found")
+)
+
+// keptHeaders stay readable in the headers of encrypted messages, to
+// deliver and thread them.
+var keptHeaders = []string{
+	"From", "To", "Cc", "Reply-To", "Date", "Message-Id", "In-Reply-To", "References",
+}
+
+// ReadKey parses an armored public key, which has to be able to encrypt.
+func ReadKey(armored string) (openpgp.EntityList, error) {
+	if len(armored) > MaxKeySize {
+		return nil, ErrInvalidKey
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil || len(entities) == 0 {
+		return nil, ErrInvalidKey
+	}
+	now := time.Now()
+	for _, e := range entities {
+		if e.PrivateKey != nil {
+			return nil, ErrPrivateKey
+		}
+		if _, ok := e.EncryptionKey(now); !ok {
+			return nil, ErrNoSubkey
+		}
+	}
+	return entities, nil
+}
+
+// Fingerprint returns the fingerprint of the primary key, in upper case hex.
+func Fingerprint(armored string) (string, error) {
+	entities, err := ReadKey(armored)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(entities[0].PrimaryKey.Fingerprint)), nil
+}
+
+// Encrypt encrypts a message to an armored public key. It returns the
+// PGP/MIME message (RFC 3156), whose encrypted part is the whole original
+// message.
+func Encrypt(armored string, raw []byte) ([]byte, error) {
+	entities, err := ReadKey(armored)
+	if err != nil {
+		return nil, err
+	}
+
+	var encrypted bytes.Buffer
+	aw, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openpgp.Encrypt(aw, entities, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	encrypted.WriteString("\n")
+
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		header = textproto.MIMEHeader{}
+	}
+	boundary, err := newBoundary()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, name := range keptHeaders {
+		for _, v := range header.Values(name) {
+			fmt.Fprintf(&buf, "%s: %s\r\n", name, v)
+		}
+	}
+	fmt.Fprintf(&buf, "Subject: %s\r\n", HiddenSubject)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"%s\"\r\n", boundary)
+	buf.WriteString("\r\n")
+	buf.WriteString("This is an OpenPGP/MIME encrypted message (RFC 3156).\r\n")
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	buf.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+	buf.WriteString("Version: 1\r\n\r\n")
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	buf.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	buf.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(encrypted.String(), "\n", "\r\n"))
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// Ciphertext returns the armored OpenPGP message in a PGP/MIME message
+// built by Encrypt, with LF line endings.
+func Ciphertext(message []byte) (string, error) {
+	start := bytes.Index(message, []byte(beginMessage))
+	if start < 0 {
+		return "", ErrNoMessage
+	}
+	end := bytes.Index(message[start:], []byte(endMessage))
+	if end < 0 {
+		return "", ErrNoMessage
+	}
+	armored := message[start : start+end+len(endMessage)]
+	return strings.ReplaceAll(string(armored), "\r\n", "\n") + "\n", nil
+}
+
+func newBoundary() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "pgp-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,112 @@
+package pgp
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMessage = "From: alice@example.com\r\n" +
+	"To: abcd123456@test.com\r\n" +
+	"Subject: Secret plans\r\n" +
+	"Message-Id: <1@example.com>\r\n" +
+	"\r\n" +
+	"Meet at noon\r\n"
+
+func newEntity(t *testing.T) *openpgp.Entity {
+	e, err := openpgp.NewEntity("Inbox", "", "abcd123456@test.com", nil)
+	require.NoError(t, err)
+	return e
+}
+
+func armorKey(t *testing.T, e *openpgp.Entity, private bool) string {
+	var buf bytes.Buffer
+	blockType := openpgp.PublicKeyType
+	if private {
+		blockType = openpgp.PrivateKeyType
+	}
+	w, err := armor.Encode(&buf, blockType, nil)
+	require.NoError(t, err)
+	if private {
+		require.NoError(t, e.SerializePrivate(w, nil))
+	} else {
+		require.NoError(t, e.Serialize(w))
+	}
+	require.NoError(t, w.Close())
+	return buf.String()
+}
+
+func TestReadKey(t *testing.T) {
+	e := newEntity(t)
+
+	_, err := ReadKey(armorKey(t, e, false))
+	assert.NoError(t, err)
+	_, err = ReadKey(armorKey(t, e, true))
+	assert.ErrorIs(t, err, ErrPrivateKey)
+	_, err = ReadKey("not a key")
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = ReadKey(strings.Repeat("a", MaxKeySize+1))
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	fingerprint, err := Fingerprint(armorKey(t, e, false))
+	require.NoError(t, err)
+	assert.Len(t, fingerprint, 40)
+	assert.Equal(t, strings.ToUpper(fingerprint), fingerprint)
+}
+
+func TestEncrypt(t *testing.T) {
+	e := newEntity(t)
+	message, err := Encrypt(armorKey(t, e, false), []byte(testMessage))
+	require.NoError(t, err)
+	assert.NotContains(t, string(message), "Meet at noon")
+	assert.NotContains(t, string(message), "Secret plans")
+
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", msg.Header.Get("From"))
+	assert.Equal(t, "<1@example.com>", msg.Header.Get("Message-Id"))
+	assert.Equal(t, HiddenSubject, msg.Header.Get("Subject"))
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/encrypted", mediaType)
+	assert.Equal(t, "application/pgp-encrypted", params["protocol"])
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	control, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "application/pgp-encrypted", control.Header.Get("Content-Type"))
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	block, err := armor.Decode(part)
+	require.NoError(t, err)
+
+	// the private key decrypts the whole original message
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{e}, nil, nil)
+	require.NoError(t, err)
+	plaintext, err := io.ReadAll(md.UnverifiedBody)
+	require.NoError(t, err)
+	assert.Equal(t, testMessage, string(plaintext))
+
+	// the armored ciphertext is read back from the message
+	ciphertext, err := Ciphertext(message)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(ciphertext, "-----BEGIN PGP MESSAGE-----"))
+	assert.True(t, strings.HasSuffix(ciphertext, "-----END PGP MESSAGE-----\n"))
+	assert.NotContains(t, ciphertext, "\r")
+	block, err = armor.Decode(strings.NewReader(ciphertext))
+	require.NoError(t, err)
+	_, err = openpgp.ReadMessage(block.Body, openpgp.EntityList{e}, nil, nil)
+	require.NoError(t, err)
+
+	_, err = Ciphertext([]byte(testMessage))
+	assert.ErrorIs(t, err, ErrNoMessage)
+}
@@ -0,0 +1,466 @@
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"secmail/blob"
+	"secmail/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// maxLineLength bounds a command line, it is the size of the read buffer
+const maxLineLength = 1024
+
+var errLineTooLong = errors.New("line too long")
+
+type state int
+
+const (
+	stateAuthorization state = iota
+	stateTransaction
+)
+
+type message struct {
+	id      uuid.UUID
+	source  []byte
+	deleted bool
+}
+
+type conn struct {
+	server *Server
+	nc     net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+
+	state    state
+	user     string
+	address  models.EmailAddress
+	messages []message
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	c := &conn{server: s}
+	c.setConn(nc)
+	return c
+}
+
+func (c *conn) setConn(nc net.Conn) {
+	c.nc = nc
+	c.r = bufio.NewReaderSize(nc, maxLineLength)
+	c.w = bufio.NewWriter(nc)
+}
+
+func (c *conn) close() {
+	c.nc.Close()
+}
+
+func (c *conn) isTLS() bool {
+	_, ok := c.nc.(*tls.Conn)
+	return ok
+}
+
+func (c *conn) remoteIP() string {
+	host, _, err := net.SplitHostPort(c.nc.RemoteAddr().String())
+	if err != nil {
+		return c.nc.RemoteAddr().String()
+	}
+	return host
+}
+
+func (c *conn) ok(format string, args ...any) {
+	fmt.Fprintf(c.w, "+OK "+format+"\r\n", args...)
+}
+
+func (c *conn) err(format string, args ...any) {
+	fmt.Fprintf(c.w, "-ERR "+format+"\r\n", args...)
+}
+
+// writeMultiline writes a dot-stuffed multi-line response body.
+func (c *conn) writeMultiline(lines [][]byte) {
+	for _, line := range lines {
+		if bytes.HasPrefix(line, []byte(".")) {
+			c.w.WriteByte('.')
+		}
+		c.w.Write(line)
+		c.w.WriteString("\r\n")
+	}
+	c.w.WriteString(".\r\n")
+}
+
+func (c *conn) serve() {
+	defer c.close()
+	// a bug in a command must not take down the other connections
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("POP3 connection from %s panicked: %v\n%s", c.remoteIP(), r, debug.Stack())
+		}
+	}()
+
+	c.ok("secmail POP3 server ready")
+	for {
+		if err := c.w.Flush(); err != nil {
+			return
+		}
+		if c.server.Timeout > 0 {
+			c.nc.SetReadDeadline(time.Now().Add(c.server.Timeout))
+		}
+
+		line, err := c.readLine()
+		if err == errLineTooLong {
+			c.err("line too long")
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if quit := c.handle(strings.ToUpper(cmd), strings.TrimSpace(arg)); quit {
+			c.w.Flush()
+			return
+		}
+	}
+}
+
+// readLine reads a command line within the read buffer. The rest of a
+// longer line is discarded and errLineTooLong returned.
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return string(line), err
+	}
+	for err == bufio.ErrBufferFull {
+		_, err = c.r.ReadSlice('\n')
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", errLineTooLong
+}
+
+// handle runs a command and reports whether the connection has to be closed.
+func (c *conn) handle(cmd, arg string) bool {
+	switch cmd {
+	case "CAPA":
+		c.capa()
+		return false
+	case "NOOP":
+		c.ok("")
+		return false
+	case "QUIT":
+		c.quit()
+		return true
+	}
+
+	if c.state == stateAuthorization {
+		switch cmd {
+		case "STLS":
+			c.stls()
+		case "USER":
+			c.userCmd(arg)
+		case "PASS":
+			c.pass(arg)
+		default:
+			c.err("unknown command or not authenticated")
+		}
+		return false
+	}
+
+	switch cmd {
+	case "STAT":
+		c.stat()
+	case "LIST":
+		c.list(arg)
+	case "UIDL":
+		c.uidl(arg)
+	case "RETR":
+		c.retr(arg)
+	case "TOP":
+		c.top(arg)
+	case "DELE":
+		c.dele(arg)
+	case "RSET":
+		c.rset()
+	default:
+		c.err("unknown command")
+	}
+	return false
+}
+
+func (c *conn) capa() {
+	c.ok("capability list follows")
+	caps := [][]byte{[]byte("USER"), []byte("UIDL"), []byte("TOP"), []byte("RESP-CODES")}
+	if c.server.TLSConfig != nil && !c.isTLS() && c.state == stateAuthorization {
+		caps = append(caps, []byte("STLS"))
+	}
+	c.writeMultiline(caps)
+}
+
+func (c *conn) stls() {
+	if c.server.TLSConfig == nil || c.isTLS() {
+		c.err("STLS not available")
+		return
+	}
+	c.ok("begin TLS negotiation")
+	c.w.Flush()
+
+	tlsConn := tls.Server(c.nc, c.server.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Warnf("POP3 TLS handshake with %s failed: %v", c.remoteIP(), err)
+		c.nc.Close()
+		return
+	}
+	c.setConn(tlsConn)
+}
+
+func (c *conn) userCmd(arg string) {
+	if !c.isTLS() && !c.server.AllowInsecureAuth {
+		c.err("[AUTH] use STLS first")
+		return
+	}
+	if arg == "" {
+		c.err("missing username")
+		return
+	}
+	c.user = strings.ToLower(arg)
+	c.ok("send password")
+}
+
+func (c *conn) pass(arg string) {
+	if c.user == "" {
+		c.err("send USER first")
+		return
+	}
+	user := c.user
+	c.user = ""
+
+	db := c.server.db
+	var addr models.EmailAddress
+	if err := db.Where("address = ? AND expires_at > ?", user, time.Now()).First(&addr).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Errorf("Database error: %+v", err)
+		}
+		c.err("[AUTH] invalid credentials")
+		return
+	}
+	if !addr.CheckAccessToken(arg) {
+		c.err("[AUTH] invalid credentials")
+		return
+	}
+
+	var messages []models.Message
+	if err := db.Preload("Attachments").Where("email_id = ?", addr.ID).
+		Order("created_at").Find(&messages).Error; err != nil {
+		log.Errorf("Database error: %+v", err)
+		c.err("[SYS/TEMP] failed to load messages")
+		return
+	}
+
+	c.messages = make([]message, 0, len(messages))
+	for i := range messages {
+		source, err := blob.Source(context.Background(), c.server.blobs, &messages[i], addr.Address)
+		if err != nil {
+			log.Warnf("Failed to build source of message %s: %v", messages[i].ID, err)
+			continue
+		}
+		c.messages = append(c.messages, message{
+			id:     messages[i].ID,
+			source: normalizeCRLF(source),
+		})
+	}
+
+	c.address = addr
+	c.state = stateTransaction
+	c.server.audit.Record(models.AuditLog{
+		EmailID:      addr.ID,
+		EmailAddress: addr.Address,
+		Action:       models.AuditActionAccess,
+		IP:           c.remoteIP(),
+		Detail:       "pop3 login",
+	})
+	c.ok("%d messages", len(c.messages))
+}
+
+// message returns the message numbered by arg, or writes an error.
+func (c *conn) message(arg string) (*message, int, bool) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		c.err("message number required")
+		return nil, 0, false
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n < 1 || n > len(c.messages) {
+		c.err("no such message")
+		return nil, 0, false
+	}
+	m := &c.messages[n-1]
+	if m.deleted {
+		c.err("message %d already deleted", n)
+		return nil, 0, false
+	}
+	return m, n, true
+}
+
+func (c *conn) stat() {
+	count, size := 0, 0
+	for _, m := range c.messages {
+		if !m.deleted {
+			count++
+			size += len(m.source)
+		}
+	}
+	c.ok("%d %d", count, size)
+}
+
+func (c *conn) list(arg string) {
+	if arg != "" {
+		if m, n, ok := c.message(arg); ok {
+			c.ok("%d %d", n, len(m.source))
+		}
+		return
+	}
+
+	c.ok("scan listing follows")
+	var lines [][]byte
+	for i, m := range c.messages {
+		if !m.deleted {
+			lines = append(lines, fmt.Appendf(nil, "%d %d", i+1, len(m.source)))
+		}
+	}
+	c.writeMultiline(lines)
+}
+
+func (c *conn) uidl(arg string) {
+	if arg != "" {
+		if m, n, ok := c.message(arg); ok {
+			c.ok("%d %s", n, m.id)
+		}
+		return
+	}
+
+	c.ok("unique-id listing follows")
+	var lines [][]byte
+	for i, m := range c.messages {
+		if !m.deleted {
+			lines = append(lines, fmt.Appendf(nil, "%d %s", i+1, m.id))
+		}
+	}
+	c.writeMultiline(lines)
+}
+
+func (c *conn) retr(arg string) {
+	m, _, ok := c.message(arg)
+	if !ok {
+		return
+	}
+	c.ok("%d octets", len(m.source))
+	c.writeMultiline(splitLines(m.source))
+}
+
+func (c *conn) top(arg string) {
+	args := strings.Fields(arg)
+	if len(args) != 2 {
+		c.err("usage: TOP msg n")
+		return
+	}
+	lineCount, err := strconv.Atoi(args[1])
+	if err != nil || lineCount < 0 {
+		c.err("invalid line count")
+		return
+	}
+	m, _, ok := c.message(args[0])
+	if !ok {
+		return
+	}
+
+	// the header, the blank line and lineCount lines of the body
+	lines := splitLines(m.source)
+	end := len(lines)
+	for i, line := range lines {
+		if len(line) == 0 {
+			end = min(i+1+lineCount, len(lines))
+			break
+		}
+	}
+	c.ok("top of message follows")
+	c.writeMultiline(lines[:end])
+}
+
+func (c *conn) dele(arg string) {
+	m, n, ok := c.message(arg)
+	if !ok {
+		return
+	}
+	m.deleted = true
+	c.ok("message %d deleted", n)
+}
+
+func (c *conn) rset() {
+	for i := range c.messages {
+		c.messages[i].deleted = false
+	}
+	c.ok("%d messages", len(c.messages))
+}
+
+// quit enters the UPDATE state: messages marked with DELE are removed if the
+// server is configured to.
+func (c *conn) quit() {
+	if c.state != stateTransaction || !c.server.DeleteOnQuit {
+		c.ok("bye")
+		return
+	}
+
+	var ids []uuid.UUID
+	for _, m := range c.messages {
+		if m.deleted {
+			ids = append(ids, m.id)
+		}
+	}
+	if len(ids) > 0 {
+		err := c.server.db.Transaction(func(tx *gorm.DB) error {
+			if err := blob.DeleteAttachments(tx, ids); err != nil {
+				return err
+			}
+			return tx.Where("id IN ? AND email_id = ?", ids, c.address.ID).Delete(&models.Message{}).Error
+		})
+		if err != nil {
+			log.Errorf("Failed to delete messages: %v", err)
+			c.err("[SYS/TEMP] failed to delete messages")
+			return
+		}
+	}
+	for i := range ids {
+		c.server.audit.Record(models.AuditLog{
+			EmailID:      c.address.ID,
+			EmailAddress: c.address.Address,
+			MessageID:    &ids[i],
+			Action:       models.AuditActionDeleteMessage,
+			IP:           c.remoteIP(),
+			Detail:       "pop3",
+		})
+	}
+	c.ok("bye, %d messages deleted", len(ids))
+}
+
+func normalizeCRLF(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+// splitLines splits a CRLF terminated source into lines without the CRLF.
+func splitLines(source []byte) [][]byte {
+	lines := bytes.Split(bytes.TrimSuffix(source, []byte("\r\n")), []byte("\r\n"))
+	return lines
+}
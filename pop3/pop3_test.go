@@ -0,0 +1,265 @@
+package pop3
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/audit"
+	"secmail/blob"
+	"secmail/config"
+	"secmail/database/databasetest"
+	"secmail/models"
+)
+
+const testRaw = "From: sender@example.com\r\n" +
+	"To: abcd123456@test.com\r\n" +
+	"Subject: Hello POP3\r\n" +
+	"\r\n" +
+	"Your code is 123456\r\n" +
+	".hidden line\r\n"
+
+func setupTestServer(t *testing.T, deleteOnQuit bool) (*gorm.DB, string, string) {
+	db := databasetest.Open(t)
+
+	email := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	token, err := email.NewAccessToken()
+	require.NoError(t, err)
+	require.NoError(t, db.Create(&email).Error)
+
+	// one message received over SMTP and one stored before raw sources were kept
+	require.NoError(t, db.Create(&models.Message{EmailID: email.ID, From: "sender@example.com", Subject: "Hello POP3", Raw: []byte(testRaw)}).Error)
+	require.NoError(t, db.Create(&models.Message{EmailID: email.ID, From: "other@example.com", Subject: "Legacy", Content: "old body", CreatedAt: time.Now().Add(time.Second)}).Error)
+
+	s := NewServer(db, nil, blob.NewMemoryStore())
+	s.AllowInsecureAuth = true
+	s.DeleteOnQuit = deleteOnQuit
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return db, l.Addr().String(), token
+}
+
+func dial(t *testing.T, addr string) *textproto.Conn {
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	line, err := c.ReadLine()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(line, "+OK"))
+	return c
+}
+
+// cmd sends a command and returns its status line.
+func cmd(t *testing.T, c *textproto.Conn, format string, args ...any) string {
+	_, err := c.Cmd(format, args...)
+	require.NoError(t, err)
+	line, err := c.ReadLine()
+	require.NoError(t, err)
+	return line
+}
+
+func login(t *testing.T, c *textproto.Conn, token string) {
+	require.True(t, strings.HasPrefix(cmd(t, c, "USER abcd123456@test.com"), "+OK"))
+	require.True(t, strings.HasPrefix(cmd(t, c, "PASS %s", token), "+OK"))
+}
+
+func TestLogin(t *testing.T) {
+	_, addr, _ := setupTestServer(t, false)
+	c := dial(t, addr)
+
+	assert.True(t, strings.HasPrefix(cmd(t, c, "STAT"), "-ERR"))
+	assert.True(t, strings.HasPrefix(cmd(t, c, "PASS wrong"), "-ERR"))
+	cmd(t, c, "USER abcd123456@test.com")
+	assert.True(t, strings.HasPrefix(cmd(t, c, "PASS wrong"), "-ERR [AUTH]"))
+	cmd(t, c, "USER unknown123@test.com")
+	assert.True(t, strings.HasPrefix(cmd(t, c, "PASS wrong"), "-ERR [AUTH]"))
+}
+
+func TestRetrieve(t *testing.T) {
+	_, addr, token := setupTestServer(t, false)
+	c := dial(t, addr)
+	login(t, c, token)
+
+	assert.True(t, strings.HasPrefix(cmd(t, c, "STAT"), "+OK 2 "))
+	assert.Equal(t, "+OK 1 "+strconv.Itoa(len(testRaw)), cmd(t, c, "LIST 1"))
+
+	cmd(t, c, "UIDL")
+	uids, err := c.ReadDotLines()
+	require.NoError(t, err)
+	assert.Len(t, uids, 2)
+
+	// the raw source is dot-unstuffed by the client
+	cmd(t, c, "RETR 1")
+	body, err := c.ReadDotBytes()
+	require.NoError(t, err)
+	assert.Equal(t, strings.ReplaceAll(testRaw, "\r\n", "\n"), string(body))
+
+	// the legacy message is rebuilt from the stored fields
+	cmd(t, c, "RETR 2")
+	body, err = c.ReadDotBytes()
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "Subject: Legacy")
+	assert.Contains(t, string(body), "old body")
+
+	cmd(t, c, "TOP 1 0")
+	top, err := c.ReadDotLines()
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: Hello POP3", top[2])
+	assert.Equal(t, "", top[len(top)-1])
+
+	assert.True(t, strings.HasPrefix(cmd(t, c, "RETR 3"), "-ERR"))
+}
+
+func TestMessageArgument(t *testing.T) {
+	_, addr, token := setupTestServer(t, false)
+	c := dial(t, addr)
+	login(t, c, token)
+
+	tests := []struct {
+		name string
+		cmd  string
+		want string
+	}{
+		{name: "retr without number", cmd: "RETR", want: "-ERR message number required"},
+		{name: "dele without number", cmd: "DELE", want: "-ERR message number required"},
+		{name: "dele blank", cmd: "DELE  ", want: "-ERR message number required"},
+		{name: "not a number", cmd: "RETR one", want: "-ERR no such message"},
+		{name: "out of range", cmd: "DELE 0", want: "-ERR no such message"},
+		{name: "top without number", cmd: "TOP", want: "-ERR usage: TOP msg n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, cmd(t, c, "%s", tt.cmd))
+		})
+	}
+	// the connection survives
+	assert.True(t, strings.HasPrefix(cmd(t, c, "STAT"), "+OK 2 "))
+}
+
+func TestDeleteOnQuit(t *testing.T) {
+	for _, deleteOnQuit := range []bool{false, true} {
+		db, addr, token := setupTestServer(t, deleteOnQuit)
+		c := dial(t, addr)
+		login(t, c, token)
+
+		assert.True(t, strings.HasPrefix(cmd(t, c, "DELE 1"), "+OK"))
+		assert.True(t, strings.HasPrefix(cmd(t, c, "RETR 1"), "-ERR"))
+		assert.True(t, strings.HasPrefix(cmd(t, c, "STAT"), "+OK 1 "))
+		assert.True(t, strings.HasPrefix(cmd(t, c, "QUIT"), "+OK"))
+
+		var count int64
+		db.Model(&models.Message{}).Count(&count)
+		if deleteOnQuit {
+			assert.Equal(t, int64(1), count)
+		} else {
+			assert.Equal(t, int64(2), count)
+		}
+	}
+}
+
+func TestDeleteOnQuitAudit(t *testing.T) {
+	db, _, token := setupTestServer(t, true)
+	recorder := audit.NewRecorder(db, config.AuditConfig{})
+	s := NewServer(db, recorder, blob.NewMemoryStore())
+	s.AllowInsecureAuth = true
+	s.DeleteOnQuit = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c := dial(t, l.Addr().String())
+	login(t, c, token)
+	assert.True(t, strings.HasPrefix(cmd(t, c, "DELE 1"), "+OK"))
+	assert.True(t, strings.HasPrefix(cmd(t, c, "DELE 2"), "+OK"))
+	assert.True(t, strings.HasPrefix(cmd(t, c, "QUIT"), "+OK bye, 2 messages deleted"))
+	recorder.Close()
+
+	var logs []models.AuditLog
+	db.Where("action = ?", models.AuditActionDeleteMessage).Order("id").Find(&logs)
+	require.Len(t, logs, 2)
+	for _, l := range logs {
+		assert.Equal(t, "abcd123456@test.com", l.EmailAddress)
+		assert.Equal(t, "127.0.0.1", l.IP)
+		assert.Equal(t, "pop3", l.Detail)
+		assert.NotNil(t, l.MessageID)
+	}
+	assert.NotEqual(t, *logs[0].MessageID, *logs[1].MessageID)
+}
+
+func TestLineTooLong(t *testing.T) {
+	_, addr, _ := setupTestServer(t, false)
+	c := dial(t, addr)
+
+	assert.Equal(t, "-ERR line too long", cmd(t, c, "NOOP %s", strings.Repeat("a", 10*maxLineLength)))
+	// the rest of the line is discarded and the connection survives
+	assert.True(t, strings.HasPrefix(cmd(t, c, "NOOP"), "+OK"))
+}
+
+func TestInsecureAuth(t *testing.T) {
+	db, _, _ := setupTestServer(t, false)
+	s := NewServer(db, nil, blob.NewMemoryStore())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c := dial(t, l.Addr().String())
+	assert.True(t, strings.HasPrefix(cmd(t, c, "USER abcd123456@test.com"), "-ERR [AUTH]"))
+}
+
+func TestShutdown(t *testing.T) {
+	db, _, token := setupTestServer(t, true)
+	s := NewServer(db, nil, blob.NewMemoryStore())
+	s.AllowInsecureAuth = true
+	s.DeleteOnQuit = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+
+	c := dial(t, l.Addr().String())
+	login(t, c, token)
+	assert.True(t, strings.HasPrefix(cmd(t, c, "DELE 1"), "+OK"))
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+	// the client quitting still deletes its messages
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown did not wait for the connection: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.True(t, strings.HasPrefix(cmd(t, c, "QUIT"), "+OK"))
+	require.NoError(t, <-shutdown)
+
+	var count int64
+	db.Model(&models.Message{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	// idle connections are closed when the context is done
+	s = NewServer(db, nil, blob.NewMemoryStore())
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	c = dial(t, l.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	_, err = c.ReadLine()
+	assert.Error(t, err)
+}
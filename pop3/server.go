@@ -0,0 +1,171 @@
+package pop3
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"secmail/audit"
+	"secmail/blob"
+	"secmail/config"
+
+	"github.com/kuun/slog"
+	"gorm.io/gorm"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+var ErrServerClosed = errors.New("pop3: server closed")
+
+// Server is a POP3 server (RFC 1939) with the STLS, UIDL, TOP and USER
+// extensions. The username is the temporary address and the password its
+// access token.
+type Server struct {
+	Addr      string
+	TLSConfig *tls.Config
+	// AllowInsecureAuth permits USER/PASS without STLS
+	AllowInsecureAuth bool
+	// DeleteOnQuit removes messages marked with DELE when the client quits,
+	// otherwise they are kept
+	DeleteOnQuit bool
+	Timeout      time.Duration
+
+	db    *gorm.DB
+	audit *audit.Recorder
+	blobs blob.Store
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewServer(db *gorm.DB, recorder *audit.Recorder, blobs blob.Store) *Server {
+	return &Server{
+		Timeout: 10 * time.Minute,
+		db:      db,
+		audit:   recorder,
+		blobs:   blobs,
+		conns:   make(map[*conn]struct{}),
+	}
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		pc := newConn(s, c)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return ErrServerClosed
+		}
+		s.conns[pc] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			pc.serve()
+			s.mu.Lock()
+			delete(s.conns, pc)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listener and closes all connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for c := range s.conns {
+		c.close()
+	}
+	return err
+}
+
+// Shutdown stops the listener and waits for the connections to end, so that
+// the messages deleted by clients quitting are removed. When ctx is done
+// first, the connections left are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+// NewPOP3Server creates the configured POP3 server.
+func NewPOP3Server(db *gorm.DB, recorder *audit.Recorder, blobs blob.Store) (*Server, error) {
+	server := NewServer(db, recorder, blobs)
+	server.Addr = fmt.Sprintf("%s:%d",
+		config.GlobalConfig.POP3.Host,
+		config.GlobalConfig.POP3.Port)
+	server.AllowInsecureAuth = config.GlobalConfig.POP3.AllowInsecureAuth
+	server.DeleteOnQuit = config.GlobalConfig.POP3.DeleteOnQuit
+
+	tlsConfig, err := config.GlobalConfig.SMTP.LoadTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	server.TLSConfig = tlsConfig
+
+	log.Infof("Starting POP3 server at %s (STLS: %v)",
+		server.Addr,
+		server.TLSConfig != nil)
+	return server, nil
+}
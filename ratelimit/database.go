@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"secmail/config"
+	"secmail/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DatabaseStore keeps buckets in the rate_limit_buckets table, so every
+// secmail instance using the same database shares the limits.
+type DatabaseStore struct {
+	db *gorm.DB
+}
+
+func NewDatabaseStore(db *gorm.DB) *DatabaseStore {
+	return &DatabaseStore{db: db}
+}
+
+func (s *DatabaseStore) Take(ctx context.Context, key string, rule config.RateLimitRule) (bool, time.Duration, error) {
+	var allowed bool
+	var retryAfter time.Duration
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		// make sure the row exists, so it can be locked below
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.RateLimitBucket{
+			Key:       key,
+			Tokens:    float64(max(rule.Burst, 1)),
+			UpdatedAt: now,
+		}).Error; err != nil {
+			return err
+		}
+
+		var b models.RateLimitBucket
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("key = ?", key).First(&b).Error; err != nil {
+			return err
+		}
+
+		var tokens float64
+		tokens, allowed, retryAfter = take(b.Tokens, b.UpdatedAt, rule, now)
+		return tx.Model(&b).Updates(map[string]any{
+			"tokens":     tokens,
+			"updated_at": now,
+		}).Error
+	})
+	return allowed, retryAfter, err
+}
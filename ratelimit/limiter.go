@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"secmail/config"
+
+	"github.com/kuun/slog"
+	"gorm.io/gorm"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+// Store keeps token buckets. Implementations must be safe for concurrent use.
+type Store interface {
+	// Take removes one token from the bucket identified by key. If the bucket
+	// is empty, it reports how long the caller has to wait for the next token.
+	Take(ctx context.Context, key string, rule config.RateLimitRule) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// NewStore creates the store named in the configuration.
+func NewStore(name string, db *gorm.DB) (Store, error) {
+	switch name {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "database":
+		return NewDatabaseStore(db), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store: %s", name)
+	}
+}
+
+type Limiter struct {
+	store Store
+}
+
+func New(store Store) *Limiter {
+	return &Limiter{store: store}
+}
+
+// Allow reports whether a request for key in the given scope may proceed.
+// A nil limiter or a disabled rule allows everything, and store errors fail
+// open so a broken store never takes the service down.
+func (l *Limiter) Allow(ctx context.Context, scope, key string, rule config.RateLimitRule) (bool, time.Duration) {
+	if l == nil || !rule.Enabled() {
+		return true, 0
+	}
+	allowed, retryAfter, err := l.store.Take(ctx, scope+":"+key, rule)
+	if err != nil {
+		log.Errorf("Rate limit store error: %v", err)
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+// take applies the token bucket algorithm to a bucket holding tokens at time
+// last, and returns the new token count.
+func take(tokens float64, last time.Time, rule config.RateLimitRule, now time.Time) (float64, bool, time.Duration) {
+	burst := float64(rule.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	rate := float64(rule.Requests) / rule.Period.Seconds()
+
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(burst, tokens+elapsed*rate)
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := time.Duration((1 - tokens) / rate * float64(time.Second))
+	return tokens, false, wait
+}
+
+// fullAfter returns how long an untouched bucket needs to refill completely.
+func fullAfter(rule config.RateLimitRule) time.Duration {
+	burst := rule.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return time.Duration(float64(rule.Period) * float64(burst) / float64(rule.Requests))
+}
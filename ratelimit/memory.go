@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"secmail/config"
+)
+
+const sweepInterval = time.Minute
+
+type memoryBucket struct {
+	tokens  float64
+	last    time.Time
+	expires time.Time
+}
+
+// MemoryStore keeps buckets in process memory. Limits are not shared between
+// replicas.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*memoryBucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, rule config.RateLimitRule) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(max(rule.Burst, 1)), last: now}
+		s.buckets[key] = b
+	}
+
+	tokens, allowed, retryAfter := take(b.tokens, b.last, rule, now)
+	b.tokens = tokens
+	b.last = now
+	b.expires = now.Add(fullAfter(rule))
+	return allowed, retryAfter, nil
+}
+
+// sweep drops buckets that have refilled completely, they are equivalent to
+// a missing bucket.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if now.After(b.expires) {
+			delete(s.buckets, key)
+		}
+	}
+}
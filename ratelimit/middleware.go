@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"secmail/config"
+	"secmail/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware limits requests per client IP, or per API key when the request
+// was authenticated with one. Rejected requests get a 429 with a Retry-After
+// header.
+func Middleware(l *Limiter, scope string, rule config.RateLimitRule) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, keyRule := c.ClientIP(), rule
+		if v, ok := c.Get("apiKey"); ok {
+			apiKey := v.(*models.APIKey)
+			key = "key-" + strconv.FormatUint(uint64(apiKey.ID), 10)
+			keyRule = config.RateLimitRule{
+				Requests: apiKey.RateLimitRequests,
+				Period:   apiKey.RateLimitPeriod,
+				Burst:    apiKey.RateLimitBurst,
+			}
+		}
+
+		allowed, retryAfter := l.Allow(c.Request.Context(), scope, key, keyRule)
+		if !allowed {
+			Reject(c, retryAfter)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Reject aborts the request with 429 Too Many Requests.
+func Reject(c *gin.Context, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+}
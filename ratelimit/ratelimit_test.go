@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"secmail/config"
+	"secmail/database/databasetest"
+)
+
+var testRule = config.RateLimitRule{
+	Requests: 1,
+	Period:   time.Minute,
+	Burst:    2,
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// burst is available immediately
+	for i := 0; i < 2; i++ {
+		allowed, _, err := store.Take(ctx, "ip", testRule)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	}
+
+	allowed, retryAfter, err := store.Take(ctx, "ip", testRule)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.InDelta(t, time.Minute.Seconds(), retryAfter.Seconds(), 1)
+
+	// other keys have their own bucket
+	allowed, _, _ = store.Take(ctx, "other", testRule)
+	assert.True(t, allowed)
+
+	// a token is refilled after one period
+	now = now.Add(time.Minute)
+	allowed, _, _ = store.Take(ctx, "ip", testRule)
+	assert.True(t, allowed)
+	allowed, _, _ = store.Take(ctx, "ip", testRule)
+	assert.False(t, allowed)
+}
+
+func TestDatabaseStore(t *testing.T) {
+	db := databasetest.Open(t)
+
+	store := NewDatabaseStore(db)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := store.Take(ctx, "ip", testRule)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, retryAfter, err := store.Take(ctx, "ip", testRule)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Greater(t, retryAfter, time.Duration(0))
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	var l *Limiter
+	allowed, _ := l.Allow(context.Background(), "scope", "ip", testRule)
+	assert.True(t, allowed)
+
+	l = New(NewMemoryStore())
+	for i := 0; i < 10; i++ {
+		allowed, _ = l.Allow(context.Background(), "scope", "ip", config.RateLimitRule{})
+		assert.True(t, allowed)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", Middleware(New(NewMemoryStore()), "test", testRule), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	codes := make([]int, 3)
+	var w *httptest.ResponseRecorder
+	for i := range codes {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		codes[i] = w.Code
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"secmail/config"
+	"secmail/models"
+
+	"github.com/google/uuid"
+	"github.com/jhillyerd/enmime"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultSendQuota       = 10
+	defaultSendQuotaPeriod = 24 * time.Hour
+)
+
+var ErrQuotaExceeded = errors.New("send quota exceeded")
+
+// Mail is a message composed by the owner of an address.
+type Mail struct {
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+	// ReplyTo is the message answered, whose Message-Id is InReplyTo and
+	// whose thread is References
+	ReplyTo    *uuid.UUID
+	InReplyTo  string
+	References []string
+}
+
+// Send builds a message from an address and queues it for each recipient.
+// It returns the Message-Id of the message.
+func Send(db *gorm.DB, addr *models.EmailAddress, m *Mail) (string, error) {
+	messageID := "<" + uuid.NewString() + "@" + config.GlobalConfig.EmailDomain + ">"
+	to := make([]mail.Address, len(m.To))
+	for i, rcpt := range m.To {
+		to[i] = mail.Address{Address: rcpt}
+	}
+	b := enmime.Builder().
+		From("", addr.Address).
+		Subject(m.Subject).
+		Date(time.Now()).
+		ToAddrs(to).
+		Header("Message-Id", messageID).
+		Text([]byte(m.Text))
+	if m.HTML != "" {
+		b = b.HTML([]byte(m.HTML))
+	}
+	if m.InReplyTo != "" {
+		b = b.Header("In-Reply-To", m.InReplyTo)
+	}
+	if len(m.References) > 0 {
+		b = b.Header("References", strings.Join(m.References, " "))
+	}
+
+	part, err := b.Build()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := part.Encode(&buf); err != nil {
+		return "", err
+	}
+	raw := buf.Bytes()
+
+	quota := config.GlobalConfig.Relay.SendQuota
+	if quota <= 0 {
+		quota = defaultSendQuota
+	}
+	period := config.GlobalConfig.Relay.SendQuotaPeriod
+	if period <= 0 {
+		period = defaultSendQuotaPeriod
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// lock the address so that concurrent sends count each other
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+			First(&models.EmailAddress{}, addr.ID).Error; err != nil {
+			return err
+		}
+		// forwarded mail and verification codes have a rule and do not count
+		var sent int64
+		if err := tx.Model(&models.OutboundMessage{}).
+			Where("email_id = ? AND rule_id IS NULL AND created_at > ?", addr.ID, time.Now().Add(-period)).
+			Count(&sent).Error; err != nil {
+			return err
+		}
+		if sent+int64(len(m.To)) > int64(quota) {
+			return ErrQuotaExceeded
+		}
+
+		for _, to := range m.To {
+			if err := tx.Create(&models.OutboundMessage{
+				EmailID:       addr.ID,
+				MessageID:     m.ReplyTo,
+				MailFrom:      addr.Address,
+				RcptTo:        to,
+				Raw:           raw,
+				Status:        models.OutboundQueued,
+				NextAttemptAt: time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
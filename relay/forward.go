@@ -0,0 +1,150 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"secmail/audit"
+	"secmail/config"
+	"secmail/models"
+
+	"github.com/jhillyerd/enmime"
+	"gorm.io/gorm"
+)
+
+// forwardedHeader marks forwarded messages, which are never forwarded again
+// so that two forwarding addresses cannot loop.
+const forwardedHeader = "X-Secmail-Forwarded-For"
+
+var (
+	finalRecipientRe = regexp.MustCompile(`(?im)^Final-Recipient:\s*[^;]*;\s*(\S+)`)
+	diagnosticRe     = regexp.MustCompile(`(?im)^Diagnostic-Code:\s*(.+)$`)
+	statusRe         = regexp.MustCompile(`(?im)^Status:\s*(\S+)`)
+)
+
+func rewriter() *srsRewriter {
+	return newSRSRewriter(config.GlobalConfig.Relay.SRSSecret, config.GlobalConfig.EmailDomain)
+}
+
+func noReplyAddress() string {
+	return "noreply@" + config.GlobalConfig.EmailDomain
+}
+
+// Forward queues a delivered message, whose source is as stored before
+// stripping its attachments, for the verified forwarding rules of its
+// address that match it.
+func Forward(db *gorm.DB, addr *models.EmailAddress, msg *models.Message, source []byte) error {
+	var rules []models.ForwardRule
+	if err := db.Where("email_id = ? AND verified_at IS NOT NULL", addr.ID).Find(&rules).Error; err != nil {
+		return err
+	}
+	var matching []models.ForwardRule
+	for _, rule := range rules {
+		if rule.Matches(msg.From, msg.Subject) {
+			matching = append(matching, rule)
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+
+	if parsed, err := mail.ReadMessage(bytes.NewReader(source)); err == nil &&
+		parsed.Header.Get(forwardedHeader) != "" {
+		log.Warnf("Not forwarding message %s for %s, it has been forwarded already", msg.ID, addr.Address)
+		return nil
+	}
+	raw := append([]byte(forwardedHeader+": "+addr.Address+"\r\n"), source...)
+
+	// bounces are forwarded with the null sender
+	mailFrom := ""
+	if msg.From != "" {
+		mailFrom = rewriter().Forward(msg.From, time.Now())
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for i := range matching {
+			if err := tx.Create(&models.OutboundMessage{
+				EmailID:       addr.ID,
+				MessageID:     &msg.ID,
+				RuleID:        &matching[i].ID,
+				MailFrom:      mailFrom,
+				RcptTo:        matching[i].Destination,
+				Raw:           raw,
+				Status:        models.OutboundQueued,
+				NextAttemptAt: time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SendVerification queues the mail asking the destination of a rule to
+// confirm it with code.
+func SendVerification(db *gorm.DB, addr *models.EmailAddress, rule *models.ForwardRule, code string) error {
+	text := fmt.Sprintf("Forwarding of the mail received by %s to this mailbox was requested.\r\n\r\n"+
+		"If you requested it, confirm it with the code:\r\n\r\n    %s\r\n\r\n"+
+		"Otherwise, ignore this message and nothing will be forwarded.\r\n", addr.Address, code)
+	part, err := enmime.Builder().
+		From("", noReplyAddress()).
+		To("", rule.Destination).
+		Subject("Confirm forwarding of " + addr.Address).
+		Date(time.Now()).
+		Text([]byte(text)).
+		Build()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := part.Encode(&buf); err != nil {
+		return err
+	}
+
+	return db.Create(&models.OutboundMessage{
+		EmailID:       addr.ID,
+		RuleID:        &rule.ID,
+		MailFrom:      noReplyAddress(),
+		RcptTo:        rule.Destination,
+		Raw:           buf.Bytes(),
+		Status:        models.OutboundQueued,
+		NextAttemptAt: time.Now(),
+	}).Error
+}
+
+// IsBounceAddress reports whether mail for an address is a bounce of
+// forwarded mail, sent back to its SRS envelope sender.
+func IsBounceAddress(address string) bool {
+	return rewriter().IsSRS(address)
+}
+
+// RecordBounce marks the forwarded message a bounce refers to as bounced,
+// using the Final-Recipient of the delivery status notification to tell
+// the messages sent with the same envelope sender apart.
+func RecordBounce(db *gorm.DB, recorder *audit.Recorder, to string, raw []byte) error {
+	if _, err := rewriter().Reverse(to, time.Now()); err != nil {
+		return err
+	}
+
+	query := db.Where("LOWER(mail_from) = ? AND status = ?", strings.ToLower(to), models.OutboundSent)
+	if m := finalRecipientRe.FindSubmatch(raw); m != nil {
+		query = query.Where("LOWER(rcpt_to) = ?", strings.ToLower(string(m[1])))
+	}
+	var msg models.OutboundMessage
+	if err := query.Order("sent_at DESC").First(&msg).Error; err != nil {
+		return err
+	}
+
+	reason := "bounced"
+	if m := diagnosticRe.FindSubmatch(raw); m != nil {
+		reason = strings.TrimSpace(string(m[1]))
+	} else if m := statusRe.FindSubmatch(raw); m != nil {
+		reason = "status " + string(m[1])
+	}
+	markBounced(db, recorder, &msg, reason)
+	return nil
+}
@@ -0,0 +1,240 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"secmail/audit"
+	"secmail/config"
+	"secmail/dkim"
+	"secmail/models"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/kuun/slog"
+	"gorm.io/gorm"
+)
+
+type __logger struct{}
+
+var log = slog.GetLogger(__logger{})
+
+const (
+	defaultMaxAttempts   = 5
+	defaultRetryInterval = 5 * time.Minute
+	// sendLease keeps other replicas off a message while it is being sent
+	sendLease = 10 * time.Minute
+	batchSize = 20
+)
+
+// pollInterval is how often the queue is checked for due messages.
+var pollInterval = 10 * time.Second
+
+// Relay sends the queued outbound messages through the smarthost, retrying
+// temporary failures with an exponential backoff. Messages are DKIM signed
+// when they are sent, with the key active at that time.
+type Relay struct {
+	db    *gorm.DB
+	audit *audit.Recorder
+	// keys is nil when DKIM is disabled
+	keys dkim.Store
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(db *gorm.DB, recorder *audit.Recorder, keys dkim.Store) (*Relay, error) {
+	cfg := config.GlobalConfig.Relay
+	if cfg.Host == "" {
+		return nil, errors.New("relay host is not configured")
+	}
+	if cfg.SRSSecret == "" {
+		return nil, errors.New("relay srs_secret is not configured")
+	}
+	return &Relay{db: db, audit: recorder, keys: keys, done: make(chan struct{})}, nil
+}
+
+// Start processes the queue in the background until Close is called.
+func (r *Relay) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			r.processQueue()
+			select {
+			case <-ticker.C:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+func (r *Relay) Close() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+func (r *Relay) processQueue() {
+	now := time.Now()
+	var due []models.OutboundMessage
+	if err := r.db.Where("status = ? AND next_attempt_at <= ?", models.OutboundQueued, now).
+		Order("next_attempt_at").
+		Limit(batchSize).
+		Find(&due).Error; err != nil {
+		log.Errorf("Failed to load the relay queue: %v", err)
+		return
+	}
+
+	for i := range due {
+		m := &due[i]
+		// claim the message, another replica may be sending it
+		attempts := m.Attempts + 1
+		result := r.db.Model(&models.OutboundMessage{}).
+			Where("id = ? AND attempts = ?", m.ID, m.Attempts).
+			Updates(map[string]any{"attempts": attempts, "next_attempt_at": now.Add(sendLease)})
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+		m.Attempts = attempts
+		r.finish(m, r.send(m))
+	}
+}
+
+// finish records the outcome of a delivery attempt.
+func (r *Relay) finish(m *models.OutboundMessage, err error) {
+	if err == nil {
+		now := time.Now()
+		if err := r.db.Model(m).Updates(map[string]any{
+			"status":     models.OutboundSent,
+			"sent_at":    now,
+			"last_error": "",
+		}).Error; err != nil {
+			log.Errorf("Failed to update outbound message %d: %v", m.ID, err)
+		}
+		action := models.AuditActionForward
+		if m.RuleID == nil {
+			action = models.AuditActionSend
+		}
+		r.audit.Record(models.AuditLog{
+			EmailID:   m.EmailID,
+			MessageID: m.MessageID,
+			Action:    action,
+			Detail:    "to " + m.RcptTo,
+		})
+		return
+	}
+
+	maxAttempts := config.GlobalConfig.Relay.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	if permanent(err) || m.Attempts >= maxAttempts {
+		markBounced(r.db, r.audit, m, err.Error())
+		return
+	}
+
+	retry := config.GlobalConfig.Relay.RetryInterval
+	if retry <= 0 {
+		retry = defaultRetryInterval
+	}
+	next := time.Now().Add(retry << (m.Attempts - 1))
+	log.Warnf("Relaying message %d to %s failed, retrying at %s: %v", m.ID, m.RcptTo, next, err)
+	if err := r.db.Model(m).Updates(map[string]any{
+		"next_attempt_at": next,
+		"last_error":      err.Error(),
+	}).Error; err != nil {
+		log.Errorf("Failed to update outbound message %d: %v", m.ID, err)
+	}
+}
+
+// markBounced gives a message up, after a permanent failure of the
+// smarthost or a bounce from the destination.
+func markBounced(db *gorm.DB, recorder *audit.Recorder, m *models.OutboundMessage, reason string) {
+	log.Warnf("Message %d to %s bounced: %s", m.ID, m.RcptTo, reason)
+	if err := db.Model(m).Updates(map[string]any{
+		"status":     models.OutboundBounced,
+		"bounced_at": time.Now(),
+		"last_error": reason,
+	}).Error; err != nil {
+		log.Errorf("Failed to update outbound message %d: %v", m.ID, err)
+	}
+	recorder.Record(models.AuditLog{
+		EmailID:   m.EmailID,
+		MessageID: m.MessageID,
+		Action:    models.AuditActionBounce,
+		Detail:    m.RcptTo + ": " + reason,
+	})
+}
+
+// permanent reports whether the smarthost rejected the message for good.
+func permanent(err error) bool {
+	var smtpErr *smtp.SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500
+}
+
+func dial() (*smtp.Client, error) {
+	cfg := config.GlobalConfig.Relay
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	tlsConfig := &tls.Config{ServerName: cfg.Host, MinVersion: tls.VersionTLS12}
+	switch cfg.TLS {
+	case "tls":
+		return smtp.DialTLS(addr, tlsConfig)
+	case "none":
+		return smtp.Dial(addr)
+	default:
+		return smtp.DialStartTLS(addr, tlsConfig)
+	}
+}
+
+func (r *Relay) send(m *models.OutboundMessage) error {
+	raw := m.Raw
+	if r.keys != nil {
+		signed, err := dkim.Sign(r.keys, config.GlobalConfig.EmailDomain, raw)
+		if err != nil {
+			return fmt.Errorf("failed to DKIM sign: %w", err)
+		}
+		raw = signed
+	}
+
+	cfg := config.GlobalConfig.Relay
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if domain := config.GlobalConfig.EmailDomain; domain != "" {
+		if err := c.Hello(domain); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(sasl.NewPlainClient("", cfg.Username, cfg.Password)); err != nil {
+			return err
+		}
+	}
+	if err := c.SendMail(m.MailFrom, []string{m.RcptTo}, bytes.NewReader(raw)); err != nil {
+		return err
+	}
+	// the message has been accepted, a failing QUIT does not matter
+	c.Quit()
+	return nil
+}
+
+func StartRelay(db *gorm.DB, recorder *audit.Recorder, keys dkim.Store) (*Relay, error) {
+	r, err := New(db, recorder, keys)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Starting relay through %s:%d", config.GlobalConfig.Relay.Host, config.GlobalConfig.Relay.Port)
+	r.Start()
+	return r, nil
+}
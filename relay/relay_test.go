@@ -0,0 +1,395 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	msgauth "github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/config"
+	"secmail/database/databasetest"
+	"secmail/dkim"
+	"secmail/models"
+)
+
+// sink is an SMTP server standing in for the smarthost.
+type sink struct {
+	mu       sync.Mutex
+	messages []sinkMessage
+	// reject fails every transaction when set
+	reject *smtp.SMTPError
+}
+
+type sinkMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+type sinkSession struct {
+	sink *sink
+	msg  sinkMessage
+}
+
+func (s *sink) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return &sinkSession{sink: s}, nil
+}
+
+func (s *sinkSession) Mail(from string, _ *smtp.MailOptions) error {
+	s.sink.mu.Lock()
+	defer s.sink.mu.Unlock()
+	if s.sink.reject != nil {
+		return s.sink.reject
+	}
+	s.msg.From = from
+	return nil
+}
+
+func (s *sinkSession) Rcpt(to string, _ *smtp.RcptOptions) error {
+	s.msg.To = append(s.msg.To, to)
+	return nil
+}
+
+func (s *sinkSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.Data = data
+	s.sink.mu.Lock()
+	s.sink.messages = append(s.sink.messages, s.msg)
+	s.sink.mu.Unlock()
+	return nil
+}
+
+func (s *sinkSession) Reset()        { s.msg = sinkMessage{} }
+func (s *sinkSession) Logout() error { return nil }
+
+func (s *sink) received() []sinkMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sinkMessage(nil), s.messages...)
+}
+
+func setupTestRelay(t *testing.T) (*gorm.DB, *Relay, *sink) {
+	sk := &sink{}
+	server := smtp.NewServer(sk)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	config.GlobalConfig = config.Config{
+		EmailDomain: "test.com",
+		Relay: config.RelayConfig{
+			Enable:        true,
+			Host:          host,
+			Port:          portNum,
+			TLS:           "none",
+			SRSSecret:     "secret",
+			MaxAttempts:   3,
+			RetryInterval: time.Minute,
+		},
+	}
+	t.Cleanup(func() { config.GlobalConfig = config.Config{} })
+
+	db := databasetest.Open(t)
+
+	r, err := New(db, nil, nil)
+	require.NoError(t, err)
+	return db, r, sk
+}
+
+// seedForward creates an address with a verified rule and a message for it.
+func seedForward(t *testing.T, db *gorm.DB, filter string) (*models.EmailAddress, *models.Message) {
+	addr := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&addr).Error)
+	now := time.Now()
+	require.NoError(t, db.Create(&models.ForwardRule{
+		EmailID:       addr.ID,
+		Destination:   "me@example.org",
+		SubjectFilter: filter,
+		VerifiedAt:    &now,
+	}).Error)
+	// an unverified rule is ignored
+	require.NoError(t, db.Create(&models.ForwardRule{EmailID: addr.ID, Destination: "other@example.org"}).Error)
+
+	msg := models.Message{
+		ID:      uuid.New(),
+		EmailID: addr.ID,
+		From:    "alice@example.com",
+		Subject: "Invoice 42",
+		Raw:     []byte("From: alice@example.com\r\nSubject: Invoice 42\r\n\r\nHello\r\n"),
+	}
+	require.NoError(t, db.Create(&msg).Error)
+	return &addr, &msg
+}
+
+func TestSRS(t *testing.T) {
+	srs := newSRSRewriter("secret", "test.com")
+	now := time.Now()
+
+	rewritten := srs.Forward("alice@example.com", now)
+	assert.True(t, strings.HasPrefix(rewritten, "SRS0="))
+	assert.True(t, strings.HasSuffix(rewritten, "=example.com=alice@test.com"))
+	assert.True(t, srs.IsSRS(rewritten))
+
+	tests := []struct {
+		name    string
+		address string
+		now     time.Time
+		want    string
+		wantErr bool
+	}{
+		{"valid", rewritten, now, "alice@example.com", false},
+		{"case insensitive", strings.ToLower(rewritten), now, "alice@example.com", false},
+		{"expired", rewritten, now.Add(30 * 24 * time.Hour), "", true},
+		{"tampered", strings.Replace(rewritten, "alice", "mallory", 1), now, "", true},
+		{"other secret", newSRSRewriter("other", "test.com").Forward("alice@example.com", now), now, "", true},
+		{"not SRS", "alice@test.com", now, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := srs.Reverse(tt.address, tt.now)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestForward(t *testing.T) {
+	db, r, sk := setupTestRelay(t)
+	addr, msg := seedForward(t, db, "invoice")
+
+	require.NoError(t, Forward(db, addr, msg, msg.Raw))
+	r.processQueue()
+
+	received := sk.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, []string{"me@example.org"}, received[0].To)
+	original, err := rewriter().Reverse(received[0].From, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", original)
+	assert.Contains(t, string(received[0].Data), forwardedHeader+": abcd123456@test.com")
+	assert.Contains(t, string(received[0].Data), "Subject: Invoice 42")
+
+	var queued models.OutboundMessage
+	require.NoError(t, db.First(&queued).Error)
+	assert.Equal(t, models.OutboundSent, queued.Status)
+	assert.Equal(t, 1, queued.Attempts)
+	assert.NotNil(t, queued.SentAt)
+
+	// a forwarded message is not forwarded again
+	looped := models.Message{ID: uuid.New(), EmailID: addr.ID, Subject: "Invoice", Raw: received[0].Data}
+	require.NoError(t, db.Create(&looped).Error)
+	require.NoError(t, Forward(db, addr, &looped, looped.Raw))
+	var count int64
+	db.Model(&models.OutboundMessage{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestForwardFilter(t *testing.T) {
+	db, _, _ := setupTestRelay(t)
+	addr, msg := seedForward(t, db, "newsletter")
+
+	require.NoError(t, Forward(db, addr, msg, msg.Raw))
+	var count int64
+	db.Model(&models.OutboundMessage{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name        string
+		reject      *smtp.SMTPError
+		runs        int
+		wantStatus  string
+		wantAttempt int
+	}{
+		{"temporary failure", &smtp.SMTPError{Code: 451, Message: "Try later"}, 1, models.OutboundQueued, 1},
+		{"permanent failure", &smtp.SMTPError{Code: 550, Message: "No such user"}, 1, models.OutboundBounced, 1},
+		{"attempts exhausted", &smtp.SMTPError{Code: 451, Message: "Try later"}, 3, models.OutboundBounced, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, r, sk := setupTestRelay(t)
+			sk.reject = tt.reject
+			addr, msg := seedForward(t, db, "")
+			require.NoError(t, Forward(db, addr, msg, msg.Raw))
+
+			for i := 0; i < tt.runs; i++ {
+				// make the retry due
+				db.Model(&models.OutboundMessage{}).Where("status = ?", models.OutboundQueued).
+					Update("next_attempt_at", time.Now().Add(-time.Second))
+				r.processQueue()
+			}
+
+			var queued models.OutboundMessage
+			require.NoError(t, db.First(&queued).Error)
+			assert.Equal(t, tt.wantStatus, queued.Status)
+			assert.Equal(t, tt.wantAttempt, queued.Attempts)
+			assert.Contains(t, queued.LastError, tt.reject.Message)
+			if tt.wantStatus == models.OutboundQueued {
+				assert.WithinDuration(t, time.Now().Add(time.Minute), queued.NextAttemptAt, 5*time.Second)
+			}
+		})
+	}
+}
+
+func TestRecordBounce(t *testing.T) {
+	db, r, sk := setupTestRelay(t)
+	addr, msg := seedForward(t, db, "")
+	require.NoError(t, Forward(db, addr, msg, msg.Raw))
+	r.processQueue()
+	received := sk.received()
+	require.Len(t, received, 1)
+	bounceTo := received[0].From
+
+	dsn := []byte("From: MAILER-DAEMON@example.org\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: message/delivery-status\r\n\r\n" +
+		"Final-Recipient: rfc822; me@example.org\r\n" +
+		"Status: 5.1.1\r\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+		"--b--\r\n")
+
+	assert.True(t, IsBounceAddress(bounceTo))
+	assert.False(t, IsBounceAddress(addr.Address))
+	assert.Error(t, RecordBounce(db, nil, "SRS0=xxxx=AA=example.com=alice@test.com", dsn))
+	require.NoError(t, RecordBounce(db, nil, bounceTo, dsn))
+
+	var queued models.OutboundMessage
+	require.NoError(t, db.First(&queued).Error)
+	assert.Equal(t, models.OutboundBounced, queued.Status)
+	assert.Equal(t, "smtp; 550 5.1.1 User unknown", queued.LastError)
+	assert.NotNil(t, queued.BouncedAt)
+}
+
+func TestSendVerification(t *testing.T) {
+	db, r, sk := setupTestRelay(t)
+	addr := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&addr).Error)
+	rule := models.ForwardRule{EmailID: addr.ID, Destination: "me@example.org"}
+	require.NoError(t, db.Create(&rule).Error)
+
+	require.NoError(t, SendVerification(db, &addr, &rule, "fc_code"))
+	r.processQueue()
+
+	received := sk.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, "noreply@test.com", received[0].From)
+	assert.True(t, bytes.Contains(received[0].Data, []byte("fc_code")))
+}
+
+func TestSend(t *testing.T) {
+	db, r, sk := setupTestRelay(t)
+	r.keys = dkim.NewDatabaseStore(db)
+	key, err := dkim.Rotate(r.keys, dkim.AlgorithmEd25519)
+	require.NoError(t, err)
+	require.NoError(t, r.keys.Activate(key.Selector))
+	record, err := key.TXTRecord()
+	require.NoError(t, err)
+	addr := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&addr).Error)
+
+	messageID, err := Send(db, &addr, &Mail{
+		To:         []string{"bob@example.org"},
+		Subject:    "Re: Confirm",
+		Text:       "Yes",
+		InReplyTo:  "<b@example.org>",
+		References: []string{"<a@example.org>", "<b@example.org>"},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(messageID, "@test.com>"))
+	r.processQueue()
+
+	received := sk.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, "abcd123456@test.com", received[0].From)
+	data := string(received[0].Data)
+	assert.Contains(t, data, "Message-Id: "+messageID)
+	assert.Contains(t, data, "In-Reply-To: <b@example.org>")
+	assert.Contains(t, data, "References: <a@example.org> <b@example.org>")
+
+	verifications, err := msgauth.VerifyWithOptions(bytes.NewReader(received[0].Data), &msgauth.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			assert.Equal(t, key.RecordName("test.com"), domain)
+			return []string{record}, nil
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	assert.NoError(t, verifications[0].Err)
+	assert.Equal(t, "test.com", verifications[0].Domain)
+}
+
+func TestSendQuota(t *testing.T) {
+	db, _, _ := setupTestRelay(t)
+	config.GlobalConfig.Relay.SendQuota = 3
+	addr := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&addr).Error)
+
+	// forwarded mail does not count
+	ruleID := uint(1)
+	require.NoError(t, db.Create(&models.OutboundMessage{EmailID: addr.ID, RuleID: &ruleID}).Error)
+
+	_, err := Send(db, &addr, &Mail{To: []string{"a@example.org", "b@example.org"}})
+	require.NoError(t, err)
+	_, err = Send(db, &addr, &Mail{To: []string{"c@example.org", "d@example.org"}})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = Send(db, &addr, &Mail{To: []string{"c@example.org"}})
+	require.NoError(t, err)
+	_, err = Send(db, &addr, &Mail{To: []string{"e@example.org"}})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestSendQuotaConcurrent(t *testing.T) {
+	db, _, _ := setupTestRelay(t)
+	config.GlobalConfig.Relay.SendQuota = 5
+	addr := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&addr).Error)
+
+	const sends = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, sends)
+	for i := 0; i < sends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := Send(db, &addr, &Mail{To: []string{"rcpt" + strconv.Itoa(i) + "@example.org"}})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	sent := 0
+	for err := range errs {
+		if err == nil {
+			sent++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrQuotaExceeded)
+	}
+	assert.Equal(t, 5, sent)
+	var queued int64
+	require.NoError(t, db.Model(&models.OutboundMessage{}).Count(&queued).Error)
+	assert.Equal(t, int64(5), queued)
+}
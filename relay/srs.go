@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// SRS (Sender Rewriting Scheme) rewrites the envelope sender of forwarded
+// mail into an address of our domain, so that SPF checks of the destination
+// pass and bounces come back to us:
+//
+//	SRS0=HHHH=TT=example.com=alice@secmail.example
+//
+// HHHH authenticates the rest and TT is the day the address was made.
+
+const (
+	srsPrefix   = "SRS0="
+	srsHashLen  = 4
+	srsMaxAge   = 21 // days
+	srsBase32   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	srsTimeSize = 1024 // days, two base32 digits
+)
+
+var errInvalidSRS = errors.New("invalid SRS address")
+
+type srsRewriter struct {
+	secret []byte
+	domain string
+}
+
+func newSRSRewriter(secret, domain string) *srsRewriter {
+	return &srsRewriter{secret: []byte(secret), domain: strings.ToLower(domain)}
+}
+
+func (s *srsRewriter) hash(timestamp, domain, local string) string {
+	mac := hmac.New(sha1.New, s.secret)
+	mac.Write([]byte(strings.ToLower(timestamp + domain + local)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:srsHashLen]
+}
+
+func srsDay(t time.Time) int {
+	return int(t.Unix()/86400) % srsTimeSize
+}
+
+func srsTimestamp(t time.Time) string {
+	day := srsDay(t)
+	return string([]byte{srsBase32[day/32], srsBase32[day%32]})
+}
+
+// Forward rewrites a sender. The null sender of bounces is kept.
+func (s *srsRewriter) Forward(sender string, now time.Time) string {
+	local, domain, ok := strings.Cut(sender, "@")
+	if !ok {
+		return sender
+	}
+	ts := srsTimestamp(now)
+	return srsPrefix + s.hash(ts, domain, local) + "=" + ts + "=" + domain + "=" + local + "@" + s.domain
+}
+
+// IsSRS reports whether an address looks like one made by Forward.
+func (s *srsRewriter) IsSRS(address string) bool {
+	local, domain, ok := strings.Cut(address, "@")
+	return ok && strings.EqualFold(domain, s.domain) && len(local) > len(srsPrefix) &&
+		strings.EqualFold(local[:len(srsPrefix)], srsPrefix)
+}
+
+// Reverse returns the original sender of an address made by Forward,
+// checking its hash and age.
+func (s *srsRewriter) Reverse(address string, now time.Time) (string, error) {
+	if !s.IsSRS(address) {
+		return "", errInvalidSRS
+	}
+	local, _, _ := strings.Cut(address, "@")
+	parts := strings.SplitN(local[len(srsPrefix):], "=", 4)
+	if len(parts) != 4 || len(parts[1]) != 2 {
+		return "", errInvalidSRS
+	}
+	hash, ts, domain, user := parts[0], parts[1], parts[2], parts[3]
+	if !hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(s.hash(ts, domain, user)))) {
+		return "", errInvalidSRS
+	}
+
+	hi := strings.IndexByte(srsBase32, strings.ToUpper(ts)[0])
+	lo := strings.IndexByte(srsBase32, strings.ToUpper(ts)[1])
+	if hi < 0 || lo < 0 {
+		return "", errInvalidSRS
+	}
+	age := (srsDay(now) - (hi*32 + lo) + srsTimeSize) % srsTimeSize
+	if age > srsMaxAge {
+		return "", errInvalidSRS
+	}
+	return user + "@" + domain, nil
+}
@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"errors"
+	"time"
+
+	"secmail/models"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"gorm.io/gorm"
+)
+
+// CRAM-MD5 is not offered: it needs the plain password on the server, and
+// only password hashes are stored.
+
+const (
+	authLogin = "LOGIN"
+
+	lastUsedResolution = time.Minute
+)
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+func (s *Session) AuthMechanisms() []string {
+	return []string{sasl.Plain, authLogin}
+}
+
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return errInvalidCredentials
+			}
+			return s.authenticate(username, password)
+		}), nil
+	case authLogin:
+		return &loginServer{authenticate: s.authenticate}, nil
+	}
+	return nil, smtp.ErrAuthUnsupported
+}
+
+// authenticate checks SMTP credentials and tags the session with their
+// project.
+func (s *Session) authenticate(username, password string) error {
+	db := s.backend.db
+	var cred models.SMTPCredential
+	if err := db.Where("username = ?", username).First(&cred).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			log.Errorf("Database error: %+v", err)
+		}
+		log.Warnf("SMTP authentication failed for %s from %s", username, s.remoteIP)
+		return errInvalidCredentials
+	}
+	if !cred.CheckPassword(password) {
+		log.Warnf("SMTP authentication failed for %s from %s", username, s.remoteIP)
+		return errInvalidCredentials
+	}
+
+	now := time.Now()
+	if cred.LastUsedAt == nil || now.Sub(*cred.LastUsedAt) > lastUsedResolution {
+		if err := db.Model(&cred).UpdateColumn("last_used_at", now).Error; err != nil {
+			log.Warnf("Failed to update last use of SMTP credential %d: %v", cred.ID, err)
+		}
+	}
+
+	s.project = cred.Project
+	s.authenticated = true
+	return nil
+}
+
+// loginServer implements the obsolete but widely used LOGIN mechanism:
+// the username and password are each sent in response to a prompt.
+type loginServer struct {
+	authenticate func(username, password string) error
+	username     string
+	step         int
+}
+
+func (a *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.step {
+	case 0:
+		a.step++
+		// the client may send the username with the AUTH command
+		if response != nil {
+			a.username = string(response)
+			a.step++
+			return []byte("Password:"), false, nil
+		}
+		return []byte("Username:"), false, nil
+	case 1:
+		a.username = string(response)
+		a.step++
+		return []byte("Password:"), false, nil
+	case 2:
+		a.step++
+		return nil, true, a.authenticate(a.username, string(response))
+	}
+	return nil, true, sasl.ErrUnexpectedClientResponse
+}
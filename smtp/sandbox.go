@@ -0,0 +1,51 @@
+package smtp
+
+import (
+	"time"
+
+	"secmail/config"
+	"secmail/models"
+
+	"gorm.io/gorm"
+)
+
+const defaultSandboxTTL = 24 * time.Hour
+
+// sandboxAddress returns the inbox of a recipient in sandbox mode, creating
+// it, or reviving it if it expired or was deleted.
+func (s *Session) sandboxAddress(to string) (*models.EmailAddress, error) {
+	ttl := config.GlobalConfig.Sandbox.TTL
+	if ttl <= 0 {
+		ttl = defaultSandboxTTL
+	}
+	expiresAt := time.Now().Add(ttl)
+	db := s.backend.db
+
+	var addr models.EmailAddress
+	err := db.Unscoped().Where("address = ?", to).First(&addr).Error
+	if err == gorm.ErrRecordNotFound {
+		addr = models.EmailAddress{
+			Address:      to,
+			ExpiresAt:    expiresAt,
+			Project:      s.project,
+			CreatorIP:    s.remoteIP,
+			CreatorAgent: "smtp sandbox",
+		}
+		return &addr, db.Create(&addr).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.DeletedAt.Valid || time.Now().After(addr.ExpiresAt) {
+		addr.DeletedAt = gorm.DeletedAt{}
+		addr.ExpiresAt = expiresAt
+		if err := db.Unscoped().Model(&addr).Updates(map[string]any{
+			"deleted_at": nil,
+			"expires_at": expiresAt,
+		}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &addr, nil
+}
@@ -2,13 +2,21 @@ package smtp
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"fmt"
 	"io"
+	"net"
+	"strings"
+	"time"
 
+	"secmail/audit"
+	"secmail/blob"
 	"secmail/config"
+	"secmail/filter"
 	"secmail/models"
-	"time"
+	"secmail/pgp"
+	"secmail/ratelimit"
+	"secmail/relay"
 
 	"github.com/emersion/go-smtp"
 	"github.com/google/uuid"
@@ -22,30 +30,66 @@ type __logger struct{}
 var log = slog.GetLogger(__logger{})
 
 type Backend struct {
-	db *gorm.DB
+	db      *gorm.DB
+	limiter *ratelimit.Limiter
+	audit   *audit.Recorder
+	blobs   blob.Store
 }
 
 type Session struct {
-	backend *Backend
-	from    string
-	to      string
+	backend  *Backend
+	remoteIP string
+	helo     string
+	from     string
+	to       []string
+	// project of the SMTP AUTH credentials
+	project       string
+	authenticated bool
 }
 
-func NewBackend(db *gorm.DB) *Backend {
-	return &Backend{db: db}
+func NewBackend(db *gorm.DB, limiter *ratelimit.Limiter, recorder *audit.Recorder, blobs blob.Store) *Backend {
+	return &Backend{db: db, limiter: limiter, audit: recorder, blobs: blobs}
 }
 
-func (b *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
-	return &Session{backend: b}, nil
+func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	remoteIP := c.Conn().RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = host
+	}
+	return &Session{backend: b, remoteIP: remoteIP, helo: c.Hostname()}, nil
 }
 
 func (s *Session) Mail(from string, _ *smtp.MailOptions) error {
+	if config.GlobalConfig.Sandbox.Enable && config.GlobalConfig.Sandbox.RequireAuth && !s.authenticated {
+		return smtp.ErrAuthRequired
+	}
+
+	allowed, _ := s.backend.limiter.Allow(context.Background(), "smtp_sender", s.remoteIP,
+		config.GlobalConfig.RateLimit.SMTPSender)
+	if !allowed {
+		log.Warnf("Rate limit exceeded for SMTP client %s", s.remoteIP)
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many messages from your IP, try again later",
+		}
+	}
 	s.from = from
 	return nil
 }
 
 func (s *Session) Rcpt(to string, _ *smtp.RcptOptions) error {
-	s.to = to
+	allowed, _ := s.backend.limiter.Allow(context.Background(), "smtp_recipient", to,
+		config.GlobalConfig.RateLimit.SMTPRecipient)
+	if !allowed {
+		log.Warnf("Rate limit exceeded for recipient %s", to)
+		return &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 2, 1},
+			Message:      "Mailbox is receiving too much mail, try again later",
+		}
+	}
+	s.to = append(s.to, strings.ToLower(to))
 	return nil
 }
 
@@ -55,22 +99,125 @@ func (s *Session) Data(r io.Reader) error {
 	if _, err := buf.ReadFrom(r); err != nil {
 		return err
 	}
+	raw := buf.Bytes()
 
 	// parse the email using enmime
-	env, err := enmime.ReadEnvelope(bytes.NewReader(buf.Bytes()))
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
 	if err != nil {
 		return err
 	}
 
+	// filter the message for every recipient before storing it. The reply
+	// to DATA covers all recipients: a rule rejecting the message drops its
+	// inbox, and only rejects the transaction when no other inbox takes the
+	// message.
+	var inboxes []inbox
+	var reject *filter.Reject
+	for _, to := range s.to {
+		if config.GlobalConfig.Relay.Enable && relay.IsBounceAddress(to) {
+			if err := relay.RecordBounce(s.backend.db, s.backend.audit, to, raw); err != nil {
+				log.Warnf("Discarding bounce for %s: %v", to, err)
+			}
+			continue
+		}
+
+		addr, err := s.recipient(to)
+		if err != nil {
+			return err
+		}
+		if addr == nil {
+			continue
+		}
+		result := s.filter(addr, raw, env)
+		if result.Reject != nil {
+			log.Infof("Message from %s to %s rejected by filter rules", s.from, to)
+			s.backend.audit.Record(models.AuditLog{
+				EmailID:      addr.ID,
+				EmailAddress: addr.Address,
+				Action:       models.AuditActionDeliver,
+				IP:           s.remoteIP,
+				UserAgent:    s.helo,
+				Detail:       "from " + s.from + " rejected by filter rules",
+			})
+			if reject == nil {
+				reject = result.Reject
+			}
+			continue
+		}
+		inboxes = append(inboxes, inbox{addr: addr, result: result})
+	}
+	if reject != nil && len(inboxes) == 0 {
+		return &smtp.SMTPError{
+			Code:         reject.Code,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      reject.Message,
+		}
+	}
+
+	for _, in := range inboxes {
+		if err := s.deliver(in.addr, raw, env, in.result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inbox is a recipient of a message with the outcome of its filter rules.
+type inbox struct {
+	addr   *models.EmailAddress
+	result filter.Result
+}
+
+// recipient returns the inbox of a recipient, nil when mail for it is
+// discarded because it is unknown or expired. In sandbox mode, inboxes are
+// provisioned on demand.
+func (s *Session) recipient(to string) (*models.EmailAddress, error) {
+	if config.GlobalConfig.Sandbox.Enable {
+		addr, err := s.sandboxAddress(to)
+		if err != nil {
+			log.Errorf("Failed to provision sandbox address %s: %v", to, err)
+			return nil, err
+		}
+		return addr, nil
+	}
+
 	// find the recipient email address in the database
-	var addr models.EmailAddress
-	if err := s.backend.db.Where("address = ? AND expires_at > ?", s.to, time.Now()).
-		First(&addr).Error; err != nil {
+	addr := &models.EmailAddress{}
+	if err := s.backend.db.Where("address = ? AND expires_at > ?", to, time.Now()).
+		First(addr).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			log.Warnf("Email address %s not found or expired", s.to)
+			log.Warnf("Email address %s not found or expired", to)
 		} else {
 			log.Errorf("Database error: %+v", err)
 		}
+		return nil, nil
+	}
+	return addr, nil
+}
+
+// filter evaluates the filter rules of an inbox. Invalid rules are
+// ignored, so that mail is never lost to them.
+func (s *Session) filter(addr *models.EmailAddress, raw []byte, env *enmime.Envelope) filter.Result {
+	rules, err := filter.Parse(addr.FilterRules)
+	if err != nil {
+		log.Warnf("Ignoring invalid filter rules of %s: %v", addr.Address, err)
+		return filter.Result{}
+	}
+	return filter.Evaluate(rules, filter.NewMessage(s.from, raw, len(env.Attachments) > 0))
+}
+
+// deliver stores the message in an inbox, unless its filter rules discard
+// it.
+func (s *Session) deliver(addr *models.EmailAddress, raw []byte, env *enmime.Envelope, result filter.Result) error {
+	if result.Discard {
+		s.backend.audit.Record(models.AuditLog{
+			EmailID:      addr.ID,
+			EmailAddress: addr.Address,
+			Action:       models.AuditActionDeliver,
+			IP:           s.remoteIP,
+			UserAgent:    s.helo,
+			Detail:       "from " + s.from + " discarded by filter rules",
+		})
 		return nil
 	}
 
@@ -82,60 +229,123 @@ func (s *Session) Data(r io.Reader) error {
 		Subject:     env.GetHeader("Subject"),
 		Content:     env.Text,
 		HTMLContent: env.HTML,
+		Raw:         raw,
+		Project:     s.project,
+		Seen:        result.Seen,
+		Flagged:     result.Flagged,
+		Labels:      strings.Join(result.Labels, ","),
 	}
+	attachments := env.Attachments
 
-	// save attachments if they exist
-	for _, a := range env.Attachments {
-		att := models.Attachment{
-			ID:          uuid.New(),
-			MessageID:   msg.ID,
-			FileName:    a.FileName,
-			ContentType: a.ContentType,
-			Data:        a.Content,
+	// with an OpenPGP key, only the encrypted message is stored, once: the
+	// armored ciphertext is read back from it
+	if addr.PGPKey != "" {
+		encrypted, err := pgp.Encrypt(addr.PGPKey, raw)
+		if err != nil {
+			log.Errorf("Failed to encrypt message for %s: %v", addr.Address, err)
+			return err
+		}
+		msg.Subject = pgp.HiddenSubject
+		msg.Content = ""
+		msg.HTMLContent = ""
+		msg.Raw = encrypted
+		msg.PGP = true
+		attachments = nil
+	}
+
+	// save the message to the database, attachment contents go to the blob
+	// store once and are stripped from the stored source
+	ctx := context.Background()
+	var stored []string
+	hashes := make(map[string]bool, len(attachments))
+	for _, a := range attachments {
+		hashes[blob.Hash(a.Content)] = true
+	}
+	source := msg.Raw
+	msg.Raw = blob.StripSource(source, hashes)
+	err := s.backend.db.Transaction(func(tx *gorm.DB) error {
+		for _, a := range attachments {
+			key, isNew, err := blob.RefContent(ctx, tx, s.backend.blobs, addr.ID, a.Content)
+			if err != nil {
+				return err
+			}
+			if isNew {
+				stored = append(stored, key)
+			}
+			msg.Attachments = append(msg.Attachments, models.Attachment{
+				ID:          uuid.New(),
+				MessageID:   msg.ID,
+				FileName:    a.FileName,
+				ContentType: a.ContentType,
+				BlobKey:     key,
+				Hash:        blob.Hash(a.Content),
+				Size:        int64(len(a.Content)),
+			})
 		}
-		msg.Attachments = append(msg.Attachments, att)
+		return tx.Create(&msg).Error
+	})
+	if err != nil {
+		blob.Abandon(s.backend.db, stored)
+		log.Errorf("Failed to store message for %s: %v", addr.Address, err)
+		return err
 	}
 
-	// save the message to the database
-	return s.backend.db.Create(&msg).Error
+	s.backend.audit.Record(models.AuditLog{
+		EmailID:      addr.ID,
+		EmailAddress: addr.Address,
+		MessageID:    &msg.ID,
+		Action:       models.AuditActionDeliver,
+		IP:           s.remoteIP,
+		UserAgent:    s.helo,
+		Detail:       "from " + s.from,
+	})
+
+	if config.GlobalConfig.Relay.Enable {
+		if err := relay.Forward(s.backend.db, addr, &msg, source); err != nil {
+			log.Errorf("Failed to queue forwarding of message %s: %v", msg.ID, err)
+		}
+	}
+	return nil
 }
 
-func (s *Session) Reset() {}
+func (s *Session) Reset() {
+	s.from = ""
+	s.to = nil
+}
 
 func (s *Session) Logout() error {
 	return nil
 }
 
-func createSMTPServer(be *Backend) *smtp.Server {
+func createSMTPServer(be *Backend) (*smtp.Server, error) {
 	s := smtp.NewServer(be)
 	s.Domain = config.GlobalConfig.EmailDomain
 	s.ReadTimeout = 10 * time.Second
 	s.WriteTimeout = 10 * time.Second
 	s.MaxMessageBytes = 1024 * 1024
 	s.MaxRecipients = 1
-	s.AllowInsecureAuth = true
+	if config.GlobalConfig.Sandbox.Enable {
+		s.MaxRecipients = 100
+	}
+	s.AllowInsecureAuth = config.GlobalConfig.SMTP.AllowInsecureAuth
 
-	if config.GlobalConfig.SMTP.TLS.Enable {
-		cert, err := tls.LoadX509KeyPair(
-			config.GlobalConfig.SMTP.TLS.CertFile,
-			config.GlobalConfig.SMTP.TLS.KeyFile,
-		)
-		if err != nil {
-			log.Errorf("Failed to load TLS certificate: %v", err)
-			return nil
-		}
-		s.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
-		}
+	tlsConfig, err := config.GlobalConfig.SMTP.LoadTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
 	}
+	s.TLSConfig = tlsConfig
 
-	return s
+	return s, nil
 }
 
-func StartSMTPServer(db *gorm.DB) error {
-	be := NewBackend(db)
-	server := createSMTPServer(be)
+// NewSMTPServer creates the configured SMTP server. Shutdown waits for the
+// sessions delivering a message.
+func NewSMTPServer(db *gorm.DB, limiter *ratelimit.Limiter, recorder *audit.Recorder, blobs blob.Store) (*smtp.Server, error) {
+	be := NewBackend(db, limiter, recorder, blobs)
+	server, err := createSMTPServer(be)
+	if err != nil {
+		return nil, err
+	}
 	server.Addr = fmt.Sprintf("%s:%d",
 		config.GlobalConfig.SMTP.Host,
 		config.GlobalConfig.SMTP.Port)
@@ -143,5 +353,5 @@ func StartSMTPServer(db *gorm.DB) error {
 	log.Infof("Starting SMTP server at %s (STARTTLS: %v)",
 		server.Addr,
 		config.GlobalConfig.SMTP.TLS.Enable)
-	return server.ListenAndServe()
+	return server, nil
 }
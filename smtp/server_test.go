@@ -0,0 +1,455 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"secmail/blob"
+	"secmail/config"
+	"secmail/database/databasetest"
+	"secmail/models"
+	"secmail/pgp"
+)
+
+const testMessage = "From: app@example.com\r\n" +
+	"Subject: Welcome\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+// testBlobs is the blob store of the test servers.
+var testBlobs = blob.NewMemoryStore()
+
+func setupTestServer(t *testing.T, cfg config.Config) (*gorm.DB, string) {
+	config.GlobalConfig = cfg
+	t.Cleanup(func() { config.GlobalConfig = config.Config{} })
+
+	db := databasetest.Open(t)
+
+	s, err := createSMTPServer(NewBackend(db, nil, nil, testBlobs))
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return db, l.Addr().String()
+}
+
+func createCredential(t *testing.T, db *gorm.DB, project, username string) string {
+	password, hash, err := models.GenerateSMTPPassword()
+	require.NoError(t, err)
+	require.NoError(t, db.Create(&models.SMTPCredential{Project: project, Username: username, PasswordHash: hash}).Error)
+	return password
+}
+
+func sendMail(addr string, auth sasl.Client, to ...string) error {
+	return sendMessage(addr, auth, testMessage, to...)
+}
+
+func sendMessage(addr string, auth sasl.Client, message string, to ...string) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	return c.SendMail("app@example.com", to, strings.NewReader(message))
+}
+
+func TestDeliver(t *testing.T) {
+	db, addr := setupTestServer(t, config.Config{EmailDomain: "test.com"})
+	db.Create(&models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)})
+
+	require.NoError(t, sendMail(addr, nil, "ABCD123456@test.com"))
+	// mail for unknown addresses is accepted and discarded
+	require.NoError(t, sendMail(addr, nil, "unknown123@test.com"))
+
+	var messages []models.Message
+	require.NoError(t, db.Find(&messages).Error)
+	require.Len(t, messages, 1)
+	assert.Equal(t, "Welcome", messages[0].Subject)
+	assert.Equal(t, "app@example.com", messages[0].From)
+
+	var count int64
+	db.Model(&models.EmailAddress{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestShutdown(t *testing.T) {
+	db, _ := setupTestServer(t, config.Config{EmailDomain: "test.com"})
+	db.Create(&models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)})
+	s, err := createSMTPServer(NewBackend(db, nil, nil, testBlobs))
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+
+	c, err := smtp.Dial(l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Mail("app@example.com", nil))
+	require.NoError(t, c.Rcpt("abcd123456@test.com", nil))
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "Subject: Welcome\r\n")
+	require.NoError(t, err)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+	// the session being delivered is not interrupted
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown did not wait for the session: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err = io.WriteString(w, "\r\nHello\r\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, c.Quit())
+	require.NoError(t, <-shutdown)
+
+	var count int64
+	require.NoError(t, db.Model(&models.Message{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestDeliverAttachment(t *testing.T) {
+	db, addr := setupTestServer(t, config.Config{EmailDomain: "test.com"})
+	db.Create(&models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)})
+
+	message := "From: app@example.com\r\n" +
+		"Subject: Report\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment; filename=report.csv\r\n" +
+		"\r\n" +
+		"a,b\r\n" +
+		"--b--\r\n"
+	require.NoError(t, sendMessage(addr, nil, message, "abcd123456@test.com"))
+	require.NoError(t, sendMessage(addr, nil, message, "abcd123456@test.com"))
+
+	var attachments []models.Attachment
+	require.NoError(t, db.Find(&attachments).Error)
+	require.Len(t, attachments, 2)
+	att := attachments[0]
+	assert.Equal(t, "report.csv", att.FileName)
+	assert.Equal(t, int64(3), att.Size)
+	assert.Equal(t, blob.Hash([]byte("a,b")), att.Hash)
+	data, err := blob.ReadAll(context.Background(), testBlobs, att.BlobKey)
+	require.NoError(t, err)
+	assert.Equal(t, "a,b", string(data))
+
+	// the content is stored once
+	assert.Equal(t, att.BlobKey, attachments[1].BlobKey)
+	var stored models.Blob
+	require.NoError(t, db.First(&stored, "hash = ?", att.Hash).Error)
+	assert.Equal(t, 2, stored.RefCount)
+}
+
+func TestDeliverStripsAttachments(t *testing.T) {
+	db, addr := setupTestServer(t, config.Config{EmailDomain: "test.com"})
+	db.Create(&models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)})
+
+	content := bytes.Repeat([]byte{0, 1, 2, 250, 251, 252}, 100)
+	var encoded strings.Builder
+	for rest := base64.StdEncoding.EncodeToString(content); rest != ""; {
+		n := min(76, len(rest))
+		encoded.WriteString(rest[:n] + "\r\n")
+		rest = rest[n:]
+	}
+	message := "From: app@example.com\r\n" +
+		"Subject: Report\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=report.bin\r\n" +
+		"\r\n" +
+		encoded.String() +
+		"--b--\r\n"
+	require.NoError(t, sendMessage(addr, nil, message, "abcd123456@test.com"))
+
+	var msg models.Message
+	require.NoError(t, db.Preload("Attachments").First(&msg).Error)
+	require.Len(t, msg.Attachments, 1)
+	assert.Equal(t, blob.Hash(content), msg.Attachments[0].Hash)
+	// the stored source refers to the content in the blob store
+	assert.NotContains(t, string(msg.Raw), encoded.String()[:76])
+	assert.Contains(t, string(msg.Raw), "secmail-blob:"+blob.Hash(content))
+
+	source, err := blob.Source(context.Background(), testBlobs, &msg, "abcd123456@test.com")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(source), message[strings.Index(message, "From:"):]))
+	assert.Equal(t, len(source), blob.SourceSize(&msg, msg.Raw))
+}
+
+func TestDeliverPGP(t *testing.T) {
+	db, addr := setupTestServer(t, config.Config{EmailDomain: "test.com"})
+	entity, err := openpgp.NewEntity("Inbox", "", "abcd123456@test.com", nil)
+	require.NoError(t, err)
+	var key bytes.Buffer
+	w, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+	db.Create(&models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour), PGPKey: key.String()})
+
+	message := "From: app@example.com\r\n" +
+		"Subject: Report\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment; filename=report.csv\r\n" +
+		"\r\n" +
+		"a,b\r\n" +
+		"--b--\r\n"
+	require.NoError(t, sendMessage(addr, nil, message, "abcd123456@test.com"))
+
+	// only the ciphertext is stored
+	var msg models.Message
+	require.NoError(t, db.Preload("Attachments").First(&msg).Error)
+	assert.True(t, msg.PGP)
+	assert.Equal(t, "...", msg.Subject)
+	assert.Empty(t, msg.Attachments)
+	assert.Empty(t, msg.Content)
+	assert.NotContains(t, string(msg.Raw), "See attached")
+	assert.Contains(t, string(msg.Raw), "multipart/encrypted")
+
+	ciphertext, err := pgp.Ciphertext(msg.Raw)
+	require.NoError(t, err)
+	block, err := armor.Decode(strings.NewReader(ciphertext))
+	require.NoError(t, err)
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	require.NoError(t, err)
+	plaintext, err := io.ReadAll(md.UnverifiedBody)
+	require.NoError(t, err)
+	assert.Contains(t, string(plaintext), "See attached")
+}
+
+func TestSandbox(t *testing.T) {
+	db, addr := setupTestServer(t, config.Config{
+		EmailDomain: "test.com",
+		Sandbox: config.SandboxConfig{
+			Enable:      true,
+			TTL:         2 * time.Hour,
+			RequireAuth: true,
+		},
+		SMTP: config.SMTPConfig{AllowInsecureAuth: true},
+	})
+	password := createCredential(t, db, "shop", "shop")
+
+	assert.Error(t, sendMail(addr, nil, "user@example.org"))
+	assert.Error(t, sendMail(addr, sasl.NewPlainClient("", "shop", "wrong"), "user@example.org"))
+
+	// an expired inbox is revived
+	expired := models.EmailAddress{Address: "old@example.net", ExpiresAt: time.Now().Add(-time.Hour)}
+	require.NoError(t, db.Create(&expired).Error)
+
+	require.NoError(t, sendMail(addr, sasl.NewPlainClient("", "shop", password),
+		"User+tag@example.org", "old@example.net"))
+
+	var provisioned models.EmailAddress
+	require.NoError(t, db.Where("address = ?", "user+tag@example.org").First(&provisioned).Error)
+	assert.Equal(t, "shop", provisioned.Project)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), provisioned.ExpiresAt, time.Minute)
+
+	require.NoError(t, db.First(&expired, expired.ID).Error)
+	assert.True(t, expired.ExpiresAt.After(time.Now()))
+
+	var count int64
+	db.Model(&models.Message{}).Where("email_id IN ?", []uint{provisioned.ID, expired.ID}).Count(&count)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestAuth(t *testing.T) {
+	db, addr := setupTestServer(t, config.Config{
+		EmailDomain: "test.com",
+		SMTP:        config.SMTPConfig{AllowInsecureAuth: true},
+	})
+	password := createCredential(t, db, "shop", "shop")
+	db.Create(&models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)})
+
+	tests := []struct {
+		name    string
+		auth    sasl.Client
+		project string
+		wantErr bool
+	}{
+		{"plain", sasl.NewPlainClient("", "shop", password), "shop", false},
+		{"login", sasl.NewLoginClient("shop", password), "shop", false},
+		{"anonymous", nil, "", false},
+		{"wrong password", sasl.NewPlainClient("", "shop", "sp_wrong"), "", true},
+		{"unknown user", sasl.NewLoginClient("nobody", password), "", true},
+		{"identity mismatch", sasl.NewPlainClient("other", "shop", password), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.Where("1 = 1").Delete(&models.Message{})
+			err := sendMail(addr, tt.auth, "abcd123456@test.com")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var msg models.Message
+			require.NoError(t, db.First(&msg).Error)
+			assert.Equal(t, tt.project, msg.Project)
+		})
+	}
+
+	var cred models.SMTPCredential
+	require.NoError(t, db.Where("username = ?", "shop").First(&cred).Error)
+	assert.NotNil(t, cred.LastUsedAt)
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	db, addr := setupTestServer(t, config.Config{EmailDomain: "test.com"})
+	password := createCredential(t, db, "shop", "shop")
+
+	assert.Error(t, sendMail(addr, sasl.NewPlainClient("", "shop", password), "abcd123456@test.com"))
+}
+
+func TestLoginServer(t *testing.T) {
+	var username, password string
+	s := &loginServer{authenticate: func(u, p string) error {
+		username, password = u, p
+		return nil
+	}}
+
+	challenge, done, err := s.Next(nil)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "Username:", string(challenge))
+
+	challenge, done, err = s.Next([]byte("shop"))
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "Password:", string(challenge))
+
+	_, done, err = s.Next([]byte("secret"))
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "shop", username)
+	assert.Equal(t, "secret", password)
+}
+
+func TestForwarding(t *testing.T) {
+	db, addr := setupTestServer(t, config.Config{
+		EmailDomain: "test.com",
+		Sandbox:     config.SandboxConfig{Enable: true},
+		Relay:       config.RelayConfig{Enable: true, SRSSecret: "secret"},
+	})
+	inbox := models.EmailAddress{Address: "abcd123456@test.com", ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, db.Create(&inbox).Error)
+	now := time.Now()
+	require.NoError(t, db.Create(&models.ForwardRule{EmailID: inbox.ID, Destination: "me@example.org", VerifiedAt: &now}).Error)
+
+	require.NoError(t, sendMail(addr, nil, "abcd123456@test.com"))
+
+	var queued models.OutboundMessage
+	require.NoError(t, db.First(&queued).Error)
+	assert.Equal(t, "me@example.org", queued.RcptTo)
+	assert.True(t, strings.HasPrefix(queued.MailFrom, "SRS0="))
+	assert.Equal(t, models.OutboundQueued, queued.Status)
+
+	// bounces to SRS addresses are not delivered, even in sandbox mode
+	require.NoError(t, sendMail(addr, nil, queued.MailFrom))
+	var count int64
+	db.Model(&models.EmailAddress{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+	db.Model(&models.Message{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestFilterRules(t *testing.T) {
+	// sandbox mode accepts several recipients
+	db, addr := setupTestServer(t, config.Config{
+		EmailDomain: "test.com",
+		Sandbox:     config.SandboxConfig{Enable: true},
+	})
+	labelled := models.EmailAddress{
+		Address:     "abcd123456@test.com",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		FilterRules: `[{"conditions":[{"field":"subject","op":"is","value":"welcome"}],"actions":[{"type":"label","label":"onboarding"},{"type":"mark_read"},{"type":"star"}]}]`,
+	}
+	discarding := models.EmailAddress{
+		Address:     "discard123@test.com",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		FilterRules: `[{"conditions":[{"field":"from","op":"contains","value":"example.com"}],"actions":[{"type":"discard"}]}]`,
+	}
+	rejecting := models.EmailAddress{
+		Address:     "reject1234@test.com",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		FilterRules: `[{"conditions":[{"field":"size","op":"over","size":10}],"actions":[{"type":"reject","code":554,"message":"Go away"}]}]`,
+	}
+	require.NoError(t, db.Create([]*models.EmailAddress{&labelled, &discarding, &rejecting}).Error)
+
+	require.NoError(t, sendMail(addr, nil, "abcd123456@test.com", "discard123@test.com"))
+
+	var messages []models.Message
+	require.NoError(t, db.Find(&messages).Error)
+	require.Len(t, messages, 1)
+	assert.Equal(t, labelled.ID, messages[0].EmailID)
+	assert.Equal(t, []string{"onboarding"}, messages[0].LabelList())
+	assert.True(t, messages[0].Seen)
+	assert.True(t, messages[0].Flagged)
+
+	// a rejecting recipient only drops its own inbox
+	require.NoError(t, sendMail(addr, nil, "abcd123456@test.com", "reject1234@test.com"))
+	var count int64
+	db.Model(&models.Message{}).Where("email_id = ?", labelled.ID).Count(&count)
+	assert.Equal(t, int64(2), count)
+	db.Model(&models.Message{}).Where("email_id = ?", rejecting.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	// the message is rejected when no other inbox takes it, discarding it
+	// is taking it
+	require.NoError(t, sendMail(addr, nil, "reject1234@test.com", "discard123@test.com"))
+	err := sendMail(addr, nil, "reject1234@test.com")
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 554, smtpErr.Code)
+	assert.Equal(t, "Go away", smtpErr.Message)
+
+	db.Model(&models.Message{}).Count(&count)
+	assert.Equal(t, int64(2), count)
+}
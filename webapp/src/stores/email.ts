@@ -1,10 +1,12 @@
 import { defineStore } from 'pinia'
 import axios from 'axios'
 import router  from '../router'
+import { solveChallenge } from '../utils/challenge'
 
 interface StoredEmail {
   address: string
   expiresAt: string
+  accessToken?: string
 }
 
 export interface Message {
@@ -15,12 +17,19 @@ export interface Message {
   content: string
   htmlContent: string
   attachments: Array<{id: string, fileName: string}>
+  // content is the armored ciphertext of the message, encrypted to the
+  // OpenPGP key of the address
+  pgp?: boolean
 }
 
 export const useEmailStore = defineStore('email', {
   state: () => ({
     address: '',
     expiresAt: null as Date | null,
+    // password for IMAP and the other mailbox protocols
+    accessToken: '',
+    // fingerprint of the OpenPGP key incoming mail is encrypted to
+    pgpFingerprint: '',
     messages: [] as Message[],
     selectedMessage: null as Message | null,
     view: 'create' as 'create' | 'inbox'
@@ -41,6 +50,7 @@ export const useEmailStore = defineStore('email', {
             if (response.status === 200) {
               this.address = data.address
               this.expiresAt = expiresAt
+              this.accessToken = data.accessToken ?? ''
               return true
             }
           } catch (error: any) {
@@ -62,7 +72,8 @@ export const useEmailStore = defineStore('email', {
       if (this.address && this.expiresAt) {
         const data: StoredEmail = {
           address: this.address,
-          expiresAt: this.expiresAt.toISOString()
+          expiresAt: this.expiresAt.toISOString(),
+          accessToken: this.accessToken
         }
         localStorage.setItem('tempEmail', JSON.stringify(data))
       }
@@ -71,13 +82,20 @@ export const useEmailStore = defineStore('email', {
     setEmail(address: string, expiresAt: Date) {
       this.address = address
       this.expiresAt = expiresAt
+      this.accessToken = ''
+      this.pgpFingerprint = ''
       this.saveEmail()
     },
 
-    async generateEmail() {
-      const response = await axios.post('/api/email')
+    // pgpPublicKey is an optional armored OpenPGP public key, incoming mail
+    // is then stored encrypted to it
+    async generateEmail(pgpPublicKey = '') {
+      const solution = await solveChallenge()
+      const response = await axios.post('/api/email', { ...solution, pgpPublicKey: pgpPublicKey || undefined })
       this.address = response.data.address
       this.expiresAt = new Date(response.data.expiresAt)
+      this.accessToken = response.data.accessToken ?? ''
+      this.pgpFingerprint = response.data.pgpFingerprint ?? ''
       this.messages = []
     },
 
@@ -111,6 +129,8 @@ export const useEmailStore = defineStore('email', {
       await axios.delete(`/api/email/${this.address}`)
       this.address = ''
       this.expiresAt = null
+      this.accessToken = ''
+      this.pgpFingerprint = ''
       this.messages = []
       this.selectedMessage = null
     },
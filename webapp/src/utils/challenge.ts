@@ -0,0 +1,49 @@
+import axios from 'axios'
+
+interface Challenge {
+  provider: string
+  token?: string
+  difficulty?: number
+}
+
+export interface ChallengeSolution {
+  challengeToken?: string
+  challengeResponse?: string
+}
+
+function leadingZeroBits(hash: Uint8Array): number {
+  let bits = 0
+  for (const byte of hash) {
+    if (byte === 0) {
+      bits += 8
+      continue
+    }
+    return bits + Math.clz32(byte) - 24
+  }
+  return bits
+}
+
+// Find a nonce so that SHA-256(token ":" nonce) starts with `difficulty` zero bits
+async function solveProofOfWork(token: string, difficulty: number): Promise<string> {
+  const encoder = new TextEncoder()
+  for (let nonce = 0; ; nonce++) {
+    const data = encoder.encode(`${token}:${nonce}`)
+    const hash = new Uint8Array(await crypto.subtle.digest('SHA-256', data))
+    if (leadingZeroBits(hash) >= difficulty) {
+      return nonce.toString()
+    }
+  }
+}
+
+// Fetch and solve the address creation challenge, if the server requires one
+export async function solveChallenge(): Promise<ChallengeSolution> {
+  const response = await axios.get<Challenge>('/api/email/challenge')
+  const challenge = response.data
+  if (challenge.provider !== 'pow' || !challenge.token) {
+    return {}
+  }
+  return {
+    challengeToken: challenge.token,
+    challengeResponse: await solveProofOfWork(challenge.token, challenge.difficulty ?? 0)
+  }
+}
@@ -0,0 +1,18 @@
+// The private key never leaves the browser: messages of an address with an
+// OpenPGP key are stored encrypted and decrypted here.
+
+// Decrypt an armored OpenPGP message with an armored private key, unlocked
+// with its passphrase when it is protected. It returns the original message
+// source.
+export async function decryptMessage(armoredMessage: string, armoredKey: string, passphrase: string): Promise<string> {
+  // loaded on demand, only addresses with a key need it
+  const openpgp = await import('openpgp')
+  let privateKey = await openpgp.readPrivateKey({ armoredKey })
+  if (!privateKey.isDecrypted()) {
+    privateKey = await openpgp.decryptKey({ privateKey, passphrase })
+  }
+  const message = await openpgp.readMessage({ armoredMessage })
+  const { data } = await openpgp.decrypt({ message, decryptionKeys: privateKey })
+  return data as string
+}
+